@@ -34,6 +34,13 @@ func main() {
 		logger.WithError(err).Fatal("Failed to run database migrations")
 	}
 
+	// Normalize CIDs stored before CIDs were parsed
+	if normalized, err := storage.NormalizeCIDs(context.Background(), db, utils.NormalizeCID); err != nil {
+		logger.WithError(err).Error("Failed to normalize stored CIDs")
+	} else if normalized > 0 {
+		logger.WithField("cids", normalized).Info("Normalized stored CIDs")
+	}
+
 	// Initialize Redis
 	redisClient, err := storage.InitRedis(cfg)
 	if err != nil {
@@ -42,6 +42,11 @@ func main() {
 	// Start the worker pool
 	workerPool.Start()
 
+	// Follow chain head changes for deal publish, activation and slashing
+	if cfg.ChainWatch.Enabled {
+		go workers.RunChainWatcher(ctx, db, redisClient, cfg, logger)
+	}
+
 	// Wait for interrupt signal
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -49,8 +54,9 @@ func main() {
 
 	logger.Info("Shutting down worker...")
 
-	// Stop the worker pool
+	// Stop the worker pool and chain watcher
 	workerPool.Stop()
+	cancel()
 
 	logger.Info("Worker exited")
 }
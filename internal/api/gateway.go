@@ -0,0 +1,280 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/models"
+	"pinning-service/internal/services"
+	"pinning-service/pkg/config"
+	"pinning-service/pkg/utils"
+)
+
+// gatewayPublicKey marks proxied requests for content anyone may read
+type gatewayPublicKey struct{}
+
+// GatewayHandler serves pinned content at /ipfs/{cid}/{path}. Path
+// resolution, range requests, content-type detection and trustless
+// ?format=car|raw responses are delegated to the IPFS node's gateway; this
+// handler adds access control, caching headers and bandwidth metering.
+type GatewayHandler struct {
+	gatewayService   *services.GatewayService
+	uploadService    *services.UploadService
+	retrievalService *services.RetrievalService
+	proxy            *httputil.ReverseProxy
+	config           *config.Config
+	logger           *logrus.Logger
+}
+
+func NewGatewayHandler(gatewayService *services.GatewayService, uploadService *services.UploadService, retrievalService *services.RetrievalService, cfg *config.Config, logger *logrus.Logger) (*GatewayHandler, error) {
+	target, err := url.Parse(cfg.IPFS.GatewayURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IPFS gateway URL: %w", err)
+	}
+
+	h := &GatewayHandler{
+		gatewayService:   gatewayService,
+		uploadService:    uploadService,
+		retrievalService: retrievalService,
+		config:           cfg,
+		logger:           logger,
+	}
+
+	h.proxy = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.Host = target.Host
+
+			// Never forward our credentials to the node
+			req.Header.Del("Authorization")
+			req.Header.Del("X-API-Key")
+			req.Header.Del("Cookie")
+		},
+		ModifyResponse: func(res *http.Response) error {
+			// Content addressed data never changes, so it can be cached for
+			// as long as we like; only shared caches must not keep
+			// restricted content
+			if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusPartialContent || res.StatusCode == http.StatusNotModified {
+				visibility := "private"
+				if public, _ := res.Request.Context().Value(gatewayPublicKey{}).(bool); public {
+					visibility = "public"
+				}
+				res.Header.Set("Cache-Control", fmt.Sprintf("%s, max-age=%d, immutable", visibility, int(cfg.Gateway.CacheMaxAge.Seconds())))
+				if res.Header.Get("ETag") == "" {
+					res.Header.Set("ETag", fmt.Sprintf(`"%s"`, strings.TrimPrefix(res.Request.URL.Path, "/ipfs/")))
+				}
+			}
+			res.Header.Set("X-Content-Type-Options", "nosniff")
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			logger.WithError(err).WithField("path", req.URL.Path).Error("IPFS gateway request failed")
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	return h, nil
+}
+
+// Serve handles GET and HEAD requests for /ipfs/*path
+func (h *GatewayHandler) Serve(c *gin.Context) {
+	path := strings.TrimPrefix(c.Param("path"), "/")
+	cid := path
+	if i := strings.Index(path, "/"); i >= 0 {
+		cid = path[:i]
+	}
+
+	normalized, err := utils.NormalizeCID(cid)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid CID", "details": err.Error()})
+		return
+	}
+
+	// Authorize and proxy the same cleaned path, so a share link limited to
+	// a subtree cannot be walked out of with ".." or duplicate slashes
+	subpath, ok := models.CleanPath(strings.TrimPrefix(path, cid))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+		return
+	}
+	proxyPath := cid
+	if subpath != "" {
+		proxyPath += "/" + subpath
+	}
+	// The node redirects directories to their URL with a trailing slash
+	if strings.HasSuffix(path, "/") {
+		proxyPath += "/"
+	}
+
+	userID := c.GetString("userID")
+	query := c.Request.URL.Query()
+
+	access, err := h.gatewayService.Authorize(c.Request.Context(), services.GatewayRequest{
+		CID:           normalized,
+		URLCID:        cid,
+		Path:          subpath,
+		UserID:        userID,
+		ShareID:       query.Get("share"),
+		Signature:     query.Get("sig"),
+		Expires:       query.Get("exp"),
+		CountDownload: countsAsDownload(c.Request),
+	})
+	if err != nil {
+		switch err.Error() {
+		case "content not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Content not found"})
+		case "access denied":
+			if userID == "" && query.Get("share") == "" {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			} else {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			}
+		default:
+			h.logger.WithError(err).Error("Failed to authorize gateway request")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get content"})
+		}
+		return
+	}
+
+	// Cold content is on Filecoin only until a retrieval restores it
+	retrieval, err := h.retrievalService.RetrieveCold(c.Request.Context(), access.PinRequest)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to start retrieval of cold content")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get content"})
+		return
+	}
+	if retrieval != nil {
+		c.Header("Cache-Control", "no-store")
+		c.Header("Retry-After", "60")
+		c.JSON(http.StatusAccepted, gin.H{"message": "Content is being retrieved from Filecoin"})
+		return
+	}
+
+	if access.PinRequest.Encrypted {
+		h.serveDecrypted(c, access, subpath != "")
+		return
+	}
+
+	// Strip our own parameters before handing the request to the node
+	for _, param := range []string{"share", "sig", "exp", "token"} {
+		query.Del(param)
+	}
+
+	req := c.Request.Clone(context.WithValue(c.Request.Context(), gatewayPublicKey{}, access.Public))
+	req.URL.Path = "/ipfs/" + proxyPath
+	req.URL.RawPath = ""
+	req.URL.RawQuery = query.Encode()
+
+	h.proxy.ServeHTTP(c.Writer, req)
+
+	// The client may already be gone, so meter outside the request context
+	if size := c.Writer.Size(); size > 0 {
+		h.gatewayService.RecordBandwidth(context.Background(), access.PinRequest.UserID, int64(size))
+	}
+}
+
+// serveDecrypted streams the plaintext of an encrypted upload. The
+// ciphertext is a single opaque file, so paths inside it and byte ranges
+// cannot be served.
+func (h *GatewayHandler) serveDecrypted(c *gin.Context, access *services.GatewayAccess, subpath bool) {
+	pin := access.PinRequest
+	if subpath {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Encrypted content has no paths"})
+		return
+	}
+
+	var plaintext io.ReadCloser
+	if c.Request.Method != http.MethodHead {
+		var err error
+		plaintext, err = h.uploadService.OpenDecrypted(c.Request.Context(), pin)
+		if err != nil {
+			h.logger.WithError(err).WithField("pin_request_id", pin.ID).Error("Failed to open encrypted content")
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to get content"})
+			return
+		}
+		defer plaintext.Close()
+	}
+
+	contentType := pin.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	c.Header("Cache-Control", "private, no-store")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Accept-Ranges", "none")
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Length", strconv.FormatInt(pin.PlaintextSize, 10))
+	c.Status(http.StatusOK)
+	if plaintext == nil {
+		return
+	}
+
+	written, err := io.Copy(c.Writer, plaintext)
+	if err != nil {
+		// Headers are gone, all we can do is cut the response short
+		h.logger.WithError(err).WithField("pin_request_id", pin.ID).Error("Failed to decrypt content")
+	}
+
+	if written > 0 {
+		h.gatewayService.RecordBandwidth(context.Background(), pin.UserID, written)
+	}
+}
+
+// countsAsDownload returns true for requests that start a download. HEAD
+// requests and a single range resuming part way through a file are free so
+// players and download managers do not use up a share link's limit. Any
+// other range, including suffix ranges, several ranges and headers that
+// do not parse, counts, since it can fetch the whole file.
+func countsAsDownload(req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	rng := req.Header.Get("Range")
+	if rng == "" {
+		return true
+	}
+
+	spec, ok := strings.CutPrefix(rng, "bytes=")
+	if !ok {
+		return true
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return true
+	}
+	start, ok := parseRangeOffset(first)
+	if !ok || start == 0 {
+		return true
+	}
+	if last == "" {
+		return false
+	}
+	end, ok := parseRangeOffset(last)
+	return !ok || end < start
+}
+
+// parseRangeOffset parses an offset in a Range header, which is only ever
+// plain digits
+func parseRangeOffset(s string) (int64, bool) {
+	if s == "" {
+		return 0, false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
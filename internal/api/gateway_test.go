@@ -0,0 +1,55 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCountsAsDownload(t *testing.T) {
+	for _, tc := range []struct {
+		method string
+		rng    string
+		want   bool
+	}{
+		{http.MethodGet, "", true},
+		{http.MethodHead, "", false},
+		{http.MethodHead, "bytes=0-", false},
+
+		// Ranges covering the start of the file
+		{http.MethodGet, "bytes=0-", true},
+		{http.MethodGet, "bytes=0-99", true},
+		{http.MethodGet, "bytes=00-", true},
+
+		// Suffix ranges can ask for the whole file
+		{http.MethodGet, "bytes=-500", true},
+		{http.MethodGet, "bytes=-99999999999999999999", true},
+
+		// Several ranges can cover the whole file between them
+		{http.MethodGet, "bytes=1-1,0-", true},
+		{http.MethodGet, "bytes=100-199,200-", true},
+
+		// Headers that do not parse may be ignored and the whole file sent
+		{http.MethodGet, "bytes= 0-", true},
+		{http.MethodGet, "bytes= 100-", true},
+		{http.MethodGet, "bytes=+100-", true},
+		{http.MethodGet, "bytes=100", true},
+		{http.MethodGet, "bytes=100-abc", true},
+		{http.MethodGet, "bytes=200-100", true},
+		{http.MethodGet, "items=100-", true},
+		{http.MethodGet, "bytes=99999999999999999999-", true},
+
+		// Resuming part way through
+		{http.MethodGet, "bytes=100-", false},
+		{http.MethodGet, "bytes=100-199", false},
+		{http.MethodGet, "bytes=100-100", false},
+	} {
+		req := httptest.NewRequest(tc.method, "/ipfs/bafytest", nil)
+		if tc.rng != "" {
+			req.Header.Set("Range", tc.rng)
+		}
+		if got := countsAsDownload(req); got != tc.want {
+			t.Errorf("countsAsDownload(%s, %q) = %v, want %v", tc.method, tc.rng, got, tc.want)
+		}
+	}
+}
@@ -1,45 +1,166 @@
 package api
 
 import (
+	"errors"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
 	"github.com/sirupsen/logrus"
 
 	"pinning-service/internal/models"
 	"pinning-service/internal/services"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/utils"
 )
 
 type Handlers struct {
-	dealService    *services.DealService
-	pricingService *services.PricingService
-	userService    *services.UserService
-	logger         *logrus.Logger
+	dealService         *services.DealService
+	dealMonitor         *services.DealMonitor
+	renewalService      *services.RenewalService
+	repairService       *services.RepairService
+	retrievalService    *services.RetrievalService
+	gatewayService      *services.GatewayService
+	uploadService       *services.UploadService
+	aggregationService  *services.AggregationService
+	splitService        *services.SplitService
+	dataCapService      *services.DataCapService
+	transferService     *services.TransferService
+	nodePoolService     *services.NodePoolService
+	pinService          *services.PinService
+	contentService      *services.ContentService
+	reconcileService    *services.ReconcileService
+	expiryService       *services.ExpiryService
+	quotaService        *services.QuotaService
+	invoiceService      *services.InvoiceService
+	notificationService *services.NotificationService
+	pricingService      *services.PricingService
+	userService         *services.UserService
+	logger              *logrus.Logger
 }
 
 type PinRequest struct {
-	CID          string `json:"cid" binding:"required"`
-	DurationDays int    `json:"duration_days" binding:"required,min=1"`
+	CID                string           `json:"cid" binding:"required"`
+	DurationDays       int              `json:"duration_days" binding:"required,min=1"`
+	Replicas           int              `json:"replicas" binding:"omitempty,min=1,max=10"`
+	AutoRenew          string           `json:"auto_renew" binding:"omitempty,oneof=off until indefinite"`
+	RenewUntil         *time.Time       `json:"renew_until"`
+	MaxRenewalPriceFIL *decimal.Decimal `json:"max_renewal_price_fil"`
+	Verified           bool             `json:"verified"`
+	Origins            []string         `json:"origins"`
+	Tier               string           `json:"tier" binding:"omitempty,oneof=hot cold hot_cold"`
+	HotDays            int              `json:"hot_days" binding:"omitempty,min=1"`
+}
+
+type ExtendPinRequest struct {
+	Days int `json:"days" binding:"required,min=1"`
+}
+
+type LegalHoldRequest struct {
+	Hold   *bool  `json:"hold" binding:"required"`
+	Reason string `json:"reason"`
+}
+
+type DataCapAllocationRequest struct {
+	AllowanceBytes *int64 `json:"allowance_bytes" binding:"required,min=0"`
+}
+
+// AccountQuotaRequest overrides an account's quotas. Limits left out fall
+// back to the configured defaults and zero means unlimited.
+type AccountQuotaRequest struct {
+	MaxBytes          *int64 `json:"max_bytes" binding:"omitempty,min=0"`
+	MaxPins           *int64 `json:"max_pins" binding:"omitempty,min=0"`
+	RequestsPerMinute *int   `json:"requests_per_minute" binding:"omitempty,min=0"`
+	MaxPendingPins    *int   `json:"max_pending_pins" binding:"omitempty,min=0"`
+	Note              string `json:"note"`
 }
 
 type PinResponse struct {
-	ID           string  `json:"id"`
-	CID          string  `json:"cid"`
-	Status       string  `json:"status"`
-	SizeBytes    int64   `json:"size_bytes"`
-	PriceFIL     float64 `json:"price_fil"`
-	DurationDays int     `json:"duration_days"`
-	CreatedAt    string  `json:"created_at"`
+	ID            string               `json:"id"`
+	CID           string               `json:"cid"`
+	NormalizedCID string               `json:"normalized_cid"`
+	Status        string               `json:"status"`
+	SizeBytes     int64                `json:"size_bytes"`
+	PriceFIL      float64              `json:"price_fil"`
+	DurationDays  int                  `json:"duration_days"`
+	Tier          string               `json:"tier"`
+	ColdAt        string               `json:"cold_at,omitempty"`
+	ExpiresAt     string               `json:"expires_at,omitempty"`
+	DealsExpireAt string               `json:"deals_expire_at,omitempty"`
+	AutoRenew     string               `json:"auto_renew"`
+	RenewUntil    string               `json:"renew_until,omitempty"`
+	IPFSStatus    string               `json:"ipfs_status,omitempty"`
+	Origins       []string             `json:"origins,omitempty"`
+	Delegates     []string             `json:"delegates,omitempty"`
+	Progress      *PinProgressResponse `json:"progress,omitempty"`
+	CreatedAt     string               `json:"created_at"`
 }
 
-func NewHandlers(dealService *services.DealService, pricingService *services.PricingService, userService *services.UserService, logger *logrus.Logger) *Handlers {
+// PinProgressResponse reports how far fetching a pin's content has got
+type PinProgressResponse struct {
+	BlocksFetched  int64  `json:"blocks_fetched"`
+	BytesFetched   int64  `json:"bytes_fetched"`
+	TotalBytes     int64  `json:"total_bytes,omitempty"`
+	Attempts       int    `json:"attempts"`
+	StartedAt      string `json:"started_at,omitempty"`
+	LastProgressAt string `json:"last_progress_at,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// HandlerServices are the services the API handlers are built on
+type HandlerServices struct {
+	DealService         *services.DealService
+	DealMonitor         *services.DealMonitor
+	RenewalService      *services.RenewalService
+	RepairService       *services.RepairService
+	RetrievalService    *services.RetrievalService
+	GatewayService      *services.GatewayService
+	UploadService       *services.UploadService
+	AggregationService  *services.AggregationService
+	SplitService        *services.SplitService
+	DataCapService      *services.DataCapService
+	TransferService     *services.TransferService
+	NodePoolService     *services.NodePoolService
+	PinService          *services.PinService
+	ContentService      *services.ContentService
+	ReconcileService    *services.ReconcileService
+	ExpiryService       *services.ExpiryService
+	QuotaService        *services.QuotaService
+	InvoiceService      *services.InvoiceService
+	NotificationService *services.NotificationService
+	PricingService      *services.PricingService
+	UserService         *services.UserService
+}
+
+func NewHandlers(svc HandlerServices, logger *logrus.Logger) *Handlers {
 	return &Handlers{
-		dealService:    dealService,
-		pricingService: pricingService,
-		userService:    userService,
-		logger:         logger,
+		dealService:         svc.DealService,
+		dealMonitor:         svc.DealMonitor,
+		renewalService:      svc.RenewalService,
+		repairService:       svc.RepairService,
+		retrievalService:    svc.RetrievalService,
+		gatewayService:      svc.GatewayService,
+		uploadService:       svc.UploadService,
+		aggregationService:  svc.AggregationService,
+		splitService:        svc.SplitService,
+		dataCapService:      svc.DataCapService,
+		transferService:     svc.TransferService,
+		nodePoolService:     svc.NodePoolService,
+		pinService:          svc.PinService,
+		contentService:      svc.ContentService,
+		reconcileService:    svc.ReconcileService,
+		expiryService:       svc.ExpiryService,
+		quotaService:        svc.QuotaService,
+		invoiceService:      svc.InvoiceService,
+		notificationService: svc.NotificationService,
+		pricingService:      svc.PricingService,
+		userService:         svc.UserService,
+		logger:              logger,
 	}
 }
 
@@ -63,23 +184,88 @@ func (h *Handlers) PostPin(c *gin.Context) {
 		return
 	}
 
+	parsed, err := utils.ParseCID(req.CID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid CID", "details": err.Error()})
+		return
+	}
+
 	pinRequest := &models.PinRequest{
 		ID:           uuid.New(),
 		UserID:       userUUID,
-		CID:          req.CID,
+		CID:          parsed.CID,
+		OriginalCID:  parsed.Original,
+		Path:         parsed.Path,
 		DurationDays: req.DurationDays,
+		Replicas:     req.Replicas,
+		Verified:     req.Verified,
 		Status:       "pending",
+		AutoRenew:    models.AutoRenewOff,
+		Tier:         models.TierHotCold,
+		HotDays:      req.HotDays,
+	}
+	if req.Tier != "" {
+		pinRequest.Tier = req.Tier
+	}
+
+	if req.HotDays > 0 && (pinRequest.Tier != models.TierHotCold || req.HotDays >= req.DurationDays) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "hot_days requires the hot_cold tier and must be less than duration_days"})
+		return
+	}
+
+	if req.Verified && !h.dataCapService.Enabled() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Verified deals are not available"})
+		return
+	}
+	if req.Verified && !pinRequest.MakesDeals() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Verified deals are not available for the hot tier"})
+		return
+	}
+
+	origins, err := h.pinService.ValidateOrigins(req.Origins)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid origins", "details": err.Error()})
+		return
+	}
+	pinRequest.Origins = strings.Join(origins, ",")
+
+	if req.AutoRenew != "" {
+		if req.AutoRenew == models.AutoRenewUntil && (req.RenewUntil == nil || req.RenewUntil.Before(time.Now())) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "renew_until must be a future date"})
+			return
+		}
+		pinRequest.AutoRenew = req.AutoRenew
+		if req.AutoRenew == models.AutoRenewUntil {
+			pinRequest.RenewUntil = req.RenewUntil
+		}
+	}
+	pinRequest.MaxRenewalPriceFIL = req.MaxRenewalPriceFIL
+
+	// The size of a pin by CID is unknown until it is fetched, so it is
+	// checked against the account's balance at the minimum price here and
+	// against the storage quota and balance again once it is pinned
+	estimate := services.PinEstimate{PriceFIL: h.pricingService.CalculatePinPriceFIL(pinRequest, 0)}
+	if err := h.quotaService.CheckPin(c.Request.Context(), userUUID, estimate); err != nil {
+		h.quotaError(c, err)
+		return
 	}
 
-	if err := h.dealService.SubmitPinRequest(c.Request.Context(), pinRequest); err != nil {
+	if err := h.pinService.CreatePinRequest(c.Request.Context(), pinRequest); err != nil {
+		if services.QuotaExceeded(err) {
+			h.quotaError(c, err)
+			return
+		}
 		h.logger.WithError(err).Error("Failed to submit pin request")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit pin request"})
 		return
 	}
 
 	c.JSON(http.StatusAccepted, gin.H{
-		"id":      pinRequest.ID.String(),
-		"message": "Pin request submitted successfully",
+		"id":             pinRequest.ID.String(),
+		"cid":            pinRequest.DisplayCID(),
+		"normalized_cid": pinRequest.CID,
+		"message":        "Pin request submitted successfully",
+		"delegates":      h.nodePoolService.Delegates(c.Request.Context(), pinRequest.CID),
 	})
 }
 
@@ -115,13 +301,51 @@ func (h *Handlers) GetPin(c *gin.Context) {
 	}
 
 	response := PinResponse{
-		ID:           pinRequest.ID.String(),
-		CID:          pinRequest.CID,
-		Status:       pinRequest.Status,
-		SizeBytes:    pinRequest.SizeBytes,
-		PriceFIL:     pinRequest.PriceFIL,
-		DurationDays: pinRequest.DurationDays,
-		CreatedAt:    pinRequest.CreatedAt.Format("2006-01-02T15:04:05Z"),
+		ID:            pinRequest.ID.String(),
+		CID:           pinRequest.DisplayCID(),
+		NormalizedCID: pinRequest.CID,
+		Status:        pinRequest.Status,
+		SizeBytes:     pinRequest.SizeBytes,
+		PriceFIL:      pinRequest.PriceFIL,
+		DurationDays:  pinRequest.DurationDays,
+		Tier:          pinRequest.Tier,
+		AutoRenew:     pinRequest.AutoRenew,
+		CreatedAt:     pinRequest.CreatedAt.Format("2006-01-02T15:04:05Z"),
+	}
+	if pinRequest.ColdAt != nil {
+		response.ColdAt = pinRequest.ColdAt.Format("2006-01-02T15:04:05Z")
+	}
+	if pinRequest.RenewUntil != nil {
+		response.RenewUntil = pinRequest.RenewUntil.Format("2006-01-02T15:04:05Z")
+	}
+	if pinRequest.ExpiresAt != nil {
+		response.ExpiresAt = pinRequest.ExpiresAt.Format("2006-01-02T15:04:05Z")
+	}
+	if pinRequest.DealsExpireAt != nil {
+		response.DealsExpireAt = pinRequest.DealsExpireAt.Format("2006-01-02T15:04:05Z")
+	}
+	if placement, err := h.nodePoolService.GetPlacement(c.Request.Context(), pinRequest.CID); err == nil {
+		response.IPFSStatus = placement.Status
+	}
+	response.Origins = pinRequest.OriginAddrs()
+	if pinRequest.IsActive() {
+		response.Delegates = h.nodePoolService.Delegates(c.Request.Context(), pinRequest.CID)
+	}
+	if pinRequest.PinAttempts > 0 && pinRequest.Status != models.PinStatusPinned {
+		progress := &PinProgressResponse{
+			BlocksFetched: pinRequest.BlocksFetched,
+			BytesFetched:  pinRequest.BytesFetched,
+			TotalBytes:    pinRequest.SizeBytes,
+			Attempts:      pinRequest.PinAttempts,
+			Error:         pinRequest.PinError,
+		}
+		if pinRequest.PinStartedAt != nil {
+			progress.StartedAt = pinRequest.PinStartedAt.Format("2006-01-02T15:04:05Z")
+		}
+		if pinRequest.PinProgressAt != nil {
+			progress.LastProgressAt = pinRequest.PinProgressAt.Format("2006-01-02T15:04:05Z")
+		}
+		response.Progress = progress
 	}
 
 	c.JSON(http.StatusOK, response)
@@ -161,15 +385,28 @@ func (h *Handlers) GetPins(c *gin.Context) {
 
 	var responses []PinResponse
 	for _, pin := range pins {
-		responses = append(responses, PinResponse{
-			ID:           pin.ID.String(),
-			CID:          pin.CID,
-			Status:       pin.Status,
-			SizeBytes:    pin.SizeBytes,
-			PriceFIL:     pin.PriceFIL,
-			DurationDays: pin.DurationDays,
-			CreatedAt:    pin.CreatedAt.Format("2006-01-02T15:04:05Z"),
-		})
+		response := PinResponse{
+			ID:            pin.ID.String(),
+			CID:           pin.DisplayCID(),
+			NormalizedCID: pin.CID,
+			Status:        pin.Status,
+			SizeBytes:     pin.SizeBytes,
+			PriceFIL:      pin.PriceFIL,
+			DurationDays:  pin.DurationDays,
+			Tier:          pin.Tier,
+			AutoRenew:     pin.AutoRenew,
+			CreatedAt:     pin.CreatedAt.Format("2006-01-02T15:04:05Z"),
+		}
+		if pin.ColdAt != nil {
+			response.ColdAt = pin.ColdAt.Format("2006-01-02T15:04:05Z")
+		}
+		if pin.ExpiresAt != nil {
+			response.ExpiresAt = pin.ExpiresAt.Format("2006-01-02T15:04:05Z")
+		}
+		if pin.DealsExpireAt != nil {
+			response.DealsExpireAt = pin.DealsExpireAt.Format("2006-01-02T15:04:05Z")
+		}
+		responses = append(responses, response)
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -210,16 +447,25 @@ func (h *Handlers) DeletePin(c *gin.Context) {
 		return
 	}
 
+	// Content stays pinned while other pins reference it
+	if err := h.contentService.Release(c.Request.Context(), pinUUID); err != nil {
+		h.logger.WithError(err).WithField("pin_id", pinUUID).Error("Failed to release pin content")
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Pin request cancelled successfully"})
 }
 
 // GetDeals returns Filecoin deals for content
 func (h *Handlers) GetDeals(c *gin.Context) {
-	cid := c.Param("cid")
-	if cid == "" {
+	if c.Param("cid") == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "CID is required"})
 		return
 	}
+	cid, err := utils.NormalizeCID(c.Param("cid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid CID", "details": err.Error()})
+		return
+	}
 
 	userID, exists := c.Get("userID")
 	if !exists {
@@ -239,11 +485,15 @@ func (h *Handlers) GetDeals(c *gin.Context) {
 
 // PostRenewDeal renews expiring deals
 func (h *Handlers) PostRenewDeal(c *gin.Context) {
-	cid := c.Param("cid")
-	if cid == "" {
+	if c.Param("cid") == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "CID is required"})
 		return
 	}
+	cid, err := utils.NormalizeCID(c.Param("cid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid CID", "details": err.Error()})
+		return
+	}
 
 	userID, exists := c.Get("userID")
 	if !exists {
@@ -251,62 +501,1204 @@ func (h *Handlers) PostRenewDeal(c *gin.Context) {
 		return
 	}
 
-	if err := h.dealService.RenewDealsForCID(c.Request.Context(), cid, userID.(string)); err != nil {
+	renewals, err := h.renewalService.RenewDealsForCID(c.Request.Context(), cid, userID.(string))
+	if err != nil {
+		if err.Error() == "no renewable deals found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No renewable deals found"})
+			return
+		}
 		h.logger.WithError(err).Error("Failed to renew deals for CID")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to renew deals"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Deal renewal initiated"})
+	c.JSON(http.StatusOK, gin.H{"renewals": renewals})
 }
 
-// GetPricing returns current pricing information
-func (h *Handlers) GetPricing(c *gin.Context) {
-	sizeBytes := int64(1024 * 1024 * 1024) // Default 1GB
-	if s := c.Query("size_bytes"); s != "" {
-		if parsed, err := strconv.ParseInt(s, 10, 64); err == nil {
-			sizeBytes = parsed
-		}
+// PutPinRenewal updates the renewal preferences of a pin
+func (h *Handlers) PutPinRenewal(c *gin.Context) {
+	pinUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pin ID format"})
+		return
 	}
 
-	durationDays := 30 // Default 30 days
-	if d := c.Query("duration_days"); d != "" {
-		if parsed, err := strconv.Atoi(d); err == nil {
-			durationDays = parsed
-		}
+	var req services.RenewalPreferences
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format", "details": err.Error()})
+		return
 	}
 
-	price := h.pricingService.CalculatePrice(sizeBytes, durationDays)
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	pinRequest, err := h.renewalService.UpdatePreferences(c.Request.Context(), pinUUID, userID.(string), req)
+	if err != nil {
+		switch err.Error() {
+		case "pin request not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pin request not found"})
+		case "renew_until must be a future date":
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			h.logger.WithError(err).Error("Failed to update renewal preferences")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update renewal preferences"})
+		}
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"size_bytes":    sizeBytes,
-		"duration_days": durationDays,
-		"price_fil":     price,
+		"auto_renew":            pinRequest.AutoRenew,
+		"renew_until":           pinRequest.RenewUntil,
+		"max_renewal_price_fil": pinRequest.MaxRenewalPriceFIL,
 	})
 }
 
-// GetMiners returns list of available storage miners
-func (h *Handlers) GetMiners(c *gin.Context) {
-	miners, err := h.dealService.GetAvailableMiners(c.Request.Context())
+// PostPinExtend extends a pin's hot storage by a number of days, charging
+// the user's balance
+func (h *Handlers) PostPinExtend(c *gin.Context) {
+	pinUUID, err := uuid.Parse(c.Param("id"))
 	if err != nil {
-		h.logger.WithError(err).Error("Failed to get available miners")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get miners"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pin ID format"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"miners": miners})
+	var req ExtendPinRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format", "details": err.Error()})
+		return
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	extension, err := h.expiryService.Extend(c.Request.Context(), pinUUID, userID.(string), req.Days)
+	if err != nil {
+		switch {
+		case err.Error() == "pin request not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pin request not found"})
+		case err.Error() == "pin cannot be extended":
+			c.JSON(http.StatusConflict, gin.H{"error": "Pin is not pinned or its content has been released"})
+		case errors.Is(err, storage.ErrInsufficientBalance):
+			c.JSON(http.StatusPaymentRequired, gin.H{"error": "Insufficient balance"})
+		default:
+			h.logger.WithError(err).Error("Failed to extend pin")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to extend pin"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, extension)
 }
 
-// GetStats returns service statistics and health
-func (h *Handlers) GetStats(c *gin.Context) {
-	stats, err := h.dealService.GetServiceStats(c.Request.Context())
+// GetPinRenewals lists the renewal history of a pin
+func (h *Handlers) GetPinRenewals(c *gin.Context) {
+	pinUUID, err := uuid.Parse(c.Param("id"))
 	if err != nil {
-		h.logger.WithError(err).Error("Failed to get service stats")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get stats"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pin ID format"})
 		return
 	}
 
-	c.JSON(http.StatusOK, stats)
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	renewals, err := h.renewalService.GetRenewals(c.Request.Context(), pinUUID, userID.(string))
+	if err != nil {
+		if err.Error() == "pin request not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pin request not found"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to get renewals")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get renewals"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"renewals": renewals})
+}
+
+// GetPinReplicas reports the health of a pin's Filecoin replicas
+func (h *Handlers) GetPinReplicas(c *gin.Context) {
+	pinUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pin ID format"})
+		return
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	report, err := h.repairService.GetReplicaReport(c.Request.Context(), pinUUID, userID.(string))
+	if err != nil {
+		if err.Error() == "pin request not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pin request not found"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to get replica report")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get replicas"})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// GetPinAggregate shows the aggregate a small pin was stored in, with the
+// path proving its inclusion and the aggregate's deals
+func (h *Handlers) GetPinAggregate(c *gin.Context) {
+	pinUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pin ID format"})
+		return
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	inclusion, err := h.aggregationService.GetInclusion(c.Request.Context(), pinUUID, userID.(string))
+	if err != nil {
+		switch err.Error() {
+		case "pin request not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pin request not found"})
+		case "pin request is not aggregated":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pin request is not part of an aggregate"})
+		default:
+			h.logger.WithError(err).Error("Failed to get pin aggregate")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get aggregate"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, inclusion)
+}
+
+// GetPinChunks shows how an oversized pin was split and how many copies of
+// each chunk are stored
+func (h *Handlers) GetPinChunks(c *gin.Context) {
+	pinUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pin ID format"})
+		return
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	report, err := h.splitService.GetSplitReport(c.Request.Context(), pinUUID, userID.(string))
+	if err != nil {
+		switch err.Error() {
+		case "pin request not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pin request not found"})
+		case "pin request is not split":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pin request is not split into chunks"})
+		default:
+			h.logger.WithError(err).Error("Failed to get pin chunks")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get chunks"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// GetPinTransfers shows the progress of moving a pin's data to its
+// providers for manual transfer deals
+func (h *Handlers) GetPinTransfers(c *gin.Context) {
+	pinUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pin ID format"})
+		return
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	transfers, err := h.transferService.GetTransfers(c.Request.Context(), pinUUID, userID.(string))
+	if err != nil {
+		if err.Error() == "pin request not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pin request not found"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to get pin transfers")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get transfers"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"transfers": transfers})
+}
+
+// GetPinNodes shows which IPFS nodes hold a pin and their pin status
+func (h *Handlers) GetPinNodes(c *gin.Context) {
+	pinUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pin ID format"})
+		return
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	placement, err := h.nodePoolService.GetPinPlacement(c.Request.Context(), pinUUID, userID.(string))
+	if err != nil {
+		if err.Error() == "pin request not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pin request not found"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to get pin placement")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get pin nodes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, placement)
+}
+
+// GetContent serves pinned content, restoring it from Filecoin if the
+// IPFS copy has been lost
+func (h *Handlers) GetContent(c *gin.Context) {
+	if c.Param("cid") == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "CID is required"})
+		return
+	}
+	cid, err := utils.NormalizeCID(c.Param("cid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid CID", "details": err.Error()})
+		return
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	content, retrieval, err := h.retrievalService.GetContent(c.Request.Context(), cid, userID.(string))
+	if err != nil {
+		if err.Error() == "content not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Content not found"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to get content")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get content"})
+		return
+	}
+
+	if retrieval != nil {
+		c.Header("Retry-After", "60")
+		c.JSON(http.StatusAccepted, gin.H{
+			"message":   "Content is being retrieved from Filecoin",
+			"retrieval": retrieval,
+		})
+		return
+	}
+
+	defer content.Close()
+
+	c.DataFromReader(http.StatusOK, -1, "application/octet-stream", content, nil)
+}
+
+// GetRetrieval returns the status of a Filecoin retrieval
+func (h *Handlers) GetRetrieval(c *gin.Context) {
+	retrievalUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid retrieval ID format"})
+		return
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	retrieval, err := h.retrievalService.GetRetrieval(c.Request.Context(), retrievalUUID, userID.(string))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Retrieval not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, retrieval)
+}
+
+// PostUpload adds an uploaded file to IPFS and pins it, encrypting it
+// first when encrypt=true. The file is sent as the "file" field of a
+// multipart form alongside the pin options.
+func (h *Handlers) PostUpload(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.uploadService.MaxUploadSize())
+	if err := c.Request.ParseMultipartForm(32 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Upload exceeds maximum size"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid multipart form", "details": err.Error()})
+		return
+	}
+
+	durationDays, err := strconv.Atoi(c.PostForm("duration_days"))
+	if err != nil || durationDays < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "duration_days must be a positive integer"})
+		return
+	}
+
+	replicas := 0
+	if r := c.PostForm("replicas"); r != "" {
+		replicas, err = strconv.Atoi(r)
+		if err != nil || replicas < 1 || replicas > 10 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "replicas must be between 1 and 10"})
+			return
+		}
+	}
+
+	encrypt, _ := strconv.ParseBool(c.PostForm("encrypt"))
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required", "details": err.Error()})
+		return
+	}
+
+	userUUID, err := uuid.Parse(userID.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	if err := h.quotaService.CheckPin(c.Request.Context(), userUUID, services.PinEstimate{
+		SizeBytes: fileHeader.Size,
+		PriceFIL:  h.pricingService.CalculatePriceFIL(fileHeader.Size, durationDays),
+	}); err != nil {
+		h.quotaError(c, err)
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read upload"})
+		return
+	}
+	defer file.Close()
+
+	pinRequest, err := h.uploadService.Upload(c.Request.Context(), userID.(string), file, services.UploadOptions{
+		DurationDays: durationDays,
+		Replicas:     replicas,
+		ContentType:  fileHeader.Header.Get("Content-Type"),
+		Encrypt:      encrypt,
+	})
+	if err != nil {
+		if err.Error() == "encryption is not enabled" {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "Encryption is not enabled"})
+			return
+		}
+		if services.QuotaExceeded(err) {
+			h.quotaError(c, err)
+			return
+		}
+		h.logger.WithError(err).Error("Failed to upload content")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload content"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"id":        pinRequest.ID.String(),
+		"cid":       pinRequest.CID,
+		"encrypted": pinRequest.Encrypted,
+		"size":      pinRequest.PlaintextSize,
+		"message":   "Pin request submitted successfully",
+	})
+}
+
+// ShareRequest represents the API request to share a pin
+type ShareRequest struct {
+	Path         string `json:"path"`
+	ExpiresIn    int    `json:"expires_in" binding:"omitempty,min=60"`
+	MaxDownloads *int   `json:"max_downloads" binding:"omitempty,min=1"`
+}
+
+// PostPinShare creates a signed, expiring URL for a pin's content
+func (h *Handlers) PostPinShare(c *gin.Context) {
+	pinUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pin ID format"})
+		return
+	}
+
+	var req ShareRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	share, err := h.gatewayService.CreateShare(c.Request.Context(), pinUUID, userID.(string), services.ShareOptions{
+		Path:         req.Path,
+		ExpiresIn:    time.Duration(req.ExpiresIn) * time.Second,
+		MaxDownloads: req.MaxDownloads,
+	})
+	if err != nil {
+		switch {
+		case err.Error() == "pin request not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pin request not found"})
+		case err.Error() == "pin request is not pinned":
+			c.JSON(http.StatusConflict, gin.H{"error": "Pin request is not pinned yet"})
+		case err.Error() == "sharing is not enabled":
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "Sharing is not enabled"})
+		case strings.HasPrefix(err.Error(), "expiry exceeds"):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case err.Error() == "invalid path":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Path must not contain '..'"})
+		default:
+			h.logger.WithError(err).Error("Failed to create share link")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
+		}
+		return
+	}
+
+	share.URL = absoluteURL(c, share.URL)
+	c.JSON(http.StatusCreated, share)
+}
+
+// GetPinShares lists a pin's share links
+func (h *Handlers) GetPinShares(c *gin.Context) {
+	pinUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pin ID format"})
+		return
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	shares, err := h.gatewayService.GetShares(c.Request.Context(), pinUUID, userID.(string))
+	if err != nil {
+		if err.Error() == "pin request not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pin request not found"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to get share links")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get share links"})
+		return
+	}
+
+	for _, share := range shares {
+		share.URL = absoluteURL(c, share.URL)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"shares": shares})
+}
+
+// DeletePinShare revokes a share link
+func (h *Handlers) DeletePinShare(c *gin.Context) {
+	pinUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pin ID format"})
+		return
+	}
+
+	shareUUID, err := uuid.Parse(c.Param("share_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid share ID format"})
+		return
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	if err := h.gatewayService.RevokeShare(c.Request.Context(), pinUUID, shareUUID, userID.(string)); err != nil {
+		if err.Error() == "share link not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to revoke share link")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke share link"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Share link revoked"})
+}
+
+// absoluteURL prefixes a relative URL with the scheme and host the request
+// was made to
+func absoluteURL(c *gin.Context, u string) string {
+	if !strings.HasPrefix(u, "/") {
+		return u
+	}
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host + u
+}
+
+// GetBandwidthUsage returns the user's daily gateway bandwidth usage
+func (h *Handlers) GetBandwidthUsage(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	to := time.Now().UTC()
+	from := to.AddDate(0, 0, -30)
+	if f := c.Query("from"); f != "" {
+		parsed, err := time.Parse("2006-01-02", f)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date, expected YYYY-MM-DD"})
+			return
+		}
+		from = parsed
+	}
+	if t := c.Query("to"); t != "" {
+		parsed, err := time.Parse("2006-01-02", t)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date, expected YYYY-MM-DD"})
+			return
+		}
+		to = parsed
+	}
+
+	usage, err := h.gatewayService.GetBandwidthUsage(c.Request.Context(), userID.(string), from, to)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to get bandwidth usage")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get bandwidth usage"})
+		return
+	}
+
+	var totalBytes, totalRequests int64
+	for _, day := range usage {
+		totalBytes += day.Bytes
+		totalRequests += day.Requests
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"usage":          usage,
+		"total_bytes":    totalBytes,
+		"total_requests": totalRequests,
+		"from":           from.Format("2006-01-02"),
+		"to":             to.Format("2006-01-02"),
+	})
+}
+
+// GetAccountUsage returns the user's current usage against their quotas
+// and their daily usage over a period
+func (h *Handlers) GetAccountUsage(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	to := time.Now().UTC()
+	from := to.AddDate(0, 0, -30)
+	if f := c.Query("from"); f != "" {
+		parsed, err := time.Parse("2006-01-02", f)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date, expected YYYY-MM-DD"})
+			return
+		}
+		from = parsed
+	}
+	if t := c.Query("to"); t != "" {
+		parsed, err := time.Parse("2006-01-02", t)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date, expected YYYY-MM-DD"})
+			return
+		}
+		to = parsed
+	}
+
+	report, err := h.quotaService.GetUsage(c.Request.Context(), userID.(string), from, to)
+	if err != nil {
+		if err.Error() == "invalid date range" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date range, to must be after from and at most a year later"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to get account usage")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get account usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"usage":  report.Usage,
+		"limits": report.Limits,
+		"series": report.Series,
+		"from":   from.Format("2006-01-02"),
+		"to":     to.Format("2006-01-02"),
+	})
+}
+
+// GetInvoices lists the user's invoices and credit notes
+func (h *Handlers) GetInvoices(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	kind := c.Query("kind")
+	if kind != "" && kind != models.InvoiceKindInvoice && kind != models.InvoiceKindCreditNote {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "kind must be invoice or credit_note"})
+		return
+	}
+
+	page := 1
+	if p := c.Query("page"); p != "" {
+		if parsed, err := strconv.Atoi(p); err == nil && parsed > 0 {
+			page = parsed
+		}
+	}
+
+	limit := 20
+	if l := c.Query("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 100 {
+			limit = parsed
+		}
+	}
+
+	invoices, total, err := h.invoiceService.GetUserInvoices(c.Request.Context(), userID.(string), kind, page, limit)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to get invoices")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get invoices"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"invoices": invoices,
+		"total":    total,
+		"page":     page,
+		"limit":    limit,
+	})
+}
+
+// GetInvoice returns one of the user's invoices or credit notes with its
+// line items
+func (h *Handlers) GetInvoice(c *gin.Context) {
+	invoice, ok := h.userInvoice(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, invoice)
+}
+
+// GetInvoiceDownload downloads one of the user's invoices or credit notes
+// as an HTML, CSV or JSON document
+func (h *Handlers) GetInvoiceDownload(c *gin.Context) {
+	format := c.DefaultQuery("format", services.InvoiceFormatHTML)
+
+	invoice, ok := h.userInvoice(c)
+	if !ok {
+		return
+	}
+
+	data, contentType, err := h.invoiceService.Render(invoice, format)
+	if err != nil {
+		if err.Error() == "unsupported format" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format must be html, csv or json"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to render invoice")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render invoice"})
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=\""+invoice.Number+"."+format+"\"")
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// userInvoice loads the invoice named in the request if it belongs to the
+// user, responding with an error otherwise
+func (h *Handlers) userInvoice(c *gin.Context) (*models.Invoice, bool) {
+	invoiceUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invoice ID format"})
+		return nil, false
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return nil, false
+	}
+
+	invoice, err := h.invoiceService.GetInvoice(c.Request.Context(), invoiceUUID, userID.(string))
+	if err != nil {
+		if err.Error() == "invoice not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+			return nil, false
+		}
+		h.logger.WithError(err).Error("Failed to get invoice")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get invoice"})
+		return nil, false
+	}
+	return invoice, true
+}
+
+// GetDataCapUsage returns the user's DataCap allocation for verified deals
+func (h *Handlers) GetDataCapUsage(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	allocation, err := h.dataCapService.GetAllocation(c.Request.Context(), userID.(string))
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to get DataCap allocation")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get DataCap usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"allowance_bytes": allocation.AllowanceBytes,
+		"used_bytes":      allocation.UsedBytes,
+		"remaining_bytes": allocation.Remaining(),
+	})
+}
+
+// GetAdminDataCap returns the client's DataCap and every user's allocation
+func (h *Handlers) GetAdminDataCap(c *gin.Context) {
+	status, err := h.dataCapService.GetStatus(c.Request.Context())
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to get DataCap status")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get DataCap status"})
+		return
+	}
+
+	allocations, err := h.dataCapService.ListAllocations(c.Request.Context())
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list DataCap allocations")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get DataCap allocations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":      status,
+		"allocations": allocations,
+	})
+}
+
+// PutAdminDataCapAllocation sets the DataCap a user may spend on verified
+// deals
+func (h *Handlers) PutAdminDataCapAllocation(c *gin.Context) {
+	userUUID, err := uuid.Parse(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	var req DataCapAllocationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format", "details": err.Error()})
+		return
+	}
+
+	allocation, err := h.dataCapService.SetAllocation(c.Request.Context(), userUUID, *req.AllowanceBytes)
+	if err != nil {
+		switch err.Error() {
+		case "datacap is not enabled":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Verified deals are not available"})
+		case "user not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		case "allocation exceeds available datacap":
+			c.JSON(http.StatusConflict, gin.H{"error": "Allocation exceeds the unallocated DataCap"})
+		default:
+			h.logger.WithError(err).Error("Failed to set DataCap allocation")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set DataCap allocation"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, allocation)
+}
+
+// GetAdminQuota returns an account's quota override, the limits that apply
+// to it and its usage
+func (h *Handlers) GetAdminQuota(c *gin.Context) {
+	userUUID, err := uuid.Parse(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	report, err := h.quotaService.GetAccountQuota(c.Request.Context(), userUUID)
+	if err != nil {
+		if err.Error() == "user not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to get account quota")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get account quota"})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// PutAdminQuota overrides an account's quotas
+func (h *Handlers) PutAdminQuota(c *gin.Context) {
+	userUUID, err := uuid.Parse(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	var req AccountQuotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format", "details": err.Error()})
+		return
+	}
+
+	report, err := h.quotaService.SetAccountQuota(c.Request.Context(), &models.AccountQuota{
+		UserID:            userUUID,
+		MaxBytes:          req.MaxBytes,
+		MaxPins:           req.MaxPins,
+		RequestsPerMinute: req.RequestsPerMinute,
+		MaxPendingPins:    req.MaxPendingPins,
+		Note:              req.Note,
+	})
+	if err != nil {
+		if err.Error() == "user not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to set account quota")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set account quota"})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// PostAdminInvoices queues invoicing of a month given as period=YYYY-MM,
+// or of the last month that ended. Users already invoiced for the month are
+// skipped, so this also retries users that failed.
+func (h *Handlers) PostAdminInvoices(c *gin.Context) {
+	var period time.Time
+	if p := c.Query("period"); p != "" {
+		parsed, err := time.Parse("2006-01", p)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid period, expected YYYY-MM"})
+			return
+		}
+		period = parsed
+	}
+
+	if err := h.invoiceService.Enqueue(c.Request.Context(), period); err != nil {
+		if err.Error() == "period has not ended" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Period has not ended"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to queue invoicing")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue invoicing"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"status": "queued"})
+}
+
+// quotaError responds to a pin refused by the account's quotas
+func (h *Handlers) quotaError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, storage.ErrInsufficientBalance):
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": "Insufficient balance", "details": err.Error()})
+	case errors.Is(err, services.ErrStorageQuotaExceeded), errors.Is(err, services.ErrPinQuotaExceeded):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Quota exceeded", "details": err.Error()})
+	case errors.Is(err, services.ErrTooManyPendingPins):
+		c.Header("Retry-After", "60")
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many pending pins", "details": err.Error(), "retry_after": 60})
+	default:
+		h.logger.WithError(err).Error("Failed to check account quota")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check account quota"})
+	}
+}
+
+// PutAdminLegalHold places or lifts a legal hold on a pin
+func (h *Handlers) PutAdminLegalHold(c *gin.Context) {
+	pinUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pin ID format"})
+		return
+	}
+
+	var req LegalHoldRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format", "details": err.Error()})
+		return
+	}
+
+	pin, err := h.expiryService.SetLegalHold(c.Request.Context(), pinUUID, *req.Hold, req.Reason)
+	if err != nil {
+		if err.Error() == "pin request not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pin request not found"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to set legal hold")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set legal hold"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"pin_request_id": pin.ID,
+		"legal_hold":     pin.LegalHold,
+		"reason":         pin.LegalHoldReason,
+		"status":         pin.Status,
+		"expires_at":     pin.ExpiresAt,
+	})
+}
+
+// GetAdminNodes returns the health and pin count of every IPFS node
+func (h *Handlers) GetAdminNodes(c *gin.Context) {
+	nodes, err := h.nodePoolService.GetNodes(c.Request.Context())
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to get IPFS nodes")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get IPFS nodes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"nodes": nodes})
+}
+
+// PostAdminReconcile compares the IPFS nodes' pins with the database. A
+// dry run reports the discrepancies and planned actions right away;
+// otherwise a reconciliation job is queued.
+func (h *Handlers) PostAdminReconcile(c *gin.Context) {
+	dryRun := c.Query("dry_run") == "true"
+
+	if !dryRun {
+		if err := h.reconcileService.Enqueue(c.Request.Context()); err != nil {
+			if err.Error() == "IPFS Cluster manages its own pins" {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			h.logger.WithError(err).Error("Failed to queue reconciliation")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue reconciliation"})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"status": "queued"})
+		return
+	}
+
+	report, err := h.reconcileService.Reconcile(c.Request.Context(), true)
+	if err != nil {
+		if err.Error() == "IPFS Cluster manages its own pins" {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to reconcile IPFS pins")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reconcile IPFS pins"})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// GetAdminDiscrepancies lists the pin discrepancies found by
+// reconciliation, open ones only unless all=true
+func (h *Handlers) GetAdminDiscrepancies(c *gin.Context) {
+	page := 1
+	if p := c.Query("page"); p != "" {
+		if parsed, err := strconv.Atoi(p); err == nil && parsed > 0 {
+			page = parsed
+		}
+	}
+
+	limit := 20
+	if l := c.Query("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 100 {
+			limit = parsed
+		}
+	}
+
+	open := c.Query("all") != "true"
+	discrepancies, total, err := h.reconcileService.GetDiscrepancies(c.Request.Context(), open, page, limit)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to get pin discrepancies")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get pin discrepancies"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"discrepancies": discrepancies,
+		"total":         total,
+		"page":          page,
+		"limit":         limit,
+	})
+}
+
+// GetNotifications lists the user's notifications
+func (h *Handlers) GetNotifications(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	page := 1
+	if p := c.Query("page"); p != "" {
+		if parsed, err := strconv.Atoi(p); err == nil && parsed > 0 {
+			page = parsed
+		}
+	}
+
+	limit := 20
+	if l := c.Query("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 100 {
+			limit = parsed
+		}
+	}
+
+	notifications, total, err := h.notificationService.GetUserNotifications(c.Request.Context(), userID.(string), page, limit)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to get notifications")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get notifications"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"notifications": notifications,
+		"total":         total,
+		"page":          page,
+		"limit":         limit,
+	})
+}
+
+// PostNotificationRead marks a notification as read
+func (h *Handlers) PostNotificationRead(c *gin.Context) {
+	notificationUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification ID format"})
+		return
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User context not found"})
+		return
+	}
+
+	if err := h.notificationService.MarkRead(c.Request.Context(), notificationUUID, userID.(string)); err != nil {
+		h.logger.WithError(err).Error("Failed to mark notification read")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark notification read"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Notification marked as read"})
+}
+
+// GetPricing returns current pricing information
+func (h *Handlers) GetPricing(c *gin.Context) {
+	sizeBytes := int64(1024 * 1024 * 1024) // Default 1GB
+	if s := c.Query("size_bytes"); s != "" {
+		if parsed, err := strconv.ParseInt(s, 10, 64); err == nil {
+			sizeBytes = parsed
+		}
+	}
+
+	durationDays := 30 // Default 30 days
+	if d := c.Query("duration_days"); d != "" {
+		if parsed, err := strconv.Atoi(d); err == nil {
+			durationDays = parsed
+		}
+	}
+
+	hotDays := 0
+	if d := c.Query("hot_days"); d != "" {
+		if parsed, err := strconv.Atoi(d); err == nil && parsed > 0 {
+			hotDays = parsed
+		}
+	}
+
+	price := h.pricingService.CalculatePrice(sizeBytes, durationDays)
+	verifiedPrice := h.pricingService.CalculateVerifiedPrice(sizeBytes, durationDays)
+
+	c.JSON(http.StatusOK, gin.H{
+		"size_bytes":         sizeBytes,
+		"duration_days":      durationDays,
+		"price_fil":          price,
+		"verified_price_fil": verifiedPrice,
+		"tiers": gin.H{
+			models.TierHot:     h.pricingService.CalculateTierPrice(models.TierHot, 0, sizeBytes, durationDays),
+			models.TierCold:    h.pricingService.CalculateTierPrice(models.TierCold, 0, sizeBytes, durationDays),
+			models.TierHotCold: h.pricingService.CalculateTierPrice(models.TierHotCold, hotDays, sizeBytes, durationDays),
+		},
+	})
+}
+
+// GetMiners returns list of available storage miners
+func (h *Handlers) GetMiners(c *gin.Context) {
+	miners, err := h.dealService.GetAvailableMiners(c.Request.Context())
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to get available miners")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get miners"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"miners": miners})
+}
+
+// GetStats returns service statistics and health
+func (h *Handlers) GetStats(c *gin.Context) {
+	stats, err := h.dealService.GetServiceStats(c.Request.Context())
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to get service stats")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get stats"})
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// GetDealMonitorStats returns progress metrics for the latest deal monitoring sweep
+func (h *Handlers) GetDealMonitorStats(c *gin.Context) {
+	progress, err := h.dealMonitor.GetLatestSweepProgress(c.Request.Context())
+	if err != nil {
+		if err.Error() == "sweep not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No monitoring sweep found"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to get deal monitor stats")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get deal monitor stats"})
+		return
+	}
+
+	c.JSON(http.StatusOK, progress)
 }
 
 // HealthCheck returns health status
@@ -3,7 +3,9 @@ package api
 import (
 	"context"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -11,6 +13,7 @@ import (
 	"github.com/go-redis/redis/v8"
 	"github.com/sirupsen/logrus"
 
+	"pinning-service/internal/services"
 	"pinning-service/pkg/config"
 	"pinning-service/pkg/utils"
 )
@@ -98,6 +101,42 @@ func AuthMiddleware(db interface{}) gin.HandlerFunc {
 	}
 }
 
+// OptionalAuthMiddleware identifies the user when credentials are present
+// but lets anonymous requests through
+func OptionalAuthMiddleware(db interface{}) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := extractToken(c)
+		if token == "" {
+			c.Next()
+			return
+		}
+
+		if userID, err := utils.ValidateJWT(token); err == nil {
+			c.Set("userID", userID)
+			c.Set("authType", "jwt")
+		} else if userID, err := utils.ValidateAPIKey(db, token); err == nil {
+			c.Set("userID", userID)
+			c.Set("authType", "api_key")
+		}
+
+		c.Next()
+	}
+}
+
+// AdminMiddleware restricts a route group to admins. It must run after
+// AuthMiddleware.
+func AdminMiddleware(db interface{}) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !utils.IsAdmin(db, c.GetString("userID")) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
 // RateLimitMiddleware implements rate limiting using Redis
 func RateLimitMiddleware(redisClient *redis.Client, cfg *config.Config) gin.HandlerFunc {
 	return gin.HandlerFunc(func(c *gin.Context) {
@@ -136,6 +175,32 @@ func RateLimitMiddleware(redisClient *redis.Client, cfg *config.Config) gin.Hand
 	})
 }
 
+// AccountRateLimitMiddleware limits the request rate of authenticated
+// accounts to their quota. It must run after AuthMiddleware.
+func AccountRateLimitMiddleware(quotaService *services.QuotaService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("userID")
+		if userID == "" {
+			c.Next()
+			return
+		}
+
+		allowed, retryAfter := quotaService.AllowRequest(c.Request.Context(), userID)
+		if !allowed {
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			c.Header("Retry-After", strconv.Itoa(seconds))
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"error":       "Account request quota exceeded",
+				"retry_after": seconds,
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
 // extractToken extracts JWT token or API key from request
 func extractToken(c *gin.Context) string {
 	// Check Authorization header for Bearer token
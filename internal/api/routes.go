@@ -3,13 +3,17 @@ package api
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
+	"github.com/gocraft/work"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 
+	"pinning-service/internal/encryption"
 	"pinning-service/internal/filecoin"
 	"pinning-service/internal/ipfs"
 	"pinning-service/internal/services"
+	"pinning-service/internal/staging"
 	"pinning-service/internal/storage"
+	"pinning-service/internal/transfer"
 	"pinning-service/pkg/config"
 )
 
@@ -25,45 +29,208 @@ func RegisterRoutes(router *gin.Engine, db *gorm.DB, redisClient *redis.Client,
 	userRepo := storage.NewUserRepository(db)
 	pinRepo := storage.NewPinRequestRepository(db)
 	dealRepo := storage.NewFilecoinDealRepository(db)
+	renewalRepo := storage.NewRenewalRepository(db)
+	ledgerRepo := storage.NewLedgerRepository(db)
+	notificationRepo := storage.NewNotificationRepository(db)
+	retrievalRepo := storage.NewRetrievalRepository(db)
+	bandwidthRepo := storage.NewBandwidthRepository(db)
+	aggregateRepo := storage.NewAggregateRepository(db)
+	splitRepo := storage.NewSplitRepository(db)
+	dataCapRepo := storage.NewDataCapRepository(db)
+	transferRepo := storage.NewTransferRepository(db)
+	shareRepo := storage.NewShareLinkRepository(db)
+	placementRepo := storage.NewPlacementRepository(db)
+	contentRepo := storage.NewContentRepository(db)
+	discrepancyRepo := storage.NewDiscrepancyRepository(db)
+	quotaRepo := storage.NewQuotaRepository(db)
+	invoiceRepo := storage.NewInvoiceRepository(db)
 
 	// Initialize services
 	pricingService := services.NewPricingService(cfg)
 	userService := services.NewUserService(userRepo, cfg, logger)
 	dealService := services.NewDealService(ipfsClient, lotusClient, pinRepo, dealRepo, pricingService, redisClient, cfg, logger)
+	enqueuer := work.NewEnqueuer(cfg.Redis.Namespace, cfg.Redis.Pool())
+	dealMonitor := services.NewDealMonitor(lotusClient, dealRepo, redisClient, enqueuer, cfg, logger)
+
+	notificationService := services.NewNotificationService(notificationRepo, redisClient, logger)
+	nodePoolService, err := services.NewNodePoolService(pinRepo, placementRepo, cfg, logger)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to initialize IPFS node pool")
+	}
+	blobStore, err := staging.NewBlobStore(cfg.Staging)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to initialize staging store")
+	}
+	transferService := services.NewTransferService(ipfsClient, lotusClient, blobStore, pinRepo, dealRepo, transferRepo, cfg, logger)
+	dealMaker := services.NewDealMaker(lotusClient, dealRepo, dataCapRepo, transferService, cfg, logger)
+	renewalService := services.NewRenewalService(lotusClient, dealMaker, pricingService, notificationService, pinRepo, dealRepo, userRepo, renewalRepo, ledgerRepo, aggregateRepo, cfg, logger)
+	repairService := services.NewRepairService(ipfsClient, lotusClient, dealMaker, pinRepo, dealRepo, aggregateRepo, enqueuer, cfg, logger)
+	retrievalService := services.NewRetrievalService(ipfsClient, nodePoolService, lotusClient, pinRepo, dealRepo, retrievalRepo, splitRepo, enqueuer, cfg, logger)
+	keyProvider, err := encryption.NewKeyProvider(cfg.Encryption.KeyProvider, cfg.Encryption.KeyDir)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to initialize key provider")
+	}
+	aggregationService := services.NewAggregationService(ipfsClient, nodePoolService, dealMaker, pricingService, pinRepo, dealRepo, aggregateRepo, cfg, logger)
+	dataCapService := services.NewDataCapService(lotusClient, dataCapRepo, userRepo, redisClient, cfg, logger)
+	splitService := services.NewSplitService(ipfsClient, nodePoolService, lotusClient, dealMaker, pinRepo, dealRepo, splitRepo, cfg, logger)
+	gatewayService := services.NewGatewayService(pinRepo, bandwidthRepo, shareRepo, redisClient, cfg, logger)
+	contentService := services.NewContentService(nodePoolService, pricingService, contentRepo, pinRepo, cfg, logger)
+	quotaService := services.NewQuotaService(pricingService, userRepo, quotaRepo, bandwidthRepo, redisClient, cfg, logger)
+	pinService := services.NewPinService(nodePoolService, contentService, quotaService, pinRepo, enqueuer, cfg, logger)
+	uploadService := services.NewUploadService(ipfsClient, pinService, keyProvider, cfg, logger)
+	reconcileService := services.NewReconcileService(nodePoolService, placementRepo, discrepancyRepo, enqueuer, cfg, logger)
+	expiryService := services.NewExpiryService(lotusClient, contentService, pricingService, notificationService, pinRepo, ledgerRepo, cfg, logger)
+	invoiceService := services.NewInvoiceService(notificationService, pinRepo, ledgerRepo, bandwidthRepo, invoiceRepo, enqueuer, cfg, logger)
 
 	// Initialize handlers
-	handlers := NewHandlers(dealService, pricingService, userService, logger)
+	handlers := NewHandlers(HandlerServices{
+		DealService:         dealService,
+		DealMonitor:         dealMonitor,
+		RenewalService:      renewalService,
+		RepairService:       repairService,
+		RetrievalService:    retrievalService,
+		GatewayService:      gatewayService,
+		UploadService:       uploadService,
+		AggregationService:  aggregationService,
+		SplitService:        splitService,
+		DataCapService:      dataCapService,
+		TransferService:     transferService,
+		NodePoolService:     nodePoolService,
+		PinService:          pinService,
+		ContentService:      contentService,
+		ReconcileService:    reconcileService,
+		ExpiryService:       expiryService,
+		QuotaService:        quotaService,
+		InvoiceService:      invoiceService,
+		NotificationService: notificationService,
+		PricingService:      pricingService,
+		UserService:         userService,
+	}, logger)
 
 	// Add auth middleware to all routes except health and pricing
 	authGroup := router.Group("/")
-	authGroup.Use(AuthMiddleware(db))
+	authGroup.Use(AuthMiddleware(db), AccountRateLimitMiddleware(quotaService))
 
 	// Core pin management endpoints
 	authGroup.POST("/pin", handlers.PostPin)
+	authGroup.POST("/upload", handlers.PostUpload)
 	authGroup.GET("/pin/:id", handlers.GetPin)
 	authGroup.GET("/pins", handlers.GetPins)
 	authGroup.DELETE("/pin/:id", handlers.DeletePin)
+	authGroup.PUT("/pin/:id/renewal", handlers.PutPinRenewal)
+	authGroup.GET("/pin/:id/renewals", handlers.GetPinRenewals)
+	authGroup.POST("/pin/:id/extend", handlers.PostPinExtend)
+	authGroup.GET("/pin/:id/replicas", handlers.GetPinReplicas)
+	authGroup.GET("/pin/:id/aggregate", handlers.GetPinAggregate)
+	authGroup.GET("/pin/:id/chunks", handlers.GetPinChunks)
+	authGroup.GET("/pin/:id/transfers", handlers.GetPinTransfers)
+	authGroup.GET("/pin/:id/nodes", handlers.GetPinNodes)
+	authGroup.POST("/pin/:id/share", handlers.PostPinShare)
+	authGroup.GET("/pin/:id/shares", handlers.GetPinShares)
+	authGroup.DELETE("/pin/:id/share/:share_id", handlers.DeletePinShare)
 
 	// Deal management endpoints
 	authGroup.GET("/deals/:cid", handlers.GetDeals)
 	authGroup.POST("/deals/:cid/renew", handlers.PostRenewDeal)
 
+	// Content retrieval endpoints
+	authGroup.GET("/content/:cid", handlers.GetContent)
+	authGroup.GET("/retrievals/:id", handlers.GetRetrieval)
+
+	// Usage endpoints
+	authGroup.GET("/usage/bandwidth", handlers.GetBandwidthUsage)
+	authGroup.GET("/usage/datacap", handlers.GetDataCapUsage)
+	authGroup.GET("/account/usage", handlers.GetAccountUsage)
+
+	// Invoice endpoints
+	authGroup.GET("/account/invoices", handlers.GetInvoices)
+	authGroup.GET("/account/invoices/:id", handlers.GetInvoice)
+	authGroup.GET("/account/invoices/:id/download", handlers.GetInvoiceDownload)
+
+	// Admin endpoints
+	adminGroup := authGroup.Group("/admin")
+	adminGroup.Use(AdminMiddleware(db))
+	adminGroup.GET("/datacap", handlers.GetAdminDataCap)
+	adminGroup.PUT("/datacap/allocations/:user_id", handlers.PutAdminDataCapAllocation)
+	adminGroup.PUT("/pins/:id/legal-hold", handlers.PutAdminLegalHold)
+	adminGroup.GET("/accounts/:user_id/quota", handlers.GetAdminQuota)
+	adminGroup.PUT("/accounts/:user_id/quota", handlers.PutAdminQuota)
+	adminGroup.POST("/invoices/generate", handlers.PostAdminInvoices)
+	adminGroup.GET("/ipfs/nodes", handlers.GetAdminNodes)
+	adminGroup.POST("/ipfs/reconcile", handlers.PostAdminReconcile)
+	adminGroup.GET("/ipfs/discrepancies", handlers.GetAdminDiscrepancies)
+	adminGroup.GET("/stats/deals", handlers.GetDealMonitorStats)
+
+	// Notification endpoints
+	authGroup.GET("/notifications", handlers.GetNotifications)
+	authGroup.POST("/notifications/:id/read", handlers.PostNotificationRead)
+
 	// Public endpoints (no auth required)
 	router.GET("/health", handlers.HealthCheck)
 	router.GET("/pricing", handlers.GetPricing)
 	router.GET("/miners", handlers.GetMiners)
 	router.GET("/stats", handlers.GetStats)
 
+	// IPFS gateway for pinned content; authentication is optional and
+	// enforced per request depending on the access mode
+	if cfg.Gateway.Enabled {
+		gateway, err := NewGatewayHandler(gatewayService, uploadService, retrievalService, cfg, logger)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to initialize IPFS gateway")
+		}
+		router.GET("/ipfs/*path", OptionalAuthMiddleware(db), gateway.Serve)
+		router.HEAD("/ipfs/*path", OptionalAuthMiddleware(db), gateway.Serve)
+	}
+
+	// Staged CARs for providers pulling http transfer deals; providers
+	// authenticate with the transfer's own token
+	if cfg.Transfer.Mode == transfer.ModeHTTP {
+		transfers := NewTransferHandler(transferService, logger)
+		router.GET("/transfers/:id/car", transfers.ServeCAR)
+		router.HEAD("/transfers/:id/car", transfers.ServeCAR)
+	}
+
 	// API versioning
 	v1 := router.Group("/api/v1")
-	v1.Use(AuthMiddleware(db))
+	v1.Use(AuthMiddleware(db), AccountRateLimitMiddleware(quotaService))
 	{
 		v1.POST("/pin", handlers.PostPin)
+		v1.POST("/upload", handlers.PostUpload)
 		v1.GET("/pin/:id", handlers.GetPin)
 		v1.GET("/pins", handlers.GetPins)
 		v1.DELETE("/pin/:id", handlers.DeletePin)
+		v1.PUT("/pin/:id/renewal", handlers.PutPinRenewal)
+		v1.GET("/pin/:id/renewals", handlers.GetPinRenewals)
+		v1.POST("/pin/:id/extend", handlers.PostPinExtend)
+		v1.GET("/pin/:id/replicas", handlers.GetPinReplicas)
+		v1.GET("/pin/:id/aggregate", handlers.GetPinAggregate)
+		v1.GET("/pin/:id/chunks", handlers.GetPinChunks)
+		v1.GET("/pin/:id/transfers", handlers.GetPinTransfers)
+		v1.GET("/pin/:id/nodes", handlers.GetPinNodes)
+		v1.POST("/pin/:id/share", handlers.PostPinShare)
+		v1.GET("/pin/:id/shares", handlers.GetPinShares)
+		v1.DELETE("/pin/:id/share/:share_id", handlers.DeletePinShare)
 		v1.GET("/deals/:cid", handlers.GetDeals)
 		v1.POST("/deals/:cid/renew", handlers.PostRenewDeal)
+		v1.GET("/content/:cid", handlers.GetContent)
+		v1.GET("/retrievals/:id", handlers.GetRetrieval)
+		v1.GET("/usage/bandwidth", handlers.GetBandwidthUsage)
+		v1.GET("/usage/datacap", handlers.GetDataCapUsage)
+		v1.GET("/account/usage", handlers.GetAccountUsage)
+		v1.GET("/account/invoices", handlers.GetInvoices)
+		v1.GET("/account/invoices/:id", handlers.GetInvoice)
+		v1.GET("/account/invoices/:id/download", handlers.GetInvoiceDownload)
+		v1.GET("/admin/datacap", AdminMiddleware(db), handlers.GetAdminDataCap)
+		v1.PUT("/admin/datacap/allocations/:user_id", AdminMiddleware(db), handlers.PutAdminDataCapAllocation)
+		v1.PUT("/admin/pins/:id/legal-hold", AdminMiddleware(db), handlers.PutAdminLegalHold)
+		v1.GET("/admin/accounts/:user_id/quota", AdminMiddleware(db), handlers.GetAdminQuota)
+		v1.PUT("/admin/accounts/:user_id/quota", AdminMiddleware(db), handlers.PutAdminQuota)
+		v1.POST("/admin/invoices/generate", AdminMiddleware(db), handlers.PostAdminInvoices)
+		v1.GET("/admin/ipfs/nodes", AdminMiddleware(db), handlers.GetAdminNodes)
+		v1.POST("/admin/ipfs/reconcile", AdminMiddleware(db), handlers.PostAdminReconcile)
+		v1.GET("/admin/ipfs/discrepancies", AdminMiddleware(db), handlers.GetAdminDiscrepancies)
+		v1.GET("/notifications", handlers.GetNotifications)
+		v1.POST("/notifications/:id/read", handlers.PostNotificationRead)
 	}
 
 	// Public v1 endpoints
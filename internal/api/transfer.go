@@ -0,0 +1,68 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/services"
+)
+
+// TransferHandler serves staged CARs to storage providers pulling the data
+// for http transfer deals. Providers authenticate with the per-transfer
+// token from the deal's manifest.
+type TransferHandler struct {
+	transferService *services.TransferService
+	logger          *logrus.Logger
+}
+
+func NewTransferHandler(transferService *services.TransferService, logger *logrus.Logger) *TransferHandler {
+	return &TransferHandler{
+		transferService: transferService,
+		logger:          logger,
+	}
+}
+
+// ServeCAR handles GET and HEAD requests for /transfers/:id/car. Range
+// requests are supported so providers can resume interrupted downloads.
+func (h *TransferHandler) ServeCAR(c *gin.Context) {
+	transferID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transfer not found"})
+		return
+	}
+
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if token == "" {
+		token = c.Query("token")
+	}
+
+	t, car, err := h.transferService.Open(c.Request.Context(), transferID, token)
+	if err != nil {
+		switch err.Error() {
+		case "transfer not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Transfer not found"})
+		case "access denied":
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid transfer token"})
+		default:
+			h.logger.WithError(err).Error("Failed to open transfer")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open transfer"})
+		}
+		return
+	}
+	defer car.Close()
+
+	c.Header("Content-Type", "application/vnd.ipld.car")
+	c.Header("Cache-Control", "no-store")
+	http.ServeContent(c.Writer, c.Request, "", t.CreatedAt, car)
+
+	// The provider may already be gone, so record outside the request
+	// context
+	if size := c.Writer.Size(); size > 0 && c.Request.Method == http.MethodGet {
+		h.transferService.RecordProgress(context.Background(), t.ID, int64(size))
+	}
+}
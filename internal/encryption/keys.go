@@ -0,0 +1,152 @@
+package encryption
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Key provider names
+const (
+	ProviderFile = "file"
+)
+
+// KeyProvider wraps per-pin data keys with a longer lived key encryption
+// key so that only wrapped keys are ever stored in the database. keyID
+// selects the key encryption key, typically one per user.
+type KeyProvider interface {
+	Name() string
+	WrapKey(ctx context.Context, keyID string, dataKey []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// NewKeyProvider returns the key provider with the given name
+func NewKeyProvider(name, keyDir string) (KeyProvider, error) {
+	switch name {
+	case ProviderFile:
+		return NewFileKeyProvider(keyDir), nil
+	default:
+		return nil, fmt.Errorf("unknown key provider %q", name)
+	}
+}
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// FileKeyProvider keeps key encryption keys as files in a local directory,
+// creating them on first use. It is meant for development and single node
+// deployments; production setups should use a KMS backed provider.
+type FileKeyProvider struct {
+	dir string
+}
+
+func NewFileKeyProvider(dir string) *FileKeyProvider {
+	return &FileKeyProvider{dir: dir}
+}
+
+func (p *FileKeyProvider) Name() string {
+	return ProviderFile
+}
+
+// WrapKey encrypts a data key with AES-GCM under the key encryption key.
+// The key ID is bound as additional data so a wrapped key cannot be
+// unwrapped under another ID.
+func (p *FileKeyProvider) WrapKey(ctx context.Context, keyID string, dataKey []byte) ([]byte, error) {
+	kek, err := p.loadKey(keyID, true)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return aead.Seal(nonce, nonce, dataKey, []byte(keyID)), nil
+}
+
+func (p *FileKeyProvider) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	kek, err := p.loadKey(keyID, false)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrInvalidCiphertext
+	}
+	dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+
+	return dataKey, nil
+}
+
+func (p *FileKeyProvider) loadKey(keyID string, create bool) ([]byte, error) {
+	if !keyIDPattern.MatchString(keyID) {
+		return nil, fmt.Errorf("invalid key ID %q", keyID)
+	}
+	path := filepath.Join(p.dir, keyID+".key")
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && create {
+		return p.createKey(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key %s: %w", keyID, err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("malformed key file for %s", keyID)
+	}
+	return key, nil
+}
+
+func (p *FileKeyProvider) createKey(path string) ([]byte, error) {
+	if err := os.MkdirAll(p.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create key directory: %w", err)
+	}
+
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	// Write to a temporary file and link it into place so two concurrent
+	// first uploads cannot each create a key, and readers never see a
+	// partially written one
+	tmp, err := os.CreateTemp(p.dir, ".key-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(hex.EncodeToString(key)); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to write key file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write key file: %w", err)
+	}
+
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if os.IsExist(err) {
+			return p.loadKey(strings.TrimSuffix(filepath.Base(path), ".key"), false)
+		}
+		return nil, fmt.Errorf("failed to create key file: %w", err)
+	}
+	return key, nil
+}
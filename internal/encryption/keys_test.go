@@ -0,0 +1,46 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestFileKeyProviderWrapUnwrap(t *testing.T) {
+	ctx := context.Background()
+	provider := NewFileKeyProvider(t.TempDir())
+	dataKey := newKey(t)
+
+	wrapped, err := provider.WrapKey(ctx, "user-1", dataKey)
+	if err != nil {
+		t.Fatalf("WrapKey: %v", err)
+	}
+	if bytes.Contains(wrapped, dataKey) {
+		t.Fatal("wrapped key contains the data key")
+	}
+
+	got, err := provider.UnwrapKey(ctx, "user-1", wrapped)
+	if err != nil {
+		t.Fatalf("UnwrapKey: %v", err)
+	}
+	if !bytes.Equal(got, dataKey) {
+		t.Fatal("data key does not round trip")
+	}
+
+	// Wrapped keys are bound to their key ID
+	if _, err := provider.WrapKey(ctx, "user-2", newKey(t)); err != nil {
+		t.Fatalf("WrapKey: %v", err)
+	}
+	if _, err := provider.UnwrapKey(ctx, "user-2", wrapped); err == nil {
+		t.Fatal("unwrapped a key under another key ID")
+	}
+
+	// A key encryption key is never created on unwrap
+	if _, err := provider.UnwrapKey(ctx, "user-3", wrapped); err == nil {
+		t.Fatal("unwrapped a key under a missing key ID")
+	}
+
+	if _, err := provider.WrapKey(ctx, "../user-1", dataKey); err == nil {
+		t.Fatal("accepted a key ID with a path separator")
+	}
+}
@@ -0,0 +1,230 @@
+// Package encryption implements encryption at rest for uploaded content.
+//
+// Content is encrypted with a random per-pin data key using AES-256-GCM in
+// fixed size chunks so it can be streamed in both directions. The format is
+// simple enough for clients to produce or consume themselves:
+//
+//	header:  "PSE" 0x01 | chunk size (uint32, big endian) | nonce prefix (7 bytes)
+//	chunks:  AES-GCM(chunk) with nonce = prefix | chunk index (uint32) | final flag (1 byte)
+//
+// Every chunk but the last holds exactly chunk size bytes of plaintext. The
+// header is authenticated as additional data on every chunk, and the final
+// flag in the nonce makes truncation detectable.
+package encryption
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Algorithm identifies the format produced by NewEncryptWriter
+const Algorithm = "aes-256-gcm-stream-v1"
+
+// DefaultChunkSize is the plaintext size of each encrypted chunk
+const DefaultChunkSize = 64 * 1024
+
+const (
+	keySize         = 32
+	noncePrefixSize = 7
+	headerSize      = 4 + 4 + noncePrefixSize
+	maxChunkSize    = 16 * 1024 * 1024
+)
+
+var magic = []byte{'P', 'S', 'E', 0x01}
+
+// ErrInvalidCiphertext is returned when content fails authentication or is
+// not in the expected format
+var ErrInvalidCiphertext = errors.New("invalid ciphertext")
+
+// NewDataKey returns a random key for encrypting one pin's content
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	return key, nil
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	chunk   int
+	counter uint32
+	closed  bool
+}
+
+// NewEncryptWriter returns a writer that encrypts everything written to it
+// into w. Close must be called to write the final chunk; it does not close
+// w.
+func NewEncryptWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	binary.BigEndian.PutUint32(header[4:8], DefaultChunkSize)
+	if _, err := rand.Read(header[8:]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		buf:    make([]byte, 0, DefaultChunkSize),
+		chunk:  DefaultChunkSize,
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed encrypt writer")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// Only flush once more data arrives so the last chunk is always
+		// written by Close with the final flag set
+		if len(e.buf) == e.chunk {
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):e.chunk], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.flush(true)
+}
+
+func (e *encryptWriter) flush(final bool) error {
+	nonce := chunkNonce(e.header, e.counter, final)
+	sealed := e.aead.Seal(nil, nonce, e.buf, e.header)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	sealed  []byte
+	plain   []byte
+	counter uint32
+	done    bool
+}
+
+// NewDecryptReader returns a reader that decrypts content produced by
+// NewEncryptWriter. Each chunk is authenticated before any of it is
+// returned; a truncated or tampered stream yields ErrInvalidCiphertext.
+func NewDecryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	if string(header[:4]) != string(magic) {
+		return nil, ErrInvalidCiphertext
+	}
+	chunk := binary.BigEndian.Uint32(header[4:8])
+	if chunk == 0 || chunk > maxChunkSize {
+		return nil, ErrInvalidCiphertext
+	}
+
+	return &decryptReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		header: header,
+		sealed: make([]byte, int(chunk)+aead.Overhead()),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	final := false
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		final = true
+	case err != nil:
+		return err
+	default:
+		if _, err := d.r.Peek(1); err == io.EOF {
+			final = true
+		}
+	}
+
+	plain, err := d.aead.Open(nil, chunkNonce(d.header, d.counter, final), d.sealed[:n], d.header)
+	if err != nil {
+		return ErrInvalidCiphertext
+	}
+
+	d.counter++
+	d.plain = plain
+	d.done = final
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("invalid key size %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(header []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, header[8:8+noncePrefixSize])
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
@@ -0,0 +1,191 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+// sealedChunkSize is the size of a full chunk on the wire
+const sealedChunkSize = DefaultChunkSize + 16
+
+func encrypt(t *testing.T, key, plaintext []byte) []byte {
+	t.Helper()
+
+	var out bytes.Buffer
+	w, err := NewEncryptWriter(&out, key)
+	if err != nil {
+		t.Fatalf("NewEncryptWriter: %v", err)
+	}
+	// Odd sized writes so chunks are filled across write boundaries
+	for p := plaintext; len(p) > 0; {
+		n := len(p)
+		if n > 1000 {
+			n = 1000
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return out.Bytes()
+}
+
+func decrypt(key, ciphertext []byte) ([]byte, error) {
+	r, err := NewDecryptReader(bytes.NewReader(ciphertext), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+
+	key, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := newKey(t)
+
+	for _, size := range []int{
+		0,
+		1,
+		DefaultChunkSize - 1,
+		DefaultChunkSize,
+		DefaultChunkSize + 1,
+		3 * DefaultChunkSize,
+		3*DefaultChunkSize + 12345,
+	} {
+		plaintext := randomBytes(t, size)
+		ciphertext := encrypt(t, key, plaintext)
+
+		chunks := size/DefaultChunkSize + 1
+		if size > 0 && size%DefaultChunkSize == 0 {
+			chunks--
+		}
+		if want := headerSize + size + chunks*16; len(ciphertext) != want {
+			t.Errorf("size %d: ciphertext is %d bytes, want %d", size, len(ciphertext), want)
+		}
+
+		got, err := decrypt(key, ciphertext)
+		if err != nil {
+			t.Fatalf("size %d: decrypt: %v", size, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("size %d: plaintext does not round trip", size)
+		}
+	}
+}
+
+func TestEmptyInput(t *testing.T) {
+	key := newKey(t)
+	ciphertext := encrypt(t, key, nil)
+
+	// The header and one empty final chunk
+	if len(ciphertext) != headerSize+16 {
+		t.Fatalf("ciphertext is %d bytes, want %d", len(ciphertext), headerSize+16)
+	}
+
+	got, err := decrypt(key, ciphertext)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("decrypted %d bytes, want 0", len(got))
+	}
+}
+
+func TestTruncatedStream(t *testing.T) {
+	key := newKey(t)
+	ciphertext := encrypt(t, key, randomBytes(t, 3*DefaultChunkSize+100))
+
+	for name, length := range map[string]int{
+		"empty":                0,
+		"partial header":       headerSize - 1,
+		"header only":          headerSize,
+		"partial first chunk":  headerSize + 100,
+		"at chunk boundary":    headerSize + 2*sealedChunkSize,
+		"partial final chunk":  len(ciphertext) - 1,
+		"missing final chunk":  headerSize + 3*sealedChunkSize,
+		"inside a later chunk": headerSize + sealedChunkSize + 5000,
+	} {
+		if _, err := decrypt(key, ciphertext[:length]); !errors.Is(err, ErrInvalidCiphertext) {
+			t.Errorf("%s: err = %v, want ErrInvalidCiphertext", name, err)
+		}
+	}
+}
+
+func TestTamperedChunk(t *testing.T) {
+	key := newKey(t)
+	ciphertext := encrypt(t, key, randomBytes(t, 2*DefaultChunkSize+100))
+
+	for name, offset := range map[string]int{
+		"chunk size":   5,
+		"nonce prefix": 10,
+		"first chunk":  headerSize + 42,
+		"first tag":    headerSize + sealedChunkSize - 1,
+		"last chunk":   len(ciphertext) - 20,
+	} {
+		tampered := append([]byte(nil), ciphertext...)
+		tampered[offset] ^= 0x01
+
+		if _, err := decrypt(key, tampered); !errors.Is(err, ErrInvalidCiphertext) {
+			t.Errorf("%s: err = %v, want ErrInvalidCiphertext", name, err)
+		}
+	}
+}
+
+func TestReorderedChunks(t *testing.T) {
+	key := newKey(t)
+	ciphertext := encrypt(t, key, randomBytes(t, 3*DefaultChunkSize+100))
+
+	first := ciphertext[headerSize : headerSize+sealedChunkSize]
+	second := ciphertext[headerSize+sealedChunkSize : headerSize+2*sealedChunkSize]
+
+	var reordered []byte
+	reordered = append(reordered, ciphertext[:headerSize]...)
+	reordered = append(reordered, second...)
+	reordered = append(reordered, first...)
+	reordered = append(reordered, ciphertext[headerSize+2*sealedChunkSize:]...)
+
+	if _, err := decrypt(key, reordered); !errors.Is(err, ErrInvalidCiphertext) {
+		t.Fatalf("err = %v, want ErrInvalidCiphertext", err)
+	}
+
+	// A chunk from another stream under the same key does not fit either
+	other := encrypt(t, key, randomBytes(t, 3*DefaultChunkSize+100))
+	spliced := append([]byte(nil), ciphertext...)
+	copy(spliced[headerSize:], other[headerSize:headerSize+sealedChunkSize])
+
+	if _, err := decrypt(key, spliced); !errors.Is(err, ErrInvalidCiphertext) {
+		t.Fatalf("spliced: err = %v, want ErrInvalidCiphertext", err)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	ciphertext := encrypt(t, newKey(t), []byte("secret"))
+
+	if _, err := decrypt(newKey(t), ciphertext); !errors.Is(err, ErrInvalidCiphertext) {
+		t.Fatalf("err = %v, want ErrInvalidCiphertext", err)
+	}
+}
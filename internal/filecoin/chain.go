@@ -0,0 +1,294 @@
+package filecoin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/market"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+)
+
+// Head change types reported by ChainNotify
+const (
+	HeadChangeCurrent = "current"
+	HeadChangeApply   = "apply"
+	HeadChangeRevert  = "revert"
+)
+
+// TipSetRef identifies a tipset without holding on to its block headers
+type TipSetRef struct {
+	Key        string   `json:"key"`
+	Cids       []string `json:"cids"`
+	Height     int64    `json:"height"`
+	ParentKey  string   `json:"parent_key"`
+	ParentCids []string `json:"parent_cids"`
+}
+
+// HeadChange is a single tipset applied to or reverted from the chain head
+type HeadChange struct {
+	Type   string    `json:"type"`
+	TipSet TipSetRef `json:"tipset"`
+}
+
+// PublishedDeal is a deal found in a successful PublishStorageDeals message
+type PublishedDeal struct {
+	DealID      int64  `json:"deal_id"`
+	ProposalCID string `json:"proposal_cid"`
+	MessageCID  string `json:"message_cid"`
+	Client      string `json:"client"`
+	Provider    string `json:"provider"`
+	PieceCID    string `json:"piece_cid"`
+	StartEpoch  int64  `json:"start_epoch"`
+	EndEpoch    int64  `json:"end_epoch"`
+}
+
+// ChainNotify subscribes to head changes. The first notification contains
+// the current head; subsequent ones contain applied and reverted tipsets.
+func (c *LotusClient) ChainNotify(ctx context.Context) (<-chan []HeadChange, error) {
+	notifs, err := c.api.ChainNotify(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to chain head: %w", err)
+	}
+
+	out := make(chan []HeadChange)
+	go func() {
+		defer close(out)
+		for changes := range notifs {
+			converted := make([]HeadChange, 0, len(changes))
+			for _, change := range changes {
+				converted = append(converted, HeadChange{
+					Type:   change.Type,
+					TipSet: toTipSetRef(change.Val),
+				})
+			}
+
+			select {
+			case out <- converted:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// GetChainHead returns the current chain head
+func (c *LotusClient) GetChainHead(ctx context.Context) (*TipSetRef, error) {
+	head, err := c.api.ChainHead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chain head: %w", err)
+	}
+
+	ref := toTipSetRef(head)
+	return &ref, nil
+}
+
+// GetTipSetByHeight returns the canonical tipset at a height. Null rounds
+// resolve to the nearest earlier tipset.
+func (c *LotusClient) GetTipSetByHeight(ctx context.Context, height int64) (*TipSetRef, error) {
+	ts, err := c.api.ChainGetTipSetByHeight(ctx, abi.ChainEpoch(height), types.EmptyTSK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tipset at height %d: %w", height, err)
+	}
+
+	ref := toTipSetRef(ts)
+	return &ref, nil
+}
+
+// GetTipSet returns the tipset made of the given block CIDs
+func (c *LotusClient) GetTipSet(ctx context.Context, cids []string) (*TipSetRef, error) {
+	tsk, err := tipSetKey(TipSetRef{Cids: cids})
+	if err != nil {
+		return nil, err
+	}
+
+	ts, err := c.api.ChainGetTipSet(ctx, tsk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tipset: %w", err)
+	}
+
+	ref := toTipSetRef(ts)
+	return &ref, nil
+}
+
+// GetPublishedDeals scans the messages executed in a tipset for successful
+// PublishStorageDeals calls and returns the deals made by the given clients
+func (c *LotusClient) GetPublishedDeals(ctx context.Context, ts TipSetRef, clients []string) ([]PublishedDeal, error) {
+	tsk, err := tipSetKey(ts)
+	if err != nil {
+		return nil, err
+	}
+
+	tipset, err := c.api.ChainGetTipSet(ctx, tsk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tipset: %w", err)
+	}
+
+	clientIDs := make(map[address.Address]bool)
+	for _, client := range clients {
+		addr, err := address.NewFromString(client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address: %w", err)
+		}
+		clientIDs[addr] = true
+
+		idAddr, err := c.api.StateLookupID(ctx, addr, tsk)
+		if err == nil {
+			clientIDs[idAddr] = true
+		}
+	}
+
+	// Messages included in the parent tipset are executed when computing
+	// this tipset's state, so their receipts live here
+	blockCid := tipset.Blocks()[0].Cid()
+	msgs, err := c.api.ChainGetParentMessages(ctx, blockCid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get parent messages: %w", err)
+	}
+
+	receipts, err := c.api.ChainGetParentReceipts(ctx, blockCid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get parent receipts: %w", err)
+	}
+
+	var published []PublishedDeal
+	for i, msg := range msgs {
+		if i >= len(receipts) {
+			break
+		}
+		if msg.Message.To != market.Address || msg.Message.Method != market.Methods.PublishStorageDeals {
+			continue
+		}
+		if receipts[i].ExitCode != exitcode.Ok {
+			continue
+		}
+
+		var params market.PublishStorageDealsParams
+		if err := params.UnmarshalCBOR(bytes.NewReader(msg.Message.Params)); err != nil {
+			continue
+		}
+
+		var ret market.PublishStorageDealsReturn
+		if err := ret.UnmarshalCBOR(bytes.NewReader(receipts[i].Return)); err != nil {
+			continue
+		}
+
+		for j, deal := range params.Deals {
+			if j >= len(ret.IDs) {
+				break
+			}
+			if !clientIDs[deal.Proposal.Client] {
+				continue
+			}
+
+			// Lotus reports deals by the CID of the signed proposal
+			nd, err := cborutil.AsIpld(&deal)
+			if err != nil {
+				continue
+			}
+
+			published = append(published, PublishedDeal{
+				DealID:      int64(ret.IDs[j]),
+				ProposalCID: nd.Cid().String(),
+				MessageCID:  msg.Cid.String(),
+				Client:      deal.Proposal.Client.String(),
+				Provider:    deal.Proposal.Provider.String(),
+				PieceCID:    deal.Proposal.PieceCID.String(),
+				StartEpoch:  int64(deal.Proposal.StartEpoch),
+				EndEpoch:    int64(deal.Proposal.EndEpoch),
+			})
+		}
+	}
+
+	return published, nil
+}
+
+// GetMarketDealsAt returns the market state of the given deals as of a
+// tipset. Deals no longer in the market actor are omitted; any other
+// failure to look up a deal is returned.
+func (c *LotusClient) GetMarketDealsAt(ctx context.Context, ts TipSetRef, dealIDs []int64) (map[int64]MarketDealState, error) {
+	tsk, err := tipSetKey(ts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[int64]MarketDealState, len(dealIDs))
+	for _, dealID := range dealIDs {
+		deal, err := c.api.StateMarketStorageDeal(ctx, abi.DealID(dealID), tsk)
+		if err != nil {
+			// The market actor drops deals once they are expired or slashed
+			if strings.Contains(err.Error(), "not found") {
+				continue
+			}
+			return nil, fmt.Errorf("failed to get market deal %d: %w", dealID, err)
+		}
+		result[dealID] = toMarketDealState(dealID, deal)
+	}
+
+	return result, nil
+}
+
+// GetAllMarketDeals returns the state of every deal in the market actor as
+// of a tipset, in a single RPC
+func (c *LotusClient) GetAllMarketDeals(ctx context.Context, ts TipSetRef) (map[int64]MarketDealState, error) {
+	tsk, err := tipSetKey(ts)
+	if err != nil {
+		return nil, err
+	}
+
+	deals, err := c.api.StateMarketDeals(ctx, tsk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get market deals: %w", err)
+	}
+
+	result := make(map[int64]MarketDealState, len(deals))
+	for key, deal := range deals {
+		dealID, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid market deal ID %q: %w", key, err)
+		}
+		deal := deal
+		result[dealID] = toMarketDealState(dealID, &deal)
+	}
+
+	return result, nil
+}
+
+func toTipSetRef(ts *types.TipSet) TipSetRef {
+	return TipSetRef{
+		Key:        ts.Key().String(),
+		Cids:       cidStrings(ts.Cids()),
+		Height:     int64(ts.Height()),
+		ParentKey:  ts.Parents().String(),
+		ParentCids: cidStrings(ts.Parents().Cids()),
+	}
+}
+
+func cidStrings(cids []cid.Cid) []string {
+	strs := make([]string, 0, len(cids))
+	for _, c := range cids {
+		strs = append(strs, c.String())
+	}
+	return strs
+}
+
+func tipSetKey(ts TipSetRef) (types.TipSetKey, error) {
+	cids := make([]cid.Cid, 0, len(ts.Cids))
+	for _, s := range ts.Cids {
+		c, err := cid.Decode(s)
+		if err != nil {
+			return types.EmptyTSK, fmt.Errorf("invalid tipset CID: %w", err)
+		}
+		cids = append(cids, c)
+	}
+	return types.NewTipSetKey(cids...), nil
+}
@@ -0,0 +1,58 @@
+package filecoin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// HTTPRetrievalClient fetches content from storage providers that serve
+// their deals over the IPFS trustless gateway protocol, as Boost does
+type HTTPRetrievalClient struct {
+	client *http.Client
+}
+
+func NewHTTPRetrievalClient(timeout time.Duration) *HTTPRetrievalClient {
+	return &HTTPRetrievalClient{
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// RetrieveToCAR downloads the full DAG for a payload from a provider's
+// gateway endpoint into a CAR file and returns the number of bytes written
+func (c *HTTPRetrievalClient) RetrieveToCAR(ctx context.Context, endpoint, payloadCID, carPath string) (int64, error) {
+	url := fmt.Sprintf("%s/ipfs/%s?format=car&dag-scope=all", strings.TrimRight(endpoint, "/"), payloadCID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.car")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve %s from %s: %w", payloadCID, endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to retrieve %s from %s: unexpected status %d", payloadCID, endpoint, resp.StatusCode)
+	}
+
+	file, err := os.Create(carPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create CAR file: %w", err)
+	}
+	defer file.Close()
+
+	n, err := io.Copy(file, resp.Body)
+	if err != nil {
+		return n, fmt.Errorf("failed to download CAR: %w", err)
+	}
+
+	return n, nil
+}
@@ -3,11 +3,16 @@ package filecoin
 import (
 	"context"
 	"fmt"
+	"math/big"
 	"net/http"
 
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-state-types/abi"
 	lapi "github.com/filecoin-project/lotus/api"
 	"github.com/filecoin-project/lotus/api/client"
 	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
 )
 
 type LotusClient struct {
@@ -16,11 +21,31 @@ type LotusClient struct {
 
 type StartDealParams struct {
 	Data         []byte
+	PayloadCID   string
 	MinerID      string
 	Duration     int64
+	StartEpoch   int64
 	PriceFIL     float64
 	WalletAddr   string
 	VerifiedDeal bool
+
+	// Manual transfers leave moving the data to us; the provider is told
+	// the piece up front instead of pulling the DAG over graphsync
+	ManualTransfer bool
+	PieceCID       string
+	PieceSize      int64 // padded
+}
+
+// EpochsPerDay is the number of 30 second epochs in a day
+const EpochsPerDay = 2880
+
+// MinerAsk is a storage provider's current storage ask
+type MinerAsk struct {
+	MinerID          string  `json:"miner_id"`
+	PriceFIL         float64 `json:"price_fil"`
+	VerifiedPriceFIL float64 `json:"verified_price_fil"`
+	MinPieceSize     int64   `json:"min_piece_size"`
+	MaxPieceSize     int64   `json:"max_piece_size"`
 }
 
 type MinerInfo struct {
@@ -31,6 +56,30 @@ type MinerInfo struct {
 	Reputation float64 `json:"reputation"`
 }
 
+// MarketDealState is the on-chain market actor view of a storage deal.
+// SectorStartEpoch and SlashEpoch are -1 until the deal is sealed or slashed.
+type MarketDealState struct {
+	DealID           int64  `json:"deal_id"`
+	Client           string `json:"client"`
+	Provider         string `json:"provider"`
+	PieceCID         string `json:"piece_cid"`
+	VerifiedDeal     bool   `json:"verified_deal"`
+	StartEpoch       int64  `json:"start_epoch"`
+	EndEpoch         int64  `json:"end_epoch"`
+	SectorStartEpoch int64  `json:"sector_start_epoch"`
+	SlashEpoch       int64  `json:"slash_epoch"`
+}
+
+// DealInfo is the client-side view of a deal proposal tracked by Lotus
+type DealInfo struct {
+	ProposalCID string `json:"proposal_cid"`
+	DealID      int64  `json:"deal_id"`
+	State       string `json:"state"`
+	Provider    string `json:"provider"`
+	Message     string `json:"message"`
+	Failed      bool   `json:"failed"`
+}
+
 func NewLotusClient(apiURL, token string) (*LotusClient, error) {
 	headers := http.Header{}
 	if token != "" {
@@ -48,27 +97,61 @@ func NewLotusClient(apiURL, token string) (*LotusClient, error) {
 	return &LotusClient{api: api}, nil
 }
 
-// StartDeal creates a new storage deal
+// StartDeal creates a new storage deal. When PayloadCID is set the data is
+// expected to be reachable by Lotus already (imported or through its IPFS
+// blockstore) and no import is done.
 func (c *LotusClient) StartDeal(ctx context.Context, params StartDealParams) (string, error) {
-	// Import data to Lotus
-	importRes, err := c.api.ClientImport(ctx, lapi.FileRef{
-		Path:  "", // Data will be provided directly
-		IsCAR: false,
-	})
+	var root cid.Cid
+	if params.PayloadCID != "" {
+		payload, err := cid.Decode(params.PayloadCID)
+		if err != nil {
+			return "", fmt.Errorf("invalid payload CID: %w", err)
+		}
+		root = payload
+	} else {
+		// Import data to Lotus
+		importRes, err := c.api.ClientImport(ctx, lapi.FileRef{
+			Path:  "", // Data will be provided directly
+			IsCAR: false,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to import data: %w", err)
+		}
+		root = importRes.Root
+	}
+
+	wallet, err := address.NewFromString(params.WalletAddr)
+	if err != nil {
+		return "", fmt.Errorf("invalid wallet address: %w", err)
+	}
+
+	miner, err := address.NewFromString(params.MinerID)
 	if err != nil {
-		return "", fmt.Errorf("failed to import data: %w", err)
+		return "", fmt.Errorf("invalid miner address: %w", err)
+	}
+
+	dataRef := &storagemarket.DataRef{
+		TransferType: storagemarket.TTGraphsync,
+		Root:         root,
+	}
+	if params.ManualTransfer {
+		pieceCID, err := cid.Decode(params.PieceCID)
+		if err != nil {
+			return "", fmt.Errorf("invalid piece CID: %w", err)
+		}
+		dataRef.TransferType = storagemarket.TTManual
+		dataRef.PieceCid = &pieceCID
+		dataRef.PieceSize = abi.PaddedPieceSize(params.PieceSize).Unpadded()
 	}
 
 	// Prepare deal parameters
 	dealParams := &lapi.StartDealParams{
-		Data: &types.DataRef{
-			TransferType: types.TTGraphsync,
-			Root:         importRes.Root,
-		},
-		Wallet:            types.Address{},                              // Convert from string
-		Miner:             types.Address{},                              // Convert from string
+		Data:              dataRef,
+		Wallet:            wallet,
+		Miner:             miner,
 		EpochPrice:        types.NewInt(uint64(params.PriceFIL * 1e18)), // Convert FIL to attoFIL
 		MinBlocksDuration: uint64(params.Duration),
+		DealStartEpoch:    abi.ChainEpoch(params.StartEpoch),
 		VerifiedDeal:      params.VerifiedDeal,
 	}
 
@@ -160,3 +243,168 @@ func (c *LotusClient) GetWalletBalance(ctx context.Context, addr string) (float6
 	balanceFIL := float64(balance.Int64()) / 1e18
 	return balanceFIL, nil
 }
+
+// GetVerifiedClientStatus returns the DataCap in bytes the address has
+// left to spend on verified deals, 0 if it is not a verified client
+func (c *LotusClient) GetVerifiedClientStatus(ctx context.Context, addr string) (int64, error) {
+	clientAddr, err := address.NewFromString(addr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address: %w", err)
+	}
+
+	dataCap, err := c.api.StateVerifiedClientStatus(ctx, clientAddr, types.EmptyTSK)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get verified client status: %w", err)
+	}
+	if dataCap == nil || dataCap.Int == nil {
+		return 0, nil
+	}
+
+	return dataCap.Int64(), nil
+}
+
+// GetDealInfo gets the client-side state of a deal by its proposal CID,
+// including the on-chain deal ID once the deal has been published
+func (c *LotusClient) GetDealInfo(ctx context.Context, proposalCID string) (*DealInfo, error) {
+	propCid, err := cid.Decode(proposalCID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deal CID: %w", err)
+	}
+
+	info, err := c.api.ClientGetDealInfo(ctx, propCid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deal info: %w", err)
+	}
+
+	return &DealInfo{
+		ProposalCID: proposalCID,
+		DealID:      int64(info.DealID),
+		State:       storagemarket.DealStates[info.State],
+		Provider:    info.Provider.String(),
+		Message:     info.Message,
+		Failed:      info.State == storagemarket.StorageDealError || info.State == storagemarket.StorageDealFailing,
+	}, nil
+}
+
+// GetMarketDeal gets the on-chain state of a single deal
+func (c *LotusClient) GetMarketDeal(ctx context.Context, dealID int64) (*MarketDealState, error) {
+	deal, err := c.api.StateMarketStorageDeal(ctx, abi.DealID(dealID), types.EmptyTSK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get market deal %d: %w", dealID, err)
+	}
+
+	state := toMarketDealState(dealID, deal)
+	return &state, nil
+}
+
+func toMarketDealState(dealID int64, deal *lapi.MarketDeal) MarketDealState {
+	return MarketDealState{
+		DealID:           dealID,
+		Client:           deal.Proposal.Client.String(),
+		Provider:         deal.Proposal.Provider.String(),
+		PieceCID:         deal.Proposal.PieceCID.String(),
+		VerifiedDeal:     deal.Proposal.VerifiedDeal,
+		StartEpoch:       int64(deal.Proposal.StartEpoch),
+		EndEpoch:         int64(deal.Proposal.EndEpoch),
+		SectorStartEpoch: int64(deal.State.SectorStartEpoch),
+		SlashEpoch:       int64(deal.State.SlashEpoch),
+	}
+}
+
+// GetMinerAsk queries a storage provider for its current ask
+func (c *LotusClient) GetMinerAsk(ctx context.Context, minerID string) (*MinerAsk, error) {
+	miner, err := address.NewFromString(minerID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid miner address: %w", err)
+	}
+
+	info, err := c.api.StateMinerInfo(ctx, miner, types.EmptyTSK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get miner info: %w", err)
+	}
+	if info.PeerId == nil {
+		return nil, fmt.Errorf("miner %s has no peer ID", minerID)
+	}
+
+	ask, err := c.api.ClientQueryAsk(ctx, *info.PeerId, miner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ask: %w", err)
+	}
+
+	return &MinerAsk{
+		MinerID:          minerID,
+		PriceFIL:         attoFILToFIL(ask.Price),
+		VerifiedPriceFIL: attoFILToFIL(ask.VerifiedPrice),
+		MinPieceSize:     int64(ask.MinPieceSize),
+		MaxPieceSize:     int64(ask.MaxPieceSize),
+	}, nil
+}
+
+// ProviderHealth is the on-chain health of a storage provider
+type ProviderHealth struct {
+	MinerID      string         `json:"miner_id"`
+	HasPower     bool           `json:"has_power"`
+	FaultedDeals map[int64]bool `json:"faulted_deals"`
+}
+
+// GetProviderHealth checks whether a provider still has power and which of
+// the given deals are in sectors it has declared faulty
+func (c *LotusClient) GetProviderHealth(ctx context.Context, minerID string, dealIDs []int64) (*ProviderHealth, error) {
+	miner, err := address.NewFromString(minerID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid miner address: %w", err)
+	}
+
+	health := &ProviderHealth{
+		MinerID:      minerID,
+		FaultedDeals: make(map[int64]bool),
+	}
+
+	power, err := c.api.StateMinerPower(ctx, miner, types.EmptyTSK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get miner power: %w", err)
+	}
+	health.HasPower = !power.MinerPower.RawBytePower.NilOrZero()
+
+	faults, err := c.api.StateMinerFaults(ctx, miner, types.EmptyTSK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get miner faults: %w", err)
+	}
+
+	count, err := faults.Count()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read miner faults: %w", err)
+	}
+	if count == 0 || len(dealIDs) == 0 {
+		return health, nil
+	}
+
+	wanted := make(map[int64]bool, len(dealIDs))
+	for _, dealID := range dealIDs {
+		wanted[dealID] = true
+	}
+
+	// Only load the faulty sectors rather than every active sector
+	sectors, err := c.api.StateMinerSectors(ctx, miner, &faults, types.EmptyTSK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get faulty sectors: %w", err)
+	}
+
+	for _, sector := range sectors {
+		for _, dealID := range sector.DealIDs {
+			if wanted[int64(dealID)] {
+				health.FaultedDeals[int64(dealID)] = true
+			}
+		}
+	}
+
+	return health, nil
+}
+
+func attoFILToFIL(amount abi.TokenAmount) float64 {
+	if amount.Int == nil {
+		return 0
+	}
+	fil, _ := new(big.Float).Quo(new(big.Float).SetInt(amount.Int), big.NewFloat(1e18)).Float64()
+	return fil
+}
@@ -0,0 +1,16 @@
+package filecoin
+
+// minPieceSize is the smallest piece the network accepts
+const minPieceSize = 256
+
+// PaddedPieceSize estimates the padded piece size a payload occupies in a
+// sector: fr32 padding adds one bit in every 255, and pieces are rounded up
+// to a power of two
+func PaddedPieceSize(payloadBytes int64) int64 {
+	unpadded := (payloadBytes*128 + 126) / 127
+	size := int64(minPieceSize)
+	for size < unpadded {
+		size <<= 1
+	}
+	return size
+}
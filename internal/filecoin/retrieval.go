@@ -0,0 +1,67 @@
+package filecoin
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/filecoin-project/go-address"
+	lapi "github.com/filecoin-project/lotus/api"
+	"github.com/ipfs/go-cid"
+)
+
+// RetrieveToCAR retrieves a payload from a storage provider and writes it
+// to a CAR file at carPath. Retrieval is paid from the given wallet; the
+// amount paid in FIL is returned.
+func (c *LotusClient) RetrieveToCAR(ctx context.Context, payloadCID, minerID, walletAddr, carPath string) (float64, error) {
+	root, err := cid.Decode(payloadCID)
+	if err != nil {
+		return 0, fmt.Errorf("invalid payload CID: %w", err)
+	}
+
+	miner, err := address.NewFromString(minerID)
+	if err != nil {
+		return 0, fmt.Errorf("invalid miner address: %w", err)
+	}
+
+	wallet, err := address.NewFromString(walletAddr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid wallet address: %w", err)
+	}
+
+	offer, err := c.api.ClientMinerQueryOffer(ctx, miner, root, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query retrieval offer: %w", err)
+	}
+	if offer.Err != "" {
+		return 0, fmt.Errorf("miner %s cannot serve %s: %s", minerID, payloadCID, offer.Err)
+	}
+
+	order := offer.Order(wallet)
+	if err := c.api.ClientRetrieve(ctx, order, &lapi.FileRef{Path: carPath, IsCAR: true}); err != nil {
+		return 0, fmt.Errorf("failed to retrieve %s from %s: %w", payloadCID, minerID, err)
+	}
+
+	return attoFILToFIL(order.Total) + attoFILToFIL(order.UnsealPrice), nil
+}
+
+// ImportCAR imports a CAR file into the Lotus client store so deals can be
+// made for it, and returns its root CID
+func (c *LotusClient) ImportCAR(ctx context.Context, carPath string) (string, error) {
+	res, err := c.api.ClientImport(ctx, lapi.FileRef{Path: carPath, IsCAR: true})
+	if err != nil {
+		return "", fmt.Errorf("failed to import CAR: %w", err)
+	}
+
+	return res.Root.String(), nil
+}
+
+// CalcCommP computes the piece CID and padded piece size of a CAR. The
+// path must be readable by the Lotus node.
+func (c *LotusClient) CalcCommP(ctx context.Context, carPath string) (string, int64, error) {
+	res, err := c.api.ClientCalcCommP(ctx, carPath)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to calculate piece commitment: %w", err)
+	}
+
+	return res.Root.String(), int64(res.Size.Padded()), nil
+}
@@ -0,0 +1,81 @@
+package ipfs
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// maxAddrLength bounds the length of a multiaddr accepted from users
+const maxAddrLength = 1024
+
+// ParseOrigin validates a multiaddr a user gave for a peer holding their
+// content and returns it in canonical form with the peer's ID. The address
+// must end in /p2p/<peer ID>. Unless allowPrivate is set, IP addresses
+// must be publicly routable so users cannot point our nodes at the
+// networks they run in; a bare /p2p/<peer ID> is resolved by the node
+// through the DHT.
+func ParseOrigin(addr string, allowPrivate bool) (string, string, error) {
+	if len(addr) > maxAddrLength {
+		return "", "", fmt.Errorf("multiaddr is longer than %d characters", maxAddrLength)
+	}
+
+	maddr, err := ma.NewMultiaddr(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid multiaddr %q: %w", addr, err)
+	}
+
+	_, last := ma.SplitLast(maddr)
+	if last == nil || last.Protocol().Code != ma.P_P2P {
+		return "", "", fmt.Errorf("multiaddr %q does not end with /p2p/<peer ID>", addr)
+	}
+	peerID := last.Value()
+
+	var invalid error
+	ma.ForEach(maddr, func(c ma.Component) bool {
+		switch c.Protocol().Code {
+		case ma.P_UNIX:
+			invalid = fmt.Errorf("multiaddr %q is not a network address", addr)
+		case ma.P_IP4, ma.P_IP6:
+			// IPv4-mapped IPv6 addresses would slip past the IPv6 ranges
+			if c.Protocol().Code == ma.P_IP6 && net.IP(c.RawValue()).To4() != nil {
+				invalid = fmt.Errorf("multiaddr %q uses an IPv4-mapped address", addr)
+			} else if !allowPrivate && (manet.IsIPUnspecified(maddr) || !manet.IsPublicAddr(maddr)) {
+				invalid = fmt.Errorf("multiaddr %q is not a public address", addr)
+			}
+		}
+		return invalid == nil
+	})
+	if invalid != nil {
+		return "", "", invalid
+	}
+
+	canonical := maddr.String()
+	if strings.Contains(canonical, ",") {
+		return "", "", fmt.Errorf("invalid multiaddr %q", addr)
+	}
+	return canonical, peerID, nil
+}
+
+// PublicAddresses returns the addresses others can dial, dropping
+// loopback, private and unroutable ones unless allowPrivate is set
+func PublicAddresses(addrs []string, allowPrivate bool) []string {
+	var public []string
+	for _, addr := range addrs {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			continue
+		}
+		if manet.IsIPUnspecified(maddr) || manet.IsIPLoopback(maddr) {
+			continue
+		}
+		if !allowPrivate && !manet.IsPublicAddr(maddr) {
+			continue
+		}
+		public = append(public, addr)
+	}
+	return public
+}
@@ -3,13 +3,27 @@ package ipfs
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
 	"time"
 
+	gocid "github.com/ipfs/go-cid"
 	shell "github.com/ipfs/go-ipfs-api"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/multiformats/go-multicodec"
 )
 
+// maxBlockSize bounds the blocks BlockGet reads into memory; Kubo refuses
+// to exchange larger ones anyway
+const maxBlockSize = 4 << 20
+
+// Client talks to a Kubo node over its RPC API. Every call honors its
+// context. Metadata calls are also bounded by the client's timeout; calls
+// whose duration grows with the content, such as pinning, adding and
+// streams, are bounded only by the caller's context.
 type Client struct {
 	shell   *shell.Shell
 	timeout time.Duration
@@ -22,97 +36,552 @@ func NewClient(apiURL string, timeout time.Duration) *Client {
 	}
 }
 
-// Cat retrieves content from IPFS
-func (c *Client) Cat(ctx context.Context, cid string) ([]byte, error) {
+// Cat opens a stream of the content of a CID. The caller must close it.
+func (c *Client) Cat(ctx context.Context, cid string) (io.ReadCloser, error) {
+	return c.stream(ctx, fmt.Sprintf("failed to cat CID %s", cid), c.shell.Request("cat", cid))
+}
+
+// Add adds content to IPFS
+func (c *Client) Add(ctx context.Context, data []byte) (string, error) {
+	return c.AddReader(ctx, bytes.NewReader(data))
+}
+
+// AddReader streams content to IPFS without buffering it in memory
+func (c *Client) AddReader(ctx context.Context, r io.Reader) (string, error) {
+	var res struct {
+		Hash string
+	}
+	err := c.shell.Request("add").
+		Option("progress", false).
+		Body(multipartFile(files.NewReaderFile(r))).
+		Exec(ctx, &res)
+	if err != nil {
+		return "", wrapError("failed to add content to IPFS", err)
+	}
+
+	return res.Hash, nil
+}
+
+// DirectoryLink is a named entry of a directory built by NewDirectory
+type DirectoryLink struct {
+	Name string
+	CID  string
+}
+
+// NewDirectory builds a UnixFS directory linking existing content and
+// returns its CID. The linked content must already be on the node.
+func (c *Client) NewDirectory(ctx context.Context, links []DirectoryLink) (string, error) {
+	var root struct {
+		Hash string
+	}
+	if err := c.exec(ctx, c.shell.Request("object/new", "unixfs-dir"), &root); err != nil {
+		return "", wrapError("failed to create directory", err)
+	}
+
+	for _, link := range links {
+		err := c.exec(ctx, c.shell.Request("object/patch/add-link", root.Hash, link.Name, link.CID).
+			Option("create", false), &root)
+		if err != nil {
+			return "", wrapError(fmt.Sprintf("failed to link %s", link.CID), err)
+		}
+	}
+
+	return root.Hash, nil
+}
+
+// Link is a link from a DAG node to a child and the child's cumulative
+// size
+type Link struct {
+	Name string
+	CID  string
+	Size int64
+}
+
+// Links returns the links of a dag-pb node
+func (c *Client) Links(ctx context.Context, cid string) ([]Link, error) {
+	var node struct {
+		Links []struct {
+			Hash struct {
+				Target string `json:"/"`
+			}
+			Name  string
+			Tsize int64
+		}
+	}
+	if err := c.exec(ctx, c.shell.Request("dag/get", cid), &node); err != nil {
+		return nil, wrapError(fmt.Sprintf("failed to get node %s", cid), err)
+	}
+
+	links := make([]Link, len(node.Links))
+	for i, link := range node.Links {
+		links[i] = Link{Name: link.Name, CID: link.Hash.Target, Size: link.Tsize}
+	}
+	return links, nil
+}
+
+// BlockGet returns the raw bytes of a block
+func (c *Client) BlockGet(ctx context.Context, cid string) ([]byte, error) {
 	ctx, cancel := context.WithTimeout(ctx, c.timeout)
 	defer cancel()
 
-	reader, err := c.shell.Cat(cid)
+	res, err := c.send(ctx, c.shell.Request("block/get", cid))
 	if err != nil {
-		return nil, fmt.Errorf("failed to cat CID %s: %w", cid, err)
+		return nil, wrapError(fmt.Sprintf("failed to get block %s", cid), err)
 	}
-	defer reader.Close()
+	defer res.Close()
 
-	data, err := io.ReadAll(reader)
+	data, err := io.ReadAll(io.LimitReader(res, maxBlockSize+1))
 	if err != nil {
-		return nil, fmt.Errorf("failed to read content: %w", err)
+		return nil, wrapError(fmt.Sprintf("failed to read block %s", cid), err)
+	}
+	if len(data) > maxBlockSize {
+		return nil, fmt.Errorf("block %s is larger than %d bytes", cid, maxBlockSize)
 	}
-
 	return data, nil
 }
 
-// Add adds content to IPFS
-func (c *Client) Add(ctx context.Context, data []byte) (string, error) {
-	ctx, cancel := context.WithTimeout(ctx, c.timeout)
-	defer cancel()
+// BlockPut stores a raw block under the codec and hash of the CID it is
+// expected to have, and fails if the node computes a different hash
+func (c *Client) BlockPut(ctx context.Context, cid string, data []byte) error {
+	expected, err := gocid.Decode(cid)
+	if err != nil {
+		return fmt.Errorf("invalid CID %s: %w", cid, err)
+	}
+	prefix := expected.Prefix()
 
-	reader := bytes.NewReader(data)
-	cid, err := c.shell.Add(reader)
+	var res struct {
+		Key string
+	}
+	err = c.exec(ctx, c.shell.Request("block/put").
+		Option("cid-codec", multicodec.Code(prefix.Codec).String()).
+		Option("mhtype", multicodec.Code(prefix.MhType).String()).
+		Body(multipartFile(files.NewBytesFile(data))), &res)
 	if err != nil {
-		return "", fmt.Errorf("failed to add content to IPFS: %w", err)
+		return wrapError(fmt.Sprintf("failed to put block %s", cid), err)
 	}
 
-	return cid, nil
+	// CIDv0 blocks come back as CIDv1; the multihash is what identifies
+	// the block
+	stored, err := gocid.Decode(res.Key)
+	if err != nil || !bytes.Equal(stored.Hash(), expected.Hash()) {
+		return fmt.Errorf("block %s stored as %s", cid, res.Key)
+	}
+
+	return nil
 }
 
-// Pin pins content to local IPFS node
+// Pin pins content to local IPFS node, fetching it first if needed
 func (c *Client) Pin(ctx context.Context, cid string) error {
-	ctx, cancel := context.WithTimeout(ctx, c.timeout)
-	defer cancel()
+	return c.PinWithProgress(ctx, cid, nil)
+}
 
-	err := c.shell.Pin(cid)
+// PinWithProgress pins content like Pin, calling progress with the number
+// of blocks the node has walked so far. The count starts over when a pin is
+// retried, but blocks fetched by an earlier attempt are not fetched again.
+func (c *Client) PinWithProgress(ctx context.Context, cid string, progress func(blocks int64)) error {
+	op := fmt.Sprintf("failed to pin CID %s", cid)
+	res, err := c.send(ctx, c.shell.Request("pin/add", cid).
+		Option("recursive", true).
+		Option("progress", progress != nil))
 	if err != nil {
-		return fmt.Errorf("failed to pin CID %s: %w", cid, err)
+		return wrapError(op, err)
 	}
+	defer res.Close()
 
-	return nil
+	// The node streams {"Progress": n} objects and ends with {"Pins": [...]}
+	dec := json.NewDecoder(res)
+	for {
+		var msg struct {
+			Progress int64
+			Pins     []string
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return wrapError(op, err)
+		}
+		if progress != nil && len(msg.Pins) == 0 {
+			progress(msg.Progress)
+		}
+	}
 }
 
-// Unpin unpins content from local IPFS node
+// Unpin unpins content from local IPFS node. Content that is not pinned
+// returns an error matching ErrNotPinned.
 func (c *Client) Unpin(ctx context.Context, cid string) error {
-	ctx, cancel := context.WithTimeout(ctx, c.timeout)
-	defer cancel()
-
-	err := c.shell.Unpin(cid)
+	err := c.exec(ctx, c.shell.Request("pin/rm", cid).Option("recursive", true), nil)
 	if err != nil {
-		return fmt.Errorf("failed to unpin CID %s: %w", cid, err)
+		return wrapError(fmt.Sprintf("failed to unpin CID %s", cid), err)
 	}
 
 	return nil
 }
 
-// Exists checks if content exists on IPFS network
+// Exists checks if content exists on IPFS network by fetching its root
+// block
 func (c *Client) Exists(ctx context.Context, cid string) bool {
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	// Try to get object stats to check existence
-	_, err := c.shell.ObjectStat(cid)
-	return err == nil
+	return c.shell.Request("block/stat", cid).Exec(ctx, nil) == nil
+}
+
+// Identify returns the node's peer ID and version, which doubles as a
+// health check
+func (c *Client) Identify(ctx context.Context) (string, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var id struct {
+		ID string
+	}
+	if err := c.shell.Request("id").Exec(ctx, &id); err != nil {
+		return "", "", wrapError("failed to identify node", err)
+	}
+
+	var version struct {
+		Version string
+	}
+	if err := c.shell.Request("version").Exec(ctx, &version); err != nil {
+		return "", "", wrapError("failed to get node version", err)
+	}
+
+	return id.ID, version.Version, nil
+}
+
+// Addresses returns the multiaddrs the node listens on and announces,
+// each ending in its peer ID
+func (c *Client) Addresses(ctx context.Context) ([]string, error) {
+	var id struct {
+		Addresses []string
+	}
+	if err := c.exec(ctx, c.shell.Request("id"), &id); err != nil {
+		return nil, wrapError("failed to get node addresses", err)
+	}
+	return id.Addresses, nil
+}
+
+// SwarmConnect opens a connection from the node to a peer
+func (c *Client) SwarmConnect(ctx context.Context, addr string) error {
+	if err := c.exec(ctx, c.shell.Request("swarm/connect", addr), nil); err != nil {
+		return wrapError(fmt.Sprintf("failed to connect to %s", addr), err)
+	}
+	return nil
+}
+
+// PeeringAdd makes the node keep a connection to a peer open, reconnecting
+// when it drops, until PeeringRemove is called
+func (c *Client) PeeringAdd(ctx context.Context, addr string) error {
+	if err := c.exec(ctx, c.shell.Request("swarm/peering/add", addr), nil); err != nil {
+		return wrapError(fmt.Sprintf("failed to peer with %s", addr), err)
+	}
+	return nil
+}
+
+// PeeringRemove stops the node from keeping a connection to a peer
+func (c *Client) PeeringRemove(ctx context.Context, peerID string) error {
+	if err := c.exec(ctx, c.shell.Request("swarm/peering/rm", peerID), nil); err != nil {
+		return wrapError(fmt.Sprintf("failed to stop peering with %s", peerID), err)
+	}
+	return nil
+}
+
+// PeerWith connects the node to the peers at origins and keeps the
+// connections open until the returned function is called. It returns how
+// many origins it connected to. Peerings the node already had are left in
+// place when released.
+func (c *Client) PeerWith(ctx context.Context, origins []string) (int, func()) {
+	existing := make(map[string]bool)
+	if peers, err := c.PeeringPeers(ctx); err == nil {
+		for _, peerID := range peers {
+			existing[peerID] = true
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	connected := 0
+	added := make(map[string]bool)
+	for _, origin := range origins {
+		_, peerID, err := ParseOrigin(origin, true)
+		if err != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(origin, peerID string) {
+			defer wg.Done()
+			connectErr := c.SwarmConnect(ctx, origin)
+			peered := !existing[peerID] && c.PeeringAdd(ctx, origin) == nil
+
+			mu.Lock()
+			defer mu.Unlock()
+			if connectErr == nil {
+				connected++
+			}
+			if peered {
+				added[peerID] = true
+			}
+		}(origin, peerID)
+	}
+	wg.Wait()
+
+	return connected, func() {
+		// Release even when the fetch was cancelled
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		defer cancel()
+		for peerID := range added {
+			_ = c.PeeringRemove(ctx, peerID)
+		}
+	}
+}
+
+// PeeringPeers returns the IDs of the peers the node keeps connections to
+func (c *Client) PeeringPeers(ctx context.Context) ([]string, error) {
+	var res struct {
+		Peers []struct {
+			ID string
+		}
+	}
+	if err := c.exec(ctx, c.shell.Request("swarm/peering/ls"), &res); err != nil {
+		return nil, wrapError("failed to list peers", err)
+	}
+
+	peers := make([]string, len(res.Peers))
+	for i, peer := range res.Peers {
+		peers[i] = peer.ID
+	}
+	return peers, nil
+}
+
+// Resolve returns the CID at a path below a CID, such as a file in a
+// UnixFS directory
+func (c *Client) Resolve(ctx context.Context, cid, path string) (string, error) {
+	var res struct {
+		Path string
+	}
+	if err := c.exec(ctx, c.shell.Request("resolve", "/ipfs/"+cid+path), &res); err != nil {
+		return "", wrapError(fmt.Sprintf("failed to resolve %s%s", cid, path), err)
+	}
+
+	resolved := strings.TrimPrefix(res.Path, "/ipfs/")
+	if resolved == "" || strings.Contains(resolved, "/") {
+		return "", fmt.Errorf("failed to resolve %s%s: unexpected path %q", cid, path, res.Path)
+	}
+	return resolved, nil
 }
 
-// GetSize gets the size of content
+// GetSize gets the cumulative size of content. UnixFS content is sized
+// from its root; other DAGs are walked with dag stat.
 func (c *Client) GetSize(ctx context.Context, cid string) (int64, error) {
-	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	var stat struct {
+		CumulativeSize int64
+	}
+	err := c.exec(ctx, c.shell.Request("files/stat", "/ipfs/"+cid), &stat)
+	if err == nil {
+		return stat.CumulativeSize, nil
+	}
+	// Only content that is not UnixFS is worth a second try
+	if err = wrapError(fmt.Sprintf("failed to stat CID %s", cid), err); Unavailable(err) {
+		return 0, err
+	}
+
+	var dagStat struct {
+		// Kubo 0.20 and later report TotalSize
+		Size      int64
+		TotalSize int64
+	}
+	err = c.exec(ctx, c.shell.Request("dag/stat", cid).Option("progress", false), &dagStat)
+	if err != nil {
+		return 0, wrapError(fmt.Sprintf("failed to stat CID %s", cid), err)
+	}
+	if dagStat.TotalSize > 0 {
+		return dagStat.TotalSize, nil
+	}
+	return dagStat.Size, nil
+}
+
+// LocalSize returns how many bytes of a UnixFS DAG the node holds locally
+// and the DAG's total size, without fetching anything
+func (c *Client) LocalSize(ctx context.Context, cid string) (int64, int64, error) {
+	var stat struct {
+		CumulativeSize int64
+		SizeLocal      int64
+	}
+	err := c.exec(ctx, c.shell.Request("files/stat", "/ipfs/"+cid).
+		Option("with-local", true).
+		Option("offline", true), &stat)
+	if err != nil {
+		return 0, 0, wrapError(fmt.Sprintf("failed to stat CID %s", cid), err)
+	}
+
+	return stat.SizeLocal, stat.CumulativeSize, nil
+}
+
+// PinInfo describes a pin
+type PinInfo struct {
+	Type string
+}
+
+// ListPins lists recursively pinned content
+func (c *Client) ListPins(ctx context.Context) (map[string]PinInfo, error) {
+	var res struct {
+		Keys map[string]PinInfo
+	}
+	err := c.exec(ctx, c.shell.Request("pin/ls").Option("type", shell.RecursivePin), &res)
+	if err != nil {
+		return nil, wrapError("failed to list pins", err)
+	}
+
+	return res.Keys, nil
+}
+
+// RepoStat returns the bytes the node's repo uses and the most it is
+// configured to hold
+func (c *Client) RepoStat(ctx context.Context) (uint64, uint64, error) {
+	var res struct {
+		RepoSize   uint64
+		StorageMax uint64
+	}
+	err := c.exec(ctx, c.shell.Request("repo/stat").Option("size-only", true), &res)
+	if err != nil {
+		return 0, 0, wrapError("failed to get repo stats", err)
+	}
+
+	return res.RepoSize, res.StorageMax, nil
+}
+
+// RepoGC removes blocks no pin holds from the node's repo and returns the
+// number removed. Collection can take a while on large repos, so it is
+// bounded only by the caller's context.
+func (c *Client) RepoGC(ctx context.Context) (int, error) {
+	op := "failed to collect garbage"
+	res, err := c.send(ctx, c.shell.Request("repo/gc"))
+	if err != nil {
+		return 0, wrapError(op, err)
+	}
+	defer res.Close()
+
+	// The node streams an object per removed block
+	removed := 0
+	dec := json.NewDecoder(res)
+	for {
+		var msg struct {
+			Key   map[string]string
+			Error string
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return removed, nil
+		} else if err != nil {
+			return removed, wrapError(op, err)
+		}
+		if msg.Error != "" {
+			return removed, wrapError(op, fmt.Errorf("%s", msg.Error))
+		}
+		removed++
+	}
+}
+
+// IsPinned checks if content is recursively pinned on the local IPFS node,
+// without fetching anything from the network
+func (c *Client) IsPinned(ctx context.Context, cid string) bool {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	stat, err := c.shell.ObjectStat(cid)
+	var res struct {
+		Keys map[string]PinInfo
+	}
+	err := c.shell.Request("pin/ls", cid).
+		Option("type", shell.RecursivePin).
+		Exec(ctx, &res)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get object stats for CID %s: %w", cid, err)
+		return false
 	}
 
-	return int64(stat.CumulativeSize), nil
+	// Keys are reported in the node's canonical CID form, which may differ
+	// from the form requested
+	return len(res.Keys) > 0
 }
 
-// ListPins lists pinned content
-func (c *Client) ListPins(ctx context.Context) (map[string]shell.PinInfo, error) {
+// DagImport imports a CAR into the IPFS node, pinning its root, and returns
+// the root CID
+func (c *Client) DagImport(ctx context.Context, car io.Reader) (string, error) {
+	var res struct {
+		Root struct {
+			Cid struct {
+				Target string `json:"/"`
+			}
+			PinErrorMsg string
+		}
+	}
+	err := c.shell.Request("dag/import").
+		Option("pin-roots", true).
+		Body(multipartFile(files.NewReaderFile(car))).
+		Exec(ctx, &res)
+	if err != nil {
+		return "", wrapError("failed to import CAR", err)
+	}
+	if res.Root.PinErrorMsg != "" {
+		return "", fmt.Errorf("failed to pin imported CAR: %s", res.Root.PinErrorMsg)
+	}
+
+	return res.Root.Cid.Target, nil
+}
+
+// DagExport streams the DAG under a CID as a CAR. The caller must close
+// it.
+func (c *Client) DagExport(ctx context.Context, cid string) (io.ReadCloser, error) {
+	return c.stream(ctx, fmt.Sprintf("failed to export DAG %s", cid), c.shell.Request("dag/export", cid))
+}
+
+// exec runs a metadata call under the client's timeout and decodes its
+// JSON response into res, if given
+func (c *Client) exec(ctx context.Context, req *shell.RequestBuilder, res interface{}) error {
 	ctx, cancel := context.WithTimeout(ctx, c.timeout)
 	defer cancel()
 
-	pins, err := c.shell.Pins()
+	return req.Exec(ctx, res)
+}
+
+// send starts a call and returns its response body, or the RPC error
+func (c *Client) send(ctx context.Context, req *shell.RequestBuilder) (io.ReadCloser, error) {
+	res, err := req.Send(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list pins: %w", err)
+		return nil, err
+	}
+	if res.Error != nil {
+		res.Close()
+		return nil, res.Error
 	}
+	return res.Output, nil
+}
+
+// stream starts a call whose output is read by the caller. Closing the
+// stream cancels the call.
+func (c *Client) stream(ctx context.Context, op string, req *shell.RequestBuilder) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	body, err := c.send(ctx, req)
+	if err != nil {
+		cancel()
+		return nil, wrapError(op, err)
+	}
+	return &cancelReader{ReadCloser: body, cancel: cancel}, nil
+}
+
+// cancelReader cancels its request once closed
+type cancelReader struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.cancel()
+	return err
+}
 
-	return pins, nil
+// multipartFile wraps a file as the multipart body RPC calls expect
+func multipartFile(file files.Node) io.Reader {
+	dir := files.NewSliceDirectory([]files.DirEntry{files.FileEntry("", file)})
+	return files.NewMultiFileReader(dir, true)
 }
@@ -0,0 +1,365 @@
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cluster pin statuses reported per peer
+const (
+	ClusterStatusPinned       = "pinned"
+	ClusterStatusPinning      = "pinning"
+	ClusterStatusQueued       = "pin_queued"
+	ClusterStatusPinError     = "pin_error"
+	ClusterStatusUnpinned     = "unpinned"
+	ClusterStatusRemote       = "remote"
+	ClusterStatusClusterError = "cluster_error"
+)
+
+// clusterPollInterval is how often a pin's status is polled while waiting
+// for the cluster to pin it
+const clusterPollInterval = 2 * time.Second
+
+// Pinner is implemented by the clients that can hold pins: a single Kubo
+// node and an IPFS Cluster
+type Pinner interface {
+	Pin(ctx context.Context, cid string) error
+	Unpin(ctx context.Context, cid string) error
+	IsPinned(ctx context.Context, cid string) bool
+	Cat(ctx context.Context, cid string) (io.ReadCloser, error)
+	GetSize(ctx context.Context, cid string) (int64, error)
+}
+
+var (
+	_ Pinner = (*Client)(nil)
+	_ Pinner = (*ClusterClient)(nil)
+)
+
+// ClusterConfig configures a ClusterClient. Replication of 0 leaves the
+// cluster's defaults in place and -1 pins on every peer.
+type ClusterConfig struct {
+	APIURL         string
+	ProxyURL       string
+	Username       string
+	Password       string
+	ReplicationMin int
+	ReplicationMax int
+	Timeout        time.Duration
+	PinTimeout     time.Duration
+}
+
+// ClusterPeerStatus is the state of a pin on one cluster peer
+type ClusterPeerStatus struct {
+	PeerName   string    `json:"peername"`
+	IPFSPeerID string    `json:"ipfs_peer_id"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// ClusterPinStatus is the state of a pin across the cluster, keyed by
+// cluster peer ID
+type ClusterPinStatus struct {
+	Name    string                       `json:"name"`
+	PeerMap map[string]ClusterPeerStatus `json:"peer_map"`
+}
+
+// Pinned returns the peers that have finished pinning
+func (s *ClusterPinStatus) Pinned() []string {
+	var peers []string
+	for peerID, status := range s.PeerMap {
+		if status.Status == ClusterStatusPinned {
+			peers = append(peers, peerID)
+		}
+	}
+	return peers
+}
+
+// Failed returns true if a peer failed to pin
+func (s *ClusterPinStatus) Failed() bool {
+	for _, status := range s.PeerMap {
+		if status.Status == ClusterStatusPinError || status.Status == ClusterStatusClusterError {
+			return true
+		}
+	}
+	return false
+}
+
+// ClusterPeer is a peer of the cluster and the IPFS node it runs
+type ClusterPeer struct {
+	ID       string `json:"id"`
+	PeerName string `json:"peername"`
+	Version  string `json:"version"`
+	Error    string `json:"error"`
+	IPFS     struct {
+		ID    string `json:"id"`
+		Error string `json:"error"`
+	} `json:"ipfs"`
+}
+
+// Healthy returns true if the peer and its IPFS node are reachable
+func (p *ClusterPeer) Healthy() bool {
+	return p.Error == "" && p.IPFS.Error == ""
+}
+
+// ClusterClient pins through the IPFS Cluster REST API, letting the cluster
+// decide which peers hold each pin and keep it replicated. Content is read
+// through the cluster's IPFS proxy, which speaks the Kubo API.
+type ClusterClient struct {
+	apiURL     string
+	username   string
+	password   string
+	minReplica int
+	maxReplica int
+	pinTimeout time.Duration
+	http       *http.Client
+	proxy      *Client
+}
+
+func NewClusterClient(cfg ClusterConfig) *ClusterClient {
+	return &ClusterClient{
+		apiURL:     strings.TrimSuffix(cfg.APIURL, "/"),
+		username:   cfg.Username,
+		password:   cfg.Password,
+		minReplica: cfg.ReplicationMin,
+		maxReplica: cfg.ReplicationMax,
+		pinTimeout: cfg.PinTimeout,
+		http:       &http.Client{Timeout: cfg.Timeout},
+		proxy:      NewClient(cfg.ProxyURL, cfg.Timeout),
+	}
+}
+
+// MinReplication returns how many peers must pin a CID before it counts as
+// pinned
+func (c *ClusterClient) MinReplication() int {
+	if c.minReplica < 1 {
+		return 1
+	}
+	return c.minReplica
+}
+
+// Pin submits a pin and waits until enough peers have pinned it
+func (c *ClusterClient) Pin(ctx context.Context, cid string) error {
+	if err := c.PinWithReplication(ctx, cid, c.minReplica, c.maxReplica); err != nil {
+		return err
+	}
+
+	if c.pinTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.pinTimeout)
+		defer cancel()
+	}
+
+	_, err := c.WaitPinned(ctx, cid)
+	return err
+}
+
+// PinWithReplication submits a pin with its own replication factors
+// without waiting for the cluster to pin it
+func (c *ClusterClient) PinWithReplication(ctx context.Context, cid string, min, max int) error {
+	query := url.Values{}
+	if min != 0 {
+		query.Set("replication-min", strconv.Itoa(min))
+	}
+	if max != 0 {
+		query.Set("replication-max", strconv.Itoa(max))
+	}
+
+	if err := c.do(ctx, http.MethodPost, "/pins/"+cid, query, nil); err != nil {
+		return fmt.Errorf("failed to pin CID %s on cluster: %w", cid, err)
+	}
+	return nil
+}
+
+// WaitPinned polls a pin until the minimum number of peers have pinned it
+// or a peer fails
+func (c *ClusterClient) WaitPinned(ctx context.Context, cid string) (*ClusterPinStatus, error) {
+	ticker := time.NewTicker(clusterPollInterval)
+	defer ticker.Stop()
+
+	for {
+		status, err := c.Status(ctx, cid)
+		if err != nil {
+			return nil, err
+		}
+		if len(status.Pinned()) >= c.MinReplication() {
+			return status, nil
+		}
+		if status.Failed() {
+			return status, fmt.Errorf("cluster failed to pin CID %s", cid)
+		}
+
+		select {
+		case <-ctx.Done():
+			return status, fmt.Errorf("timed out waiting for cluster to pin CID %s: %w", cid, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Unpin removes a pin from the cluster
+func (c *ClusterClient) Unpin(ctx context.Context, cid string) error {
+	err := c.do(ctx, http.MethodDelete, "/pins/"+cid, nil, nil)
+	if err != nil && !strings.Contains(err.Error(), "not found") {
+		return fmt.Errorf("failed to unpin CID %s from cluster: %w", cid, err)
+	}
+	return nil
+}
+
+// IsPinned returns true if any peer has pinned a CID
+func (c *ClusterClient) IsPinned(ctx context.Context, cid string) bool {
+	status, err := c.Status(ctx, cid)
+	return err == nil && len(status.Pinned()) > 0
+}
+
+// Status returns the state of a pin on every peer
+func (c *ClusterClient) Status(ctx context.Context, cid string) (*ClusterPinStatus, error) {
+	var status ClusterPinStatus
+	if err := c.do(ctx, http.MethodGet, "/pins/"+cid, nil, &status); err != nil {
+		return nil, fmt.Errorf("failed to get cluster status of CID %s: %w", cid, err)
+	}
+	return &status, nil
+}
+
+// Allocations returns the peers the cluster allocated a pin to
+func (c *ClusterClient) Allocations(ctx context.Context, cid string) ([]string, error) {
+	var pin struct {
+		Allocations []string `json:"allocations"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/allocations/"+cid, nil, &pin); err != nil {
+		return nil, fmt.Errorf("failed to get allocations of CID %s: %w", cid, err)
+	}
+	return pin.Allocations, nil
+}
+
+// Recover retries a pin on the peers where it failed
+func (c *ClusterClient) Recover(ctx context.Context, cid string) error {
+	if err := c.do(ctx, http.MethodPost, "/pins/"+cid+"/recover", nil, nil); err != nil {
+		return fmt.Errorf("failed to recover CID %s: %w", cid, err)
+	}
+	return nil
+}
+
+// Peers returns the cluster's peers and the health of their IPFS nodes
+func (c *ClusterClient) Peers(ctx context.Context) ([]*ClusterPeer, error) {
+	var raw json.RawMessage
+	if err := c.do(ctx, http.MethodGet, "/peers", nil, &raw); err != nil {
+		return nil, fmt.Errorf("failed to list cluster peers: %w", err)
+	}
+
+	// Older clusters answer with an array, newer ones stream one object
+	// per peer
+	var peers []*ClusterPeer
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+		if err := json.Unmarshal(raw, &peers); err != nil {
+			return nil, fmt.Errorf("failed to decode cluster peers: %w", err)
+		}
+		return peers, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	for {
+		var peer ClusterPeer
+		if err := dec.Decode(&peer); err == io.EOF {
+			return peers, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to decode cluster peers: %w", err)
+		}
+		peers = append(peers, &peer)
+	}
+}
+
+// Identify returns the cluster peer ID and version of the peer behind the
+// API, which doubles as a health check
+func (c *ClusterClient) Identify(ctx context.Context) (string, string, error) {
+	var id struct {
+		ID      string `json:"id"`
+		Version string `json:"version"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/id", nil, &id); err != nil {
+		return "", "", fmt.Errorf("failed to identify cluster peer: %w", err)
+	}
+	return id.ID, id.Version, nil
+}
+
+// Cat opens a stream of content through the cluster's IPFS proxy
+func (c *ClusterClient) Cat(ctx context.Context, cid string) (io.ReadCloser, error) {
+	return c.proxy.Cat(ctx, cid)
+}
+
+// Resolve returns the CID at a path below a CID through the proxy
+func (c *ClusterClient) Resolve(ctx context.Context, cid, path string) (string, error) {
+	return c.proxy.Resolve(ctx, cid, path)
+}
+
+// Addresses returns the addresses of the IPFS node behind the cluster's
+// proxy
+func (c *ClusterClient) Addresses(ctx context.Context) ([]string, error) {
+	return c.proxy.Addresses(ctx)
+}
+
+// PeerWith connects the IPFS node behind the cluster's proxy to the peers
+// at origins until the returned function is called. Other cluster peers
+// still find the content through the DHT or the proxy's node.
+func (c *ClusterClient) PeerWith(ctx context.Context, origins []string) (int, func()) {
+	return c.proxy.PeerWith(ctx, origins)
+}
+
+// GetSize gets the size of content through the cluster's IPFS proxy
+func (c *ClusterClient) GetSize(ctx context.Context, cid string) (int64, error) {
+	return c.proxy.GetSize(ctx, cid)
+}
+
+// do sends a request to the REST API and decodes the JSON response into
+// out, if given. Streamed responses are read whole into a json.RawMessage.
+func (c *ClusterClient) do(ctx context.Context, method, path string, query url.Values, out interface{}) error {
+	u := c.apiURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return wrapError(fmt.Sprintf("cluster API %s %s", method, path), err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Message != "" {
+			return fmt.Errorf("cluster API %s %s: %s", method, path, apiErr.Message)
+		}
+		if res.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("cluster API %s %s: not found", method, path)
+		}
+		return fmt.Errorf("cluster API %s %s failed with status %d", method, path, res.StatusCode)
+	}
+
+	if out == nil {
+		return nil
+	}
+	if raw, ok := out.(*json.RawMessage); ok {
+		*raw, err = io.ReadAll(res.Body)
+		return err
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
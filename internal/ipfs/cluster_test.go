@@ -0,0 +1,346 @@
+package ipfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testCID = "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"
+
+// fakeCluster serves the parts of the IPFS Cluster REST API the client
+// uses. Each GET of a pin's status returns the next of its statuses,
+// repeating the last.
+type fakeCluster struct {
+	t           *testing.T
+	mu          sync.Mutex
+	pins        map[string]url.Values
+	statuses    map[string][]map[string]ClusterPeerStatus
+	allocations map[string][]string
+	requests    []string
+
+	// fail, if set, can answer a request with an error before it is handled
+	fail func(r *http.Request) (status int, body string)
+}
+
+func newFakeCluster(t *testing.T) (*fakeCluster, *ClusterClient) {
+	f := &fakeCluster{
+		t:           t,
+		pins:        make(map[string]url.Values),
+		statuses:    make(map[string][]map[string]ClusterPeerStatus),
+		allocations: make(map[string][]string),
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	client := NewClusterClient(ClusterConfig{
+		APIURL:         server.URL + "/",
+		ProxyURL:       server.URL,
+		Username:       "admin",
+		Password:       "secret",
+		ReplicationMin: 2,
+		ReplicationMax: 3,
+		Timeout:        5 * time.Second,
+	})
+	return f, client
+}
+
+func (f *fakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, r.Method+" "+r.URL.RequestURI())
+
+	if user, pass, ok := r.BasicAuth(); !ok || user != "admin" || pass != "secret" {
+		writeClusterError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if f.fail != nil {
+		if status, body := f.fail(r); status != 0 {
+			w.WriteHeader(status)
+			fmt.Fprint(w, body)
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/pins/"):
+		cid := strings.TrimPrefix(r.URL.Path, "/pins/")
+		f.pins[cid] = r.URL.Query()
+		writeClusterJSON(w, map[string]interface{}{"cid": cid, "allocations": f.allocations[cid]})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/pins/"):
+		cid := strings.TrimPrefix(r.URL.Path, "/pins/")
+		statuses := f.statuses[cid]
+		if len(statuses) == 0 {
+			writeClusterError(w, http.StatusNotFound, "cid is not part of the global state")
+			return
+		}
+		peerMap := statuses[0]
+		if len(statuses) > 1 {
+			f.statuses[cid] = statuses[1:]
+		}
+		writeClusterJSON(w, ClusterPinStatus{Name: "test", PeerMap: peerMap})
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/pins/"):
+		cid := strings.TrimPrefix(r.URL.Path, "/pins/")
+		if _, ok := f.pins[cid]; !ok {
+			writeClusterError(w, http.StatusNotFound, "uncommitted to state: not found")
+			return
+		}
+		delete(f.pins, cid)
+		writeClusterJSON(w, map[string]string{"cid": cid})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/allocations/"):
+		cid := strings.TrimPrefix(r.URL.Path, "/allocations/")
+		allocations, ok := f.allocations[cid]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeClusterJSON(w, map[string]interface{}{"cid": cid, "allocations": allocations})
+	default:
+		writeClusterError(w, http.StatusNotFound, "no such endpoint")
+	}
+}
+
+func writeClusterJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeClusterError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"code": status, "message": message})
+}
+
+func peerStatuses(statuses ...string) map[string]ClusterPeerStatus {
+	peerMap := make(map[string]ClusterPeerStatus, len(statuses))
+	for i, status := range statuses {
+		peerMap[fmt.Sprintf("peer-%d", i)] = ClusterPeerStatus{PeerName: fmt.Sprintf("node-%d", i), Status: status}
+	}
+	return peerMap
+}
+
+func TestClusterPin(t *testing.T) {
+	fake, client := newFakeCluster(t)
+	fake.statuses[testCID] = []map[string]ClusterPeerStatus{
+		peerStatuses(ClusterStatusPinned, ClusterStatusPinned, ClusterStatusRemote),
+	}
+
+	if err := client.Pin(context.Background(), testCID); err != nil {
+		t.Fatalf("Pin: %v", err)
+	}
+
+	query, ok := fake.pins[testCID]
+	if !ok {
+		t.Fatalf("pin was not submitted: %v", fake.requests)
+	}
+	if query.Get("replication-min") != "2" || query.Get("replication-max") != "3" {
+		t.Fatalf("pin submitted with %v, want replication 2 to 3", query)
+	}
+}
+
+func TestClusterPinWaitsForReplication(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for a status poll")
+	}
+
+	fake, client := newFakeCluster(t)
+	fake.statuses[testCID] = []map[string]ClusterPeerStatus{
+		peerStatuses(ClusterStatusPinned, ClusterStatusPinning, ClusterStatusQueued),
+		peerStatuses(ClusterStatusPinned, ClusterStatusPinned, ClusterStatusPinning),
+	}
+
+	status, err := client.WaitPinned(context.Background(), testCID)
+	if err != nil {
+		t.Fatalf("WaitPinned: %v", err)
+	}
+	if n := len(status.Pinned()); n != 2 {
+		t.Fatalf("returned with %d peers pinned, want 2", n)
+	}
+}
+
+func TestClusterPinFailures(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("allocation", func(t *testing.T) {
+		fake, client := newFakeCluster(t)
+		fake.fail = func(r *http.Request) (int, string) {
+			if r.Method == http.MethodPost {
+				return http.StatusInternalServerError, `{"code":500,"message":"not enough peers to allocate CID. Needed at least: 2. Wanted at most: 3. Available candidates: [peer-0]."}`
+			}
+			return 0, ""
+		}
+
+		err := client.Pin(ctx, testCID)
+		if err == nil || !strings.Contains(err.Error(), "not enough peers to allocate CID") {
+			t.Fatalf("err = %v, want the allocation error", err)
+		}
+		for _, request := range fake.requests {
+			if strings.HasPrefix(request, http.MethodGet) {
+				t.Fatalf("polled status after a failed allocation: %v", fake.requests)
+			}
+		}
+	})
+
+	t.Run("peer error", func(t *testing.T) {
+		fake, client := newFakeCluster(t)
+		fake.statuses[testCID] = []map[string]ClusterPeerStatus{
+			peerStatuses(ClusterStatusPinned, ClusterStatusPinError),
+		}
+
+		err := client.Pin(ctx, testCID)
+		if err == nil || !strings.Contains(err.Error(), "cluster failed to pin") {
+			t.Fatalf("err = %v, want a pin failure", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		fake, client := newFakeCluster(t)
+		client.pinTimeout = 50 * time.Millisecond
+		fake.statuses[testCID] = []map[string]ClusterPeerStatus{
+			peerStatuses(ClusterStatusPinning, ClusterStatusQueued),
+		}
+
+		err := client.Pin(ctx, testCID)
+		if err == nil || !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("err = %v, want a timeout", err)
+		}
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		_, client := newFakeCluster(t)
+		client.password = "wrong"
+
+		err := client.PinWithReplication(ctx, testCID, 1, 1)
+		if err == nil || !strings.Contains(err.Error(), "Unauthorized") {
+			t.Fatalf("err = %v, want Unauthorized", err)
+		}
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		client := NewClusterClient(ClusterConfig{APIURL: "http://127.0.0.1:1", Timeout: time.Second})
+
+		err := client.PinWithReplication(ctx, testCID, 1, 1)
+		if !errors.Is(err, ErrNodeUnavailable) || !Unavailable(err) {
+			t.Fatalf("err = %v, want ErrNodeUnavailable", err)
+		}
+	})
+}
+
+func TestClusterUnpin(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeCluster(t)
+	fake.pins[testCID] = url.Values{}
+
+	if err := client.Unpin(ctx, testCID); err != nil {
+		t.Fatalf("Unpin: %v", err)
+	}
+	if _, ok := fake.pins[testCID]; ok {
+		t.Fatal("pin was not removed")
+	}
+
+	// Unpinning is idempotent
+	if err := client.Unpin(ctx, testCID); err != nil {
+		t.Fatalf("Unpin of a missing pin: %v", err)
+	}
+
+	fake.fail = func(r *http.Request) (int, string) {
+		return http.StatusInternalServerError, `{"code":500,"message":"raft: leadership lost"}`
+	}
+	err := client.Unpin(ctx, testCID)
+	if err == nil || !strings.Contains(err.Error(), "leadership lost") {
+		t.Fatalf("err = %v, want the cluster error", err)
+	}
+}
+
+func TestClusterStatus(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeCluster(t)
+	fake.statuses[testCID] = []map[string]ClusterPeerStatus{
+		peerStatuses(ClusterStatusPinned, ClusterStatusPinning),
+	}
+
+	status, err := client.Status(ctx, testCID)
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if pinned := status.Pinned(); len(pinned) != 1 || pinned[0] != "peer-0" {
+		t.Fatalf("Pinned = %v, want [peer-0]", pinned)
+	}
+	if status.Failed() {
+		t.Fatal("Failed with no peer in error")
+	}
+	if !client.IsPinned(ctx, testCID) {
+		t.Fatal("IsPinned = false with a peer pinned")
+	}
+
+	if _, err := client.Status(ctx, "bafyunknown"); err == nil || !strings.Contains(err.Error(), "not part of the global state") {
+		t.Fatalf("err = %v, want the cluster's not found message", err)
+	}
+	if client.IsPinned(ctx, "bafyunknown") {
+		t.Fatal("IsPinned = true for an unknown CID")
+	}
+
+	fake.fail = func(r *http.Request) (int, string) {
+		return http.StatusOK, "not json"
+	}
+	if _, err := client.Status(ctx, testCID); err == nil {
+		t.Fatal("Status decoded a malformed response")
+	}
+}
+
+func TestClusterAllocations(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeCluster(t)
+	fake.allocations[testCID] = []string{"peer-0", "peer-2"}
+
+	allocations, err := client.Allocations(ctx, testCID)
+	if err != nil {
+		t.Fatalf("Allocations: %v", err)
+	}
+	if strings.Join(allocations, ",") != "peer-0,peer-2" {
+		t.Fatalf("Allocations = %v, want [peer-0 peer-2]", allocations)
+	}
+
+	// A 404 without a message body
+	if _, err := client.Allocations(ctx, "bafyunknown"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("err = %v, want not found", err)
+	}
+
+	fake.fail = func(r *http.Request) (int, string) {
+		return http.StatusServiceUnavailable, ""
+	}
+	if _, err := client.Allocations(ctx, testCID); err == nil || !strings.Contains(err.Error(), "status 503") {
+		t.Fatalf("err = %v, want status 503", err)
+	}
+}
+
+func TestClusterPeers(t *testing.T) {
+	for name, body := range map[string]string{
+		"array":    `[{"id":"peer-0","peername":"node-0"},{"id":"peer-1","peername":"node-1","ipfs":{"error":"connection refused"}}]`,
+		"streamed": "{\"id\":\"peer-0\",\"peername\":\"node-0\"}\n{\"id\":\"peer-1\",\"peername\":\"node-1\",\"ipfs\":{\"error\":\"connection refused\"}}\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			fake, client := newFakeCluster(t)
+			fake.fail = func(r *http.Request) (int, string) {
+				return http.StatusOK, body
+			}
+
+			peers, err := client.Peers(context.Background())
+			if err != nil {
+				t.Fatalf("Peers: %v", err)
+			}
+			if len(peers) != 2 || peers[0].ID != "peer-0" || !peers[0].Healthy() || peers[1].Healthy() {
+				t.Fatalf("Peers = %+v, want a healthy peer-0 and an unhealthy peer-1", peers)
+			}
+		})
+	}
+}
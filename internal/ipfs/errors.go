@@ -0,0 +1,86 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+var (
+	// ErrNotFound is returned when a node cannot find content, a path in
+	// it or a pin
+	ErrNotFound = errors.New("content not found")
+	// ErrNotPinned is returned when unpinning content that is not pinned
+	ErrNotPinned = errors.New("content not pinned")
+	// ErrTimeout is returned when a request outlives its deadline
+	ErrTimeout = errors.New("IPFS request timed out")
+	// ErrNodeUnavailable is returned when a node cannot be reached
+	ErrNodeUnavailable = errors.New("IPFS node unavailable")
+)
+
+// Error is a failed request to an IPFS node. It matches one of the
+// sentinel errors above with errors.Is when the cause is known.
+type Error struct {
+	Op   string
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+// Unavailable returns true if an error means the node itself is in trouble
+// rather than the request
+func Unavailable(err error) bool {
+	return errors.Is(err, ErrNodeUnavailable) || errors.Is(err, ErrTimeout)
+}
+
+// wrapError classifies an error returned by the RPC API
+func wrapError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Op: op, Kind: classify(err), Err: err}
+}
+
+func classify(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+
+	var rpcErr *shell.Error
+	if errors.As(err, &rpcErr) {
+		msg := strings.ToLower(rpcErr.Message)
+		switch {
+		case strings.Contains(msg, "not pinned"):
+			return ErrNotPinned
+		case strings.Contains(msg, "not found"),
+			strings.Contains(msg, "no link named"),
+			strings.Contains(msg, "could not resolve"):
+			return ErrNotFound
+		}
+		return nil
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return ErrTimeout
+		}
+		return ErrNodeUnavailable
+	}
+
+	return nil
+}
@@ -0,0 +1,474 @@
+package ipfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// virtualNodes is how many points each node has on the hash ring. More
+// points spread content more evenly across nodes.
+const virtualNodes = 128
+
+// NodeConfig is an IPFS node of a pool. The ID, not the URL, decides
+// placement, so a node can move to a new address without content moving.
+type NodeConfig struct {
+	ID     string
+	APIURL string
+}
+
+// NodeStatus is the last health check of a node
+type NodeStatus struct {
+	ID        string    `json:"id"`
+	APIURL    string    `json:"api_url"`
+	Healthy   bool      `json:"healthy"`
+	PeerID    string    `json:"peer_id,omitempty"`
+	Version   string    `json:"version,omitempty"`
+	Addresses []string  `json:"addresses,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type poolNode struct {
+	config NodeConfig
+	client *Client
+	status NodeStatus
+}
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+// Pool spreads pins over several IPFS nodes. Each CID is placed on the
+// first nodes clockwise from its hash on a consistent hash ring, so adding
+// or removing a node only moves the content next to it. Unhealthy nodes
+// are skipped and the next node on the ring takes their place.
+//
+// Nodes are health checked lazily: a check older than the check interval
+// is redone before the pool places content, and a node is rechecked as
+// soon as a request to it fails.
+type Pool struct {
+	nodes         map[string]*poolNode
+	ring          []ringPoint
+	replication   int
+	checkInterval time.Duration
+	mu            sync.RWMutex
+	checkMu       sync.Mutex
+}
+
+func NewPool(nodes []NodeConfig, replication int, timeout, checkInterval time.Duration) (*Pool, error) {
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("IPFS pool has no nodes")
+	}
+	if replication < 1 {
+		replication = 1
+	}
+	if replication > len(nodes) {
+		replication = len(nodes)
+	}
+
+	p := &Pool{
+		nodes:         make(map[string]*poolNode, len(nodes)),
+		replication:   replication,
+		checkInterval: checkInterval,
+	}
+
+	for _, node := range nodes {
+		if node.ID == "" || node.APIURL == "" {
+			return nil, fmt.Errorf("IPFS node needs an id and an api_url")
+		}
+		if _, ok := p.nodes[node.ID]; ok {
+			return nil, fmt.Errorf("duplicate IPFS node %s", node.ID)
+		}
+
+		p.nodes[node.ID] = &poolNode{
+			config: node,
+			client: NewClient(node.APIURL, timeout),
+			// Optimistic until the first check
+			status: NodeStatus{ID: node.ID, APIURL: node.APIURL, Healthy: true},
+		}
+		for i := 0; i < virtualNodes; i++ {
+			p.ring = append(p.ring, ringPoint{hash: hashKey(node.ID + "#" + strconv.Itoa(i)), node: node.ID})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+
+	return p, nil
+}
+
+// Replication returns how many nodes each CID is pinned on
+func (p *Pool) Replication() int {
+	return p.replication
+}
+
+// Has returns true if a node is part of the pool
+func (p *Pool) Has(nodeID string) bool {
+	_, ok := p.nodes[nodeID]
+	return ok
+}
+
+// Client returns the client of a node
+func (p *Pool) Client(nodeID string) (*Client, bool) {
+	node, ok := p.nodes[nodeID]
+	if !ok {
+		return nil, false
+	}
+	return node.client, true
+}
+
+// Status returns the health of every node, rechecking stale nodes
+func (p *Pool) Status(ctx context.Context) []NodeStatus {
+	p.refresh(ctx, false)
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	statuses := make([]NodeStatus, 0, len(p.nodes))
+	for _, node := range p.nodes {
+		statuses = append(statuses, node.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// CheckHealth checks every node now and returns their health
+func (p *Pool) CheckHealth(ctx context.Context) []NodeStatus {
+	p.refresh(ctx, true)
+	return p.Status(ctx)
+}
+
+// Healthy returns true if a node passed its last health check
+func (p *Pool) Healthy(nodeID string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	node, ok := p.nodes[nodeID]
+	return ok && node.status.Healthy
+}
+
+// Placement returns the nodes a CID belongs on when every node is healthy
+func (p *Pool) Placement(cid string) []string {
+	return p.ringOrder(cid)[:p.replication]
+}
+
+// Place returns the healthy nodes a CID should be pinned on, failing over
+// to the next nodes on the ring for unhealthy ones
+func (p *Pool) Place(ctx context.Context, cid string) []string {
+	p.refresh(ctx, false)
+
+	var placed []string
+	for _, nodeID := range p.ringOrder(cid) {
+		if len(placed) == p.replication {
+			break
+		}
+		if p.Healthy(nodeID) {
+			placed = append(placed, nodeID)
+		}
+	}
+	return placed
+}
+
+// Pin pins a CID on its healthy nodes and returns the nodes holding it. A
+// node that fails is replaced by the next healthy node on the ring; an
+// error is returned only if no node could pin the CID.
+func (p *Pool) Pin(ctx context.Context, cid string) ([]string, error) {
+	return p.PinWithProgress(ctx, cid, nil)
+}
+
+// PinWithProgress pins like Pin, calling progress with the node being
+// pinned and the blocks it has walked. Nodes are pinned one after another,
+// so the count starts over for each.
+func (p *Pool) PinWithProgress(ctx context.Context, cid string, progress func(nodeID string, blocks int64)) ([]string, error) {
+	p.refresh(ctx, false)
+
+	var pinned []string
+	var lastErr error
+	for _, nodeID := range p.ringOrder(cid) {
+		if len(pinned) == p.replication {
+			break
+		}
+		if !p.Healthy(nodeID) {
+			continue
+		}
+
+		if err := p.pinOn(ctx, nodeID, cid, progress); err != nil {
+			lastErr = err
+			continue
+		}
+		pinned = append(pinned, nodeID)
+	}
+
+	if len(pinned) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no healthy IPFS nodes")
+		}
+		return nil, lastErr
+	}
+	return pinned, nil
+}
+
+// PinOn pins a CID on one node
+func (p *Pool) PinOn(ctx context.Context, nodeID, cid string) error {
+	return p.pinOn(ctx, nodeID, cid, nil)
+}
+
+func (p *Pool) pinOn(ctx context.Context, nodeID, cid string, progress func(nodeID string, blocks int64)) error {
+	node, ok := p.nodes[nodeID]
+	if !ok {
+		return fmt.Errorf("unknown IPFS node %s", nodeID)
+	}
+
+	var report func(int64)
+	if progress != nil {
+		report = func(blocks int64) { progress(nodeID, blocks) }
+	}
+	if err := node.client.PinWithProgress(ctx, cid, report); err != nil {
+		if Unavailable(err) {
+			p.recheck(ctx, node)
+		}
+		return fmt.Errorf("node %s: %w", nodeID, err)
+	}
+	return nil
+}
+
+// Unpin unpins a CID from the given nodes. Nodes that no longer pin it are
+// not an error. The nodes that were unpinned are returned even when some
+// fail.
+func (p *Pool) Unpin(ctx context.Context, cid string, nodeIDs []string) ([]string, error) {
+	var unpinned []string
+	var lastErr error
+	for _, nodeID := range nodeIDs {
+		node, ok := p.nodes[nodeID]
+		if !ok {
+			continue
+		}
+
+		if err := node.client.Unpin(ctx, cid); err != nil && !errors.Is(err, ErrNotPinned) {
+			if Unavailable(err) {
+				p.recheck(ctx, node)
+			}
+			lastErr = fmt.Errorf("node %s: %w", nodeID, err)
+			continue
+		}
+		unpinned = append(unpinned, nodeID)
+	}
+	return unpinned, lastErr
+}
+
+// IsPinned returns the nodes among nodeIDs that pin a CID
+func (p *Pool) IsPinned(ctx context.Context, cid string, nodeIDs []string) []string {
+	var pinned []string
+	for _, nodeID := range nodeIDs {
+		if node, ok := p.nodes[nodeID]; ok && p.Healthy(nodeID) && node.client.IsPinned(ctx, cid) {
+			pinned = append(pinned, nodeID)
+		}
+	}
+	return pinned
+}
+
+// Cat opens a stream of a CID from the first healthy node that serves it,
+// trying the preferred nodes (usually those known to pin it) first
+func (p *Pool) Cat(ctx context.Context, cid string, preferred []string) (io.ReadCloser, error) {
+	var stream io.ReadCloser
+	err := p.try(ctx, cid, preferred, func(client *Client) error {
+		var err error
+		stream, err = client.Cat(ctx, cid)
+		return err
+	})
+	return stream, err
+}
+
+// GetSize returns the size of a CID from the first healthy node that knows
+// it, trying the preferred nodes first
+func (p *Pool) GetSize(ctx context.Context, cid string, preferred []string) (int64, error) {
+	var size int64
+	err := p.try(ctx, cid, preferred, func(client *Client) error {
+		var err error
+		size, err = client.GetSize(ctx, cid)
+		return err
+	})
+	return size, err
+}
+
+// Resolve returns the CID at a path below a CID, preferring the given
+// nodes
+func (p *Pool) Resolve(ctx context.Context, cid, path string, preferred []string) (string, error) {
+	var resolved string
+	err := p.try(ctx, cid, preferred, func(client *Client) error {
+		var err error
+		resolved, err = client.Resolve(ctx, cid, path)
+		return err
+	})
+	return resolved, err
+}
+
+// Addresses returns the addresses of the given nodes as of their last
+// health check
+func (p *Pool) Addresses(nodeIDs []string) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var addrs []string
+	for _, nodeID := range nodeIDs {
+		if node, ok := p.nodes[nodeID]; ok {
+			addrs = append(addrs, node.status.Addresses...)
+		}
+	}
+	return addrs
+}
+
+// PeerWith connects the given nodes to the peers at origins until the
+// returned function is called, and returns how many connections were made
+func (p *Pool) PeerWith(ctx context.Context, nodeIDs []string, origins []string) (int, func()) {
+	connected := 0
+	var releases []func()
+	for _, nodeID := range nodeIDs {
+		node, ok := p.nodes[nodeID]
+		if !ok {
+			continue
+		}
+		n, release := node.client.PeerWith(ctx, origins)
+		connected += n
+		releases = append(releases, release)
+	}
+
+	return connected, func() {
+		for _, release := range releases {
+			release()
+		}
+	}
+}
+
+// LocalSize returns how many bytes of a CID one node holds and the CID's
+// total size
+func (p *Pool) LocalSize(ctx context.Context, nodeID, cid string) (int64, int64, error) {
+	node, ok := p.nodes[nodeID]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown IPFS node %s", nodeID)
+	}
+	return node.client.LocalSize(ctx, cid)
+}
+
+// try runs fn against healthy nodes until it succeeds
+func (p *Pool) try(ctx context.Context, cid string, preferred []string, fn func(*Client) error) error {
+	p.refresh(ctx, false)
+
+	order := append([]string(nil), preferred...)
+	seen := make(map[string]bool, len(p.nodes))
+	for _, nodeID := range preferred {
+		seen[nodeID] = true
+	}
+	for _, nodeID := range p.ringOrder(cid) {
+		if !seen[nodeID] {
+			order = append(order, nodeID)
+		}
+	}
+
+	lastErr := fmt.Errorf("no healthy IPFS nodes")
+	for _, nodeID := range order {
+		node, ok := p.nodes[nodeID]
+		if !ok || !p.Healthy(nodeID) {
+			continue
+		}
+
+		if err := fn(node.client); err != nil {
+			if Unavailable(err) {
+				p.recheck(ctx, node)
+			}
+			lastErr = fmt.Errorf("node %s: %w", nodeID, err)
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
+
+// ringOrder returns every node in the order they follow a CID on the ring
+func (p *Pool) ringOrder(cid string) []string {
+	hash := hashKey(cid)
+	start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= hash })
+
+	order := make([]string, 0, len(p.nodes))
+	seen := make(map[string]bool, len(p.nodes))
+	for i := 0; i < len(p.ring) && len(order) < len(p.nodes); i++ {
+		point := p.ring[(start+i)%len(p.ring)]
+		if !seen[point.node] {
+			seen[point.node] = true
+			order = append(order, point.node)
+		}
+	}
+	return order
+}
+
+// refresh health checks nodes whose last check is older than the check
+// interval, or every node if force is set
+func (p *Pool) refresh(ctx context.Context, force bool) {
+	p.checkMu.Lock()
+	defer p.checkMu.Unlock()
+
+	var stale []*poolNode
+	p.mu.RLock()
+	for _, node := range p.nodes {
+		if force || time.Since(node.status.CheckedAt) >= p.checkInterval {
+			stale = append(stale, node)
+		}
+	}
+	p.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, node := range stale {
+		wg.Add(1)
+		go func(node *poolNode) {
+			defer wg.Done()
+			p.check(ctx, node)
+		}(node)
+	}
+	wg.Wait()
+}
+
+// recheck checks a node after a request to it failed, so an outage is
+// noticed before the next scheduled check
+func (p *Pool) recheck(ctx context.Context, node *poolNode) {
+	p.checkMu.Lock()
+	defer p.checkMu.Unlock()
+	p.check(ctx, node)
+}
+
+func (p *Pool) check(ctx context.Context, node *poolNode) {
+	peerID, version, err := node.client.Identify(ctx)
+	if ctx.Err() != nil {
+		// Our caller gave up, which says nothing about the node
+		return
+	}
+
+	status := NodeStatus{
+		ID:        node.config.ID,
+		APIURL:    node.config.APIURL,
+		Healthy:   err == nil,
+		PeerID:    peerID,
+		Version:   version,
+		CheckedAt: time.Now(),
+	}
+	if err != nil {
+		status.Error = err.Error()
+	} else if addrs, err := node.client.Addresses(ctx); err == nil {
+		status.Addresses = addrs
+	}
+
+	p.mu.Lock()
+	node.status = status
+	p.mu.Unlock()
+}
+
+func hashKey(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
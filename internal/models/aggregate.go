@@ -0,0 +1,55 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Aggregate packs many small pins into one DAG large enough for storage
+// providers to accept as a deal. The aggregate root is a UnixFS directory
+// linking each member's root under its pin request ID.
+type Aggregate struct {
+	ID           uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	RootCID      string    `gorm:"size:255;index" json:"root_cid"`
+	Status       string    `gorm:"size:20;default:'building'" json:"status"`
+	SizeBytes    int64     `gorm:"default:0" json:"size_bytes"`
+	PieceSize    int64     `gorm:"default:0" json:"piece_size"`
+	EntryCount   int       `gorm:"default:0" json:"entry_count"`
+	DurationDays int       `gorm:"not null" json:"duration_days"`
+	Replicas     int       `gorm:"default:0" json:"replicas"`
+	Error        string    `gorm:"type:text" json:"error,omitempty"`
+	CreatedAt    time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt    time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (Aggregate) TableName() string {
+	return "aggregates"
+}
+
+// Aggregate status constants
+const (
+	AggregateStatusBuilding = "building"
+	AggregateStatusReady    = "ready"
+	AggregateStatusDealt    = "dealt"
+	AggregateStatusFailed   = "failed"
+)
+
+// AggregateEntry records where a pin lives inside an aggregate. Resolving
+// Path under the aggregate root must yield CID, which proves the pin is
+// included in every deal made for the aggregate.
+type AggregateEntry struct {
+	ID           uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	AggregateID  uuid.UUID `gorm:"type:uuid;index;not null" json:"aggregate_id"`
+	PinRequestID uuid.UUID `gorm:"type:uuid;uniqueIndex;not null" json:"pin_request_id"`
+	CID          string    `gorm:"size:255;not null" json:"cid"`
+	Path         string    `gorm:"size:64;not null" json:"path"`
+	Position     int       `gorm:"not null" json:"position"`
+	Offset       int64     `gorm:"not null" json:"offset"`
+	SizeBytes    int64     `gorm:"not null" json:"size_bytes"`
+	CreatedAt    time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (AggregateEntry) TableName() string {
+	return "aggregate_entries"
+}
@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// BandwidthUsage is the gateway egress attributed to a user on one day
+type BandwidthUsage struct {
+	UserID    uuid.UUID `gorm:"type:uuid;primaryKey" json:"user_id"`
+	Date      time.Time `gorm:"type:date;primaryKey" json:"date"`
+	Bytes     int64     `gorm:"default:0" json:"bytes"`
+	Requests  int64     `gorm:"default:0" json:"requests"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (BandwidthUsage) TableName() string {
+	return "bandwidth_usage"
+}
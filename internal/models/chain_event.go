@@ -0,0 +1,50 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ChainEvent records a deal state change observed on chain. Events are kept
+// until their tipset is final so they can be undone when the tipset is
+// reverted by a reorg.
+type ChainEvent struct {
+	ID                 uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	FilecoinDealID     uuid.UUID `gorm:"type:uuid;index;not null" json:"filecoin_deal_id"`
+	PinRequestID       uuid.UUID `gorm:"type:uuid;index;not null" json:"pin_request_id"`
+	DealID             int64     `gorm:"not null" json:"deal_id"`
+	Type               string    `gorm:"size:20;not null" json:"type"`
+	TipSetKey          string    `gorm:"type:text;index;not null" json:"tipset_key"`
+	Height             int64     `gorm:"index;not null" json:"height"`
+	PreviousStatus     string    `gorm:"size:20" json:"previous_status"`
+	PreviousDealID     int64     `gorm:"default:0" json:"previous_deal_id"`
+	PreviousStartEpoch int64     `gorm:"default:0" json:"previous_start_epoch"`
+	PreviousEndEpoch   int64     `gorm:"default:0" json:"previous_end_epoch"`
+	CreatedAt          time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (ChainEvent) TableName() string {
+	return "chain_events"
+}
+
+// Chain event types
+const (
+	ChainEventPublished = "published"
+	ChainEventActivated = "activated"
+	ChainEventSlashed   = "slashed"
+	ChainEventReverted  = "reverted"
+)
+
+// ChainCheckpoint is the last tipset fully processed by a chain follower
+type ChainCheckpoint struct {
+	Name      string    `gorm:"size:64;primaryKey" json:"name"`
+	TipSetKey string    `gorm:"type:text;not null" json:"tipset_key"`
+	Cids      string    `gorm:"type:text;not null" json:"cids"`
+	Height    int64     `gorm:"not null" json:"height"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (ChainCheckpoint) TableName() string {
+	return "chain_checkpoints"
+}
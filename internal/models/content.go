@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Content is a CID stored once however many users pin it. Each pinned
+// pin request referencing it holds one reference, and the IPFS pin is
+// dropped once the last reference is released. Deals for the content are
+// made and renewed through one of the referencing pins, DealPinID; the
+// others share them.
+type Content struct {
+	ID         uuid.UUID  `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	CID        string     `gorm:"size:255;uniqueIndex;not null" json:"cid"`
+	SizeBytes  int64      `gorm:"default:0" json:"size_bytes"`
+	RefCount   int        `gorm:"default:0" json:"ref_count"`
+	Status     string     `gorm:"size:20;default:'pinned'" json:"status"`
+	DealPinID  *uuid.UUID `gorm:"type:uuid;index" json:"deal_pin_id,omitempty"`
+	PinnedAt   *time.Time `json:"pinned_at,omitempty"`
+	UnpinnedAt *time.Time `json:"unpinned_at,omitempty"`
+	CreatedAt  time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt  time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (Content) TableName() string {
+	return "contents"
+}
+
+// Content statuses. Content is unpinning between its last reference being
+// released and the IPFS pin being removed. Cold content is still
+// referenced but only stored on Filecoin, since every pin referencing it
+// is in the cold tier.
+const (
+	ContentStatusPinned    = "pinned"
+	ContentStatusUnpinning = "unpinning"
+	ContentStatusUnpinned  = "unpinned"
+	ContentStatusCold      = "cold"
+)
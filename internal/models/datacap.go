@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DataCapAllocation is the share of our verified client DataCap an admin
+// has granted a user. Used grows as the user's verified deals are made.
+type DataCapAllocation struct {
+	ID             uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	UserID         uuid.UUID `gorm:"type:uuid;uniqueIndex;not null" json:"user_id"`
+	AllowanceBytes int64     `gorm:"not null;default:0" json:"allowance_bytes"`
+	UsedBytes      int64     `gorm:"not null;default:0" json:"used_bytes"`
+	CreatedAt      time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt      time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (DataCapAllocation) TableName() string {
+	return "datacap_allocations"
+}
+
+// Remaining returns how much of the allowance is left
+func (a *DataCapAllocation) Remaining() int64 {
+	if a.UsedBytes >= a.AllowanceBytes {
+		return 0
+	}
+	return a.AllowanceBytes - a.UsedBytes
+}
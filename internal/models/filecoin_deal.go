@@ -7,17 +7,23 @@ import (
 )
 
 type FilecoinDeal struct {
-	ID            uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
-	PinRequestID  uuid.UUID `gorm:"type:uuid;index;not null" json:"pin_request_id"`
-	DealCID       string    `gorm:"size:64;index" json:"deal_cid"`
-	MinerID       string    `gorm:"size:20;not null" json:"miner_id"`
-	StartEpoch    int64     `gorm:"not null" json:"start_epoch"`
-	EndEpoch      int64     `gorm:"not null" json:"end_epoch"`
-	Status        string    `gorm:"size:20;default:'pending'" json:"status"`
-	StoragePrice  float64   `gorm:"type:decimal(18,8);default:0" json:"storage_price"`
-	RetrievalCost float64   `gorm:"type:decimal(18,8);default:0" json:"retrieval_cost"`
-	CreatedAt     time.Time `gorm:"autoCreateTime" json:"created_at"`
-	UpdatedAt     time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+	ID            uuid.UUID  `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	PinRequestID  uuid.UUID  `gorm:"type:uuid;index;not null" json:"pin_request_id"`
+	AggregateID   *uuid.UUID `gorm:"type:uuid;index" json:"aggregate_id,omitempty"`
+	ChunkID       *uuid.UUID `gorm:"type:uuid;index" json:"chunk_id,omitempty"`
+	DealCID       string     `gorm:"size:64;index" json:"deal_cid"`
+	DealID        int64      `gorm:"index;default:0" json:"deal_id"`
+	MinerID       string     `gorm:"size:20;not null" json:"miner_id"`
+	StartEpoch    int64      `gorm:"not null" json:"start_epoch"`
+	EndEpoch      int64      `gorm:"not null" json:"end_epoch"`
+	Status        string     `gorm:"size:20;default:'pending'" json:"status"`
+	StoragePrice  float64    `gorm:"type:decimal(18,8);default:0" json:"storage_price"`
+	RetrievalCost float64    `gorm:"type:decimal(18,8);default:0" json:"retrieval_cost"`
+	Verified      bool       `gorm:"default:false" json:"verified"`
+	DataCapBytes  int64      `gorm:"column:datacap_bytes;default:0" json:"datacap_bytes,omitempty"`
+	LastCheckedAt *time.Time `json:"last_checked_at,omitempty"`
+	CreatedAt     time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt     time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
 
 	// Relationships
 	PinRequest PinRequest `gorm:"foreignKey:PinRequestID" json:"pin_request,omitempty"`
@@ -52,3 +58,14 @@ func (d *FilecoinDeal) IsExpired() bool {
 func (d *FilecoinDeal) NeedsRenewal(currentEpoch int64, renewalThreshold int64) bool {
 	return d.IsActive() && (d.EndEpoch-currentEpoch) <= renewalThreshold
 }
+
+// IsOnChain returns true once the deal has been published and has a deal ID
+func (d *FilecoinDeal) IsOnChain() bool {
+	return d.DealID > 0
+}
+
+// AwaitingActivation returns true if the deal is expected to change state
+// soon, i.e. it has been proposed or published but not yet sealed
+func (d *FilecoinDeal) AwaitingActivation() bool {
+	return d.Status == DealStatusPending || d.Status == DealStatusPublished
+}
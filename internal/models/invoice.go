@@ -0,0 +1,66 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// Invoice is a monthly statement of a user's ledger: the charges made in
+// the period as line items, the payments received and the balance at either
+// end. Refunds made in the period are issued as a separate credit note.
+// Invoices are generated once per user, kind and period and never change.
+type Invoice struct {
+	ID                uuid.UUID       `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	UserID            uuid.UUID       `gorm:"type:uuid;not null;uniqueIndex:idx_invoices_user_kind_period" json:"user_id"`
+	Kind              string          `gorm:"size:20;not null;uniqueIndex:idx_invoices_user_kind_period" json:"kind"`
+	Number            string          `gorm:"size:64;not null" json:"number"`
+	CreditedInvoiceID *uuid.UUID      `gorm:"type:uuid" json:"credited_invoice_id,omitempty"`
+	PeriodStart       time.Time       `gorm:"not null;uniqueIndex:idx_invoices_user_kind_period" json:"period_start"`
+	PeriodEnd         time.Time       `gorm:"not null" json:"period_end"`
+	TotalFIL          decimal.Decimal `gorm:"type:decimal(38,18);not null" json:"total_fil"`
+	CreditsFIL        decimal.Decimal `gorm:"type:decimal(38,18);not null" json:"credits_fil"`
+	PaymentsFIL       decimal.Decimal `gorm:"type:decimal(38,18);not null" json:"payments_fil"`
+	OpeningBalanceFIL decimal.Decimal `gorm:"type:decimal(38,18);not null" json:"opening_balance_fil"`
+	ClosingBalanceFIL decimal.Decimal `gorm:"type:decimal(38,18);not null" json:"closing_balance_fil"`
+	EntryCount        int             `gorm:"default:0" json:"entry_count"`
+	Lines             []*InvoiceLine  `gorm:"foreignKey:InvoiceID" json:"lines,omitempty"`
+	IssuedAt          time.Time       `gorm:"not null" json:"issued_at"`
+	CreatedAt         time.Time       `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (Invoice) TableName() string {
+	return "invoices"
+}
+
+// Invoice kinds
+const (
+	InvoiceKindInvoice    = "invoice"
+	InvoiceKindCreditNote = "credit_note"
+)
+
+// InvoiceLine is one item of an invoice or credit note: the ledger entries
+// of one category for one pin and deal, or usage that is metered but not
+// charged such as gateway bandwidth
+type InvoiceLine struct {
+	ID             uuid.UUID       `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	InvoiceID      uuid.UUID       `gorm:"type:uuid;index;not null" json:"-"`
+	Position       int             `gorm:"not null" json:"position"`
+	Kind           string          `gorm:"size:32;not null" json:"kind"`
+	Description    string          `gorm:"size:255" json:"description"`
+	PinRequestID   *uuid.UUID      `gorm:"type:uuid" json:"pin_request_id,omitempty"`
+	FilecoinDealID *uuid.UUID      `gorm:"type:uuid" json:"filecoin_deal_id,omitempty"`
+	Quantity       int64           `gorm:"not null" json:"quantity"`
+	Unit           string          `gorm:"size:20;not null" json:"unit"`
+	AmountFIL      decimal.Decimal `gorm:"type:decimal(38,18);not null" json:"amount_fil"`
+}
+
+func (InvoiceLine) TableName() string {
+	return "invoice_lines"
+}
+
+// Invoice line kinds besides the ledger categories
+const (
+	InvoiceLineBandwidth = "bandwidth"
+)
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// LedgerEntry is a single movement of a user's balance. Amounts are always
+// positive; the entry type determines the direction. Every entry carries an
+// idempotency key so retried operations never charge twice.
+type LedgerEntry struct {
+	ID             uuid.UUID       `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	UserID         uuid.UUID       `gorm:"type:uuid;index;not null" json:"user_id"`
+	PinRequestID   *uuid.UUID      `gorm:"type:uuid;index" json:"pin_request_id,omitempty"`
+	FilecoinDealID *uuid.UUID      `gorm:"type:uuid;index" json:"filecoin_deal_id,omitempty"`
+	Type           string          `gorm:"size:20;not null" json:"type"`
+	Category       string          `gorm:"size:32;not null" json:"category"`
+	AmountFIL      decimal.Decimal `gorm:"type:decimal(38,18);not null" json:"amount_fil"`
+	Description    string          `gorm:"size:255" json:"description"`
+	IdempotencyKey string          `gorm:"size:255;uniqueIndex;not null" json:"-"`
+	CreatedAt      time.Time       `gorm:"autoCreateTime;index" json:"created_at"`
+}
+
+func (LedgerEntry) TableName() string {
+	return "ledger_entries"
+}
+
+// Ledger entry types
+const (
+	LedgerTypeCharge = "charge"
+	LedgerTypeCredit = "credit"
+	LedgerTypeRefund = "refund"
+)
+
+// Ledger entry categories
+const (
+	LedgerCategoryStorage   = "storage"
+	LedgerCategoryRenewal   = "renewal"
+	LedgerCategoryExtension = "extension"
+	LedgerCategoryDeposit   = "deposit"
+)
+
+// IsDebit returns true if the entry reduces the user's balance
+func (e *LedgerEntry) IsDebit() bool {
+	return e.Type == LedgerTypeCharge
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Notification is a message to a user about their account or content
+type Notification struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;index;not null" json:"user_id"`
+	Type      string     `gorm:"size:32;not null" json:"type"`
+	Message   string     `gorm:"type:text;not null" json:"message"`
+	Data      string     `gorm:"type:text" json:"data,omitempty"`
+	Key       string     `gorm:"size:255;uniqueIndex;not null" json:"-"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+	CreatedAt time.Time  `gorm:"autoCreateTime;index" json:"created_at"`
+}
+
+func (Notification) TableName() string {
+	return "notifications"
+}
+
+// Notification types
+const (
+	NotificationLowBalance     = "low_balance"
+	NotificationRenewalSkipped = "renewal_skipped"
+	NotificationRenewalFailed  = "renewal_failed"
+	NotificationRenewed        = "renewed"
+	NotificationPinExpiring    = "pin_expiring"
+	NotificationDealsExpiring  = "deals_expiring"
+	NotificationPinExpired     = "pin_expired"
+	NotificationPinExtended    = "pin_extended"
+	NotificationPinCold        = "pin_cold"
+	NotificationInvoiceIssued  = "invoice_issued"
+)
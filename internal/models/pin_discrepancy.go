@@ -0,0 +1,59 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PinDiscrepancy is a difference between what an IPFS node pins and what
+// the database says it should, found by reconciliation. A discrepancy
+// stays open while it is seen again on each run and is resolved once it
+// is fixed or disappears.
+type PinDiscrepancy struct {
+	ID          uuid.UUID  `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	NodeID      string     `gorm:"size:64;index;not null" json:"node_id"`
+	CID         string     `gorm:"size:255;not null" json:"cid"`
+	Kind        string     `gorm:"size:20;not null" json:"kind"`
+	Action      string     `gorm:"size:20" json:"action,omitempty"`
+	Error       string     `gorm:"type:text" json:"error,omitempty"`
+	FirstSeenAt time.Time  `json:"first_seen_at"`
+	LastSeenAt  time.Time  `json:"last_seen_at"`
+	ResolvedAt  *time.Time `gorm:"index" json:"resolved_at,omitempty"`
+	CreatedAt   time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt   time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (PinDiscrepancy) TableName() string {
+	return "pin_discrepancies"
+}
+
+// Discrepancy kinds. A CID is referenced while a pin request, stored
+// content, aggregate, split or retrieval still needs it.
+const (
+	// DiscrepancyMissing is a referenced CID placed on a node that does not
+	// pin it
+	DiscrepancyMissing = "missing"
+	// DiscrepancyStale is an unreferenced CID placed on a node that does
+	// not pin it
+	DiscrepancyStale = "stale"
+	// DiscrepancyUntracked is a referenced CID a node pins without a
+	// placement on it
+	DiscrepancyUntracked = "untracked"
+	// DiscrepancyOrphaned is an unreferenced CID a node pins without a
+	// placement on it
+	DiscrepancyOrphaned = "orphaned"
+	// DiscrepancyUnreferenced is a CID placed on and pinned by a node that
+	// nothing references any more
+	DiscrepancyUnreferenced = "unreferenced"
+)
+
+// Reconciliation actions
+const (
+	DiscrepancyActionRepin   = "repin"
+	DiscrepancyActionDrop    = "drop_placement"
+	DiscrepancyActionAdopt   = "adopt"
+	DiscrepancyActionUnpin   = "unpin"
+	DiscrepancyActionWait    = "wait"
+	DiscrepancyActionCleared = "cleared"
+)
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PinPlacement records that an IPFS node holds a pin of a CID: a node of
+// the pool, or a cluster peer when IPFS Cluster manages pins
+type PinPlacement struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	CID       string    `gorm:"size:255;uniqueIndex:idx_pin_placements_cid_node;not null" json:"cid"`
+	NodeID    string    `gorm:"size:64;uniqueIndex:idx_pin_placements_cid_node;index;not null" json:"node_id"`
+	Status    string    `gorm:"size:20;default:'pinned'" json:"status"`
+	Error     string    `gorm:"type:text" json:"error,omitempty"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (PinPlacement) TableName() string {
+	return "pin_placements"
+}
+
+// Placement statuses. Pins on Kubo nodes are pinned once recorded; cluster
+// peers report progress.
+const (
+	PlacementStatusPinned  = "pinned"
+	PlacementStatusPinning = "pinning"
+	PlacementStatusError   = "error"
+)
+
+// Hot storage statuses summarizing the placements of a CID
+const (
+	IPFSStatusPinned   = "pinned"
+	IPFSStatusPinning  = "pinning"
+	IPFSStatusError    = "error"
+	IPFSStatusUnpinned = "unpinned"
+)
+
+// SummarizePlacements returns the hot storage status of a CID from its
+// placements. A CID is pinned once the required number of nodes hold it,
+// or once nothing more is in progress and at least one node does.
+func SummarizePlacements(placements []*PinPlacement, required int) string {
+	pinned, pinning, failed := 0, 0, 0
+	for _, placement := range placements {
+		switch placement.Status {
+		case PlacementStatusPinned:
+			pinned++
+		case PlacementStatusPinning:
+			pinning++
+		case PlacementStatusError:
+			failed++
+		}
+	}
+
+	switch {
+	case pinned > 0 && pinned >= required:
+		return IPFSStatusPinned
+	case pinning > 0:
+		return IPFSStatusPinning
+	case pinned > 0:
+		return IPFSStatusPinned
+	case failed > 0:
+		return IPFSStatusError
+	default:
+		return IPFSStatusUnpinned
+	}
+}
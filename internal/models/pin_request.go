@@ -1,6 +1,7 @@
 package models
 
 import (
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -10,13 +11,74 @@ import (
 type PinRequest struct {
 	ID           uuid.UUID       `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
 	UserID       uuid.UUID       `gorm:"type:uuid;index;not null" json:"user_id"`
-	CID          string          `gorm:"size:64;index;not null" json:"cid"`
+	CID          string          `gorm:"size:255;index;not null" json:"cid"`
 	Status       string          `gorm:"size:20;default:'pending'" json:"status"`
 	SizeBytes    int64           `gorm:"default:0" json:"size_bytes"`
 	PriceFIL     decimal.Decimal `gorm:"type:decimal(18,8);default:0" json:"price_fil"`
 	DurationDays int             `gorm:"not null" json:"duration_days"`
-	CreatedAt    time.Time       `gorm:"autoCreateTime" json:"created_at"`
-	UpdatedAt    time.Time       `gorm:"autoUpdateTime" json:"updated_at"`
+	Replicas     int             `gorm:"default:0" json:"replicas"`
+	AggregateID  *uuid.UUID      `gorm:"type:uuid;index" json:"aggregate_id,omitempty"`
+	Verified     bool            `gorm:"default:false" json:"verified"`
+
+	// Renewal preferences
+	AutoRenew          string           `gorm:"size:20;default:'off'" json:"auto_renew"`
+	RenewUntil         *time.Time       `json:"renew_until,omitempty"`
+	MaxRenewalPriceFIL *decimal.Decimal `gorm:"type:decimal(18,8)" json:"max_renewal_price_fil,omitempty"`
+
+	// Encryption at rest; CID is then the ciphertext's CID and the data
+	// key is only stored wrapped by the key provider
+	Encrypted           bool   `gorm:"default:false" json:"encrypted"`
+	EncryptionAlgorithm string `gorm:"size:40" json:"encryption_algorithm,omitempty"`
+	KeyProvider         string `gorm:"size:20" json:"key_provider,omitempty"`
+	KeyID               string `gorm:"size:100" json:"key_id,omitempty"`
+	WrappedKey          []byte `gorm:"type:bytea" json:"-"`
+	PlaintextSize       int64  `gorm:"default:0" json:"plaintext_size,omitempty"`
+	ContentType         string `gorm:"size:255" json:"content_type,omitempty"`
+
+	// The CID or IPFS path as the user gave it, since CID is always stored
+	// as CIDv1 in base32 so the same content matches in any encoding. Path
+	// is the part below the user's CID until a worker resolves it into CID.
+	OriginalCID string `gorm:"type:text" json:"original_cid,omitempty"`
+	Path        string `gorm:"type:text" json:"path,omitempty"`
+
+	// The content this pin references once pinned. Pins of content whose
+	// deals are made through another pin share those deals.
+	ContentID   *uuid.UUID `gorm:"type:uuid;index" json:"content_id,omitempty"`
+	SharesDeals bool       `gorm:"default:false" json:"shares_deals,omitempty"`
+
+	// Hot storage ends at ExpiresAt unless the pin is extended, after which
+	// the pin is expired and its content released once the grace period
+	// has passed. Filecoin storage ends separately, with the pin's last
+	// deal. A legal hold keeps the pin from expiring.
+	ExpiresAt       *time.Time `gorm:"index" json:"expires_at,omitempty"`
+	ExpiredAt       *time.Time `json:"expired_at,omitempty"`
+	DealsExpireAt   *time.Time `json:"deals_expire_at,omitempty"`
+	LegalHold       bool       `gorm:"default:false" json:"legal_hold,omitempty"`
+	LegalHoldReason string     `gorm:"type:text" json:"-"`
+
+	// Storage tier: hot keeps the content on IPFS only, cold on Filecoin
+	// only and hot_cold on both. A hot_cold pin with HotDays set moves to
+	// cold at ColdAt, and a cold pin's IPFS copy is dropped once its deals
+	// are active.
+	Tier    string     `gorm:"size:20;default:'hot_cold'" json:"tier"`
+	HotDays int        `gorm:"default:0" json:"hot_days,omitempty"`
+	ColdAt  *time.Time `gorm:"index" json:"cold_at,omitempty"`
+
+	// Multiaddrs of peers the user says hold the content, comma separated
+	Origins string `gorm:"type:text" json:"-"`
+
+	// Progress of fetching the content into IPFS. The heartbeat is set
+	// while a worker is pinning and cleared when it stops.
+	PinAttempts    int        `gorm:"default:0" json:"pin_attempts,omitempty"`
+	BlocksFetched  int64      `gorm:"default:0" json:"blocks_fetched,omitempty"`
+	BytesFetched   int64      `gorm:"default:0" json:"bytes_fetched,omitempty"`
+	PinError       string     `gorm:"type:text" json:"pin_error,omitempty"`
+	PinStartedAt   *time.Time `json:"pin_started_at,omitempty"`
+	PinProgressAt  *time.Time `json:"pin_progress_at,omitempty"`
+	PinHeartbeatAt *time.Time `gorm:"index" json:"-"`
+
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updated_at"`
 
 	// Relationships
 	User          User           `gorm:"foreignKey:UserID" json:"user,omitempty"`
@@ -30,17 +92,122 @@ func (PinRequest) TableName() string {
 // Status constants
 const (
 	PinStatusPending   = "pending"
+	PinStatusPinning   = "pinning"
 	PinStatusPinned    = "pinned"
 	PinStatusFailed    = "failed"
 	PinStatusCancelled = "cancelled"
+	PinStatusExpired   = "expired"
 )
 
+// Storage tiers
+const (
+	TierHot     = "hot"
+	TierCold    = "cold"
+	TierHotCold = "hot_cold"
+)
+
+// Auto-renew modes
+const (
+	AutoRenewOff        = "off"
+	AutoRenewUntil      = "until"
+	AutoRenewIndefinite = "indefinite"
+)
+
+// DisplayCID returns the CID in the form the user gave it
+func (p *PinRequest) DisplayCID() string {
+	if p.OriginalCID != "" {
+		return p.OriginalCID
+	}
+	return p.CID
+}
+
+// OriginAddrs returns the multiaddrs of the peers holding the content
+func (p *PinRequest) OriginAddrs() []string {
+	if p.Origins == "" {
+		return nil
+	}
+	return strings.Split(p.Origins, ",")
+}
+
 // IsActive returns true if the pin request is in an active state
 func (p *PinRequest) IsActive() bool {
-	return p.Status == PinStatusPending || p.Status == PinStatusPinned
+	return p.Status == PinStatusPending || p.Status == PinStatusPinning || p.Status == PinStatusPinned
 }
 
 // CanBeCancelled returns true if the pin request can be cancelled
 func (p *PinRequest) CanBeCancelled() bool {
-	return p.Status == PinStatusPending
+	return p.Status == PinStatusPending || p.Status == PinStatusPinning
+}
+
+// MakesDeals returns true if the pin's content is stored on Filecoin
+func (p *PinRequest) MakesDeals() bool {
+	return p.Tier != TierHot
+}
+
+// TierAt returns the tier storage of the pin from start is priced at and,
+// for a hot_cold pin, how many of its days are still hot. A hot_cold pin
+// past ColdAt is priced as cold.
+func (p *PinRequest) TierAt(start time.Time) (string, int) {
+	if p.Tier != TierHotCold || p.ColdAt == nil {
+		return p.Tier, 0
+	}
+	hotDays := int(p.ColdAt.Sub(start).Hours() / 24)
+	if hotDays <= 0 {
+		return TierCold, 0
+	}
+	return TierHotCold, hotDays
+}
+
+// CanBeExtended returns true if the pin's hot storage can still be
+// extended: it is pinned, or expired but its content not yet released
+func (p *PinRequest) CanBeExtended() bool {
+	if p.ExpiresAt == nil {
+		return false
+	}
+	return p.Status == PinStatusPinned || (p.Status == PinStatusExpired && p.ContentID != nil)
+}
+
+// WantsRenewal returns true if the user's renewal preferences allow renewing
+// at the given time
+func (p *PinRequest) WantsRenewal(now time.Time) bool {
+	switch p.AutoRenew {
+	case AutoRenewIndefinite:
+		return true
+	case AutoRenewUntil:
+		return p.RenewUntil != nil && now.Before(*p.RenewUntil)
+	default:
+		return false
+	}
+}
+
+// RenewalDays returns how many days a renewal starting at the given time
+// should cover, capped by the renew-until date
+func (p *PinRequest) RenewalDays(start time.Time) int {
+	days := p.DurationDays
+	if p.AutoRenew == AutoRenewUntil && p.RenewUntil != nil {
+		remaining := int(p.RenewUntil.Sub(start).Hours() / 24)
+		if remaining < days {
+			days = remaining
+		}
+	}
+	return days
+}
+
+// RetentionDays returns how many more days the user wants the content
+// stored, up to the pin's expiry including any extensions. Pins that renew
+// indefinitely always want a full duration.
+func (p *PinRequest) RetentionDays(now time.Time) int {
+	if p.AutoRenew == AutoRenewIndefinite {
+		return p.DurationDays
+	}
+
+	end := p.CreatedAt.AddDate(0, 0, p.DurationDays)
+	if p.ExpiresAt != nil {
+		end = *p.ExpiresAt
+	}
+	if p.AutoRenew == AutoRenewUntil && p.RenewUntil != nil && p.RenewUntil.After(end) {
+		end = *p.RenewUntil
+	}
+
+	return int(end.Sub(now).Hours() / 24)
 }
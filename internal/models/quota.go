@@ -0,0 +1,54 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AccountQuota overrides the configured limits of one account. A nil limit
+// falls back to the configured default; zero means unlimited.
+type AccountQuota struct {
+	UserID            uuid.UUID `gorm:"type:uuid;primaryKey" json:"user_id"`
+	MaxBytes          *int64    `json:"max_bytes,omitempty"`
+	MaxPins           *int64    `json:"max_pins,omitempty"`
+	RequestsPerMinute *int      `json:"requests_per_minute,omitempty"`
+	MaxPendingPins    *int      `json:"max_pending_pins,omitempty"`
+	Note              string    `gorm:"type:text" json:"note,omitempty"`
+	CreatedAt         time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt         time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (AccountQuota) TableName() string {
+	return "account_quotas"
+}
+
+// AccountUsage is what an account currently has pinned and waiting to be
+// pinned, recounted whenever one of its pin requests changes status
+type AccountUsage struct {
+	UserID      uuid.UUID `gorm:"type:uuid;primaryKey" json:"user_id"`
+	PinnedBytes int64     `gorm:"default:0" json:"pinned_bytes"`
+	PinnedPins  int64     `gorm:"default:0" json:"pinned_pins"`
+	PendingPins int64     `gorm:"default:0" json:"pending_pins"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func (AccountUsage) TableName() string {
+	return "account_usage"
+}
+
+// UsageDaily is an account's usage on one day: what it had pinned at the
+// end of the day, at most during the day, and how many pins it requested
+type UsageDaily struct {
+	UserID      uuid.UUID `gorm:"type:uuid;primaryKey" json:"-"`
+	Date        time.Time `gorm:"type:date;primaryKey" json:"date"`
+	PinnedBytes int64     `gorm:"default:0" json:"pinned_bytes"`
+	PeakBytes   int64     `gorm:"default:0" json:"peak_bytes"`
+	PinnedPins  int64     `gorm:"default:0" json:"pinned_pins"`
+	PinsCreated int64     `gorm:"default:0" json:"pins_created"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func (UsageDaily) TableName() string {
+	return "usage_daily"
+}
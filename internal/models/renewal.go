@@ -0,0 +1,52 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// Renewal tracks renewing one expiring deal. The idempotency key is derived
+// from the expiring deal so manual and automatic renewals of the same deal
+// resolve to the same row.
+type Renewal struct {
+	ID             uuid.UUID       `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	PinRequestID   uuid.UUID       `gorm:"type:uuid;index;not null" json:"pin_request_id"`
+	FilecoinDealID uuid.UUID       `gorm:"type:uuid;index;not null" json:"filecoin_deal_id"`
+	NewDealID      *uuid.UUID      `gorm:"type:uuid" json:"new_deal_id,omitempty"`
+	IdempotencyKey string          `gorm:"size:255;uniqueIndex;not null" json:"-"`
+	Trigger        string          `gorm:"size:20;not null" json:"trigger"`
+	Status         string          `gorm:"size:20;default:'pending'" json:"status"`
+	MinerID        string          `gorm:"size:20" json:"miner_id"`
+	PriceFIL       decimal.Decimal `gorm:"type:decimal(38,18);default:0" json:"price_fil"`
+	Attempts       int             `gorm:"default:0" json:"attempts"`
+	ClaimedAt      *time.Time      `json:"claimed_at,omitempty"`
+	Error          string          `gorm:"type:text" json:"error,omitempty"`
+	CreatedAt      time.Time       `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt      time.Time       `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (Renewal) TableName() string {
+	return "deal_renewals"
+}
+
+// Renewal triggers
+const (
+	RenewalTriggerAuto   = "auto"
+	RenewalTriggerManual = "manual"
+)
+
+// Renewal status constants
+const (
+	RenewalStatusPending    = "pending"
+	RenewalStatusInProgress = "in_progress"
+	RenewalStatusCompleted  = "completed"
+	RenewalStatusSkipped    = "skipped"
+	RenewalStatusFailed     = "failed"
+)
+
+// IsFinal returns true if the renewal will not be attempted again
+func (r *Renewal) IsFinal() bool {
+	return r.Status == RenewalStatusCompleted || r.Status == RenewalStatusSkipped
+}
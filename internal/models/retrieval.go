@@ -0,0 +1,52 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Retrieval tracks fetching content back from a Filecoin storage provider
+// after the IPFS copy has been lost. A pin has at most one unfinished
+// retrieval at a time.
+type Retrieval struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	UserID         uuid.UUID  `gorm:"type:uuid;index;not null" json:"user_id"`
+	PinRequestID   uuid.UUID  `gorm:"type:uuid;index;not null;uniqueIndex:idx_retrievals_active_pin,where:status <> 'completed' AND status <> 'failed'" json:"pin_request_id"`
+	FilecoinDealID *uuid.UUID `gorm:"type:uuid;index" json:"filecoin_deal_id,omitempty"`
+	CID            string     `gorm:"size:255;index;not null" json:"cid"`
+	MinerID        string     `gorm:"size:20" json:"miner_id,omitempty"`
+	Method         string     `gorm:"size:20" json:"method,omitempty"`
+	Status         string     `gorm:"size:20;default:'queued'" json:"status"`
+	BytesReceived  int64      `gorm:"default:0" json:"bytes_received"`
+	CostFIL        float64    `gorm:"type:decimal(18,8);default:0" json:"cost_fil"`
+	Attempts       int        `gorm:"default:0" json:"attempts"`
+	Error          string     `gorm:"type:text" json:"error,omitempty"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+	CreatedAt      time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt      time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (Retrieval) TableName() string {
+	return "retrievals"
+}
+
+// Retrieval methods
+const (
+	RetrievalMethodLotus = "lotus"
+	RetrievalMethodHTTP  = "http"
+)
+
+// Retrieval status constants
+const (
+	RetrievalStatusQueued     = "queued"
+	RetrievalStatusInProgress = "in_progress"
+	RetrievalStatusCompleted  = "completed"
+	RetrievalStatusFailed     = "failed"
+)
+
+// IsFinished returns true if the retrieval has completed or failed
+func (r *Retrieval) IsFinished() bool {
+	return r.Status == RetrievalStatusCompleted || r.Status == RetrievalStatusFailed
+}
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ShareLink grants access to pinned content through a signed gateway URL
+// without the owner's credentials. A link can be limited to a path inside
+// the DAG and to a number of downloads, and revoked at any time.
+type ShareLink struct {
+	ID           uuid.UUID  `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	UserID       uuid.UUID  `gorm:"type:uuid;index;not null" json:"user_id"`
+	PinRequestID uuid.UUID  `gorm:"type:uuid;index;not null" json:"pin_request_id"`
+	CID          string     `gorm:"size:255;index;not null" json:"cid"`
+	Path         string     `gorm:"type:text" json:"path,omitempty"`
+	MaxDownloads *int       `json:"max_downloads,omitempty"`
+	Downloads    int        `gorm:"default:0" json:"downloads"`
+	ExpiresAt    time.Time  `gorm:"not null" json:"expires_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt    time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt    time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (ShareLink) TableName() string {
+	return "share_links"
+}
+
+// IsUsable returns true if the link is neither revoked, expired nor used up
+func (l *ShareLink) IsUsable(now time.Time) bool {
+	if l.RevokedAt != nil || !now.Before(l.ExpiresAt) {
+		return false
+	}
+	return l.MaxDownloads == nil || l.Downloads < *l.MaxDownloads
+}
+
+// Allows returns true if the link covers a path inside the shared DAG. An
+// empty link path shares the whole DAG.
+func (l *ShareLink) Allows(p string) bool {
+	cleaned, ok := CleanPath(p)
+	if !ok {
+		return false
+	}
+	if l.Path == "" {
+		return true
+	}
+	return cleaned == l.Path || strings.HasPrefix(cleaned, l.Path+"/")
+}
+
+// CleanPath normalizes a path inside a DAG to the form share links store:
+// no leading or trailing slash and no empty or "." segments. It returns
+// false if the path has a ".." segment, which could climb out of a shared
+// subtree.
+func CleanPath(p string) (string, bool) {
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return "", false
+		}
+	}
+	return strings.Trim(path.Clean("/"+p), "/"), true
+}
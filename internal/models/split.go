@@ -0,0 +1,70 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SplitManifest records how a DAG too large for a single deal was divided
+// into chunks along sub-DAG boundaries. The blocks above those boundaries
+// (the spine) are kept as SplitBlocks so the root can be reassembled from
+// the chunks alone.
+type SplitManifest struct {
+	ID           uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	PinRequestID uuid.UUID `gorm:"type:uuid;uniqueIndex;not null" json:"pin_request_id"`
+	RootCID      string    `gorm:"size:255;not null" json:"root_cid"`
+	Status       string    `gorm:"size:20;default:'storing'" json:"status"`
+	SizeBytes    int64     `gorm:"default:0" json:"size_bytes"`
+	ChunkCount   int       `gorm:"default:0" json:"chunk_count"`
+	CreatedAt    time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt    time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (SplitManifest) TableName() string {
+	return "split_manifests"
+}
+
+// Split manifest status constants. A split pin is active only once every
+// chunk is stored at the pin's replication policy.
+const (
+	SplitStatusStoring = "storing"
+	SplitStatusActive  = "active"
+)
+
+// SplitChunk is one deal-sized part of a split DAG. Its root is a
+// directory linking the sub-DAG roots it carries, in DAG order.
+type SplitChunk struct {
+	ID         uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	ManifestID uuid.UUID `gorm:"type:uuid;index;not null" json:"manifest_id"`
+	Position   int       `gorm:"not null" json:"position"`
+	RootCID    string    `gorm:"size:255;not null" json:"root_cid"`
+	SubRoots   string    `gorm:"type:text;not null" json:"-"`
+	SizeBytes  int64     `gorm:"not null" json:"size_bytes"`
+	PieceSize  int64     `gorm:"not null" json:"piece_size"`
+	CreatedAt  time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (SplitChunk) TableName() string {
+	return "split_chunks"
+}
+
+// SubRootCIDs returns the roots of the sub-DAGs carried by the chunk
+func (c *SplitChunk) SubRootCIDs() []string {
+	if c.SubRoots == "" {
+		return nil
+	}
+	return strings.Split(c.SubRoots, ",")
+}
+
+// SplitBlock is a raw block of a split DAG's spine
+type SplitBlock struct {
+	ManifestID uuid.UUID `gorm:"type:uuid;primaryKey" json:"manifest_id"`
+	CID        string    `gorm:"size:255;primaryKey" json:"cid"`
+	Data       []byte    `gorm:"type:bytea;not null" json:"-"`
+}
+
+func (SplitBlock) TableName() string {
+	return "split_blocks"
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Transfer tracks moving a deal's data to its provider when the deal does
+// not use graphsync: the staged CAR, its piece commitment and how much of
+// it the provider has downloaded
+type Transfer struct {
+	ID               uuid.UUID  `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	DealCID          string     `gorm:"size:64;uniqueIndex;not null" json:"deal_cid"`
+	MinerID          string     `gorm:"size:20;not null" json:"miner_id"`
+	Mode             string     `gorm:"size:20;not null" json:"mode"`
+	Status           string     `gorm:"size:20;default:'staged'" json:"status"`
+	PayloadCID       string     `gorm:"size:255;index;not null" json:"payload_cid"`
+	PieceCID         string     `gorm:"size:128;not null" json:"piece_cid"`
+	PieceSize        int64      `gorm:"not null" json:"piece_size"`
+	CARSize          int64      `gorm:"not null" json:"car_size"`
+	BytesTransferred int64      `gorm:"default:0" json:"bytes_transferred"`
+	Token            string     `gorm:"size:64" json:"-"`
+	ManifestPath     string     `gorm:"type:text" json:"-"`
+	Error            string     `gorm:"type:text" json:"error,omitempty"`
+	CompletedAt      *time.Time `json:"completed_at,omitempty"`
+	CleanedAt        *time.Time `json:"cleaned_at,omitempty"`
+	CreatedAt        time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt        time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (Transfer) TableName() string {
+	return "transfers"
+}
+
+// Transfer statuses
+const (
+	TransferStatusStaged       = "staged"
+	TransferStatusTransferring = "transferring"
+	TransferStatusCompleted    = "completed"
+	TransferStatusFailed       = "failed"
+)
+
+// Progress returns the fraction of the CAR the provider has received
+func (t *Transfer) Progress() float64 {
+	if t.Status == TransferStatusCompleted {
+		return 1
+	}
+	if t.CARSize == 0 {
+		return 0
+	}
+	progress := float64(t.BytesTransferred) / float64(t.CARSize)
+	if progress > 1 {
+		progress = 1
+	}
+	return progress
+}
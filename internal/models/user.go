@@ -14,7 +14,8 @@ type User struct {
 	ID        uuid.UUID       `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
 	APIKey    string          `gorm:"size:64;uniqueIndex;not null" json:"-"`
 	Email     string          `gorm:"size:255;uniqueIndex;not null" json:"email"`
-	Balance   decimal.Decimal `gorm:"type:decimal(18,8);default:0" json:"balance"`
+	Balance   decimal.Decimal `gorm:"type:decimal(38,18);default:0" json:"balance"`
+	IsAdmin   bool            `gorm:"default:false" json:"is_admin"`
 	CreatedAt time.Time       `gorm:"autoCreateTime" json:"created_at"`
 	UpdatedAt time.Time       `gorm:"autoUpdateTime" json:"updated_at"`
 
@@ -0,0 +1,291 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/filecoin"
+	"pinning-service/internal/ipfs"
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+// JobBuildAggregates is the job that batches small pins into aggregates
+const JobBuildAggregates = "build_aggregates"
+
+// Inclusion shows where a pin lives inside an aggregate and the deals that
+// store it
+type Inclusion struct {
+	Aggregate *models.Aggregate      `json:"aggregate"`
+	Entry     *models.AggregateEntry `json:"entry"`
+	ProofPath string                 `json:"proof_path"`
+	Deals     []*models.FilecoinDeal `json:"deals"`
+}
+
+// AggregationService batches pins too small for a deal of their own into
+// aggregate DAGs and makes deals for those instead. Each member pin gets a
+// deal row per aggregate deal carrying its proportional share of the cost.
+type AggregationService struct {
+	ipfsClient     *ipfs.Client
+	nodePool       *NodePoolService
+	dealMaker      *DealMaker
+	pricingService *PricingService
+	pinRepo        storage.PinRequestRepository
+	dealRepo       storage.FilecoinDealRepository
+	aggregateRepo  storage.AggregateRepository
+	config         *config.Config
+	logger         *logrus.Logger
+}
+
+func NewAggregationService(ipfsClient *ipfs.Client, nodePool *NodePoolService, dealMaker *DealMaker, pricingService *PricingService, pinRepo storage.PinRequestRepository, dealRepo storage.FilecoinDealRepository, aggregateRepo storage.AggregateRepository, cfg *config.Config, logger *logrus.Logger) *AggregationService {
+	return &AggregationService{
+		ipfsClient:     ipfsClient,
+		nodePool:       nodePool,
+		dealMaker:      dealMaker,
+		pricingService: pricingService,
+		pinRepo:        pinRepo,
+		dealRepo:       dealRepo,
+		aggregateRepo:  aggregateRepo,
+		config:         cfg,
+		logger:         logger,
+	}
+}
+
+// BuildAggregates makes deals for aggregates that were built but not dealt
+// yet, then groups waiting small pins by duration and replication policy
+// and builds an aggregate from every group that is large enough or has
+// waited too long. It returns the number of aggregates built.
+func (s *AggregationService) BuildAggregates(ctx context.Context) (int, error) {
+	ready, err := s.aggregateRepo.GetByStatus(ctx, models.AggregateStatusReady, 100)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get ready aggregates: %w", err)
+	}
+	for _, aggregate := range ready {
+		if err := s.makeDeals(ctx, aggregate); err != nil {
+			s.logger.WithError(err).WithField("aggregate_id", aggregate.ID).Warn("Failed to make aggregate deals")
+		}
+	}
+
+	candidates, err := s.pinRepo.GetAggregationCandidates(ctx, s.config.Aggregation.MaxPinSize, s.config.Aggregation.BatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get aggregation candidates: %w", err)
+	}
+
+	// Candidates arrive oldest first and keep that order within a group
+	type groupKey struct{ durationDays, replicas int }
+	var order []groupKey
+	groups := make(map[groupKey][]*models.PinRequest)
+	for _, pin := range candidates {
+		key := groupKey{pin.DurationDays, pin.Replicas}
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], pin)
+	}
+
+	built := 0
+	for _, key := range order {
+		for _, batch := range s.batches(groups[key]) {
+			aggregate, err := s.build(ctx, batch, key.durationDays, key.replicas)
+			if err != nil {
+				s.logger.WithError(err).Error("Failed to build aggregate")
+				continue
+			}
+			built++
+
+			if err := s.makeDeals(ctx, aggregate); err != nil {
+				s.logger.WithError(err).WithField("aggregate_id", aggregate.ID).Warn("Failed to make aggregate deals, will retry")
+			}
+		}
+	}
+
+	return built, nil
+}
+
+// GetInclusion returns the aggregate one of the user's pins was stored in
+func (s *AggregationService) GetInclusion(ctx context.Context, pinID uuid.UUID, userID string) (*Inclusion, error) {
+	pin, err := s.pinRepo.GetByID(ctx, pinID)
+	if err != nil || pin.UserID.String() != userID {
+		return nil, fmt.Errorf("pin request not found")
+	}
+	if pin.AggregateID == nil {
+		return nil, fmt.Errorf("pin request is not aggregated")
+	}
+
+	aggregate, err := s.aggregateRepo.GetByID(ctx, *pin.AggregateID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aggregate: %w", err)
+	}
+	entry, err := s.aggregateRepo.GetEntryByPinRequestID(ctx, pin.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aggregate entry: %w", err)
+	}
+	deals, err := s.dealRepo.GetByPinRequestID(ctx, pin.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deals: %w", err)
+	}
+
+	var aggregateDeals []*models.FilecoinDeal
+	for _, deal := range deals {
+		if deal.AggregateID != nil && *deal.AggregateID == aggregate.ID {
+			aggregateDeals = append(aggregateDeals, deal)
+		}
+	}
+
+	return &Inclusion{
+		Aggregate: aggregate,
+		Entry:     entry,
+		ProofPath: "/ipfs/" + aggregate.RootCID + "/" + entry.Path,
+		Deals:     aggregateDeals,
+	}, nil
+}
+
+// batches splits a group of pins into aggregates no larger than the target
+// size. A trailing batch below the minimum size is held back until its
+// oldest pin has waited long enough.
+func (s *AggregationService) batches(pins []*models.PinRequest) [][]*models.PinRequest {
+	cfg := s.config.Aggregation
+
+	var batches [][]*models.PinRequest
+	var current []*models.PinRequest
+	var size int64
+	for _, pin := range pins {
+		if len(current) > 0 && (size+pin.SizeBytes > cfg.TargetSize || len(current) >= cfg.MaxEntries) {
+			batches = append(batches, current)
+			current, size = nil, 0
+		}
+		current = append(current, pin)
+		size += pin.SizeBytes
+	}
+
+	if len(current) > 0 && (size >= cfg.MinSize || time.Since(current[0].CreatedAt) >= cfg.MaxWait) {
+		batches = append(batches, current)
+	}
+
+	return batches
+}
+
+// build claims a batch of pins for a new aggregate, links them into one
+// directory and pins it
+func (s *AggregationService) build(ctx context.Context, pins []*models.PinRequest, durationDays, replicas int) (*models.Aggregate, error) {
+	aggregate := &models.Aggregate{
+		ID:           uuid.New(),
+		Status:       models.AggregateStatusBuilding,
+		EntryCount:   len(pins),
+		DurationDays: durationDays,
+		Replicas:     replicas,
+	}
+
+	entries := make([]*models.AggregateEntry, len(pins))
+	links := make([]ipfs.DirectoryLink, len(pins))
+	for i, pin := range pins {
+		entries[i] = &models.AggregateEntry{
+			ID:           uuid.New(),
+			AggregateID:  aggregate.ID,
+			PinRequestID: pin.ID,
+			CID:          pin.CID,
+			Path:         pin.ID.String(),
+			Position:     i,
+			Offset:       aggregate.SizeBytes,
+			SizeBytes:    pin.SizeBytes,
+		}
+		links[i] = ipfs.DirectoryLink{Name: entries[i].Path, CID: pin.CID}
+		aggregate.SizeBytes += pin.SizeBytes
+	}
+	aggregate.PieceSize = filecoin.PaddedPieceSize(aggregate.SizeBytes)
+
+	if err := s.aggregateRepo.Create(ctx, aggregate, entries); err != nil {
+		if errors.Is(err, storage.ErrAlreadyAggregated) {
+			return nil, fmt.Errorf("pins were claimed by another aggregate")
+		}
+		return nil, fmt.Errorf("failed to create aggregate: %w", err)
+	}
+
+	root, err := s.ipfsClient.NewDirectory(ctx, links)
+	if err == nil {
+		err = s.nodePool.Pin(ctx, root)
+	}
+	if err != nil {
+		if failErr := s.aggregateRepo.Fail(ctx, aggregate.ID, err.Error()); failErr != nil {
+			s.logger.WithError(failErr).WithField("aggregate_id", aggregate.ID).Error("Failed to release aggregate")
+		}
+		return nil, err
+	}
+
+	aggregate.RootCID = root
+	aggregate.Status = models.AggregateStatusReady
+	if err := s.aggregateRepo.Update(ctx, aggregate); err != nil {
+		return nil, fmt.Errorf("failed to update aggregate: %w", err)
+	}
+
+	// Members pay their share of the aggregate instead of the minimum
+	// deal size each
+	for _, pin := range pins {
+		pin.PriceFIL = s.pricingService.CalculateAggregateShareFIL(pin.SizeBytes, aggregate.SizeBytes, durationDays)
+		pin.AggregateID = &aggregate.ID
+		if err := s.pinRepo.Update(ctx, pin); err != nil {
+			s.logger.WithError(err).WithField("pin_request_id", pin.ID).Warn("Failed to update aggregated pin price")
+		}
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"aggregate_id": aggregate.ID,
+		"root_cid":     root,
+		"entries":      len(entries),
+		"size_bytes":   aggregate.SizeBytes,
+		"piece_size":   aggregate.PieceSize,
+	}).Info("Aggregate built")
+
+	return aggregate, nil
+}
+
+// makeDeals makes the aggregate's replication policy worth of deals. The
+// aggregate stays ready for another attempt if no provider accepts it.
+func (s *AggregationService) makeDeals(ctx context.Context, aggregate *models.Aggregate) error {
+	entries, err := s.aggregateRepo.GetEntries(ctx, aggregate.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get aggregate entries: %w", err)
+	}
+
+	replicas := aggregate.Replicas
+	if replicas < 1 {
+		replicas = s.config.Repair.DefaultReplicas
+	}
+
+	asks, err := s.dealMaker.SelectProviders(ctx, ProviderCriteria{
+		PieceSize: aggregate.PieceSize,
+		Count:     replicas,
+	})
+	if err != nil {
+		return err
+	}
+
+	made := 0
+	for _, ask := range asks {
+		if _, err := s.dealMaker.MakeAggregateDeal(ctx, AggregateDealRequest{
+			Aggregate: aggregate,
+			Entries:   entries,
+			Ask:       ask,
+		}); err != nil {
+			s.logger.WithError(err).WithFields(logrus.Fields{
+				"aggregate_id": aggregate.ID,
+				"miner_id":     ask.MinerID,
+			}).Warn("Aggregate deal proposal failed")
+			continue
+		}
+		made++
+	}
+
+	if made == 0 {
+		return ErrNoProviders
+	}
+
+	aggregate.Status = models.AggregateStatusDealt
+	return s.aggregateRepo.Update(ctx, aggregate)
+}
@@ -0,0 +1,403 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"pinning-service/internal/filecoin"
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+const chainWatcherCheckpoint = "deal_watcher"
+
+// ChainAPI is the subset of chain access the watcher needs. LotusClient
+// implements it; a fake chain can drive the watcher deterministically.
+type ChainAPI interface {
+	ChainNotify(ctx context.Context) (<-chan []filecoin.HeadChange, error)
+	GetTipSetByHeight(ctx context.Context, height int64) (*filecoin.TipSetRef, error)
+	GetTipSet(ctx context.Context, cids []string) (*filecoin.TipSetRef, error)
+	GetPublishedDeals(ctx context.Context, ts filecoin.TipSetRef, clients []string) ([]filecoin.PublishedDeal, error)
+	GetMarketDealsAt(ctx context.Context, ts filecoin.TipSetRef, dealIDs []int64) (map[int64]filecoin.MarketDealState, error)
+}
+
+// ChainWatcher follows chain head changes and updates our deals as they are
+// published, activated and slashed. Every change is recorded as a
+// ChainEvent against its tipset so it can be undone if the tipset is
+// reverted, and is published on the deal events channel.
+type ChainWatcher struct {
+	chain       ChainAPI
+	dealRepo    storage.FilecoinDealRepository
+	chainRepo   storage.ChainRepository
+	redisClient *redis.Client
+	config      *config.Config
+	logger      *logrus.Logger
+	wallets     []string
+
+	last         *models.ChainCheckpoint
+	activeCursor uuid.UUID
+}
+
+func NewChainWatcher(chain ChainAPI, dealRepo storage.FilecoinDealRepository, chainRepo storage.ChainRepository, redisClient *redis.Client, cfg *config.Config, logger *logrus.Logger) *ChainWatcher {
+	wallets := cfg.ChainWatch.Wallets
+	if len(wallets) == 0 && cfg.Filecoin.WalletAddress != "" {
+		wallets = []string{cfg.Filecoin.WalletAddress}
+	}
+
+	return &ChainWatcher{
+		chain:       chain,
+		dealRepo:    dealRepo,
+		chainRepo:   chainRepo,
+		redisClient: redisClient,
+		config:      cfg,
+		logger:      logger,
+		wallets:     wallets,
+	}
+}
+
+// Run follows the chain until the context is cancelled or the head change
+// subscription ends
+func (w *ChainWatcher) Run(ctx context.Context) error {
+	notifs, err := w.chain.ChainNotify(ctx)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case changes, ok := <-notifs:
+			if !ok {
+				return fmt.Errorf("chain notification channel closed")
+			}
+
+			for _, change := range changes {
+				var err error
+				switch change.Type {
+				case filecoin.HeadChangeCurrent:
+					err = w.catchUp(ctx, change.TipSet)
+				case filecoin.HeadChangeRevert:
+					err = w.revert(ctx, change.TipSet)
+				case filecoin.HeadChangeApply:
+					err = w.apply(ctx, change.TipSet)
+				}
+				if err != nil {
+					return fmt.Errorf("failed to handle %s of tipset at height %d: %w", change.Type, change.TipSet.Height, err)
+				}
+			}
+		}
+	}
+}
+
+// catchUp replays tipsets between the persisted checkpoint and the current
+// head. If the checkpoint is no longer canonical the chain reorged while we
+// were offline, so events within reorg depth are undone and replayed.
+func (w *ChainWatcher) catchUp(ctx context.Context, head filecoin.TipSetRef) error {
+	checkpoint, err := w.chainRepo.GetCheckpoint(ctx, chainWatcherCheckpoint)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// First run: start following from the current head
+		w.logger.WithField("height", head.Height).Info("Chain watcher starting from current head")
+		return w.saveCheckpoint(ctx, head)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get checkpoint: %w", err)
+	}
+	w.last = checkpoint
+
+	start := checkpoint.Height
+	canonical, err := w.chain.GetTipSetByHeight(ctx, checkpoint.Height)
+	if err != nil {
+		return err
+	}
+	if canonical.Key != checkpoint.TipSetKey {
+		start = checkpoint.Height - w.config.ChainWatch.ReorgDepth
+		w.logger.WithFields(logrus.Fields{
+			"checkpoint_height": checkpoint.Height,
+			"rewind_to":         start,
+		}).Warn("Checkpoint tipset is no longer canonical, rewinding")
+
+		if err := w.revertAbove(ctx, start); err != nil {
+			return err
+		}
+		w.last = &models.ChainCheckpoint{Name: chainWatcherCheckpoint, Height: start}
+	}
+
+	if head.Height-start > 1 {
+		w.logger.WithFields(logrus.Fields{
+			"from": start + 1,
+			"to":   head.Height,
+		}).Info("Chain watcher catching up")
+	}
+
+	for height := start + 1; height <= head.Height; height++ {
+		ts, err := w.chain.GetTipSetByHeight(ctx, height)
+		if err != nil {
+			return err
+		}
+		// Null rounds resolve to an earlier tipset we have already applied
+		if ts.Height != height {
+			continue
+		}
+		if err := w.apply(ctx, *ts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// apply processes a tipset added to the chain
+func (w *ChainWatcher) apply(ctx context.Context, ts filecoin.TipSetRef) error {
+	if w.last != nil && ts.Height <= w.last.Height {
+		return nil
+	}
+
+	if err := w.applyPublished(ctx, ts); err != nil {
+		return err
+	}
+	if err := w.applyMarketState(ctx, ts); err != nil {
+		return err
+	}
+
+	if err := w.saveCheckpoint(ctx, ts); err != nil {
+		return err
+	}
+
+	// Events for final tipsets can no longer be reverted
+	return w.chainRepo.PruneEvents(ctx, ts.Height-w.config.ChainWatch.ReorgDepth)
+}
+
+// applyPublished links PublishStorageDeals messages in the tipset to our
+// pending deals by proposal CID
+func (w *ChainWatcher) applyPublished(ctx context.Context, ts filecoin.TipSetRef) error {
+	if len(w.wallets) == 0 {
+		return nil
+	}
+
+	published, err := w.chain.GetPublishedDeals(ctx, ts, w.wallets)
+	if err != nil {
+		return err
+	}
+	if len(published) == 0 {
+		return nil
+	}
+
+	byProposal := make(map[string]filecoin.PublishedDeal, len(published))
+	proposalCIDs := make([]string, 0, len(published))
+	for _, p := range published {
+		byProposal[p.ProposalCID] = p
+		proposalCIDs = append(proposalCIDs, p.ProposalCID)
+	}
+
+	deals, err := w.dealRepo.GetByDealCIDs(ctx, proposalCIDs)
+	if err != nil {
+		return fmt.Errorf("failed to get deals by proposal: %w", err)
+	}
+
+	for _, deal := range deals {
+		p := byProposal[deal.DealCID]
+		if deal.DealID == p.DealID && deal.Status != models.DealStatusPending {
+			continue
+		}
+
+		event := w.newEvent(deal, ts, models.ChainEventPublished)
+		event.DealID = p.DealID
+
+		deal.DealID = p.DealID
+		deal.Status = models.DealStatusPublished
+		deal.StartEpoch = p.StartEpoch
+		deal.EndEpoch = p.EndEpoch
+
+		if err := w.record(ctx, deal, event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyMarketState checks market actor state for deals awaiting activation,
+// plus a rolling window of active deals, for activation and slashing
+func (w *ChainWatcher) applyMarketState(ctx context.Context, ts filecoin.TipSetRef) error {
+	watched, err := w.dealRepo.GetPublishedDeals(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get published deals: %w", err)
+	}
+
+	active, err := w.dealRepo.GetNextBatch(ctx, []string{models.DealStatusActive}, w.activeCursor, w.config.ChainWatch.ActiveBatchSize)
+	if err != nil {
+		return fmt.Errorf("failed to get active deals: %w", err)
+	}
+	if len(active) < w.config.ChainWatch.ActiveBatchSize {
+		w.activeCursor = uuid.Nil
+	} else {
+		w.activeCursor = active[len(active)-1].ID
+	}
+	watched = append(watched, active...)
+
+	dealIDs := make([]int64, 0, len(watched))
+	for _, deal := range watched {
+		dealIDs = append(dealIDs, deal.DealID)
+	}
+	if len(dealIDs) == 0 {
+		return nil
+	}
+
+	states, err := w.chain.GetMarketDealsAt(ctx, ts, dealIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, deal := range watched {
+		state, ok := states[deal.DealID]
+		if !ok {
+			continue
+		}
+
+		var event *models.ChainEvent
+		switch {
+		case state.SlashEpoch >= 0 && deal.Status != models.DealStatusSlashed:
+			event = w.newEvent(deal, ts, models.ChainEventSlashed)
+			deal.Status = models.DealStatusSlashed
+		case state.SectorStartEpoch >= 0 && deal.Status == models.DealStatusPublished:
+			event = w.newEvent(deal, ts, models.ChainEventActivated)
+			deal.Status = models.DealStatusActive
+		default:
+			continue
+		}
+
+		if err := w.record(ctx, deal, event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revert undoes every event recorded against a tipset removed from the chain
+func (w *ChainWatcher) revert(ctx context.Context, ts filecoin.TipSetRef) error {
+	events, err := w.chainRepo.GetEventsByTipSet(ctx, ts.Key)
+	if err != nil {
+		return fmt.Errorf("failed to get events for tipset: %w", err)
+	}
+
+	if err := w.undo(ctx, events); err != nil {
+		return err
+	}
+
+	// The parent is not necessarily one epoch lower: null rounds have no
+	// tipset
+	parent, err := w.chain.GetTipSet(ctx, ts.ParentCids)
+	if err != nil {
+		return err
+	}
+	return w.saveCheckpoint(ctx, *parent)
+}
+
+// revertAbove undoes every event recorded above a height
+func (w *ChainWatcher) revertAbove(ctx context.Context, height int64) error {
+	events, err := w.chainRepo.GetEventsAboveHeight(ctx, height)
+	if err != nil {
+		return fmt.Errorf("failed to get events above height: %w", err)
+	}
+	return w.undo(ctx, events)
+}
+
+// undo restores deals to their state before each event. Events must be
+// ordered newest first.
+func (w *ChainWatcher) undo(ctx context.Context, events []*models.ChainEvent) error {
+	ids := make([]uuid.UUID, 0, len(events))
+	for _, event := range events {
+		deal, err := w.dealRepo.GetByID(ctx, event.FilecoinDealID)
+		if err != nil {
+			return fmt.Errorf("failed to get deal for reverted event: %w", err)
+		}
+
+		deal.Status = event.PreviousStatus
+		deal.DealID = event.PreviousDealID
+		deal.StartEpoch = event.PreviousStartEpoch
+		deal.EndEpoch = event.PreviousEndEpoch
+		if err := w.dealRepo.Update(ctx, deal); err != nil {
+			return fmt.Errorf("failed to revert deal: %w", err)
+		}
+
+		reverted := *event
+		reverted.Type = models.ChainEventReverted
+		w.emit(ctx, &reverted)
+
+		ids = append(ids, event.ID)
+	}
+
+	return w.chainRepo.DeleteEvents(ctx, ids)
+}
+
+func (w *ChainWatcher) newEvent(deal *models.FilecoinDeal, ts filecoin.TipSetRef, eventType string) *models.ChainEvent {
+	return &models.ChainEvent{
+		ID:                 uuid.New(),
+		FilecoinDealID:     deal.ID,
+		PinRequestID:       deal.PinRequestID,
+		DealID:             deal.DealID,
+		Type:               eventType,
+		TipSetKey:          ts.Key,
+		Height:             ts.Height,
+		PreviousStatus:     deal.Status,
+		PreviousDealID:     deal.DealID,
+		PreviousStartEpoch: deal.StartEpoch,
+		PreviousEndEpoch:   deal.EndEpoch,
+	}
+}
+
+// record persists a deal change with its event and publishes the event
+func (w *ChainWatcher) record(ctx context.Context, deal *models.FilecoinDeal, event *models.ChainEvent) error {
+	if err := w.dealRepo.Update(ctx, deal); err != nil {
+		return fmt.Errorf("failed to update deal: %w", err)
+	}
+	if err := w.chainRepo.CreateEvent(ctx, event); err != nil {
+		return fmt.Errorf("failed to record chain event: %w", err)
+	}
+
+	w.logger.WithFields(logrus.Fields{
+		"deal_id":  deal.DealID,
+		"event":    event.Type,
+		"height":   event.Height,
+		"miner_id": deal.MinerID,
+	}).Info("Deal state changed on chain")
+
+	w.emit(ctx, event)
+	return nil
+}
+
+// emit publishes an event for other components; delivery is best effort
+func (w *ChainWatcher) emit(ctx context.Context, event *models.ChainEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	if err := w.redisClient.Publish(ctx, w.config.ChainWatch.EventsChannel, payload).Err(); err != nil {
+		w.logger.WithError(err).WithField("event", event.Type).Warn("Failed to publish deal event")
+	}
+}
+
+func (w *ChainWatcher) saveCheckpoint(ctx context.Context, ts filecoin.TipSetRef) error {
+	checkpoint := &models.ChainCheckpoint{
+		Name:      chainWatcherCheckpoint,
+		TipSetKey: ts.Key,
+		Cids:      strings.Join(ts.Cids, ","),
+		Height:    ts.Height,
+	}
+	if err := w.chainRepo.SaveCheckpoint(ctx, checkpoint); err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	w.last = checkpoint
+	return nil
+}
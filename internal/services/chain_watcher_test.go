@@ -0,0 +1,474 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"pinning-service/internal/filecoin"
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+// fakeChain is a chain of tipsets keyed by their single block CID. Heights
+// without a canonical tipset are null rounds.
+type fakeChain struct {
+	mu        sync.Mutex
+	tipsets   map[string]filecoin.TipSetRef
+	canonical map[int64]string
+	published map[string][]filecoin.PublishedDeal
+	market    map[string]map[int64]filecoin.MarketDealState
+	notifs    chan []filecoin.HeadChange
+}
+
+func newFakeChain() *fakeChain {
+	return &fakeChain{
+		tipsets:   make(map[string]filecoin.TipSetRef),
+		canonical: make(map[int64]string),
+		published: make(map[string][]filecoin.PublishedDeal),
+		market:    make(map[string]map[int64]filecoin.MarketDealState),
+		notifs:    make(chan []filecoin.HeadChange),
+	}
+}
+
+// add adds a tipset on top of parent and makes it canonical at its height
+func (c *fakeChain) add(key string, height int64, parent string) filecoin.TipSetRef {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ts := filecoin.TipSetRef{Key: key, Cids: []string{key}, Height: height}
+	if parent != "" {
+		ts.ParentKey = parent
+		ts.ParentCids = []string{parent}
+	}
+	c.tipsets[key] = ts
+	c.canonical[height] = key
+	return ts
+}
+
+func (c *fakeChain) ChainNotify(ctx context.Context) (<-chan []filecoin.HeadChange, error) {
+	return c.notifs, nil
+}
+
+func (c *fakeChain) GetTipSetByHeight(ctx context.Context, height int64) (*filecoin.TipSetRef, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for h := height; h >= 0; h-- {
+		if key, ok := c.canonical[h]; ok {
+			ts := c.tipsets[key]
+			return &ts, nil
+		}
+	}
+	return nil, fmt.Errorf("no tipset at or below height %d", height)
+}
+
+func (c *fakeChain) GetTipSet(ctx context.Context, cids []string) (*filecoin.TipSetRef, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ts, ok := c.tipsets[strings.Join(cids, ",")]
+	if !ok {
+		return nil, fmt.Errorf("unknown tipset %v", cids)
+	}
+	return &ts, nil
+}
+
+func (c *fakeChain) GetPublishedDeals(ctx context.Context, ts filecoin.TipSetRef, clients []string) ([]filecoin.PublishedDeal, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.published[ts.Key], nil
+}
+
+func (c *fakeChain) GetMarketDealsAt(ctx context.Context, ts filecoin.TipSetRef, dealIDs []int64) (map[int64]filecoin.MarketDealState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := make(map[int64]filecoin.MarketDealState)
+	for _, dealID := range dealIDs {
+		if state, ok := c.market[ts.Key][dealID]; ok {
+			result[dealID] = state
+		}
+	}
+	return result, nil
+}
+
+// fakeDealRepo keeps deals in memory. Methods the watcher does not use
+// panic through the nil embedded interface.
+type fakeDealRepo struct {
+	storage.FilecoinDealRepository
+	mu    sync.Mutex
+	deals map[uuid.UUID]*models.FilecoinDeal
+}
+
+func (r *fakeDealRepo) get(id uuid.UUID) models.FilecoinDeal {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return *r.deals[id]
+}
+
+func (r *fakeDealRepo) find(match func(*models.FilecoinDeal) bool) []*models.FilecoinDeal {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var deals []*models.FilecoinDeal
+	for _, deal := range r.deals {
+		if match(deal) {
+			copied := *deal
+			deals = append(deals, &copied)
+		}
+	}
+	sort.Slice(deals, func(i, j int) bool { return deals[i].ID.String() < deals[j].ID.String() })
+	return deals
+}
+
+func (r *fakeDealRepo) GetByID(ctx context.Context, id uuid.UUID) (*models.FilecoinDeal, error) {
+	deals := r.find(func(d *models.FilecoinDeal) bool { return d.ID == id })
+	if len(deals) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return deals[0], nil
+}
+
+func (r *fakeDealRepo) Update(ctx context.Context, deal *models.FilecoinDeal) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	copied := *deal
+	r.deals[deal.ID] = &copied
+	return nil
+}
+
+func (r *fakeDealRepo) GetByDealCIDs(ctx context.Context, dealCIDs []string) ([]*models.FilecoinDeal, error) {
+	return r.find(func(d *models.FilecoinDeal) bool {
+		for _, c := range dealCIDs {
+			if d.DealCID == c {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+func (r *fakeDealRepo) GetPublishedDeals(ctx context.Context) ([]*models.FilecoinDeal, error) {
+	return r.find(func(d *models.FilecoinDeal) bool { return d.Status == models.DealStatusPublished }), nil
+}
+
+func (r *fakeDealRepo) GetNextBatch(ctx context.Context, statuses []string, afterID uuid.UUID, limit int) ([]*models.FilecoinDeal, error) {
+	deals := r.find(func(d *models.FilecoinDeal) bool {
+		for _, s := range statuses {
+			if d.Status == s && d.ID.String() > afterID.String() {
+				return true
+			}
+		}
+		return false
+	})
+	if len(deals) > limit {
+		deals = deals[:limit]
+	}
+	return deals, nil
+}
+
+// fakeChainRepo keeps the checkpoint and events in memory
+type fakeChainRepo struct {
+	mu         sync.Mutex
+	checkpoint *models.ChainCheckpoint
+	events     []*models.ChainEvent
+}
+
+func (r *fakeChainRepo) GetCheckpoint(ctx context.Context, name string) (*models.ChainCheckpoint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.checkpoint == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	copied := *r.checkpoint
+	return &copied, nil
+}
+
+func (r *fakeChainRepo) SaveCheckpoint(ctx context.Context, checkpoint *models.ChainCheckpoint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	copied := *checkpoint
+	r.checkpoint = &copied
+	return nil
+}
+
+func (r *fakeChainRepo) CreateEvent(ctx context.Context, event *models.ChainEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	copied := *event
+	r.events = append(r.events, &copied)
+	return nil
+}
+
+// filter returns matching events, newest first
+func (r *fakeChainRepo) filter(match func(*models.ChainEvent) bool) []*models.ChainEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var events []*models.ChainEvent
+	for i := len(r.events) - 1; i >= 0; i-- {
+		if match(r.events[i]) {
+			copied := *r.events[i]
+			events = append(events, &copied)
+		}
+	}
+	return events
+}
+
+func (r *fakeChainRepo) GetEventsByTipSet(ctx context.Context, tipSetKey string) ([]*models.ChainEvent, error) {
+	return r.filter(func(e *models.ChainEvent) bool { return e.TipSetKey == tipSetKey }), nil
+}
+
+func (r *fakeChainRepo) GetEventsAboveHeight(ctx context.Context, height int64) ([]*models.ChainEvent, error) {
+	events := r.filter(func(e *models.ChainEvent) bool { return e.Height > height })
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Height > events[j].Height })
+	return events, nil
+}
+
+func (r *fakeChainRepo) DeleteEvents(ctx context.Context, ids []uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	deleted := make(map[uuid.UUID]bool, len(ids))
+	for _, id := range ids {
+		deleted[id] = true
+	}
+	kept := r.events[:0]
+	for _, event := range r.events {
+		if !deleted[event.ID] {
+			kept = append(kept, event)
+		}
+	}
+	r.events = kept
+	return nil
+}
+
+func (r *fakeChainRepo) PruneEvents(ctx context.Context, belowHeight int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	kept := r.events[:0]
+	for _, event := range r.events {
+		if event.Height >= belowHeight {
+			kept = append(kept, event)
+		}
+	}
+	r.events = kept
+	return nil
+}
+
+// watcherHarness runs a ChainWatcher against the fake chain. The repositories
+// outlive the watcher so it can be stopped and restarted.
+type watcherHarness struct {
+	chain     *fakeChain
+	deals     *fakeDealRepo
+	chainRepo *fakeChainRepo
+	cfg       *config.Config
+	cancel    context.CancelFunc
+	done      chan error
+}
+
+func newWatcherHarness(t *testing.T, deals ...*models.FilecoinDeal) *watcherHarness {
+	t.Helper()
+
+	h := &watcherHarness{
+		chain:     newFakeChain(),
+		deals:     &fakeDealRepo{deals: make(map[uuid.UUID]*models.FilecoinDeal)},
+		chainRepo: &fakeChainRepo{},
+		cfg:       &config.Config{},
+	}
+	for _, deal := range deals {
+		copied := *deal
+		h.deals.deals[deal.ID] = &copied
+	}
+
+	h.cfg.ChainWatch.Wallets = []string{"f1client"}
+	h.cfg.ChainWatch.ReorgDepth = 900
+	h.cfg.ChainWatch.ActiveBatchSize = 100
+	h.cfg.ChainWatch.EventsChannel = "deal_events"
+
+	t.Cleanup(h.stop)
+	return h
+}
+
+// start runs a new watcher on a fresh head change subscription
+func (h *watcherHarness) start(t *testing.T) {
+	t.Helper()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	// Nothing listens here; event publishing is best effort
+	redisClient := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialTimeout: 50 * time.Millisecond})
+	t.Cleanup(func() { redisClient.Close() })
+
+	h.chain.notifs = make(chan []filecoin.HeadChange)
+	watcher := NewChainWatcher(h.chain, h.deals, h.chainRepo, redisClient, h.cfg, logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- watcher.Run(ctx) }()
+	h.cancel, h.done = cancel, done
+}
+
+// stop cancels the running watcher and waits for it to return
+func (h *watcherHarness) stop() {
+	if h.cancel == nil {
+		return
+	}
+	h.cancel()
+	<-h.done
+	h.cancel, h.done = nil, nil
+}
+
+// send delivers head changes and waits until the watcher has handled them:
+// the subscription is unbuffered, so the empty batch that follows is only
+// received once the changes are processed
+func (h *watcherHarness) send(t *testing.T, changes ...filecoin.HeadChange) {
+	t.Helper()
+
+	for _, batch := range [][]filecoin.HeadChange{changes, nil} {
+		select {
+		case h.chain.notifs <- batch:
+		case err := <-h.done:
+			h.cancel = nil
+			t.Fatalf("watcher stopped: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out delivering head changes")
+		}
+	}
+}
+
+func (h *watcherHarness) checkpoint(t *testing.T) models.ChainCheckpoint {
+	t.Helper()
+
+	checkpoint, err := h.chainRepo.GetCheckpoint(context.Background(), chainWatcherCheckpoint)
+	if err != nil {
+		t.Fatalf("failed to get checkpoint: %v", err)
+	}
+	return *checkpoint
+}
+
+func applied(ts filecoin.TipSetRef) filecoin.HeadChange {
+	return filecoin.HeadChange{Type: filecoin.HeadChangeApply, TipSet: ts}
+}
+
+func reverted(ts filecoin.TipSetRef) filecoin.HeadChange {
+	return filecoin.HeadChange{Type: filecoin.HeadChangeRevert, TipSet: ts}
+}
+
+func current(ts filecoin.TipSetRef) filecoin.HeadChange {
+	return filecoin.HeadChange{Type: filecoin.HeadChangeCurrent, TipSet: ts}
+}
+
+func pendingDeal() *models.FilecoinDeal {
+	return &models.FilecoinDeal{
+		ID:           uuid.New(),
+		PinRequestID: uuid.New(),
+		DealCID:      "bafyproposal",
+		MinerID:      "f01000",
+		StartEpoch:   150,
+		EndEpoch:     1000,
+		Status:       models.DealStatusPending,
+	}
+}
+
+func assertDeal(t *testing.T, got models.FilecoinDeal, status string, dealID, startEpoch, endEpoch int64) {
+	t.Helper()
+
+	if got.Status != status || got.DealID != dealID || got.StartEpoch != startEpoch || got.EndEpoch != endEpoch {
+		t.Fatalf("deal = %s/%d epochs %d-%d, want %s/%d epochs %d-%d",
+			got.Status, got.DealID, got.StartEpoch, got.EndEpoch, status, dealID, startEpoch, endEpoch)
+	}
+}
+
+func assertCheckpoint(t *testing.T, got models.ChainCheckpoint, key string, height int64) {
+	t.Helper()
+
+	if got.TipSetKey != key || got.Height != height {
+		t.Fatalf("checkpoint = %s at %d, want %s at %d", got.TipSetKey, got.Height, key, height)
+	}
+}
+
+func TestChainWatcherRevertsDealsOnReorg(t *testing.T) {
+	deal := pendingDeal()
+	h := newWatcherHarness(t, deal)
+
+	// Height 10 is a null round, so ts11's parent is ts9
+	ts9 := h.chain.add("ts9", 9, "ts8")
+	ts11 := h.chain.add("ts11", 11, "ts9")
+	ts12 := h.chain.add("ts12", 12, "ts11")
+	h.chain.published["ts11"] = []filecoin.PublishedDeal{
+		{DealID: 4242, ProposalCID: "bafyproposal", StartEpoch: 200, EndEpoch: 1200},
+	}
+	h.chain.market["ts12"] = map[int64]filecoin.MarketDealState{
+		4242: {DealID: 4242, SectorStartEpoch: 12, SlashEpoch: -1},
+	}
+
+	h.start(t)
+	h.send(t, current(ts9))
+	assertCheckpoint(t, h.checkpoint(t), "ts9", 9)
+
+	h.send(t, applied(ts11), applied(ts12))
+	assertDeal(t, h.deals.get(deal.ID), models.DealStatusActive, 4242, 200, 1200)
+	assertCheckpoint(t, h.checkpoint(t), "ts12", 12)
+
+	// A competing fork replaces both tipsets and does not include the deal
+	fork11 := h.chain.add("fork11", 11, "ts9")
+
+	h.send(t, reverted(ts12))
+	assertDeal(t, h.deals.get(deal.ID), models.DealStatusPublished, 4242, 200, 1200)
+	assertCheckpoint(t, h.checkpoint(t), "ts11", 11)
+
+	h.send(t, reverted(ts11))
+	assertDeal(t, h.deals.get(deal.ID), models.DealStatusPending, 0, 150, 1000)
+	assertCheckpoint(t, h.checkpoint(t), "ts9", 9)
+	if events, _ := h.chainRepo.GetEventsAboveHeight(context.Background(), 0); len(events) != 0 {
+		t.Fatalf("%d events left after reverting, want 0", len(events))
+	}
+
+	h.send(t, applied(fork11))
+	assertDeal(t, h.deals.get(deal.ID), models.DealStatusPending, 0, 150, 1000)
+	assertCheckpoint(t, h.checkpoint(t), "fork11", 11)
+}
+
+func TestChainWatcherRewindsStaleCheckpoint(t *testing.T) {
+	deal := pendingDeal()
+	h := newWatcherHarness(t, deal)
+	h.cfg.ChainWatch.ReorgDepth = 3
+
+	ts4 := h.chain.add("ts4", 4, "ts3")
+	ts5 := h.chain.add("ts5", 5, "ts4")
+	ts6 := h.chain.add("ts6", 6, "ts5")
+	h.chain.published["ts5"] = []filecoin.PublishedDeal{
+		{DealID: 7, ProposalCID: "bafyproposal", StartEpoch: 300, EndEpoch: 1300},
+	}
+
+	h.start(t)
+	h.send(t, current(ts4), applied(ts5), applied(ts6))
+	assertDeal(t, h.deals.get(deal.ID), models.DealStatusPublished, 7, 300, 1300)
+	assertCheckpoint(t, h.checkpoint(t), "ts6", 6)
+	h.stop()
+
+	// While the watcher was down the chain reorged below its checkpoint
+	h.chain.add("alt5", 5, "ts4")
+	h.chain.add("alt6", 6, "alt5")
+	alt7 := h.chain.add("alt7", 7, "alt6")
+
+	h.start(t)
+	h.send(t, current(alt7))
+	assertDeal(t, h.deals.get(deal.ID), models.DealStatusPending, 0, 150, 1000)
+	assertCheckpoint(t, h.checkpoint(t), "alt7", 7)
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+// ContentService stores each CID once however many users pin it. A pinned
+// pin request holds a reference to its CID's content; pinning content that
+// is already stored only adds a reference and shares the deals made
+// through the first pin, and content is unpinned from IPFS once the last
+// reference is released.
+type ContentService struct {
+	nodePool       *NodePoolService
+	pricingService *PricingService
+	contentRepo    storage.ContentRepository
+	pinRepo        storage.PinRequestRepository
+	config         *config.Config
+	logger         *logrus.Logger
+}
+
+func NewContentService(nodePool *NodePoolService, pricingService *PricingService, contentRepo storage.ContentRepository, pinRepo storage.PinRequestRepository, cfg *config.Config, logger *logrus.Logger) *ContentService {
+	return &ContentService{
+		nodePool:       nodePool,
+		pricingService: pricingService,
+		contentRepo:    contentRepo,
+		pinRepo:        pinRepo,
+		config:         cfg,
+		logger:         logger,
+	}
+}
+
+// Share makes a pin reference its CID's content if another pin already
+// stores it, charging the stored content price when a discount is
+// configured. Cold pins can share content only stored on Filecoin. It
+// returns the content, or nil if the CID still needs to be pinned.
+func (s *ContentService) Share(ctx context.Context, pin *models.PinRequest) (*models.Content, error) {
+	statuses := []string{models.ContentStatusPinned}
+	if pin.Tier == models.TierCold {
+		statuses = append(statuses, models.ContentStatusCold)
+	}
+
+	content, err := s.contentRepo.Share(ctx, pin.ID, pin.CID, statuses)
+	if err != nil {
+		return nil, fmt.Errorf("failed to share content: %w", err)
+	}
+	if content == nil {
+		return nil, nil
+	}
+
+	if s.config.Pricing.StoredContentDiscountPercentage > 0 {
+		price := s.pricingService.CalculateStoredPriceFIL(s.pricingService.CalculatePinPriceFIL(pin, content.SizeBytes))
+		if err := s.pinRepo.SetPrice(ctx, pin.ID, price); err != nil {
+			s.logger.WithError(err).WithField("pin_id", pin.ID).Error("Failed to set stored content price")
+		}
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"pin_id":     pin.ID,
+		"cid":        pin.CID,
+		"references": content.RefCount,
+	}).Info("Content is already stored, sharing it")
+
+	return content, nil
+}
+
+// Attach records that a pin has pinned its CID's content
+func (s *ContentService) Attach(ctx context.Context, pin *models.PinRequest, sizeBytes int64) (*models.Content, error) {
+	content, err := s.contentRepo.Attach(ctx, pin.ID, pin.CID, sizeBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record content: %w", err)
+	}
+	return content, nil
+}
+
+// NeedsDeals reports whether deals must be made through a pin: its tier
+// stores content on Filecoin and it does not rely on deals made through
+// another pin of the same content
+func (s *ContentService) NeedsDeals(ctx context.Context, pinID uuid.UUID) (bool, error) {
+	pin, err := s.pinRepo.GetByID(ctx, pinID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get pin request: %w", err)
+	}
+	return pin.MakesDeals() && !pin.SharesDeals, nil
+}
+
+// Release drops a pin's reference to its content and unpins the content
+// from IPFS if no other pin references it. Releasing a pin without a
+// reference does nothing.
+func (s *ContentService) Release(ctx context.Context, pinID uuid.UUID) error {
+	content, err := s.contentRepo.Release(ctx, pinID)
+	if err != nil {
+		return fmt.Errorf("failed to release content: %w", err)
+	}
+	if content == nil {
+		return nil
+	}
+	if content.Status != models.ContentStatusUnpinning {
+		s.logger.WithFields(logrus.Fields{
+			"pin_id":     pinID,
+			"cid":        content.CID,
+			"references": content.RefCount,
+		}).Info("Content still referenced, keeping it pinned")
+		return nil
+	}
+
+	return s.unpin(ctx, content)
+}
+
+// unpin removes unreferenced content from IPFS. A pin may reference the
+// content again while it is being unpinned, in which case it is pinned
+// again.
+func (s *ContentService) unpin(ctx context.Context, content *models.Content) error {
+	if err := s.nodePool.Unpin(ctx, content.CID); err != nil {
+		return fmt.Errorf("failed to unpin content %s: %w", content.CID, err)
+	}
+
+	unpinned, err := s.contentRepo.FinishUnpin(ctx, content.ID)
+	if err != nil {
+		return fmt.Errorf("failed to mark content unpinned: %w", err)
+	}
+	if !unpinned {
+		if err := s.nodePool.Pin(ctx, content.CID); err != nil {
+			return fmt.Errorf("failed to pin content %s again: %w", content.CID, err)
+		}
+		return nil
+	}
+
+	s.logger.WithField("cid", content.CID).Info("Unpinned unreferenced content")
+	return nil
+}
+
+// Cool drops the IPFS copy of content that only cold pins reference, which
+// is then only stored on Filecoin. A pin of another tier may reference
+// the content while it is being unpinned, in which case it is pinned
+// again. It returns false if the content was not cooled.
+func (s *ContentService) Cool(ctx context.Context, content *models.Content) (bool, error) {
+	cooled, err := s.contentRepo.Cool(ctx, content.ID)
+	if err != nil {
+		return false, fmt.Errorf("failed to mark content cold: %w", err)
+	}
+	if !cooled {
+		return false, nil
+	}
+
+	if err := s.dropCold(ctx, content.CID); err != nil {
+		return false, err
+	}
+
+	s.logger.WithField("cid", content.CID).Info("Moved content to cold storage")
+	return true, nil
+}
+
+// DropRestored unpins cold content that was retrieved back into IPFS
+func (s *ContentService) DropRestored(ctx context.Context, content *models.Content) error {
+	if err := s.dropCold(ctx, content.CID); err != nil {
+		return err
+	}
+
+	s.logger.WithField("cid", content.CID).Info("Dropped restored copy of cold content")
+	return nil
+}
+
+// dropCold unpins cold content from IPFS, pinning it again if it is no
+// longer cold by the time it is unpinned
+func (s *ContentService) dropCold(ctx context.Context, cid string) error {
+	if err := s.nodePool.Unpin(ctx, cid); err != nil {
+		return fmt.Errorf("failed to unpin content %s: %w", cid, err)
+	}
+
+	content, err := s.contentRepo.GetByCID(ctx, cid)
+	if err != nil {
+		return fmt.Errorf("failed to get content: %w", err)
+	}
+	if content.Status == models.ContentStatusPinned {
+		if err := s.nodePool.Pin(ctx, cid); err != nil {
+			return fmt.Errorf("failed to pin content %s again: %w", cid, err)
+		}
+	}
+	return nil
+}
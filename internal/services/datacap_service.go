@@ -0,0 +1,190 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/filecoin"
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+// JobRefreshDataCap is the job that re-reads our DataCap from chain and
+// reconciles allocation usage with the verified deals made
+const JobRefreshDataCap = "refresh_datacap"
+
+const dataCapStatusKey = "datacap:status"
+
+// DataCapStatus is our verified client DataCap and how much of it is
+// promised to users
+type DataCapStatus struct {
+	Address          string    `json:"address"`
+	DataCapBytes     int64     `json:"datacap_bytes"`
+	AllocatedBytes   int64     `json:"allocated_bytes"`
+	UsedBytes        int64     `json:"used_bytes"`
+	UnallocatedBytes int64     `json:"unallocated_bytes"`
+	CheckedAt        time.Time `json:"checked_at"`
+}
+
+// DataCapService tracks the DataCap of our client address and the budgets
+// admins hand out from it. Verified deals spend a user's budget through the
+// DealMaker.
+type DataCapService struct {
+	lotusClient *filecoin.LotusClient
+	dataCapRepo storage.DataCapRepository
+	userRepo    storage.UserRepository
+	redisClient *redis.Client
+	config      *config.Config
+	logger      *logrus.Logger
+}
+
+func NewDataCapService(lotusClient *filecoin.LotusClient, dataCapRepo storage.DataCapRepository, userRepo storage.UserRepository, redisClient *redis.Client, cfg *config.Config, logger *logrus.Logger) *DataCapService {
+	return &DataCapService{
+		lotusClient: lotusClient,
+		dataCapRepo: dataCapRepo,
+		userRepo:    userRepo,
+		redisClient: redisClient,
+		config:      cfg,
+		logger:      logger,
+	}
+}
+
+// Enabled returns true if pins may ask for verified deals
+func (s *DataCapService) Enabled() bool {
+	return s.config.DataCap.Enabled
+}
+
+// Refresh reconciles allocation usage with the verified deals on record,
+// reads the client's remaining DataCap from chain and caches the result
+func (s *DataCapService) Refresh(ctx context.Context) (*DataCapStatus, error) {
+	if err := s.dataCapRepo.Reconcile(ctx); err != nil {
+		return nil, fmt.Errorf("failed to reconcile DataCap usage: %w", err)
+	}
+
+	dataCap, err := s.lotusClient.GetVerifiedClientStatus(ctx, s.config.Filecoin.WalletAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	allocations, err := s.dataCapRepo.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get allocations: %w", err)
+	}
+
+	status := &DataCapStatus{
+		Address:      s.config.Filecoin.WalletAddress,
+		DataCapBytes: dataCap,
+		CheckedAt:    time.Now(),
+	}
+	for _, allocation := range allocations {
+		status.AllocatedBytes += allocation.AllowanceBytes
+		status.UsedBytes += allocation.UsedBytes
+		status.UnallocatedBytes -= allocation.Remaining()
+	}
+	status.UnallocatedBytes += dataCap
+
+	if status.UnallocatedBytes < 0 {
+		s.logger.WithFields(logrus.Fields{
+			"datacap_bytes":     dataCap,
+			"unallocated_bytes": status.UnallocatedBytes,
+		}).Warn("DataCap allocations exceed the client's remaining DataCap")
+	}
+
+	err = s.redisClient.HSet(ctx, dataCapStatusKey, map[string]interface{}{
+		"address":           status.Address,
+		"datacap_bytes":     status.DataCapBytes,
+		"allocated_bytes":   status.AllocatedBytes,
+		"used_bytes":        status.UsedBytes,
+		"unallocated_bytes": status.UnallocatedBytes,
+		"checked_at":        status.CheckedAt.Format(time.RFC3339),
+	}).Err()
+	if err != nil {
+		s.logger.WithError(err).Warn("Failed to cache DataCap status")
+	}
+
+	return status, nil
+}
+
+// GetStatus returns the last refreshed DataCap status, refreshing it if
+// none is cached
+func (s *DataCapService) GetStatus(ctx context.Context) (*DataCapStatus, error) {
+	fields, err := s.redisClient.HGetAll(ctx, dataCapStatusKey).Result()
+	if err != nil || len(fields) == 0 {
+		return s.Refresh(ctx)
+	}
+
+	status := &DataCapStatus{Address: fields["address"]}
+	status.DataCapBytes, _ = strconv.ParseInt(fields["datacap_bytes"], 10, 64)
+	status.AllocatedBytes, _ = strconv.ParseInt(fields["allocated_bytes"], 10, 64)
+	status.UsedBytes, _ = strconv.ParseInt(fields["used_bytes"], 10, 64)
+	status.UnallocatedBytes, _ = strconv.ParseInt(fields["unallocated_bytes"], 10, 64)
+	status.CheckedAt, _ = time.Parse(time.RFC3339, fields["checked_at"])
+
+	return status, nil
+}
+
+// GetAllocation returns a user's DataCap budget. Users without one get an
+// empty allocation.
+func (s *DataCapService) GetAllocation(ctx context.Context, userID string) (*models.DataCapAllocation, error) {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID")
+	}
+
+	allocation, err := s.dataCapRepo.GetByUserID(ctx, userUUID)
+	if err != nil {
+		return &models.DataCapAllocation{UserID: userUUID}, nil
+	}
+	return allocation, nil
+}
+
+// ListAllocations returns every user's DataCap budget
+func (s *DataCapService) ListAllocations(ctx context.Context) ([]*models.DataCapAllocation, error) {
+	return s.dataCapRepo.List(ctx)
+}
+
+// SetAllocation sets a user's DataCap budget. The budgets still unspent
+// across all users may not exceed the DataCap left on chain.
+func (s *DataCapService) SetAllocation(ctx context.Context, userID uuid.UUID, allowanceBytes int64) (*models.DataCapAllocation, error) {
+	if !s.config.DataCap.Enabled {
+		return nil, fmt.Errorf("datacap is not enabled")
+	}
+
+	if _, err := s.userRepo.GetByID(ctx, userID); err != nil {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	status, err := s.Refresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the change in the user's unspent budget needs to be covered
+	current, err := s.GetAllocation(ctx, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	next := &models.DataCapAllocation{AllowanceBytes: allowanceBytes, UsedBytes: current.UsedBytes}
+	if increase := next.Remaining() - current.Remaining(); increase > 0 && increase > status.UnallocatedBytes {
+		return nil, fmt.Errorf("allocation exceeds available datacap")
+	}
+
+	allocation, err := s.dataCapRepo.SetAllowance(ctx, userID, allowanceBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set allocation: %w", err)
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"user_id":         userID,
+		"allowance_bytes": allowanceBytes,
+	}).Info("DataCap allocation updated")
+
+	return allocation, nil
+}
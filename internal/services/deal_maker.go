@@ -0,0 +1,420 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/filecoin"
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+const (
+	// dealStartBufferEpochs is how far ahead new deals are scheduled to start,
+	// matching the Lotus default of 49 hours
+	dealStartBufferEpochs = 49 * 120
+
+	// maxAskQueries bounds how many providers are queried when no candidate
+	// list is configured
+	maxAskQueries = 20
+)
+
+// ErrNoProviders is returned when no storage provider accepts a deal
+var ErrNoProviders = errors.New("no suitable storage providers found")
+
+// ErrNoDataCap is returned when a verified deal is not covered by the
+// user's DataCap allocation
+var ErrNoDataCap = errors.New("not enough DataCap for a verified deal")
+
+// ProviderCriteria describes the storage providers a deal can be made with
+type ProviderCriteria struct {
+	Preferred   []string // tried first, in order
+	Exclude     []string
+	PieceSize   int64
+	Verified    bool    // only providers storing verified deals for free
+	MaxPriceFIL float64 // per GiB per epoch, 0 for no limit
+	Count       int
+}
+
+// DealRequest describes a storage deal for existing pinned content. Deals
+// for one chunk of a split pin set ChunkID and carry the chunk's root and
+// size.
+type DealRequest struct {
+	PinRequest   *models.PinRequest
+	PayloadCID   string
+	ChunkID      *uuid.UUID
+	SizeBytes    int64
+	Ask          *filecoin.MinerAsk
+	StartEpoch   int64
+	DurationDays int
+	Verified     bool
+}
+
+// DealMaker selects storage providers and makes deals for content that is
+// already available over IPFS
+type DealMaker struct {
+	lotusClient *filecoin.LotusClient
+	dealRepo    storage.FilecoinDealRepository
+	dataCapRepo storage.DataCapRepository
+	transfers   *TransferService
+	config      *config.Config
+	logger      *logrus.Logger
+}
+
+func NewDealMaker(lotusClient *filecoin.LotusClient, dealRepo storage.FilecoinDealRepository, dataCapRepo storage.DataCapRepository, transfers *TransferService, cfg *config.Config, logger *logrus.Logger) *DealMaker {
+	return &DealMaker{
+		lotusClient: lotusClient,
+		dealRepo:    dealRepo,
+		dataCapRepo: dataCapRepo,
+		transfers:   transfers,
+		config:      cfg,
+		logger:      logger,
+	}
+}
+
+// CanMakeVerified returns true if the pin asked for verified deals and its
+// owner has DataCap left for one of the given payload size
+func (m *DealMaker) CanMakeVerified(ctx context.Context, pin *models.PinRequest, sizeBytes int64) bool {
+	if !m.config.DataCap.Enabled || !pin.Verified {
+		return false
+	}
+
+	allocation, err := m.dataCapRepo.GetByUserID(ctx, pin.UserID)
+	if err != nil {
+		return false
+	}
+
+	return allocation.Remaining() >= filecoin.PaddedPieceSize(sizeBytes)
+}
+
+// SelectProviders returns the asks of providers matching the criteria.
+// Preferred providers come first in the order given; the rest are ordered by
+// price.
+func (m *DealMaker) SelectProviders(ctx context.Context, criteria ProviderCriteria) ([]*filecoin.MinerAsk, error) {
+	if criteria.Count <= 0 {
+		criteria.Count = 1
+	}
+
+	seen := make(map[string]bool)
+	for _, minerID := range criteria.Exclude {
+		seen[minerID] = true
+	}
+
+	var selected []*filecoin.MinerAsk
+	for _, minerID := range criteria.Preferred {
+		if len(selected) >= criteria.Count {
+			return selected, nil
+		}
+		if seen[minerID] {
+			continue
+		}
+		seen[minerID] = true
+
+		if ask := m.queryAsk(ctx, minerID, criteria); ask != nil {
+			selected = append(selected, ask)
+		}
+	}
+
+	if len(selected) >= criteria.Count {
+		return selected, nil
+	}
+
+	candidates, err := m.candidateMiners(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var others []*filecoin.MinerAsk
+	for _, minerID := range candidates {
+		if seen[minerID] {
+			continue
+		}
+		seen[minerID] = true
+
+		if ask := m.queryAsk(ctx, minerID, criteria); ask != nil {
+			others = append(others, ask)
+		}
+	}
+
+	sort.Slice(others, func(i, j int) bool {
+		return askPrice(others[i], criteria.Verified) < askPrice(others[j], criteria.Verified)
+	})
+
+	for _, ask := range others {
+		if len(selected) >= criteria.Count {
+			break
+		}
+		selected = append(selected, ask)
+	}
+
+	if len(selected) == 0 {
+		return nil, ErrNoProviders
+	}
+
+	return selected, nil
+}
+
+// AggregateDealRequest describes a storage deal for an aggregate of pins.
+// Deal rows are recorded for Entries only, so a renewal or repair can cover
+// just the members still storing with the aggregate. DurationDays defaults
+// to the aggregate's.
+type AggregateDealRequest struct {
+	Aggregate    *models.Aggregate
+	Entries      []*models.AggregateEntry
+	Ask          *filecoin.MinerAsk
+	StartEpoch   int64
+	DurationDays int
+	Verified     bool
+}
+
+// proposal is a deal proposed to a provider
+type proposal struct {
+	dealCID    string
+	startEpoch int64
+	duration   int64
+	epochPrice float64
+}
+
+// MakeDeal proposes a deal to the provider in the request and records it as
+// pending
+func (m *DealMaker) MakeDeal(ctx context.Context, req DealRequest) (*models.FilecoinDeal, error) {
+	payloadCID := req.PayloadCID
+	if payloadCID == "" {
+		payloadCID = req.PinRequest.CID
+	}
+
+	sizeBytes := req.SizeBytes
+	if sizeBytes == 0 {
+		sizeBytes = req.PinRequest.SizeBytes
+	}
+
+	// Verified deals use up the piece size in DataCap once published
+	var dataCapBytes int64
+	if req.Verified {
+		dataCapBytes = filecoin.PaddedPieceSize(sizeBytes)
+		reserved, err := m.dataCapRepo.Reserve(ctx, req.PinRequest.UserID, dataCapBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reserve DataCap: %w", err)
+		}
+		if !reserved {
+			return nil, ErrNoDataCap
+		}
+	}
+
+	p, err := m.propose(ctx, payloadCID, sizeBytes, req.Ask, req.StartEpoch, req.DurationDays, req.Verified)
+	if err != nil {
+		if req.Verified {
+			if releaseErr := m.dataCapRepo.Release(ctx, req.PinRequest.UserID, dataCapBytes); releaseErr != nil {
+				m.logger.WithError(releaseErr).WithField("user_id", req.PinRequest.UserID).Error("Failed to release DataCap")
+			}
+		}
+		return nil, err
+	}
+
+	deal := &models.FilecoinDeal{
+		ID:           uuid.New(),
+		PinRequestID: req.PinRequest.ID,
+		ChunkID:      req.ChunkID,
+		DealCID:      p.dealCID,
+		MinerID:      req.Ask.MinerID,
+		StartEpoch:   p.startEpoch,
+		EndEpoch:     p.startEpoch + p.duration,
+		Status:       models.DealStatusPending,
+		StoragePrice: p.epochPrice * float64(p.duration),
+		Verified:     req.Verified,
+		DataCapBytes: dataCapBytes,
+	}
+
+	if err := m.dealRepo.Create(ctx, deal); err != nil {
+		return nil, fmt.Errorf("failed to record deal %s: %w", p.dealCID, err)
+	}
+
+	m.logger.WithFields(logrus.Fields{
+		"pin_request_id": req.PinRequest.ID,
+		"deal_cid":       p.dealCID,
+		"miner_id":       req.Ask.MinerID,
+		"start_epoch":    p.startEpoch,
+		"verified":       req.Verified,
+	}).Info("Started storage deal")
+
+	return deal, nil
+}
+
+// MakeAggregateDeal proposes one deal for a whole aggregate and records a
+// deal row for each member pin, carrying its share of the price, so every
+// pin sees the deal like one of its own
+func (m *DealMaker) MakeAggregateDeal(ctx context.Context, req AggregateDealRequest) ([]*models.FilecoinDeal, error) {
+	aggregate := req.Aggregate
+
+	durationDays := req.DurationDays
+	if durationDays == 0 {
+		durationDays = aggregate.DurationDays
+	}
+
+	p, err := m.propose(ctx, aggregate.RootCID, aggregate.SizeBytes, req.Ask, req.StartEpoch, durationDays, req.Verified)
+	if err != nil {
+		return nil, err
+	}
+
+	total := decimal.NewFromFloat(p.epochPrice).Mul(decimal.NewFromInt(p.duration))
+	deals := make([]*models.FilecoinDeal, len(req.Entries))
+	for i, entry := range req.Entries {
+		deals[i] = &models.FilecoinDeal{
+			ID:           uuid.New(),
+			PinRequestID: entry.PinRequestID,
+			AggregateID:  &aggregate.ID,
+			DealCID:      p.dealCID,
+			MinerID:      req.Ask.MinerID,
+			StartEpoch:   p.startEpoch,
+			EndEpoch:     p.startEpoch + p.duration,
+			Status:       models.DealStatusPending,
+			StoragePrice: shareOf(total, entry.SizeBytes, aggregate.SizeBytes).InexactFloat64(),
+		}
+	}
+
+	if err := m.dealRepo.CreateBatch(ctx, deals); err != nil {
+		return nil, fmt.Errorf("failed to record deal %s: %w", p.dealCID, err)
+	}
+
+	m.logger.WithFields(logrus.Fields{
+		"aggregate_id": aggregate.ID,
+		"entries":      len(req.Entries),
+		"deal_cid":     p.dealCID,
+		"miner_id":     req.Ask.MinerID,
+		"start_epoch":  p.startEpoch,
+	}).Info("Started aggregate storage deal")
+
+	return deals, nil
+}
+
+// propose starts a deal with a provider for content already reachable over
+// IPFS, enforcing the minimum start delay and duration
+func (m *DealMaker) propose(ctx context.Context, payloadCID string, sizeBytes int64, ask *filecoin.MinerAsk, startEpoch int64, durationDays int, verified bool) (*proposal, error) {
+	currentEpoch, err := m.lotusClient.GetCurrentEpoch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current epoch: %w", err)
+	}
+
+	if startEpoch < currentEpoch+dealStartBufferEpochs {
+		startEpoch = currentEpoch + dealStartBufferEpochs
+	}
+
+	duration := int64(durationDays) * filecoin.EpochsPerDay
+	if duration < m.config.Filecoin.MinDealDuration {
+		duration = m.config.Filecoin.MinDealDuration
+	}
+
+	// Asks are priced per GiB per epoch
+	sizeGiB := float64(sizeBytes) / (1024 * 1024 * 1024)
+	epochPrice := askPrice(ask, verified) * sizeGiB
+
+	params := filecoin.StartDealParams{
+		PayloadCID:   payloadCID,
+		MinerID:      ask.MinerID,
+		Duration:     duration,
+		StartEpoch:   startEpoch,
+		PriceFIL:     epochPrice,
+		WalletAddr:   m.config.Filecoin.WalletAddress,
+		VerifiedDeal: verified,
+	}
+
+	var staged *StagedPayload
+	if m.transfers.Manual() {
+		staged, err = m.transfers.Prepare(ctx, payloadCID)
+		if err != nil {
+			return nil, err
+		}
+		params.ManualTransfer = true
+		params.PieceCID = staged.PieceCID
+		params.PieceSize = staged.PieceSize
+	}
+
+	dealCID, err := m.lotusClient.StartDeal(ctx, params)
+	if err != nil {
+		if staged != nil {
+			m.transfers.Discard(ctx, payloadCID)
+		}
+		return nil, err
+	}
+
+	if staged != nil {
+		// The deal stands even if the provider cannot be told where to get
+		// the data; it fails on its own if the data never arrives
+		if _, err := m.transfers.Register(ctx, dealCID, ask.MinerID, staged); err != nil {
+			m.logger.WithError(err).WithField("deal_cid", dealCID).Error("Failed to register deal transfer")
+		}
+	}
+
+	return &proposal{
+		dealCID:    dealCID,
+		startEpoch: startEpoch,
+		duration:   duration,
+		epochPrice: epochPrice,
+	}, nil
+}
+
+// queryAsk returns the provider's ask if it accepts the deal, nil otherwise
+func (m *DealMaker) queryAsk(ctx context.Context, minerID string, criteria ProviderCriteria) *filecoin.MinerAsk {
+	ask, err := m.lotusClient.GetMinerAsk(ctx, minerID)
+	if err != nil {
+		m.logger.WithError(err).WithField("miner_id", minerID).Debug("Failed to query storage ask")
+		return nil
+	}
+
+	if criteria.PieceSize > 0 {
+		if criteria.PieceSize < ask.MinPieceSize || (ask.MaxPieceSize > 0 && criteria.PieceSize > ask.MaxPieceSize) {
+			return nil
+		}
+	}
+	if criteria.MaxPriceFIL > 0 && askPrice(ask, criteria.Verified) > criteria.MaxPriceFIL {
+		return nil
+	}
+	if criteria.Verified && ask.VerifiedPriceFIL > 0 {
+		return nil
+	}
+
+	return ask
+}
+
+// candidateMiners returns the configured candidate providers, falling back
+// to the largest miners on chain
+func (m *DealMaker) candidateMiners(ctx context.Context) ([]string, error) {
+	if len(m.config.Filecoin.CandidateMiners) > 0 {
+		return m.config.Filecoin.CandidateMiners, nil
+	}
+
+	miners, err := m.lotusClient.GetAvailableMiners(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(miners, func(i, j int) bool {
+		return miners[i].Power > miners[j].Power
+	})
+
+	var ids []string
+	for _, miner := range miners {
+		if len(ids) >= maxAskQueries {
+			break
+		}
+		if miner.Available && miner.Power > 0 {
+			ids = append(ids, miner.ID)
+		}
+	}
+
+	return ids, nil
+}
+
+func askPrice(ask *filecoin.MinerAsk, verified bool) float64 {
+	if verified {
+		return ask.VerifiedPriceFIL
+	}
+	return ask.PriceFIL
+}
@@ -0,0 +1,538 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gocraft/work"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/filecoin"
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+// Job names used to fan out deal monitoring batches
+const (
+	JobMonitorDealBatch         = "monitor_deal_batch"
+	JobMonitorDealBatchPriority = "monitor_deal_batch_priority"
+)
+
+const (
+	dealMonitorLatestKey = "deal_monitor:latest"
+	dealMonitorSweepKey  = "deal_monitor:sweep:%s"
+	dealMonitorChainKey  = "deal_monitor:sweep:%s:chain"
+)
+
+// SweepProgress reports how far a monitoring sweep has got
+type SweepProgress struct {
+	SweepID          string     `json:"sweep_id"`
+	Epoch            int64      `json:"epoch"`
+	StartedAt        time.Time  `json:"started_at"`
+	FinishedAt       *time.Time `json:"finished_at,omitempty"`
+	TotalBatches     int64      `json:"total_batches"`
+	CompletedBatches int64      `json:"completed_batches"`
+	FailedBatches    int64      `json:"failed_batches"`
+	DealsChecked     int64      `json:"deals_checked"`
+	DealsChanged     int64      `json:"deals_changed"`
+	DealsExpired     int64      `json:"deals_expired"`
+	RPCCalls         int64      `json:"rpc_calls"`
+	Snapshot         bool       `json:"snapshot"`
+}
+
+// DealMonitor tracks on-chain state of our deals. A sweep partitions deals
+// into ID-range batches and fans them out as jobs; deals awaiting activation
+// are enqueued on a higher priority queue since they change state soonest.
+type DealMonitor struct {
+	lotusClient *filecoin.LotusClient
+	dealRepo    storage.FilecoinDealRepository
+	redisClient *redis.Client
+	enqueuer    *work.Enqueuer
+	config      *config.Config
+	logger      *logrus.Logger
+	lotusSem    chan struct{}
+}
+
+func NewDealMonitor(lotusClient *filecoin.LotusClient, dealRepo storage.FilecoinDealRepository, redisClient *redis.Client, enqueuer *work.Enqueuer, cfg *config.Config, logger *logrus.Logger) *DealMonitor {
+	concurrency := cfg.Monitor.LotusConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return &DealMonitor{
+		lotusClient: lotusClient,
+		dealRepo:    dealRepo,
+		redisClient: redisClient,
+		enqueuer:    enqueuer,
+		config:      cfg,
+		logger:      logger,
+		lotusSem:    make(chan struct{}, concurrency),
+	}
+}
+
+// StartSweep begins a new monitoring sweep and enqueues its batch jobs
+func (m *DealMonitor) StartSweep(ctx context.Context) (*SweepProgress, error) {
+	epoch, err := m.lotusClient.GetCurrentEpoch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	progress := &SweepProgress{
+		SweepID:   uuid.New().String(),
+		Epoch:     epoch,
+		StartedAt: time.Now().UTC(),
+	}
+
+	// Expiry is fully determined by the end epoch, no RPC needed
+	expired, err := m.dealRepo.MarkExpired(ctx, epoch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mark expired deals: %w", err)
+	}
+	progress.DealsExpired = expired
+
+	if m.config.Monitor.UseMarketSnapshot {
+		calls, err := m.storeSnapshot(ctx, progress.SweepID)
+		progress.RPCCalls += calls
+		if err != nil {
+			// Batches fall back to per-deal lookups
+			m.logger.WithError(err).Warn("Failed to snapshot market deals")
+		} else {
+			progress.Snapshot = true
+		}
+	}
+
+	priorityStatuses := []string{models.DealStatusPending, models.DealStatusPublished}
+	activeStatuses := []string{models.DealStatusActive}
+
+	priorityBatches, err := m.planBatches(ctx, priorityStatuses)
+	if err != nil {
+		return nil, err
+	}
+	activeBatches, err := m.planBatches(ctx, activeStatuses)
+	if err != nil {
+		return nil, err
+	}
+	progress.TotalBatches = int64(len(priorityBatches) + len(activeBatches))
+
+	if err := m.saveProgress(ctx, progress); err != nil {
+		return nil, err
+	}
+
+	for _, batch := range priorityBatches {
+		if err := m.enqueueBatch(JobMonitorDealBatchPriority, progress.SweepID, priorityStatuses, batch); err != nil {
+			return nil, err
+		}
+	}
+	for _, batch := range activeBatches {
+		if err := m.enqueueBatch(JobMonitorDealBatch, progress.SweepID, activeStatuses, batch); err != nil {
+			return nil, err
+		}
+	}
+
+	m.logger.WithFields(logrus.Fields{
+		"sweep_id":      progress.SweepID,
+		"epoch":         epoch,
+		"batches":       progress.TotalBatches,
+		"deals_expired": expired,
+		"snapshot":      progress.Snapshot,
+	}).Info("Deal monitoring sweep started")
+
+	return progress, nil
+}
+
+// ProcessBatch checks every deal in (afterID, untilID] with the given
+// statuses and records any state changes. A batch whose sweep or deals
+// cannot be loaded is counted as failed and completed rather than retried,
+// so the sweep still finishes; its deals are checked again by the next
+// sweep.
+func (m *DealMonitor) ProcessBatch(ctx context.Context, sweepID string, statuses []string, afterID, untilID uuid.UUID) error {
+	progress, err := m.GetSweepProgress(ctx, sweepID)
+	if err != nil {
+		m.logger.WithError(err).WithField("sweep_id", sweepID).Error("Failed to load sweep progress")
+		m.incr(ctx, sweepID, "failed_batches", 1)
+		m.completeBatch(ctx, sweepID)
+		return nil
+	}
+
+	deals, err := m.dealRepo.GetBatch(ctx, statuses, afterID, untilID)
+	if err != nil {
+		m.logger.WithError(err).WithField("sweep_id", sweepID).Error("Failed to load deal batch")
+		m.incr(ctx, sweepID, "failed_batches", 1)
+		m.completeBatch(ctx, sweepID)
+		return nil
+	}
+
+	var snapshot map[int64]*filecoin.MarketDealState
+	if progress.Snapshot {
+		snapshot, err = m.loadSnapshot(ctx, sweepID, deals)
+		if err != nil {
+			m.logger.WithError(err).WithField("sweep_id", sweepID).Warn("Failed to load market snapshot, falling back to per-deal lookups")
+		}
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		changed  int64
+		rpcCalls int64
+		checked  = make([]uuid.UUID, 0, len(deals))
+	)
+
+	for _, deal := range deals {
+		if !deal.IsOnChain() && deal.DealCID == "" {
+			continue
+		}
+
+		if state, ok := snapshot[deal.DealID]; ok && deal.IsOnChain() {
+			if m.applyMarketState(deal, state, progress.Epoch) {
+				if err := m.dealRepo.Update(ctx, deal); err != nil {
+					m.logger.WithError(err).WithField("deal_id", deal.ID).Error("Failed to update deal")
+					continue
+				}
+				changed++
+			}
+			checked = append(checked, deal.ID)
+			continue
+		}
+
+		wg.Add(1)
+		go func(deal *models.FilecoinDeal) {
+			defer wg.Done()
+
+			m.lotusSem <- struct{}{}
+			isChanged, calls, err := m.checkDeal(ctx, deal, progress.Epoch)
+			<-m.lotusSem
+
+			mu.Lock()
+			defer mu.Unlock()
+			rpcCalls += calls
+			if err != nil {
+				m.logger.WithError(err).WithField("deal_id", deal.ID).Warn("Failed to check deal")
+				return
+			}
+			if isChanged {
+				if err := m.dealRepo.Update(ctx, deal); err != nil {
+					m.logger.WithError(err).WithField("deal_id", deal.ID).Error("Failed to update deal")
+					return
+				}
+				changed++
+			}
+			checked = append(checked, deal.ID)
+		}(deal)
+	}
+	wg.Wait()
+
+	if err := m.dealRepo.TouchChecked(ctx, checked, time.Now().UTC()); err != nil {
+		m.logger.WithError(err).Warn("Failed to record deal check time")
+	}
+
+	m.incr(ctx, sweepID, "deals_checked", int64(len(checked)))
+	m.incr(ctx, sweepID, "deals_changed", changed)
+	m.incr(ctx, sweepID, "rpc_calls", rpcCalls)
+	m.completeBatch(ctx, sweepID)
+
+	return nil
+}
+
+// GetSweepProgress returns metrics for a sweep
+func (m *DealMonitor) GetSweepProgress(ctx context.Context, sweepID string) (*SweepProgress, error) {
+	fields, err := m.redisClient.HGetAll(ctx, fmt.Sprintf(dealMonitorSweepKey, sweepID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sweep progress: %w", err)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("sweep not found")
+	}
+
+	progress := &SweepProgress{SweepID: sweepID}
+	progress.Epoch, _ = strconv.ParseInt(fields["epoch"], 10, 64)
+	progress.TotalBatches, _ = strconv.ParseInt(fields["total_batches"], 10, 64)
+	progress.CompletedBatches, _ = strconv.ParseInt(fields["completed_batches"], 10, 64)
+	progress.FailedBatches, _ = strconv.ParseInt(fields["failed_batches"], 10, 64)
+	progress.DealsChecked, _ = strconv.ParseInt(fields["deals_checked"], 10, 64)
+	progress.DealsChanged, _ = strconv.ParseInt(fields["deals_changed"], 10, 64)
+	progress.DealsExpired, _ = strconv.ParseInt(fields["deals_expired"], 10, 64)
+	progress.RPCCalls, _ = strconv.ParseInt(fields["rpc_calls"], 10, 64)
+	progress.Snapshot = fields["snapshot"] == "1"
+	progress.StartedAt, _ = time.Parse(time.RFC3339, fields["started_at"])
+	if finished, err := time.Parse(time.RFC3339, fields["finished_at"]); err == nil {
+		progress.FinishedAt = &finished
+	}
+
+	return progress, nil
+}
+
+// GetLatestSweepProgress returns metrics for the most recently started sweep
+func (m *DealMonitor) GetLatestSweepProgress(ctx context.Context) (*SweepProgress, error) {
+	sweepID, err := m.redisClient.Get(ctx, dealMonitorLatestKey).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("sweep not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest sweep: %w", err)
+	}
+	return m.GetSweepProgress(ctx, sweepID)
+}
+
+// checkDeal refreshes a single deal with per-deal RPCs. It returns whether
+// the deal changed and how many RPCs were made.
+func (m *DealMonitor) checkDeal(ctx context.Context, deal *models.FilecoinDeal, epoch int64) (bool, int64, error) {
+	var calls int64
+	changed := false
+
+	if !deal.IsOnChain() {
+		calls++
+		info, err := m.lotusClient.GetDealInfo(ctx, deal.DealCID)
+		if err != nil {
+			return false, calls, err
+		}
+		if info.Failed {
+			deal.Status = models.DealStatusFailed
+			return true, calls, nil
+		}
+		if info.DealID == 0 {
+			return false, calls, nil
+		}
+		deal.DealID = info.DealID
+		changed = true
+	}
+
+	calls++
+	state, err := m.lotusClient.GetMarketDeal(ctx, deal.DealID)
+	if err != nil {
+		// The market actor drops deals once they are expired or slashed
+		if deal.IsActive() {
+			if deal.EndEpoch <= epoch {
+				deal.Status = models.DealStatusExpired
+			} else {
+				deal.Status = models.DealStatusSlashed
+			}
+			return true, calls, nil
+		}
+		return changed, calls, err
+	}
+
+	return m.applyMarketState(deal, state, epoch) || changed, calls, nil
+}
+
+// applyMarketState maps on-chain deal state onto our deal record and
+// returns true if anything changed
+func (m *DealMonitor) applyMarketState(deal *models.FilecoinDeal, state *filecoin.MarketDealState, epoch int64) bool {
+	status := models.DealStatusPublished
+	switch {
+	case state.SlashEpoch >= 0:
+		status = models.DealStatusSlashed
+	case state.EndEpoch <= epoch:
+		status = models.DealStatusExpired
+	case state.SectorStartEpoch >= 0:
+		status = models.DealStatusActive
+	}
+
+	changed := deal.Status != status || deal.StartEpoch != state.StartEpoch || deal.EndEpoch != state.EndEpoch
+	deal.Status = status
+	deal.StartEpoch = state.StartEpoch
+	deal.EndEpoch = state.EndEpoch
+	return changed
+}
+
+// dealBatch is an ID range (AfterID, UntilID] of deals to check
+type dealBatch struct {
+	AfterID uuid.UUID
+	UntilID uuid.UUID
+}
+
+// planBatches splits deals with the given statuses into ID ranges of at
+// most BatchSize deals. The last range is open-ended.
+func (m *DealMonitor) planBatches(ctx context.Context, statuses []string) ([]dealBatch, error) {
+	boundaries, err := m.dealRepo.GetBatchBoundaries(ctx, statuses, m.config.Monitor.BatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to plan deal batches: %w", err)
+	}
+
+	batches := make([]dealBatch, 0, len(boundaries)+1)
+	after := uuid.Nil
+	for _, until := range boundaries {
+		batches = append(batches, dealBatch{AfterID: after, UntilID: until})
+		after = until
+	}
+	return append(batches, dealBatch{AfterID: after}), nil
+}
+
+func (m *DealMonitor) enqueueBatch(jobName string, sweepID string, statuses []string, batch dealBatch) error {
+	_, err := m.enqueuer.Enqueue(jobName, map[string]interface{}{
+		"sweep_id": sweepID,
+		"statuses": strings.Join(statuses, ","),
+		"after_id": batch.AfterID.String(),
+		"until_id": batch.UntilID.String(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enqueue deal batch: %w", err)
+	}
+	return nil
+}
+
+// storeSnapshot fetches the market state of every deal as of the current
+// head in one StateMarketDeals call and stores the state of our on-chain
+// deals in Redis for batch jobs to read, so every batch of the sweep sees
+// the same chain state without an RPC per deal. Our deals are read a batch
+// at a time and each batch is written out before the next is read. It
+// returns the number of RPCs made.
+func (m *DealMonitor) storeSnapshot(ctx context.Context, sweepID string) (int64, error) {
+	head, err := m.lotusClient.GetChainHead(ctx)
+	if err != nil {
+		return 1, err
+	}
+
+	m.lotusSem <- struct{}{}
+	states, err := m.lotusClient.GetAllMarketDeals(ctx, *head)
+	<-m.lotusSem
+	if err != nil {
+		return 2, err
+	}
+
+	key := fmt.Sprintf(dealMonitorChainKey, sweepID)
+	statuses := []string{models.DealStatusPublished, models.DealStatusActive}
+	afterID := uuid.Nil
+	for {
+		deals, err := m.dealRepo.GetNextBatch(ctx, statuses, afterID, m.config.Monitor.BatchSize)
+		if err != nil {
+			return 2, fmt.Errorf("failed to get deals: %w", err)
+		}
+		if len(deals) == 0 {
+			break
+		}
+		afterID = deals[len(deals)-1].ID
+
+		// Deals missing from the market actor are left for their batch to
+		// look up individually
+		values := make(map[string]interface{}, len(deals))
+		for _, deal := range deals {
+			state, ok := states[deal.DealID]
+			if !deal.IsOnChain() || !ok {
+				continue
+			}
+			encoded, err := json.Marshal(state)
+			if err != nil {
+				return 2, err
+			}
+			values[strconv.FormatInt(deal.DealID, 10)] = encoded
+		}
+		if len(values) > 0 {
+			if err := m.redisClient.HSet(ctx, key, values).Err(); err != nil {
+				return 2, err
+			}
+		}
+	}
+
+	return 2, m.redisClient.Expire(ctx, key, m.config.Monitor.SnapshotTTL).Err()
+}
+
+func (m *DealMonitor) loadSnapshot(ctx context.Context, sweepID string, deals []*models.FilecoinDeal) (map[int64]*filecoin.MarketDealState, error) {
+	var fields []string
+	for _, deal := range deals {
+		if deal.IsOnChain() {
+			fields = append(fields, strconv.FormatInt(deal.DealID, 10))
+		}
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	values, err := m.redisClient.HMGet(ctx, fmt.Sprintf(dealMonitorChainKey, sweepID), fields...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := make(map[int64]*filecoin.MarketDealState, len(values))
+	for _, value := range values {
+		encoded, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var state filecoin.MarketDealState
+		if err := json.Unmarshal([]byte(encoded), &state); err != nil {
+			continue
+		}
+		snapshot[state.DealID] = &state
+	}
+
+	return snapshot, nil
+}
+
+func (m *DealMonitor) saveProgress(ctx context.Context, progress *SweepProgress) error {
+	key := fmt.Sprintf(dealMonitorSweepKey, progress.SweepID)
+	snapshot := "0"
+	if progress.Snapshot {
+		snapshot = "1"
+	}
+
+	pipe := m.redisClient.Pipeline()
+	pipe.HSet(ctx, key, map[string]interface{}{
+		"epoch":             progress.Epoch,
+		"started_at":        progress.StartedAt.Format(time.RFC3339),
+		"total_batches":     progress.TotalBatches,
+		"completed_batches": 0,
+		"failed_batches":    0,
+		"deals_checked":     0,
+		"deals_changed":     0,
+		"deals_expired":     progress.DealsExpired,
+		"rpc_calls":         progress.RPCCalls,
+		"snapshot":          snapshot,
+	})
+	pipe.Expire(ctx, key, 7*24*time.Hour)
+	pipe.Set(ctx, dealMonitorLatestKey, progress.SweepID, 7*24*time.Hour)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save sweep progress: %w", err)
+	}
+	return nil
+}
+
+func (m *DealMonitor) incr(ctx context.Context, sweepID, field string, value int64) {
+	if value == 0 {
+		return
+	}
+	if err := m.redisClient.HIncrBy(ctx, fmt.Sprintf(dealMonitorSweepKey, sweepID), field, value).Err(); err != nil {
+		m.logger.WithError(err).WithField("sweep_id", sweepID).Warn("Failed to update sweep progress")
+	}
+}
+
+// completeBatch counts a finished batch and closes out the sweep once every
+// batch has reported in
+func (m *DealMonitor) completeBatch(ctx context.Context, sweepID string) {
+	key := fmt.Sprintf(dealMonitorSweepKey, sweepID)
+	completed, err := m.redisClient.HIncrBy(ctx, key, "completed_batches", 1).Result()
+	if err != nil {
+		m.logger.WithError(err).WithField("sweep_id", sweepID).Warn("Failed to update sweep progress")
+		return
+	}
+
+	total, err := m.redisClient.HGet(ctx, key, "total_batches").Int64()
+	if err != nil || completed < total {
+		return
+	}
+
+	m.redisClient.HSet(ctx, key, "finished_at", time.Now().UTC().Format(time.RFC3339))
+	m.redisClient.Del(ctx, fmt.Sprintf(dealMonitorChainKey, sweepID))
+
+	if progress, err := m.GetSweepProgress(ctx, sweepID); err == nil {
+		m.logger.WithFields(logrus.Fields{
+			"sweep_id":       sweepID,
+			"batches":        progress.TotalBatches,
+			"failed_batches": progress.FailedBatches,
+			"deals_checked":  progress.DealsChecked,
+			"deals_changed":  progress.DealsChanged,
+			"deals_expired":  progress.DealsExpired,
+			"rpc_calls":      progress.RPCCalls,
+			"duration":       time.Since(progress.StartedAt),
+		}).Info("Deal monitoring sweep completed")
+	}
+}
@@ -0,0 +1,336 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"pinning-service/internal/filecoin"
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+// JobProcessExpiry is the job that warns about, expires and releases pins
+// whose storage is ending
+const JobProcessExpiry = "process_expiry"
+
+// Extension is the outcome of extending a pin's hot storage
+type Extension struct {
+	PinRequestID uuid.UUID       `json:"pin_request_id"`
+	Days         int             `json:"days"`
+	ExpiresAt    time.Time       `json:"expires_at"`
+	PriceFIL     decimal.Decimal `json:"price_fil"`
+}
+
+// ExpiryService enforces how long pins are kept. Hot storage on IPFS ends
+// at a pin's expires_at, set when it is pinned, and Filecoin storage ends
+// with the pin's last deal; users are warned ahead of both. A pin whose
+// hot storage ends is extended when its auto-renew preferences ask for it
+// and the user can pay, and expired otherwise. Expired pins keep their
+// content for a grace period, during which they can still be extended,
+// then release it. Pins under legal hold never expire.
+type ExpiryService struct {
+	lotusClient    *filecoin.LotusClient
+	contentService *ContentService
+	pricingService *PricingService
+	notifications  *NotificationService
+	pinRepo        storage.PinRequestRepository
+	ledgerRepo     storage.LedgerRepository
+	config         *config.Config
+	logger         *logrus.Logger
+}
+
+func NewExpiryService(
+	lotusClient *filecoin.LotusClient,
+	contentService *ContentService,
+	pricingService *PricingService,
+	notifications *NotificationService,
+	pinRepo storage.PinRequestRepository,
+	ledgerRepo storage.LedgerRepository,
+	cfg *config.Config,
+	logger *logrus.Logger,
+) *ExpiryService {
+	return &ExpiryService{
+		lotusClient:    lotusClient,
+		contentService: contentService,
+		pricingService: pricingService,
+		notifications:  notifications,
+		pinRepo:        pinRepo,
+		ledgerRepo:     ledgerRepo,
+		config:         cfg,
+		logger:         logger,
+	}
+}
+
+// ProcessExpiry refreshes when each pin's deals end, warns users whose
+// storage ends within the notice period, expires pins whose hot storage
+// has ended and releases the content of pins expired for longer than the
+// grace period
+func (s *ExpiryService) ProcessExpiry(ctx context.Context) error {
+	now := time.Now().UTC()
+
+	if epoch, err := s.lotusClient.GetCurrentEpoch(ctx); err != nil {
+		s.logger.WithError(err).Warn("Failed to get current epoch, deal expiry not refreshed")
+	} else if err := s.pinRepo.RefreshDealsExpiry(ctx, epoch, now); err != nil {
+		s.logger.WithError(err).Warn("Failed to refresh deal expiry")
+	}
+
+	notice := now.AddDate(0, 0, s.config.Expiry.NoticeDays)
+	expired := 0
+	afterID := uuid.Nil
+	for {
+		pins, err := s.pinRepo.GetNextExpiring(ctx, notice, afterID, s.config.Expiry.BatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to get expiring pins: %w", err)
+		}
+		if len(pins) == 0 {
+			break
+		}
+
+		for _, pin := range pins {
+			if pin.ExpiresAt != nil && !pin.ExpiresAt.After(now) {
+				if s.expire(ctx, pin, now) {
+					expired++
+				}
+				continue
+			}
+			s.warn(ctx, pin, now)
+		}
+		afterID = pins[len(pins)-1].ID
+	}
+
+	released, err := s.releaseExpired(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"expired":  expired,
+		"released": released,
+	}).Info("Expiry run completed")
+
+	return nil
+}
+
+// Extend adds days to the hot storage of one of the user's pins, charging
+// for them. Expired pins can be extended until their content is released
+// and are extended from now.
+func (s *ExpiryService) Extend(ctx context.Context, pinID uuid.UUID, userID string, days int) (*Extension, error) {
+	pin, err := s.pinRepo.GetByID(ctx, pinID)
+	if err != nil || pin.UserID.String() != userID {
+		return nil, fmt.Errorf("pin request not found")
+	}
+	if !pin.CanBeExtended() {
+		return nil, fmt.Errorf("pin cannot be extended")
+	}
+
+	extension, err := s.extend(ctx, pin, days, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	s.notify(ctx, pin.UserID, models.NotificationPinExtended, fmt.Sprintf("extended:%s:%d", pin.ID, extension.ExpiresAt.Unix()),
+		fmt.Sprintf("Storage of %s was extended by %d days until %s", pin.DisplayCID(), days, extension.ExpiresAt.Format("2006-01-02")),
+		map[string]interface{}{"pin_request_id": pin.ID, "cid": pin.CID, "expires_at": extension.ExpiresAt, "price_fil": extension.PriceFIL})
+
+	return extension, nil
+}
+
+// SetLegalHold places or lifts a legal hold on a pin. Held pins neither
+// expire nor lose their content.
+func (s *ExpiryService) SetLegalHold(ctx context.Context, pinID uuid.UUID, hold bool, reason string) (*models.PinRequest, error) {
+	if err := s.pinRepo.SetLegalHold(ctx, pinID, hold, reason); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("pin request not found")
+		}
+		return nil, fmt.Errorf("failed to set legal hold: %w", err)
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"pin_id": pinID,
+		"hold":   hold,
+	}).Info("Legal hold changed")
+
+	return s.pinRepo.GetByID(ctx, pinID)
+}
+
+// extend charges for and applies an extension of a pin's hot storage. The
+// charge is keyed on the expiry being extended, so a retried extension
+// charges once, and refunded if a concurrent extension got there first.
+func (s *ExpiryService) extend(ctx context.Context, pin *models.PinRequest, days int, now time.Time) (*Extension, error) {
+	from := *pin.ExpiresAt
+	start := from
+	if start.Before(now) {
+		start = now
+	}
+	to := start.AddDate(0, 0, days)
+	price := s.price(pin, start, days)
+
+	key := fmt.Sprintf("extension:%s:%d:%d", pin.ID, from.UnixNano(), days)
+	charged, err := s.ledgerRepo.Charge(ctx, &models.LedgerEntry{
+		ID:             uuid.New(),
+		UserID:         pin.UserID,
+		PinRequestID:   &pin.ID,
+		Category:       models.LedgerCategoryExtension,
+		AmountFIL:      price,
+		Description:    fmt.Sprintf("Extension of %s for %d days", pin.CID, days),
+		IdempotencyKey: key,
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrInsufficientBalance) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to charge extension: %w", err)
+	}
+
+	extended, err := s.pinRepo.Extend(ctx, pin.ID, from, to)
+	if err != nil || !extended {
+		if charged {
+			if _, refundErr := s.ledgerRepo.Credit(ctx, &models.LedgerEntry{
+				ID:             uuid.New(),
+				UserID:         pin.UserID,
+				PinRequestID:   &pin.ID,
+				Type:           models.LedgerTypeRefund,
+				Category:       models.LedgerCategoryExtension,
+				AmountFIL:      price,
+				Description:    fmt.Sprintf("Refund of failed extension of %s", pin.CID),
+				IdempotencyKey: key + ":refund",
+			}); refundErr != nil {
+				s.logger.WithError(refundErr).WithField("pin_id", pin.ID).Error("Failed to refund extension charge")
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to extend pin: %w", err)
+		}
+		return nil, fmt.Errorf("pin cannot be extended")
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"pin_id":     pin.ID,
+		"days":       days,
+		"expires_at": to,
+	}).Info("Pin extended")
+
+	return &Extension{PinRequestID: pin.ID, Days: days, ExpiresAt: to, PriceFIL: price}, nil
+}
+
+// expire ends a pin's hot storage, first extending it if the user asked
+// for renewals and can afford one. It returns true if the pin expired.
+func (s *ExpiryService) expire(ctx context.Context, pin *models.PinRequest, now time.Time) bool {
+	log := s.logger.WithField("pin_id", pin.ID)
+
+	if pin.WantsRenewal(now) {
+		days := pin.RenewalDays(now)
+		price := s.price(pin, now, days)
+		switch {
+		case days <= 0:
+		case pin.MaxRenewalPriceFIL != nil && price.GreaterThan(*pin.MaxRenewalPriceFIL):
+			log.WithField("price_fil", price).Info("Extension exceeds the maximum renewal price, expiring pin")
+		default:
+			if _, err := s.extend(ctx, pin, days, now); err == nil {
+				return false
+			} else if errors.Is(err, storage.ErrInsufficientBalance) {
+				s.notify(ctx, pin.UserID, models.NotificationLowBalance, fmt.Sprintf("low-balance:extension:%s:%d", pin.ID, pin.ExpiresAt.Unix()),
+					fmt.Sprintf("Your balance is too low to keep %s pinned (%s FIL required)", pin.DisplayCID(), price),
+					map[string]interface{}{"pin_request_id": pin.ID, "cid": pin.CID, "required_fil": price})
+			} else {
+				log.WithError(err).Warn("Failed to extend pin, expiring it")
+			}
+		}
+	}
+
+	expired, err := s.pinRepo.Expire(ctx, pin.ID, now)
+	if err != nil {
+		log.WithError(err).Error("Failed to expire pin")
+		return false
+	}
+	if !expired {
+		return false
+	}
+
+	releaseAt := now.Add(s.config.Expiry.GracePeriod)
+	s.notify(ctx, pin.UserID, models.NotificationPinExpired, fmt.Sprintf("expired:%s:%d", pin.ID, pin.ExpiresAt.Unix()),
+		fmt.Sprintf("Storage of %s has expired and it will be unpinned after %s unless extended", pin.DisplayCID(), releaseAt.Format("2006-01-02 15:04 MST")),
+		map[string]interface{}{"pin_request_id": pin.ID, "cid": pin.CID, "unpin_at": releaseAt})
+
+	log.Info("Pin expired")
+	return true
+}
+
+// warn tells the user that a pin's hot storage or deals end within the
+// notice period. Pins that renew are only warned about when they are not
+// going to be renewed.
+func (s *ExpiryService) warn(ctx context.Context, pin *models.PinRequest, now time.Time) {
+	notice := now.AddDate(0, 0, s.config.Expiry.NoticeDays)
+	renews := pin.WantsRenewal(now)
+
+	if pin.ExpiresAt != nil && pin.ExpiresAt.Before(notice) && !renews {
+		s.notify(ctx, pin.UserID, models.NotificationPinExpiring, fmt.Sprintf("expiring:%s:%d", pin.ID, pin.ExpiresAt.Unix()),
+			fmt.Sprintf("Storage of %s expires on %s", pin.DisplayCID(), pin.ExpiresAt.Format("2006-01-02")),
+			map[string]interface{}{"pin_request_id": pin.ID, "cid": pin.CID, "expires_at": pin.ExpiresAt})
+	}
+
+	// Deals renew only through the pin they were made for
+	if pin.DealsExpireAt != nil && pin.DealsExpireAt.Before(notice) && (!renews || pin.SharesDeals) {
+		day := pin.DealsExpireAt.Truncate(24 * time.Hour)
+		s.notify(ctx, pin.UserID, models.NotificationDealsExpiring, fmt.Sprintf("deals-expiring:%s:%d", pin.ID, day.Unix()),
+			fmt.Sprintf("Filecoin storage of %s ends on %s", pin.DisplayCID(), pin.DealsExpireAt.Format("2006-01-02")),
+			map[string]interface{}{"pin_request_id": pin.ID, "cid": pin.CID, "deals_expire_at": pin.DealsExpireAt})
+	}
+}
+
+// releaseExpired releases the content of pins expired for longer than the
+// grace period, unpinning it from IPFS unless other pins reference it
+func (s *ExpiryService) releaseExpired(ctx context.Context, now time.Time) (int, error) {
+	released := 0
+	afterID := uuid.Nil
+	for {
+		pins, err := s.pinRepo.GetNextExpired(ctx, now.Add(-s.config.Expiry.GracePeriod), afterID, s.config.Expiry.BatchSize)
+		if err != nil {
+			return released, fmt.Errorf("failed to get expired pins: %w", err)
+		}
+		if len(pins) == 0 {
+			return released, nil
+		}
+
+		for _, pin := range pins {
+			// The pin may have been extended or held since it was listed
+			current, err := s.pinRepo.GetByID(ctx, pin.ID)
+			if err != nil || current.Status != models.PinStatusExpired || current.LegalHold {
+				continue
+			}
+			if err := s.contentService.Release(ctx, pin.ID); err != nil {
+				s.logger.WithError(err).WithField("pin_id", pin.ID).Error("Failed to release expired pin")
+				continue
+			}
+			released++
+		}
+		afterID = pins[len(pins)-1].ID
+	}
+}
+
+// price returns what extending a pin from start costs: the price of its
+// tier, with days after a hot_cold pin moves to cold priced as cold. Pins
+// sharing stored content get the stored content discount on that, as they
+// did when pinned.
+func (s *ExpiryService) price(pin *models.PinRequest, start time.Time, days int) decimal.Decimal {
+	tier, hotDays := pin.TierAt(start)
+	price := s.pricingService.CalculateTierPriceFIL(tier, hotDays, pin.SizeBytes, days)
+	if pin.SharesDeals {
+		price = s.pricingService.CalculateStoredPriceFIL(price)
+	}
+	return price
+}
+
+func (s *ExpiryService) notify(ctx context.Context, userID uuid.UUID, notificationType, key, message string, data map[string]interface{}) {
+	if err := s.notifications.Notify(ctx, userID, notificationType, key, message, data); err != nil {
+		s.logger.WithError(err).WithField("type", notificationType).Warn("Failed to send notification")
+	}
+}
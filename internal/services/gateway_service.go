@@ -0,0 +1,383 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+	"pinning-service/pkg/utils"
+)
+
+// JobFlushBandwidth is the job that persists metered gateway bandwidth
+const JobFlushBandwidth = "flush_bandwidth"
+
+// Gateway access modes
+const (
+	GatewayAccessPublic = "public"
+	GatewayAccessOwner  = "owner"
+)
+
+const (
+	gatewayBandwidthKey      = "gateway:bandwidth:%s"
+	gatewayBandwidthFlushKey = "gateway:bandwidth:%s:flush"
+)
+
+// GatewayRequest describes a request for content through the gateway.
+// UserID is empty for anonymous requests; the share fields come from a
+// share link URL, if any.
+type GatewayRequest struct {
+	// CID is normalized; URLCID is the CID as it appears in the URL, which
+	// is what share links are signed over
+	CID           string
+	URLCID        string
+	Path          string
+	UserID        string
+	ShareID       string
+	Signature     string
+	Expires       string
+	CountDownload bool
+}
+
+// GatewayAccess describes a permitted gateway request
+type GatewayAccess struct {
+	PinRequest *models.PinRequest
+	Public     bool
+}
+
+// ShareOptions limits what a share link grants
+type ShareOptions struct {
+	Path         string
+	ExpiresIn    time.Duration
+	MaxDownloads *int
+}
+
+// Share is a share link together with its signed URL
+type Share struct {
+	*models.ShareLink
+	URL string `json:"url"`
+}
+
+// GatewayService decides who may read pinned content through the gateway
+// and meters the bandwidth served. Usage is counted in Redis and flushed to
+// the database periodically so the request path never waits on Postgres.
+type GatewayService struct {
+	pinRepo       storage.PinRequestRepository
+	bandwidthRepo storage.BandwidthRepository
+	shareRepo     storage.ShareLinkRepository
+	redisClient   *redis.Client
+	config        *config.Config
+	logger        *logrus.Logger
+}
+
+func NewGatewayService(pinRepo storage.PinRequestRepository, bandwidthRepo storage.BandwidthRepository, shareRepo storage.ShareLinkRepository, redisClient *redis.Client, cfg *config.Config, logger *logrus.Logger) *GatewayService {
+	return &GatewayService{
+		pinRepo:       pinRepo,
+		bandwidthRepo: bandwidthRepo,
+		shareRepo:     shareRepo,
+		redisClient:   redisClient,
+		config:        cfg,
+		logger:        logger,
+	}
+}
+
+// Authorize checks that a CID is pinned by the service and that the
+// requester may read it, either as an owner, through a share link or
+// because the gateway is public. The returned pin's owner is billed for
+// the bandwidth.
+func (s *GatewayService) Authorize(ctx context.Context, req GatewayRequest) (*GatewayAccess, error) {
+	pins, err := s.pinRepo.GetByCID(ctx, req.CID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pin requests: %w", err)
+	}
+
+	var owned, first *models.PinRequest
+	for _, pin := range pins {
+		if pin.Status != models.PinStatusPinned {
+			continue
+		}
+		if first == nil {
+			first = pin
+		}
+		if req.UserID != "" && pin.UserID.String() == req.UserID {
+			owned = pin
+		}
+	}
+
+	if first == nil {
+		return nil, fmt.Errorf("content not found")
+	}
+	if owned != nil {
+		return &GatewayAccess{PinRequest: owned}, nil
+	}
+
+	// A share link is authoritative even on a public gateway so revoked
+	// or used up links stop working
+	if req.ShareID != "" {
+		return s.authorizeShare(ctx, req, pins)
+	}
+
+	// Encrypted content is never decrypted for anonymous readers
+	if s.config.Gateway.Access != GatewayAccessOwner && !first.Encrypted {
+		return &GatewayAccess{PinRequest: first, Public: true}, nil
+	}
+
+	return nil, fmt.Errorf("access denied")
+}
+
+// CreateShare creates a signed link to one of the user's pins
+func (s *GatewayService) CreateShare(ctx context.Context, pinID uuid.UUID, userID string, opts ShareOptions) (*Share, error) {
+	if s.config.Gateway.SigningKey == "" {
+		return nil, fmt.Errorf("sharing is not enabled")
+	}
+
+	pin, err := s.pinRepo.GetByID(ctx, pinID)
+	if err != nil || pin.UserID.String() != userID {
+		return nil, fmt.Errorf("pin request not found")
+	}
+	if pin.Status != models.PinStatusPinned {
+		return nil, fmt.Errorf("pin request is not pinned")
+	}
+
+	ttl := opts.ExpiresIn
+	if ttl == 0 {
+		ttl = s.config.Gateway.ShareDefaultTTL
+	}
+	if ttl > s.config.Gateway.ShareMaxTTL {
+		return nil, fmt.Errorf("expiry exceeds maximum of %s", s.config.Gateway.ShareMaxTTL)
+	}
+
+	sharedPath, ok := models.CleanPath(opts.Path)
+	if !ok {
+		return nil, fmt.Errorf("invalid path")
+	}
+
+	link := &models.ShareLink{
+		ID:           uuid.New(),
+		UserID:       pin.UserID,
+		PinRequestID: pin.ID,
+		CID:          pin.CID,
+		Path:         sharedPath,
+		MaxDownloads: opts.MaxDownloads,
+		ExpiresAt:    time.Now().UTC().Add(ttl).Truncate(time.Second),
+	}
+	if err := s.shareRepo.Create(ctx, link); err != nil {
+		return nil, fmt.Errorf("failed to create share link: %w", err)
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"share_id":       link.ID,
+		"pin_request_id": pin.ID,
+		"expires_at":     link.ExpiresAt,
+	}).Info("Share link created")
+
+	return s.share(link), nil
+}
+
+// GetShares lists the share links of one of the user's pins
+func (s *GatewayService) GetShares(ctx context.Context, pinID uuid.UUID, userID string) ([]*Share, error) {
+	pin, err := s.pinRepo.GetByID(ctx, pinID)
+	if err != nil || pin.UserID.String() != userID {
+		return nil, fmt.Errorf("pin request not found")
+	}
+
+	links, err := s.shareRepo.GetByPinRequestID(ctx, pin.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get share links: %w", err)
+	}
+
+	shares := make([]*Share, len(links))
+	for i, link := range links {
+		shares[i] = s.share(link)
+	}
+	return shares, nil
+}
+
+// RevokeShare disables a share link immediately
+func (s *GatewayService) RevokeShare(ctx context.Context, pinID, shareID uuid.UUID, userID string) error {
+	link, err := s.shareRepo.GetByID(ctx, shareID)
+	if err != nil || link.PinRequestID != pinID || link.UserID.String() != userID {
+		return fmt.Errorf("share link not found")
+	}
+
+	if err := s.shareRepo.Revoke(ctx, link.ID); err != nil {
+		return fmt.Errorf("failed to revoke share link: %w", err)
+	}
+
+	s.logger.WithField("share_id", link.ID).Info("Share link revoked")
+	return nil
+}
+
+func (s *GatewayService) authorizeShare(ctx context.Context, req GatewayRequest, pins []*models.PinRequest) (*GatewayAccess, error) {
+	shareID, err := uuid.Parse(req.ShareID)
+	if err != nil {
+		return nil, fmt.Errorf("access denied")
+	}
+	if err := utils.VerifyPathSignature(s.config.Gateway.SigningKey, shareSigningPath(shareID, req.URLCID), req.Signature, req.Expires); err != nil {
+		return nil, fmt.Errorf("access denied")
+	}
+
+	link, err := s.shareRepo.GetByID(ctx, shareID)
+	if err != nil || link.CID != req.CID || !link.IsUsable(time.Now()) || !link.Allows(req.Path) {
+		return nil, fmt.Errorf("access denied")
+	}
+
+	// The sharer is billed, so the shared pin itself must still be live
+	var pin *models.PinRequest
+	for _, p := range pins {
+		if p.ID == link.PinRequestID && p.Status == models.PinStatusPinned {
+			pin = p
+		}
+	}
+	if pin == nil {
+		return nil, fmt.Errorf("content not found")
+	}
+
+	if req.CountDownload {
+		claimed, err := s.shareRepo.ClaimDownload(ctx, link.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count download: %w", err)
+		}
+		if !claimed {
+			return nil, fmt.Errorf("access denied")
+		}
+	}
+
+	return &GatewayAccess{PinRequest: pin}, nil
+}
+
+// share signs a link's URL. The URL is relative when no public gateway URL
+// is configured.
+func (s *GatewayService) share(link *models.ShareLink) *Share {
+	path := "/ipfs/" + link.CID
+	if link.Path != "" {
+		path += "/" + link.Path
+	}
+
+	signature := utils.SignPath(s.config.Gateway.SigningKey, shareSigningPath(link.ID, link.CID), link.ExpiresAt)
+	query := url.Values{}
+	query.Set("share", link.ID.String())
+	query.Set("exp", strconv.FormatInt(link.ExpiresAt.Unix(), 10))
+	query.Set("sig", signature)
+
+	return &Share{
+		ShareLink: link,
+		URL:       strings.TrimRight(s.config.Gateway.PublicURL, "/") + path + "?" + query.Encode(),
+	}
+}
+
+// shareSigningPath is what a share URL's signature covers. Path
+// restrictions and download limits live in the database so they can be
+// enforced and revoked without reissuing URLs.
+func shareSigningPath(shareID uuid.UUID, cid string) string {
+	return "/ipfs/" + cid + "?share=" + shareID.String()
+}
+
+// RecordBandwidth meters bytes served on behalf of a user
+func (s *GatewayService) RecordBandwidth(ctx context.Context, userID uuid.UUID, bytes int64) {
+	key := fmt.Sprintf(gatewayBandwidthKey, time.Now().UTC().Format("2006-01-02"))
+
+	pipe := s.redisClient.Pipeline()
+	pipe.HIncrBy(ctx, key, userID.String()+":bytes", bytes)
+	pipe.HIncrBy(ctx, key, userID.String()+":requests", 1)
+	pipe.Expire(ctx, key, 7*24*time.Hour)
+	if _, err := pipe.Exec(ctx); err != nil {
+		s.logger.WithError(err).WithField("user_id", userID).Warn("Failed to meter gateway bandwidth")
+	}
+}
+
+// FlushBandwidth moves metered usage from Redis into the database. Each
+// day's counters are renamed before being read so increments arriving
+// during the flush start a fresh hash instead of being lost.
+func (s *GatewayService) FlushBandwidth(ctx context.Context) error {
+	now := time.Now().UTC()
+	for _, day := range []time.Time{now.AddDate(0, 0, -1), now} {
+		date := day.Format("2006-01-02")
+		key := fmt.Sprintf(gatewayBandwidthKey, date)
+		flushKey := fmt.Sprintf(gatewayBandwidthFlushKey, date)
+
+		// A previous flush may have failed after renaming
+		exists, err := s.redisClient.Exists(ctx, flushKey).Result()
+		if err != nil {
+			return fmt.Errorf("failed to check bandwidth counters: %w", err)
+		}
+		if exists == 0 {
+			if err := s.redisClient.Rename(ctx, key, flushKey).Err(); err != nil {
+				if strings.Contains(err.Error(), "no such key") {
+					continue
+				}
+				return fmt.Errorf("failed to rotate bandwidth counters: %w", err)
+			}
+		}
+
+		if err := s.flushDay(ctx, flushKey, day); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetBandwidthUsage returns a user's daily gateway usage between two dates
+func (s *GatewayService) GetBandwidthUsage(ctx context.Context, userID string, from, to time.Time) ([]*models.BandwidthUsage, error) {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+	return s.bandwidthRepo.GetByUserID(ctx, userUUID, from, to)
+}
+
+func (s *GatewayService) flushDay(ctx context.Context, flushKey string, day time.Time) error {
+	counters, err := s.redisClient.HGetAll(ctx, flushKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read bandwidth counters: %w", err)
+	}
+
+	type usage struct{ bytes, requests int64 }
+	totals := make(map[uuid.UUID]*usage)
+	for field, value := range counters {
+		parts := strings.SplitN(field, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		userID, err := uuid.Parse(parts[0])
+		if err != nil {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if totals[userID] == nil {
+			totals[userID] = &usage{}
+		}
+		switch parts[1] {
+		case "bytes":
+			totals[userID].bytes += n
+		case "requests":
+			totals[userID].requests += n
+		}
+	}
+
+	date := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	for userID, total := range totals {
+		if err := s.bandwidthRepo.Add(ctx, userID, date, total.bytes, total.requests); err != nil {
+			return fmt.Errorf("failed to record bandwidth usage: %w", err)
+		}
+		// Remove as we go so a retry after a partial failure does not
+		// count users twice
+		s.redisClient.HDel(ctx, flushKey, userID.String()+":bytes", userID.String()+":requests")
+	}
+
+	return s.redisClient.Del(ctx, flushKey).Err()
+}
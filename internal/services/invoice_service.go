@@ -0,0 +1,538 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocraft/work"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+// JobGenerateInvoices is the job that issues monthly invoices
+const JobGenerateInvoices = "generate_invoices"
+
+// Invoice formats
+const (
+	InvoiceFormatJSON = "json"
+	InvoiceFormatHTML = "html"
+	InvoiceFormatCSV  = "csv"
+)
+
+// InvoiceReport counts what an invoicing run issued
+type InvoiceReport struct {
+	PeriodStart time.Time `json:"period_start"`
+	Invoices    int       `json:"invoices"`
+	CreditNotes int       `json:"credit_notes"`
+	Failed      int       `json:"failed"`
+}
+
+// InvoiceService issues a monthly invoice to every user with ledger entries
+// in the month. An invoice lists the month's charges as line items per
+// category, pin and deal, along with the payments received and the balance
+// at the start and end of the month. Refunds are issued on a separate
+// credit note. Every document is checked against totals summed by the
+// database before it is stored, so the amounts match the ledger exactly.
+type InvoiceService struct {
+	notifications *NotificationService
+	pinRepo       storage.PinRequestRepository
+	ledgerRepo    storage.LedgerRepository
+	bandwidthRepo storage.BandwidthRepository
+	invoiceRepo   storage.InvoiceRepository
+	enqueuer      *work.Enqueuer
+	config        *config.Config
+	logger        *logrus.Logger
+}
+
+func NewInvoiceService(
+	notifications *NotificationService,
+	pinRepo storage.PinRequestRepository,
+	ledgerRepo storage.LedgerRepository,
+	bandwidthRepo storage.BandwidthRepository,
+	invoiceRepo storage.InvoiceRepository,
+	enqueuer *work.Enqueuer,
+	cfg *config.Config,
+	logger *logrus.Logger,
+) *InvoiceService {
+	return &InvoiceService{
+		notifications: notifications,
+		pinRepo:       pinRepo,
+		ledgerRepo:    ledgerRepo,
+		bandwidthRepo: bandwidthRepo,
+		invoiceRepo:   invoiceRepo,
+		enqueuer:      enqueuer,
+		config:        cfg,
+		logger:        logger,
+	}
+}
+
+// Enqueue queues invoicing of the month containing period, or of the last
+// month that ended if period is zero
+func (s *InvoiceService) Enqueue(ctx context.Context, period time.Time) error {
+	var args map[string]interface{}
+	if !period.IsZero() {
+		start := monthStart(period)
+		if !s.closed(start) {
+			return fmt.Errorf("period has not ended")
+		}
+		args = map[string]interface{}{"period": start.Format("2006-01")}
+	}
+	if _, err := s.enqueuer.EnqueueUnique(JobGenerateInvoices, args); err != nil {
+		return fmt.Errorf("failed to enqueue invoicing: %w", err)
+	}
+	return nil
+}
+
+// GenerateInvoices issues the invoices of the last month that ended at
+// least the grace period ago
+func (s *InvoiceService) GenerateInvoices(ctx context.Context) (*InvoiceReport, error) {
+	end := monthStart(time.Now().Add(-s.config.Invoicing.Grace))
+	return s.GeneratePeriod(ctx, end.AddDate(0, -1, 0))
+}
+
+// GeneratePeriod issues the invoices of the month containing period to every
+// user with ledger entries in it who has none yet. Users that fail are
+// retried on the next run.
+func (s *InvoiceService) GeneratePeriod(ctx context.Context, period time.Time) (*InvoiceReport, error) {
+	start := monthStart(period)
+	end := start.AddDate(0, 1, 0)
+	if !s.closed(start) {
+		return nil, fmt.Errorf("period has not ended")
+	}
+
+	report := &InvoiceReport{PeriodStart: start}
+	afterID := uuid.Nil
+	for {
+		userIDs, err := s.invoiceRepo.GetUninvoicedUsers(ctx, start, end, afterID, s.config.Invoicing.BatchSize)
+		if err != nil {
+			return report, fmt.Errorf("failed to get users to invoice: %w", err)
+		}
+		if len(userIDs) == 0 {
+			break
+		}
+
+		for _, userID := range userIDs {
+			invoice, creditNote, err := s.generate(ctx, userID, start, end)
+			if err != nil {
+				s.logger.WithError(err).WithFields(logrus.Fields{
+					"user_id": userID,
+					"period":  start.Format("2006-01"),
+				}).Error("Failed to generate invoice")
+				report.Failed++
+				continue
+			}
+			if invoice == nil {
+				continue
+			}
+			report.Invoices++
+			if creditNote != nil {
+				report.CreditNotes++
+			}
+			s.notify(ctx, invoice)
+		}
+		afterID = userIDs[len(userIDs)-1]
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"period":       start.Format("2006-01"),
+		"invoices":     report.Invoices,
+		"credit_notes": report.CreditNotes,
+		"failed":       report.Failed,
+	}).Info("Invoicing run completed")
+
+	return report, nil
+}
+
+// GetUserInvoices lists a user's invoices and credit notes
+func (s *InvoiceService) GetUserInvoices(ctx context.Context, userID string, kind string, page, limit int) ([]*models.Invoice, int64, error) {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid user ID: %w", err)
+	}
+	return s.invoiceRepo.GetByUserID(ctx, userUUID, kind, page, limit)
+}
+
+// GetInvoice returns one of a user's invoices or credit notes with its lines
+func (s *InvoiceService) GetInvoice(ctx context.Context, id uuid.UUID, userID string) (*models.Invoice, error) {
+	invoice, err := s.invoiceRepo.GetByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("invoice not found")
+		}
+		return nil, fmt.Errorf("failed to get invoice: %w", err)
+	}
+	if invoice.UserID.String() != userID {
+		return nil, fmt.Errorf("invoice not found")
+	}
+	return invoice, nil
+}
+
+// Render renders an invoice in a format, returning the document and its
+// content type
+func (s *InvoiceService) Render(invoice *models.Invoice, format string) ([]byte, string, error) {
+	switch format {
+	case InvoiceFormatJSON:
+		data, err := json.MarshalIndent(invoice, "", "  ")
+		return data, "application/json", err
+	case InvoiceFormatCSV:
+		data, err := renderInvoiceCSV(invoice)
+		return data, "text/csv; charset=utf-8", err
+	case InvoiceFormatHTML:
+		data, err := renderInvoiceHTML(invoice)
+		return data, "text/html; charset=utf-8", err
+	}
+	return nil, "", fmt.Errorf("unsupported format")
+}
+
+// closed returns true if the month starting at start ended at least the
+// grace period ago
+func (s *InvoiceService) closed(start time.Time) bool {
+	return !start.AddDate(0, 1, 0).After(time.Now().Add(-s.config.Invoicing.Grace))
+}
+
+// generate builds and stores a user's invoice for a period, and a credit
+// note if they were refunded in it. It returns nils if the period was
+// invoiced concurrently.
+func (s *InvoiceService) generate(ctx context.Context, userID uuid.UUID, start, end time.Time) (*models.Invoice, *models.Invoice, error) {
+	entries, err := s.ledgerRepo.GetByUserID(ctx, userID, start, end)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get ledger entries: %w", err)
+	}
+	closing, err := s.ledgerRepo.GetBalanceAt(ctx, userID, end)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get closing balance: %w", err)
+	}
+
+	now := time.Now().UTC()
+	invoice := &models.Invoice{
+		ID:                uuid.New(),
+		UserID:            userID,
+		Kind:              models.InvoiceKindInvoice,
+		Number:            invoiceNumber("INV", start, userID),
+		PeriodStart:       start,
+		PeriodEnd:         end,
+		ClosingBalanceFIL: closing,
+		EntryCount:        len(entries),
+		IssuedAt:          now,
+	}
+
+	var charges, refunds []*models.LedgerEntry
+	for _, entry := range entries {
+		switch entry.Type {
+		case models.LedgerTypeCharge:
+			charges = append(charges, entry)
+		case models.LedgerTypeRefund:
+			refunds = append(refunds, entry)
+		default:
+			invoice.PaymentsFIL = invoice.PaymentsFIL.Add(entry.AmountFIL)
+		}
+	}
+
+	cids := make(map[uuid.UUID]string)
+	invoice.Lines, invoice.TotalFIL = s.lines(ctx, charges, cids)
+
+	bandwidth, err := s.bandwidthRepo.GetByUserID(ctx, userID, start, end.AddDate(0, 0, -1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get bandwidth usage: %w", err)
+	}
+	var bandwidthBytes, requests int64
+	for _, day := range bandwidth {
+		bandwidthBytes += day.Bytes
+		requests += day.Requests
+	}
+	if bandwidthBytes > 0 {
+		invoice.Lines = append(invoice.Lines, &models.InvoiceLine{
+			ID:          uuid.New(),
+			Position:    len(invoice.Lines) + 1,
+			Kind:        models.InvoiceLineBandwidth,
+			Description: fmt.Sprintf("Gateway bandwidth (%d requests, not charged)", requests),
+			Quantity:    bandwidthBytes,
+			Unit:        "bytes",
+			AmountFIL:   decimal.Zero,
+		})
+	}
+
+	invoices := []*models.Invoice{invoice}
+	var creditNote *models.Invoice
+	if len(refunds) > 0 {
+		creditNote = &models.Invoice{
+			ID:                uuid.New(),
+			UserID:            userID,
+			Kind:              models.InvoiceKindCreditNote,
+			Number:            invoiceNumber("CN", start, userID),
+			CreditedInvoiceID: &invoice.ID,
+			PeriodStart:       start,
+			PeriodEnd:         end,
+			EntryCount:        len(refunds),
+			IssuedAt:          now,
+		}
+		creditNote.Lines, creditNote.TotalFIL = s.lines(ctx, refunds, cids)
+		invoice.CreditsFIL = creditNote.TotalFIL
+		invoices = append(invoices, creditNote)
+	}
+
+	invoice.OpeningBalanceFIL = closing.Sub(invoice.PaymentsFIL).Sub(invoice.CreditsFIL).Add(invoice.TotalFIL)
+
+	if err := s.reconcile(ctx, invoice); err != nil {
+		return nil, nil, err
+	}
+
+	created, err := s.invoiceRepo.Create(ctx, invoices)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to store invoice: %w", err)
+	}
+	if !created {
+		return nil, nil, nil
+	}
+	return invoice, creditNote, nil
+}
+
+// reconcile checks an invoice's totals against the ledger totals summed by
+// the database. They differ only if entries were added to the period while
+// the invoice was built, in which case it is built again on the next run.
+func (s *InvoiceService) reconcile(ctx context.Context, invoice *models.Invoice) error {
+	totals, err := s.ledgerRepo.GetTotals(ctx, invoice.UserID, invoice.PeriodStart, invoice.PeriodEnd)
+	if err != nil {
+		return fmt.Errorf("failed to get ledger totals: %w", err)
+	}
+
+	payments := decimal.Zero
+	for entryType, total := range totals {
+		if entryType != models.LedgerTypeCharge && entryType != models.LedgerTypeRefund {
+			payments = payments.Add(total)
+		}
+	}
+
+	if !totals[models.LedgerTypeCharge].Equal(invoice.TotalFIL) ||
+		!totals[models.LedgerTypeRefund].Equal(invoice.CreditsFIL) ||
+		!payments.Equal(invoice.PaymentsFIL) {
+		return fmt.Errorf("invoice does not reconcile with ledger: charges %s/%s, refunds %s/%s, payments %s/%s",
+			invoice.TotalFIL, totals[models.LedgerTypeCharge],
+			invoice.CreditsFIL, totals[models.LedgerTypeRefund],
+			invoice.PaymentsFIL, payments)
+	}
+	return nil
+}
+
+// lineKey groups ledger entries into invoice lines
+type lineKey struct {
+	category string
+	pinID    uuid.UUID
+	dealID   uuid.UUID
+}
+
+// lines groups ledger entries by category, pin and deal, in the order the
+// first entry of each group was made, and returns them with their total
+func (s *InvoiceService) lines(ctx context.Context, entries []*models.LedgerEntry, cids map[uuid.UUID]string) ([]*models.InvoiceLine, decimal.Decimal) {
+	var lines []*models.InvoiceLine
+	byKey := make(map[lineKey]*models.InvoiceLine)
+	total := decimal.Zero
+
+	for _, entry := range entries {
+		key := lineKey{category: entry.Category}
+		if entry.PinRequestID != nil {
+			key.pinID = *entry.PinRequestID
+		}
+		if entry.FilecoinDealID != nil {
+			key.dealID = *entry.FilecoinDealID
+		}
+
+		line, ok := byKey[key]
+		if !ok {
+			line = &models.InvoiceLine{
+				ID:             uuid.New(),
+				Position:       len(lines) + 1,
+				Kind:           entry.Category,
+				Description:    entry.Description,
+				PinRequestID:   entry.PinRequestID,
+				FilecoinDealID: entry.FilecoinDealID,
+				Unit:           entry.Type + "s",
+			}
+			byKey[key] = line
+			lines = append(lines, line)
+		}
+		line.Quantity++
+		line.AmountFIL = line.AmountFIL.Add(entry.AmountFIL)
+		total = total.Add(entry.AmountFIL)
+	}
+
+	for _, line := range lines {
+		if line.Quantity > 1 {
+			subject := "account"
+			if line.PinRequestID != nil {
+				subject = s.pinCID(ctx, *line.PinRequestID, cids)
+			}
+			line.Description = fmt.Sprintf("%d %s %s for %s", line.Quantity, line.Kind, line.Unit, subject)
+		}
+	}
+
+	return lines, total
+}
+
+// pinCID returns the CID of a pin for line descriptions, falling back to
+// the pin's ID if it no longer exists
+func (s *InvoiceService) pinCID(ctx context.Context, pinID uuid.UUID, cids map[uuid.UUID]string) string {
+	if cid, ok := cids[pinID]; ok {
+		return cid
+	}
+	cid := pinID.String()
+	if pin, err := s.pinRepo.GetByID(ctx, pinID); err == nil {
+		cid = pin.DisplayCID()
+	}
+	cids[pinID] = cid
+	return cid
+}
+
+func (s *InvoiceService) notify(ctx context.Context, invoice *models.Invoice) {
+	if err := s.notifications.Notify(ctx, invoice.UserID, models.NotificationInvoiceIssued, "invoice:"+invoice.ID.String(),
+		fmt.Sprintf("Your statement for %s is available: %s FIL charged", invoice.PeriodStart.Format("January 2006"), invoice.TotalFIL),
+		map[string]interface{}{"invoice_id": invoice.ID, "number": invoice.Number, "total_fil": invoice.TotalFIL}); err != nil {
+		s.logger.WithError(err).WithField("invoice_id", invoice.ID).Warn("Failed to send notification")
+	}
+}
+
+// monthStart returns the start of the UTC month containing t
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// invoiceNumber numbers a user's document of a period
+func invoiceNumber(prefix string, start time.Time, userID uuid.UUID) string {
+	return fmt.Sprintf("%s-%s-%s", prefix, start.Format("200601"), strings.ToUpper(userID.String()[:8]))
+}
+
+// formatFIL formats an amount to the attoFIL
+func formatFIL(amount decimal.Decimal) string {
+	return amount.StringFixed(18)
+}
+
+func renderInvoiceCSV(invoice *models.Invoice) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	rows := [][]string{{"number", "position", "kind", "description", "pin_request_id", "filecoin_deal_id", "quantity", "unit", "amount_fil"}}
+	for _, line := range invoice.Lines {
+		var pinID, dealID string
+		if line.PinRequestID != nil {
+			pinID = line.PinRequestID.String()
+		}
+		if line.FilecoinDealID != nil {
+			dealID = line.FilecoinDealID.String()
+		}
+		rows = append(rows, []string{
+			invoice.Number, strconv.Itoa(line.Position), line.Kind, line.Description,
+			pinID, dealID, strconv.FormatInt(line.Quantity, 10), line.Unit, formatFIL(line.AmountFIL),
+		})
+	}
+
+	rows = append(rows, []string{invoice.Number, "", "total", "Total", "", "", "", "", formatFIL(invoice.TotalFIL)})
+	if invoice.Kind == models.InvoiceKindInvoice {
+		rows = append(rows,
+			[]string{invoice.Number, "", "credits", "Credit notes", "", "", "", "", formatFIL(invoice.CreditsFIL)},
+			[]string{invoice.Number, "", "payments", "Payments", "", "", "", "", formatFIL(invoice.PaymentsFIL)},
+			[]string{invoice.Number, "", "opening_balance", "Opening balance", "", "", "", "", formatFIL(invoice.OpeningBalanceFIL)},
+			[]string{invoice.Number, "", "closing_balance", "Closing balance", "", "", "", "", formatFIL(invoice.ClosingBalanceFIL)},
+		)
+	}
+
+	if err := w.WriteAll(rows); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var invoiceTemplate = template.Must(template.New("invoice").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}} {{.Number}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ddd; padding: 0.4em; text-align: left; }
+td.amount, th.amount { text-align: right; font-family: monospace; }
+</style>
+</head>
+<body>
+<h1>{{.Title}} {{.Number}}</h1>
+<p>Period: {{.Period}}<br>Issued: {{.IssuedAt}}{{if .Credits}}<br>Credits invoice: {{.Credits}}{{end}}</p>
+<table>
+<tr><th>#</th><th>Description</th><th>Quantity</th><th class="amount">Amount (FIL)</th></tr>
+{{range .Lines}}<tr><td>{{.Position}}</td><td>{{.Description}}</td><td>{{.Quantity}} {{.Unit}}</td><td class="amount">{{.Amount}}</td></tr>
+{{end}}<tr><th></th><th>Total</th><th></th><th class="amount">{{.Total}}</th></tr>
+</table>
+{{if .Statement}}<h2>Statement</h2>
+<table>
+<tr><td>Opening balance</td><td class="amount">{{.Opening}}</td></tr>
+<tr><td>Payments</td><td class="amount">{{.Payments}}</td></tr>
+<tr><td>Credit notes</td><td class="amount">{{.CreditNotes}}</td></tr>
+<tr><td>Charges</td><td class="amount">{{.Total}}</td></tr>
+<tr><th>Closing balance</th><th class="amount">{{.Closing}}</th></tr>
+</table>
+{{end}}</body>
+</html>
+`))
+
+type invoiceLineView struct {
+	Position    int
+	Description string
+	Quantity    int64
+	Unit        string
+	Amount      string
+}
+
+func renderInvoiceHTML(invoice *models.Invoice) ([]byte, error) {
+	view := struct {
+		Title, Number, Period, IssuedAt, Credits       string
+		Lines                                          []invoiceLineView
+		Total, Opening, Payments, CreditNotes, Closing string
+		Statement                                      bool
+	}{
+		Title:       "Invoice",
+		Number:      invoice.Number,
+		Period:      invoice.PeriodStart.Format("2 January 2006") + " to " + invoice.PeriodEnd.AddDate(0, 0, -1).Format("2 January 2006"),
+		IssuedAt:    invoice.IssuedAt.Format("2 January 2006"),
+		Total:       formatFIL(invoice.TotalFIL),
+		Opening:     formatFIL(invoice.OpeningBalanceFIL),
+		Payments:    formatFIL(invoice.PaymentsFIL),
+		CreditNotes: formatFIL(invoice.CreditsFIL),
+		Closing:     formatFIL(invoice.ClosingBalanceFIL),
+		Statement:   invoice.Kind == models.InvoiceKindInvoice,
+	}
+	if invoice.Kind == models.InvoiceKindCreditNote {
+		view.Title = "Credit note"
+		if invoice.CreditedInvoiceID != nil {
+			view.Credits = invoiceNumber("INV", invoice.PeriodStart, invoice.UserID)
+		}
+	}
+	for _, line := range invoice.Lines {
+		view.Lines = append(view.Lines, invoiceLineView{
+			Position:    line.Position,
+			Description: line.Description,
+			Quantity:    line.Quantity,
+			Unit:        line.Unit,
+			Amount:      formatFIL(line.AmountFIL),
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := invoiceTemplate.Execute(&buf, view); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
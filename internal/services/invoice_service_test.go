@@ -0,0 +1,229 @@
+package services
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+// invoicePinRepo returns the pins named on invoice lines
+type invoicePinRepo struct {
+	storage.PinRequestRepository
+	pins map[uuid.UUID]*models.PinRequest
+}
+
+func (r *invoicePinRepo) GetByID(ctx context.Context, id uuid.UUID) (*models.PinRequest, error) {
+	if pin, ok := r.pins[id]; ok {
+		return pin, nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+type fakeBandwidthRepo struct {
+	storage.BandwidthRepository
+}
+
+func (r *fakeBandwidthRepo) GetByUserID(ctx context.Context, userID uuid.UUID, from, to time.Time) ([]*models.BandwidthUsage, error) {
+	return nil, nil
+}
+
+type fakeInvoiceRepo struct {
+	storage.InvoiceRepository
+	invoices []*models.Invoice
+}
+
+func (r *fakeInvoiceRepo) Create(ctx context.Context, invoices []*models.Invoice) (bool, error) {
+	r.invoices = append(r.invoices, invoices...)
+	return true, nil
+}
+
+// racingLedgerRepo records an entry in the period after the invoice's
+// entries were read, as a charge made while the invoice is built would
+type racingLedgerRepo struct {
+	*fakeLedgerRepo
+	late *models.LedgerEntry
+}
+
+func (r *racingLedgerRepo) GetTotals(ctx context.Context, userID uuid.UUID, from, to time.Time) (map[string]decimal.Decimal, error) {
+	if r.late != nil {
+		if _, err := r.Charge(ctx, r.late); err != nil {
+			return nil, err
+		}
+		r.late = nil
+	}
+	return r.fakeLedgerRepo.GetTotals(ctx, userID, from, to)
+}
+
+func TestGenerateInvoice(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+	userID := uuid.New()
+	pin := &models.PinRequest{ID: uuid.New(), UserID: userID, CID: "bafyinvoiced"}
+	otherPin := &models.PinRequest{ID: uuid.New(), UserID: userID, CID: "bafyextended"}
+	dealID := uuid.New()
+
+	entry := func(entryType, category, amount string, at time.Time, pinID, dealID *uuid.UUID) *models.LedgerEntry {
+		return &models.LedgerEntry{
+			ID:             uuid.New(),
+			UserID:         userID,
+			PinRequestID:   pinID,
+			FilecoinDealID: dealID,
+			Type:           entryType,
+			Category:       category,
+			AmountFIL:      decimal.RequireFromString(amount),
+			Description:    category + " " + amount,
+			IdempotencyKey: uuid.NewString(),
+			CreatedAt:      at,
+		}
+	}
+	in := func(days int) time.Time { return start.AddDate(0, 0, days) }
+	after := func(days int) time.Time { return end.AddDate(0, 0, days) }
+
+	for _, tc := range []struct {
+		name    string
+		entries []*models.LedgerEntry
+		late    *models.LedgerEntry
+
+		wantErr     bool
+		total       string
+		credits     string
+		payments    string
+		opening     string
+		closing     string
+		lines       []int64
+		creditLines int
+	}{
+		{
+			name: "charges, refunds and credits",
+			entries: []*models.LedgerEntry{
+				entry(models.LedgerTypeCredit, models.LedgerCategoryDeposit, "5", in(1), nil, nil),
+				entry(models.LedgerTypeCharge, models.LedgerCategoryRenewal, "2", in(2), &pin.ID, &dealID),
+				entry(models.LedgerTypeCharge, models.LedgerCategoryRenewal, "1.5", in(3), &pin.ID, &dealID),
+				entry(models.LedgerTypeCharge, models.LedgerCategoryExtension, "0.25", in(4), &otherPin.ID, nil),
+				entry(models.LedgerTypeRefund, models.LedgerCategoryRenewal, "1", in(5), &pin.ID, &dealID),
+				// Entries after the period are left to the next invoice and
+				// to the balance after it
+				entry(models.LedgerTypeCharge, models.LedgerCategoryRenewal, "3", after(1), &pin.ID, &dealID),
+				entry(models.LedgerTypeCredit, models.LedgerCategoryDeposit, "4", after(2), nil, nil),
+			},
+			total:       "3.75",
+			credits:     "1",
+			payments:    "5",
+			opening:     "10",
+			closing:     "12.25",
+			lines:       []int64{2, 1},
+			creditLines: 1,
+		},
+		{
+			name: "payments only",
+			entries: []*models.LedgerEntry{
+				entry(models.LedgerTypeCredit, models.LedgerCategoryDeposit, "5", in(10), nil, nil),
+				entry(models.LedgerTypeCharge, models.LedgerCategoryRenewal, "2", after(0), &pin.ID, &dealID),
+			},
+			total:    "0",
+			credits:  "0",
+			payments: "5",
+			opening:  "10",
+			closing:  "15",
+		},
+		{
+			name: "entry added while building",
+			entries: []*models.LedgerEntry{
+				entry(models.LedgerTypeCharge, models.LedgerCategoryRenewal, "2", in(2), &pin.ID, &dealID),
+			},
+			late:    entry(models.LedgerTypeCharge, models.LedgerCategoryExtension, "1", in(20), &otherPin.ID, nil),
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ledger := newFakeLedgerRepo()
+			ledger.balances[userID] = decimal.NewFromInt(10)
+			for _, e := range tc.entries {
+				var err error
+				if e.Type == models.LedgerTypeCharge {
+					_, err = ledger.Charge(ctx, e)
+				} else {
+					_, err = ledger.Credit(ctx, e)
+				}
+				if err != nil {
+					t.Fatalf("apply %s: %v", e.Description, err)
+				}
+			}
+
+			invoiceRepo := &fakeInvoiceRepo{}
+			pinRepo := &invoicePinRepo{pins: map[uuid.UUID]*models.PinRequest{pin.ID: pin, otherPin.ID: otherPin}}
+			logger := logrus.New()
+			logger.SetOutput(io.Discard)
+			s := NewInvoiceService(nil, pinRepo, &racingLedgerRepo{fakeLedgerRepo: ledger, late: tc.late}, &fakeBandwidthRepo{}, invoiceRepo, nil, &config.Config{}, logger)
+
+			invoice, creditNote, err := s.generate(ctx, userID, start, end)
+			if tc.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "does not reconcile") {
+					t.Fatalf("generate returned %v, want a reconciliation error", err)
+				}
+				if len(invoiceRepo.invoices) != 0 {
+					t.Fatalf("stored %d documents for an invoice that does not reconcile", len(invoiceRepo.invoices))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("generate: %v", err)
+			}
+
+			for _, amount := range []struct {
+				name      string
+				got, want decimal.Decimal
+			}{
+				{"total", invoice.TotalFIL, decimal.RequireFromString(tc.total)},
+				{"credits", invoice.CreditsFIL, decimal.RequireFromString(tc.credits)},
+				{"payments", invoice.PaymentsFIL, decimal.RequireFromString(tc.payments)},
+				{"opening balance", invoice.OpeningBalanceFIL, decimal.RequireFromString(tc.opening)},
+				{"closing balance", invoice.ClosingBalanceFIL, decimal.RequireFromString(tc.closing)},
+			} {
+				if !amount.got.Equal(amount.want) {
+					t.Errorf("%s is %s FIL, want %s FIL", amount.name, amount.got, amount.want)
+				}
+			}
+
+			if len(invoice.Lines) != len(tc.lines) {
+				t.Fatalf("%d invoice lines, want %d", len(invoice.Lines), len(tc.lines))
+			}
+			for i, line := range invoice.Lines {
+				if line.Position != i+1 || line.Quantity != tc.lines[i] {
+					t.Errorf("line %d is #%d with %d entries, want #%d with %d", i, line.Position, line.Quantity, i+1, tc.lines[i])
+				}
+				if line.Quantity > 1 && !strings.Contains(line.Description, pin.CID) {
+					t.Errorf("grouped line described as %q, want the pin's CID", line.Description)
+				}
+			}
+
+			if tc.creditLines == 0 {
+				if creditNote != nil {
+					t.Fatalf("issued a credit note without refunds")
+				}
+				return
+			}
+			if creditNote == nil || len(creditNote.Lines) != tc.creditLines {
+				t.Fatalf("credit note %+v, want %d lines", creditNote, tc.creditLines)
+			}
+			if *creditNote.CreditedInvoiceID != invoice.ID || !creditNote.TotalFIL.Equal(invoice.CreditsFIL) {
+				t.Errorf("credit note for %s totals %s FIL, want %s FIL for %s", creditNote.CreditedInvoiceID, creditNote.TotalFIL, invoice.CreditsFIL, invoice.ID)
+			}
+			if len(invoiceRepo.invoices) != 2 {
+				t.Errorf("stored %d documents, want the invoice and its credit note", len(invoiceRepo.invoices))
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+// JobProcessLifecycle is the job that moves pins between storage tiers
+const JobProcessLifecycle = "process_lifecycle"
+
+// LifecycleReport counts what a lifecycle run did
+type LifecycleReport struct {
+	MovedToCold int `json:"moved_to_cold"`
+	Cooled      int `json:"cooled"`
+	Dropped     int `json:"dropped"`
+}
+
+// LifecycleService moves pins between storage tiers. A hot_cold pin whose
+// lifecycle rule is due moves to the cold tier. Content that only cold
+// pins reference has its IPFS copy dropped once it has an active deal, so
+// it is then only stored on Filecoin, and copies of cold content
+// retrieved back into IPFS are dropped again after the restore TTL.
+type LifecycleService struct {
+	contentService *ContentService
+	notifications  *NotificationService
+	pinRepo        storage.PinRequestRepository
+	contentRepo    storage.ContentRepository
+	config         *config.Config
+	logger         *logrus.Logger
+}
+
+func NewLifecycleService(
+	contentService *ContentService,
+	notifications *NotificationService,
+	pinRepo storage.PinRequestRepository,
+	contentRepo storage.ContentRepository,
+	cfg *config.Config,
+	logger *logrus.Logger,
+) *LifecycleService {
+	return &LifecycleService{
+		contentService: contentService,
+		notifications:  notifications,
+		pinRepo:        pinRepo,
+		contentRepo:    contentRepo,
+		config:         cfg,
+		logger:         logger,
+	}
+}
+
+// ProcessLifecycle moves due pins to the cold tier, drops the IPFS copy of
+// content that is now only needed cold and of cold content restored longer
+// than the restore TTL ago
+func (s *LifecycleService) ProcessLifecycle(ctx context.Context) (*LifecycleReport, error) {
+	now := time.Now().UTC()
+	report := &LifecycleReport{}
+
+	moved, err := s.moveToCold(ctx, now)
+	report.MovedToCold = moved
+	if err != nil {
+		return report, err
+	}
+
+	cooled, err := s.cool(ctx)
+	report.Cooled = cooled
+	if err != nil {
+		return report, err
+	}
+
+	dropped, err := s.dropRestored(ctx, now)
+	report.Dropped = dropped
+	if err != nil {
+		return report, err
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"moved_to_cold": report.MovedToCold,
+		"cooled":        report.Cooled,
+		"dropped":       report.Dropped,
+	}).Info("Lifecycle run completed")
+
+	return report, nil
+}
+
+// moveToCold moves hot_cold pins whose lifecycle rule is due to the cold
+// tier. Their IPFS copy is dropped by cool once nothing else needs it.
+func (s *LifecycleService) moveToCold(ctx context.Context, now time.Time) (int, error) {
+	moved := 0
+	afterID := uuid.Nil
+	for {
+		pins, err := s.pinRepo.GetNextColdDue(ctx, now, afterID, s.config.Lifecycle.BatchSize)
+		if err != nil {
+			return moved, fmt.Errorf("failed to get pins due for cold storage: %w", err)
+		}
+		if len(pins) == 0 {
+			return moved, nil
+		}
+
+		for _, pin := range pins {
+			ok, err := s.pinRepo.MoveToCold(ctx, pin.ID, now)
+			if err != nil {
+				s.logger.WithError(err).WithField("pin_id", pin.ID).Error("Failed to move pin to cold storage")
+				continue
+			}
+			if !ok {
+				continue
+			}
+			moved++
+
+			if err := s.notifications.Notify(ctx, pin.UserID, models.NotificationPinCold, "cold:"+pin.ID.String(),
+				fmt.Sprintf("%s moved to cold storage and will be served from Filecoin", pin.DisplayCID()),
+				map[string]interface{}{"pin_request_id": pin.ID, "cid": pin.CID}); err != nil {
+				s.logger.WithError(err).WithField("pin_id", pin.ID).Warn("Failed to send notification")
+			}
+		}
+		afterID = pins[len(pins)-1].ID
+	}
+}
+
+// cool drops the IPFS copy of content that only cold pins reference and
+// that has an active deal to retrieve it from
+func (s *LifecycleService) cool(ctx context.Context) (int, error) {
+	cooled := 0
+	afterID := uuid.Nil
+	for {
+		contents, err := s.contentRepo.GetNextCoolable(ctx, afterID, s.config.Lifecycle.BatchSize)
+		if err != nil {
+			return cooled, fmt.Errorf("failed to get content for cold storage: %w", err)
+		}
+		if len(contents) == 0 {
+			return cooled, nil
+		}
+
+		for _, content := range contents {
+			ok, err := s.contentService.Cool(ctx, content)
+			if err != nil {
+				s.logger.WithError(err).WithField("cid", content.CID).Error("Failed to move content to cold storage")
+				continue
+			}
+			if ok {
+				cooled++
+			}
+		}
+		afterID = contents[len(contents)-1].ID
+	}
+}
+
+// dropRestored unpins cold content whose last retrieval finished more than
+// the restore TTL ago
+func (s *LifecycleService) dropRestored(ctx context.Context, now time.Time) (int, error) {
+	dropped := 0
+	afterID := uuid.Nil
+	for {
+		contents, err := s.contentRepo.GetNextRestored(ctx, now.Add(-s.config.Lifecycle.RestoreTTL), afterID, s.config.Lifecycle.BatchSize)
+		if err != nil {
+			return dropped, fmt.Errorf("failed to get restored content: %w", err)
+		}
+		if len(contents) == 0 {
+			return dropped, nil
+		}
+
+		for _, content := range contents {
+			if err := s.contentService.DropRestored(ctx, content); err != nil {
+				s.logger.WithError(err).WithField("cid", content.CID).Error("Failed to drop restored content")
+				continue
+			}
+			dropped++
+		}
+		afterID = contents[len(contents)-1].ID
+	}
+}
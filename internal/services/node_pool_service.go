@@ -0,0 +1,620 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/ipfs"
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+// JobRebalanceNodes is the job that health checks the IPFS nodes and moves
+// pins to the nodes they belong on, or with IPFS Cluster, syncs pin status
+// from the cluster and recovers failed pins
+const JobRebalanceNodes = "rebalance_nodes"
+
+// defaultNodeID names the single node used when no pool is configured
+const defaultNodeID = "default"
+
+// IPFS backends
+const (
+	IPFSBackendKubo    = "kubo"
+	IPFSBackendCluster = "cluster"
+)
+
+// NodeReport is a node of the pool with the number of CIDs it holds
+type NodeReport struct {
+	ipfs.NodeStatus
+	Pins int64 `json:"pins"`
+}
+
+// PlacementReport is where a pin's content is held in hot storage
+type PlacementReport struct {
+	Backend string                 `json:"backend"`
+	Status  string                 `json:"status"`
+	Nodes   []*models.PinPlacement `json:"nodes"`
+}
+
+// NodePoolService pins content across the configured IPFS nodes and keeps
+// track of which nodes hold each CID. Placement follows a consistent hash
+// of the CID; when a node is down its pins fail over to the next node on
+// the ring, and rebalancing moves them back once it recovers or when nodes
+// are added or removed.
+//
+// Content is added and DAGs are built on the node at ipfs.api_url; pool
+// nodes fetch it from there over bitswap when they pin it, so all nodes
+// must be able to reach each other.
+//
+// With the cluster backend IPFS Cluster decides placement and keeps pins
+// replicated instead; the service records the cluster's per peer status.
+type NodePoolService struct {
+	pool          *ipfs.Pool
+	cluster       *ipfs.ClusterClient
+	pinRepo       storage.PinRequestRepository
+	placementRepo storage.PlacementRepository
+	config        *config.Config
+	logger        *logrus.Logger
+}
+
+func NewNodePoolService(pinRepo storage.PinRequestRepository, placementRepo storage.PlacementRepository, cfg *config.Config, logger *logrus.Logger) (*NodePoolService, error) {
+	s := &NodePoolService{
+		pinRepo:       pinRepo,
+		placementRepo: placementRepo,
+		config:        cfg,
+		logger:        logger,
+	}
+
+	switch cfg.IPFS.Backend {
+	case IPFSBackendKubo:
+	case IPFSBackendCluster:
+		s.cluster = ipfs.NewClusterClient(ipfs.ClusterConfig{
+			APIURL:         cfg.IPFS.Cluster.APIURL,
+			ProxyURL:       cfg.IPFS.Cluster.ProxyURL,
+			Username:       cfg.IPFS.Cluster.Username,
+			Password:       cfg.IPFS.Cluster.Password,
+			ReplicationMin: cfg.IPFS.Cluster.ReplicationMin,
+			ReplicationMax: cfg.IPFS.Cluster.ReplicationMax,
+			Timeout:        cfg.IPFS.Timeout,
+			PinTimeout:     cfg.IPFS.Cluster.PinTimeout,
+		})
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown IPFS backend %q", cfg.IPFS.Backend)
+	}
+
+	nodes := make([]ipfs.NodeConfig, len(cfg.IPFS.Nodes))
+	for i, node := range cfg.IPFS.Nodes {
+		nodes[i] = ipfs.NodeConfig{ID: node.ID, APIURL: node.APIURL}
+	}
+	if len(nodes) == 0 {
+		nodes = []ipfs.NodeConfig{{ID: defaultNodeID, APIURL: cfg.IPFS.APIURL}}
+	}
+
+	pool, err := ipfs.NewPool(nodes, cfg.IPFS.Replication, cfg.IPFS.Timeout, cfg.IPFS.HealthCheckInterval)
+	if err != nil {
+		return nil, err
+	}
+	s.pool = pool
+
+	return s, nil
+}
+
+// Pin pins a CID on the nodes it is placed on and records them
+func (s *NodePoolService) Pin(ctx context.Context, cid string) error {
+	return s.PinWithProgress(ctx, cid, nil)
+}
+
+// PinWithProgress pins like Pin, reporting the blocks walked by the node
+// being pinned. IPFS Cluster does not report progress, so progress is
+// never called with the cluster backend.
+func (s *NodePoolService) PinWithProgress(ctx context.Context, cid string, progress func(nodeID string, blocks int64)) error {
+	if s.cluster != nil {
+		err := s.cluster.Pin(ctx, cid)
+		if _, syncErr := s.syncCluster(ctx, cid); syncErr != nil {
+			s.logger.WithError(syncErr).WithField("cid", cid).Warn("Failed to record cluster pin status")
+		}
+		return err
+	}
+
+	nodeIDs, err := s.pool.PinWithProgress(ctx, cid, progress)
+	if err != nil {
+		return fmt.Errorf("failed to pin CID %s: %w", cid, err)
+	}
+
+	if err := s.placementRepo.Add(ctx, cid, nodeIDs); err != nil {
+		return fmt.Errorf("failed to record placement: %w", err)
+	}
+
+	if len(nodeIDs) < s.pool.Replication() {
+		s.logger.WithFields(logrus.Fields{
+			"cid":   cid,
+			"nodes": nodeIDs,
+		}).Warn("CID pinned on fewer nodes than configured")
+	}
+
+	return nil
+}
+
+// PeerWithOrigins connects the nodes a CID is being pinned on to the
+// peers the user said hold it, so they need not be found through the DHT.
+// The connections are kept open until the returned function is called.
+func (s *NodePoolService) PeerWithOrigins(ctx context.Context, cid string, origins []string) func() {
+	if len(origins) == 0 {
+		return func() {}
+	}
+	if max := s.config.Pinning.MaxOriginConnections; max > 0 && len(origins) > max {
+		origins = origins[:max]
+	}
+
+	var connected int
+	var release func()
+	if s.cluster != nil {
+		connected, release = s.cluster.PeerWith(ctx, origins)
+	} else {
+		connected, release = s.pool.PeerWith(ctx, s.pool.Place(ctx, cid), origins)
+	}
+
+	if connected == 0 {
+		s.logger.WithFields(logrus.Fields{
+			"cid":     cid,
+			"origins": len(origins),
+		}).Warn("Could not connect to any origin, relying on content routing")
+	}
+	return release
+}
+
+// Delegates returns the multiaddrs of the nodes a CID is pinned on, for
+// users to connect their node to so ours can fetch from it directly
+func (s *NodePoolService) Delegates(ctx context.Context, cid string) []string {
+	if len(s.config.Pinning.Delegates) > 0 {
+		return s.config.Pinning.Delegates
+	}
+
+	var addrs []string
+	if s.cluster != nil {
+		var err error
+		addrs, err = s.cluster.Addresses(ctx)
+		if err != nil {
+			s.logger.WithError(err).Warn("Failed to get cluster node addresses")
+			return nil
+		}
+	} else {
+		addrs = s.pool.Addresses(s.pool.Place(ctx, cid))
+	}
+
+	return ipfs.PublicAddresses(addrs, s.config.Pinning.AllowPrivateAddrs)
+}
+
+// ReportsProgress returns true if pins report their progress
+func (s *NodePoolService) ReportsProgress() bool {
+	return s.cluster == nil
+}
+
+// LocalSize returns how many bytes of a CID a node holds and the CID's
+// total size
+func (s *NodePoolService) LocalSize(ctx context.Context, nodeID, cid string) (int64, int64, error) {
+	if s.cluster != nil {
+		return 0, 0, fmt.Errorf("IPFS Cluster does not report local sizes")
+	}
+	return s.pool.LocalSize(ctx, nodeID, cid)
+}
+
+// Unpin unpins a CID from every node holding it
+func (s *NodePoolService) Unpin(ctx context.Context, cid string) error {
+	if s.cluster != nil {
+		if err := s.cluster.Unpin(ctx, cid); err != nil {
+			return err
+		}
+		if err := s.placementRepo.Replace(ctx, cid, nil); err != nil {
+			return fmt.Errorf("failed to remove placement: %w", err)
+		}
+		return nil
+	}
+
+	nodeIDs, err := s.placementRepo.GetNodes(ctx, cid)
+	if err != nil {
+		return fmt.Errorf("failed to get placement: %w", err)
+	}
+
+	unpinned, unpinErr := s.pool.Unpin(ctx, cid, nodeIDs)
+
+	// Nodes removed from the pool cannot be reached to unpin
+	for _, nodeID := range nodeIDs {
+		if !s.pool.Has(nodeID) {
+			unpinned = append(unpinned, nodeID)
+		}
+	}
+	if err := s.placementRepo.Remove(ctx, cid, unpinned); err != nil {
+		return fmt.Errorf("failed to remove placement: %w", err)
+	}
+
+	if unpinErr != nil {
+		return fmt.Errorf("failed to unpin CID %s: %w", cid, unpinErr)
+	}
+	return nil
+}
+
+// IsPinned returns true if a healthy node is known to pin a CID
+func (s *NodePoolService) IsPinned(ctx context.Context, cid string) bool {
+	if s.cluster != nil {
+		return s.cluster.IsPinned(ctx, cid)
+	}
+
+	nodeIDs, err := s.placementRepo.GetNodes(ctx, cid)
+	if err != nil {
+		return false
+	}
+	return len(s.pool.IsPinned(ctx, cid, nodeIDs)) > 0
+}
+
+// Cat opens a stream of a CID, preferring the nodes that hold it. The
+// caller must close it.
+func (s *NodePoolService) Cat(ctx context.Context, cid string) (io.ReadCloser, error) {
+	if s.cluster != nil {
+		return s.cluster.Cat(ctx, cid)
+	}
+
+	nodeIDs, _ := s.placementRepo.GetNodes(ctx, cid)
+	return s.pool.Cat(ctx, cid, nodeIDs)
+}
+
+// GetSize returns the size of a CID, preferring the nodes that hold it
+func (s *NodePoolService) GetSize(ctx context.Context, cid string) (int64, error) {
+	if s.cluster != nil {
+		return s.cluster.GetSize(ctx, cid)
+	}
+
+	nodeIDs, _ := s.placementRepo.GetNodes(ctx, cid)
+	return s.pool.GetSize(ctx, cid, nodeIDs)
+}
+
+// Resolve returns the CID at a path below a CID, asking the nodes the CID
+// is placed on since those were dialled to its origins
+func (s *NodePoolService) Resolve(ctx context.Context, cid, path string) (string, error) {
+	if s.cluster != nil {
+		return s.cluster.Resolve(ctx, cid, path)
+	}
+	return s.pool.Resolve(ctx, cid, path, s.pool.Place(ctx, cid))
+}
+
+// GetNodes returns the health and pin count of every node
+func (s *NodePoolService) GetNodes(ctx context.Context) ([]*NodeReport, error) {
+	counts, err := s.placementRepo.CountByNode(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count pins: %w", err)
+	}
+
+	if s.cluster != nil {
+		return s.clusterNodes(ctx, counts)
+	}
+
+	statuses := s.pool.Status(ctx)
+	reports := make([]*NodeReport, len(statuses))
+	for i, status := range statuses {
+		reports[i] = &NodeReport{NodeStatus: status, Pins: counts[status.ID]}
+	}
+	return reports, nil
+}
+
+// GetPinPlacement returns where a user's pin is held in hot storage
+func (s *NodePoolService) GetPinPlacement(ctx context.Context, pinID uuid.UUID, userID string) (*PlacementReport, error) {
+	pin, err := s.pinRepo.GetByID(ctx, pinID)
+	if err != nil || pin.UserID.String() != userID {
+		return nil, fmt.Errorf("pin request not found")
+	}
+
+	return s.GetPlacement(ctx, pin.CID)
+}
+
+// GetPlacement returns where a CID is held in hot storage
+func (s *NodePoolService) GetPlacement(ctx context.Context, cid string) (*PlacementReport, error) {
+	placements, err := s.placementRepo.GetByCID(ctx, cid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get placement: %w", err)
+	}
+
+	report := &PlacementReport{
+		Backend: IPFSBackendKubo,
+		Status:  models.SummarizePlacements(placements, s.required()),
+		Nodes:   placements,
+	}
+	if s.cluster != nil {
+		report.Backend = IPFSBackendCluster
+	}
+	return report, nil
+}
+
+// Rebalance health checks every node, adopts pins that have no recorded
+// placement yet and moves CIDs to the nodes they are placed on. It
+// returns the number of CIDs moved. With IPFS Cluster it syncs pin status
+// from the cluster instead and returns the number of pins recovered.
+func (s *NodePoolService) Rebalance(ctx context.Context) (int, error) {
+	if s.cluster != nil {
+		return s.syncClusterPins(ctx)
+	}
+
+	for _, status := range s.pool.CheckHealth(ctx) {
+		if !status.Healthy {
+			s.logger.WithFields(logrus.Fields{
+				"node_id": status.ID,
+				"api_url": status.APIURL,
+				"error":   status.Error,
+			}).Warn("IPFS node is unhealthy")
+		}
+	}
+
+	if err := s.adopt(ctx); err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	afterCID := ""
+	for {
+		cids, err := s.placementRepo.GetNextCIDs(ctx, afterCID, s.config.IPFS.RebalanceBatchSize)
+		if err != nil {
+			return moved, fmt.Errorf("failed to get placements: %w", err)
+		}
+		if len(cids) == 0 {
+			break
+		}
+
+		for _, cid := range cids {
+			changed, err := s.rebalance(ctx, cid)
+			if err != nil {
+				s.logger.WithError(err).WithField("cid", cid).Warn("Failed to rebalance CID")
+				continue
+			}
+			if changed {
+				moved++
+			}
+		}
+		afterCID = cids[len(cids)-1]
+	}
+
+	return moved, nil
+}
+
+// adopt records where pins without a placement live, such as pins made
+// before the pool existed. CIDs found on no node are pinned through the
+// pool, which fetches them from the network.
+func (s *NodePoolService) adopt(ctx context.Context) error {
+	var allNodes []string
+	for _, status := range s.pool.Status(ctx) {
+		allNodes = append(allNodes, status.ID)
+	}
+
+	afterID := uuid.Nil
+	for {
+		pins, err := s.pinRepo.GetNextUnplaced(ctx, afterID, s.config.IPFS.RebalanceBatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to get unplaced pins: %w", err)
+		}
+		if len(pins) == 0 {
+			return nil
+		}
+
+		for _, pin := range pins {
+			if holders := s.pool.IsPinned(ctx, pin.CID, allNodes); len(holders) > 0 {
+				err = s.placementRepo.Add(ctx, pin.CID, holders)
+			} else {
+				err = s.Pin(ctx, pin.CID)
+			}
+			if err != nil {
+				s.logger.WithError(err).WithField("pin_request_id", pin.ID).Warn("Failed to adopt pin")
+			}
+		}
+		afterID = pins[len(pins)-1].ID
+	}
+}
+
+// rebalance pins a CID on the healthy nodes it is placed on, then unpins
+// it from healthy nodes it no longer belongs on. Copies on unhealthy nodes
+// are left recorded until the node recovers or is removed.
+func (s *NodePoolService) rebalance(ctx context.Context, cid string) (bool, error) {
+	current, err := s.placementRepo.GetNodes(ctx, cid)
+	if err != nil {
+		return false, err
+	}
+
+	target := s.pool.Place(ctx, cid)
+	if len(target) == 0 {
+		return false, fmt.Errorf("no healthy IPFS nodes")
+	}
+
+	holds := make(map[string]bool, len(current))
+	for _, nodeID := range current {
+		holds[nodeID] = true
+	}
+	wanted := make(map[string]bool, len(target))
+	for _, nodeID := range target {
+		wanted[nodeID] = true
+	}
+
+	changed := false
+	for _, nodeID := range target {
+		if holds[nodeID] {
+			continue
+		}
+		// Never drop a copy before the new one is in place
+		if err := s.pool.PinOn(ctx, nodeID, cid); err != nil {
+			return changed, err
+		}
+		if err := s.placementRepo.Add(ctx, cid, []string{nodeID}); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+
+	var extra, gone []string
+	for _, nodeID := range current {
+		switch {
+		case wanted[nodeID]:
+		case !s.pool.Has(nodeID):
+			gone = append(gone, nodeID)
+		case s.pool.Healthy(nodeID):
+			extra = append(extra, nodeID)
+		}
+	}
+
+	unpinned, unpinErr := s.pool.Unpin(ctx, cid, extra)
+	if err := s.placementRepo.Remove(ctx, cid, append(unpinned, gone...)); err != nil {
+		return changed, err
+	}
+	if len(unpinned) > 0 || len(gone) > 0 {
+		changed = true
+	}
+
+	if changed {
+		s.logger.WithFields(logrus.Fields{
+			"cid":  cid,
+			"from": current,
+			"to":   target,
+		}).Info("Rebalanced CID across IPFS nodes")
+	}
+
+	return changed, unpinErr
+}
+
+// Pool returns the pool of Kubo nodes. IPFS Cluster keeps its own pin
+// state, so there is no pool with the cluster backend.
+func (s *NodePoolService) Pool() (*ipfs.Pool, error) {
+	if s.cluster != nil {
+		return nil, fmt.Errorf("IPFS Cluster manages its own pins")
+	}
+	return s.pool, nil
+}
+
+// required returns how many nodes must hold a CID for it to count as
+// pinned
+func (s *NodePoolService) required() int {
+	if s.cluster != nil {
+		return s.cluster.MinReplication()
+	}
+	return s.pool.Replication()
+}
+
+// syncCluster records the cluster's per peer status of a pin and returns
+// it
+func (s *NodePoolService) syncCluster(ctx context.Context, cid string) (*ipfs.ClusterPinStatus, error) {
+	status, err := s.cluster.Status(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+
+	var placements []*models.PinPlacement
+	for peerID, peer := range status.PeerMap {
+		placement := &models.PinPlacement{ID: uuid.New(), CID: cid, NodeID: peerID, Error: peer.Error}
+		switch peer.Status {
+		case ipfs.ClusterStatusPinned:
+			placement.Status = models.PlacementStatusPinned
+		case ipfs.ClusterStatusPinning, ipfs.ClusterStatusQueued:
+			placement.Status = models.PlacementStatusPinning
+		case ipfs.ClusterStatusPinError, ipfs.ClusterStatusClusterError:
+			placement.Status = models.PlacementStatusError
+		default:
+			// Peers not allocated the pin report it as remote
+			continue
+		}
+		placements = append(placements, placement)
+	}
+
+	if err := s.placementRepo.Replace(ctx, cid, placements); err != nil {
+		return nil, fmt.Errorf("failed to record placement: %w", err)
+	}
+	return status, nil
+}
+
+// syncClusterPins submits pins the cluster does not track yet, records the
+// status of every tracked pin and asks the cluster to recover failed ones
+func (s *NodePoolService) syncClusterPins(ctx context.Context) (int, error) {
+	afterID := uuid.Nil
+	for {
+		pins, err := s.pinRepo.GetNextUnplaced(ctx, afterID, s.config.IPFS.RebalanceBatchSize)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get unplaced pins: %w", err)
+		}
+		if len(pins) == 0 {
+			break
+		}
+
+		for _, pin := range pins {
+			// The cluster pins in the background; the status is picked
+			// up on the next sync
+			err := s.cluster.PinWithReplication(ctx, pin.CID, s.config.IPFS.Cluster.ReplicationMin, s.config.IPFS.Cluster.ReplicationMax)
+			if err == nil {
+				_, err = s.syncCluster(ctx, pin.CID)
+			}
+			if err != nil {
+				s.logger.WithError(err).WithField("pin_request_id", pin.ID).Warn("Failed to adopt pin into cluster")
+			}
+		}
+		afterID = pins[len(pins)-1].ID
+	}
+
+	recovered := 0
+	afterCID := ""
+	for {
+		cids, err := s.placementRepo.GetNextCIDs(ctx, afterCID, s.config.IPFS.RebalanceBatchSize)
+		if err != nil {
+			return recovered, fmt.Errorf("failed to get placements: %w", err)
+		}
+		if len(cids) == 0 {
+			return recovered, nil
+		}
+
+		for _, cid := range cids {
+			status, err := s.syncCluster(ctx, cid)
+			if err != nil {
+				s.logger.WithError(err).WithField("cid", cid).Warn("Failed to sync cluster pin status")
+				continue
+			}
+			if !status.Failed() {
+				continue
+			}
+
+			if err := s.cluster.Recover(ctx, cid); err != nil {
+				s.logger.WithError(err).WithField("cid", cid).Warn("Failed to recover cluster pin")
+				continue
+			}
+			recovered++
+		}
+		afterCID = cids[len(cids)-1]
+	}
+}
+
+// clusterNodes reports the peers of the cluster
+func (s *NodePoolService) clusterNodes(ctx context.Context, counts map[string]int64) ([]*NodeReport, error) {
+	peers, err := s.cluster.Peers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	reports := make([]*NodeReport, len(peers))
+	for i, peer := range peers {
+		report := &NodeReport{
+			NodeStatus: ipfs.NodeStatus{
+				ID:        peer.ID,
+				Healthy:   peer.Healthy(),
+				PeerID:    peer.IPFS.ID,
+				Version:   peer.Version,
+				CheckedAt: now,
+			},
+			Pins: counts[peer.ID],
+		}
+		if peer.Error != "" {
+			report.Error = peer.Error
+		} else {
+			report.Error = peer.IPFS.Error
+		}
+		reports[i] = report
+	}
+	return reports, nil
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+)
+
+// NotificationsChannel is the Redis channel new notifications are published on
+const NotificationsChannel = "notifications"
+
+type NotificationService struct {
+	notificationRepo storage.NotificationRepository
+	redisClient      *redis.Client
+	logger           *logrus.Logger
+}
+
+func NewNotificationService(notificationRepo storage.NotificationRepository, redisClient *redis.Client, logger *logrus.Logger) *NotificationService {
+	return &NotificationService{
+		notificationRepo: notificationRepo,
+		redisClient:      redisClient,
+		logger:           logger,
+	}
+}
+
+// Notify records a notification for a user. Notifications with a key that
+// has already been used are dropped, so callers can notify on every run
+// without spamming the user.
+func (s *NotificationService) Notify(ctx context.Context, userID uuid.UUID, notificationType, key, message string, data map[string]interface{}) error {
+	notification := &models.Notification{
+		ID:      uuid.New(),
+		UserID:  userID,
+		Type:    notificationType,
+		Message: message,
+		Key:     key,
+	}
+
+	if data != nil {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return fmt.Errorf("failed to encode notification data: %w", err)
+		}
+		notification.Data = string(encoded)
+	}
+
+	created, err := s.notificationRepo.Create(ctx, notification)
+	if err != nil {
+		return fmt.Errorf("failed to create notification: %w", err)
+	}
+	if !created {
+		return nil
+	}
+
+	payload, err := json.Marshal(notification)
+	if err == nil {
+		if err := s.redisClient.Publish(ctx, NotificationsChannel, payload).Err(); err != nil {
+			s.logger.WithError(err).WithField("type", notificationType).Warn("Failed to publish notification")
+		}
+	}
+
+	return nil
+}
+
+// GetUserNotifications lists a user's notifications, newest first
+func (s *NotificationService) GetUserNotifications(ctx context.Context, userID string, page, limit int) ([]*models.Notification, int64, error) {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid user ID: %w", err)
+	}
+	return s.notificationRepo.GetByUserID(ctx, userUUID, page, limit)
+}
+
+// MarkRead marks one of the user's notifications as read
+func (s *NotificationService) MarkRead(ctx context.Context, id uuid.UUID, userID string) error {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return fmt.Errorf("invalid user ID: %w", err)
+	}
+	return s.notificationRepo.MarkRead(ctx, id, userUUID)
+}
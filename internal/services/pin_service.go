@@ -0,0 +1,422 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gocraft/work"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/ipfs"
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+	"pinning-service/pkg/utils"
+)
+
+const (
+	// JobProcessPin is the job that fetches and pins a pin request's
+	// content and then makes its deals
+	JobProcessPin = "process_pin"
+	// JobRetryPins is the job that retries stalled, failed and abandoned
+	// pinning attempts
+	JobRetryPins = "retry_pins"
+)
+
+// retryBatchSize bounds how many pins one retry pass picks up
+const retryBatchSize = 500
+
+var (
+	errPinStalled   = errors.New("pin made no progress")
+	errPinCancelled = errors.New("pin request is no longer being pinned")
+)
+
+// PinService fetches the content of pin requests into IPFS. Large DAGs
+// can take hours to fetch, so pins run without a timeout and their
+// progress (blocks walked and bytes held) is saved periodically along
+// with a heartbeat. A pin that makes no progress for the stall timeout is
+// cancelled and retried, and a pin whose worker died is picked up again
+// once its heartbeat goes stale; blocks fetched by earlier attempts stay
+// in the node's blockstore, so retries resume where they left off.
+//
+// The size of a pin by CID is unknown until it is fetched, so a pin that
+// turns out to take its account over its storage quota or balance is
+// failed and its content released.
+type PinService struct {
+	nodePool       *NodePoolService
+	contentService *ContentService
+	quotaService   *QuotaService
+	pinRepo        storage.PinRequestRepository
+	enqueuer       *work.Enqueuer
+	config         *config.Config
+	logger         *logrus.Logger
+}
+
+func NewPinService(nodePool *NodePoolService, contentService *ContentService, quotaService *QuotaService, pinRepo storage.PinRequestRepository, enqueuer *work.Enqueuer, cfg *config.Config, logger *logrus.Logger) *PinService {
+	return &PinService{
+		nodePool:       nodePool,
+		contentService: contentService,
+		quotaService:   quotaService,
+		pinRepo:        pinRepo,
+		enqueuer:       enqueuer,
+		config:         cfg,
+		logger:         logger,
+	}
+}
+
+// CreatePinRequest records a new pin request and queues it for pinning. It
+// returns a quota error if the account holds or has pending as many pins
+// as its quota allows.
+func (s *PinService) CreatePinRequest(ctx context.Context, pin *models.PinRequest) error {
+	limits, err := s.quotaService.PinLimits(ctx, pin.UserID)
+	if err != nil {
+		return err
+	}
+	if err := s.pinRepo.CreateWithinLimits(ctx, pin, limits); err != nil {
+		if err = limitError(err); QuotaExceeded(err) {
+			return err
+		}
+		return fmt.Errorf("failed to create pin request: %w", err)
+	}
+
+	if _, err := s.enqueuer.EnqueueUnique(JobProcessPin, map[string]interface{}{
+		"pin_id": pin.ID.String(),
+	}); err != nil {
+		return fmt.Errorf("failed to queue pin request: %w", err)
+	}
+
+	return nil
+}
+
+// PinContent pins a pin request's content, saving progress as it goes. It
+// returns true once the content is pinned, and false without an error if
+// the request is not pending or another worker is pinning it.
+func (s *PinService) PinContent(ctx context.Context, pinID uuid.UUID) (bool, error) {
+	pin, err := s.pinRepo.GetByID(ctx, pinID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get pin request: %w", err)
+	}
+	if pin.Status == models.PinStatusPinned {
+		return true, nil
+	}
+
+	claimed, err := s.pinRepo.ClaimPin(ctx, pinID, time.Now().Add(-s.heartbeatTimeout()))
+	if err != nil {
+		return false, fmt.Errorf("failed to claim pin request: %w", err)
+	}
+	if !claimed {
+		s.logger.WithFields(logrus.Fields{
+			"pin_id": pinID,
+			"status": pin.Status,
+		}).Info("Pin request is not waiting to be pinned, skipping")
+		return false, nil
+	}
+	attempt := pin.PinAttempts + 1
+
+	s.logger.WithFields(logrus.Fields{
+		"pin_id":  pinID,
+		"cid":     pin.CID,
+		"attempt": attempt,
+	}).Info("Pinning content")
+
+	// Dial the peers the user says hold the content; fresh content is
+	// often not announced to the DHT yet
+	release := s.nodePool.PeerWithOrigins(ctx, pin.CID, pin.OriginAddrs())
+	defer release()
+
+	if pin.Path != "" {
+		if err := s.resolvePath(ctx, pin); err != nil {
+			return false, s.failAttempt(ctx, pinID, attempt, err)
+		}
+		// The resolved CID may be placed on other nodes
+		releaseResolved := s.nodePool.PeerWithOrigins(ctx, pin.CID, pin.OriginAddrs())
+		defer releaseResolved()
+	}
+
+	// Content another pin already stores only needs a reference
+	content, err := s.contentService.Share(ctx, pin)
+	if err != nil {
+		return false, s.failAttempt(ctx, pinID, attempt, err)
+	}
+	if content != nil {
+		return s.markPinned(ctx, pin, content.SizeBytes)
+	}
+
+	tracker := &pinTracker{maxBlocks: pin.BlocksFetched, maxBytes: pin.BytesFetched, activeAt: time.Now()}
+	pinCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.watch(pinCtx, cancel, pin, tracker)
+	}()
+
+	err = s.nodePool.PinWithProgress(pinCtx, pin.CID, tracker.report)
+	cause := context.Cause(pinCtx)
+	cancel(nil)
+	wg.Wait()
+
+	if err != nil {
+		if errors.Is(cause, errPinCancelled) {
+			return false, nil
+		}
+		if errors.Is(cause, errPinStalled) {
+			err = fmt.Errorf("%w for %s", errPinStalled, s.config.Pinning.StallTimeout)
+		}
+
+		return false, s.failAttempt(ctx, pinID, attempt, err)
+	}
+
+	size, err := s.nodePool.GetSize(ctx, pin.CID)
+	if err != nil {
+		s.logger.WithError(err).WithField("cid", pin.CID).Warn("Failed to get size of pinned content")
+	}
+	if _, err := s.contentService.Attach(ctx, pin, size); err != nil {
+		return false, err
+	}
+
+	return s.markPinned(ctx, pin, size)
+}
+
+// markPinned completes a pin that references its content, once the
+// account's storage quota and balance allow for its size. A pin they do
+// not allow is failed and its reference released.
+func (s *PinService) markPinned(ctx context.Context, pin *models.PinRequest, size int64) (bool, error) {
+	limits, err := s.quotaService.PinLimits(ctx, pin.UserID)
+	if err != nil {
+		return false, err
+	}
+
+	quotaErr := s.quotaService.CheckPinned(ctx, pin, size)
+	if quotaErr == nil {
+		quotaErr = limitError(s.pinRepo.MarkPinned(ctx, pin.ID, size, limits.MaxBytes))
+	}
+	if quotaErr == nil {
+		return true, nil
+	}
+	if !QuotaExceeded(quotaErr) {
+		return false, fmt.Errorf("failed to mark pin request pinned: %w", quotaErr)
+	}
+
+	s.logger.WithError(quotaErr).WithFields(logrus.Fields{
+		"pin_id":     pin.ID,
+		"size_bytes": size,
+	}).Warn("Pin exceeds the account's quota, failing it")
+
+	if err := s.contentService.Release(ctx, pin.ID); err != nil {
+		return false, err
+	}
+	if err := s.pinRepo.ReleasePin(ctx, pin.ID, quotaErr.Error(), true); err != nil {
+		return false, fmt.Errorf("failed to fail pin request: %w", err)
+	}
+	return false, nil
+}
+
+// resolvePath resolves the path below a pin request's CID and pins the CID
+// it points at instead
+func (s *PinService) resolvePath(ctx context.Context, pin *models.PinRequest) error {
+	resolved, err := s.nodePool.Resolve(ctx, pin.CID, pin.Path)
+	if err != nil {
+		return err
+	}
+	resolved, err = utils.NormalizeCID(resolved)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s%s: %w", pin.CID, pin.Path, err)
+	}
+	if err := s.pinRepo.ResolvePath(ctx, pin.ID, resolved); err != nil {
+		return fmt.Errorf("failed to save resolved CID: %w", err)
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"pin_id":   pin.ID,
+		"path":     pin.CID + pin.Path,
+		"resolved": resolved,
+	}).Info("Resolved pin path")
+
+	pin.CID, pin.Path = resolved, ""
+	return nil
+}
+
+// failAttempt ends a failed pinning attempt, failing the pin request once it
+// is out of attempts, and returns err
+func (s *PinService) failAttempt(ctx context.Context, pinID uuid.UUID, attempt int, err error) error {
+	failed := attempt >= s.config.Pinning.MaxAttempts
+	if releaseErr := s.pinRepo.ReleasePin(ctx, pinID, err.Error(), failed); releaseErr != nil {
+		s.logger.WithError(releaseErr).WithField("pin_id", pinID).Error("Failed to release pin request")
+	}
+	return err
+}
+
+// ValidateOrigins checks the origin multiaddrs of a pin request and
+// returns them in canonical form
+func (s *PinService) ValidateOrigins(origins []string) ([]string, error) {
+	if max := s.config.Pinning.MaxOrigins; len(origins) > max {
+		return nil, fmt.Errorf("at most %d origins are allowed", max)
+	}
+
+	seen := make(map[string]bool, len(origins))
+	canonical := make([]string, 0, len(origins))
+	for _, origin := range origins {
+		addr, _, err := ipfs.ParseOrigin(origin, s.config.Pinning.AllowPrivateAddrs)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[addr] {
+			seen[addr] = true
+			canonical = append(canonical, addr)
+		}
+	}
+	return canonical, nil
+}
+
+// RetryPins queues another attempt for pins whose last attempt failed or
+// whose worker stopped sending heartbeats, and fails those that are out of
+// attempts. It returns how many pins were retried or failed.
+func (s *PinService) RetryPins(ctx context.Context) (int, error) {
+	pins, err := s.pinRepo.GetOrphanedPins(ctx, time.Now().Add(-s.heartbeatTimeout()), retryBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get orphaned pins: %w", err)
+	}
+
+	handled := 0
+	for _, pin := range pins {
+		if pin.PinAttempts >= s.config.Pinning.MaxAttempts {
+			pinError := pin.PinError
+			if pinError == "" {
+				pinError = "pinning was interrupted"
+			}
+			if err := s.pinRepo.ReleasePin(ctx, pin.ID, fmt.Sprintf("gave up after %d attempts: %s", pin.PinAttempts, pinError), true); err != nil {
+				s.logger.WithError(err).WithField("pin_id", pin.ID).Error("Failed to fail pin request")
+				continue
+			}
+			handled++
+			continue
+		}
+
+		// Unique so a pin is not queued again while an attempt is waiting
+		if _, err := s.enqueuer.EnqueueUnique(JobProcessPin, map[string]interface{}{
+			"pin_id": pin.ID.String(),
+		}); err != nil {
+			s.logger.WithError(err).WithField("pin_id", pin.ID).Error("Failed to enqueue pin retry")
+			continue
+		}
+		handled++
+	}
+
+	return handled, nil
+}
+
+// watch saves a pin's progress every progress interval until ctx is done,
+// cancelling the pin if it stalls or the request stops being pinned
+func (s *PinService) watch(ctx context.Context, cancel context.CancelCauseFunc, pin *models.PinRequest, tracker *pinTracker) {
+	ticker := time.NewTicker(s.config.Pinning.ProgressInterval)
+	defer ticker.Stop()
+
+	tracksProgress := s.nodePool.ReportsProgress()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var totalBytes int64
+		if nodeID := tracker.currentNode(); nodeID != "" {
+			local, total, err := s.nodePool.LocalSize(ctx, nodeID, pin.CID)
+			if err == nil {
+				tracker.reportBytes(local)
+				totalBytes = total
+			}
+		}
+
+		blocks, bytes, activeAt, advanced := tracker.snapshot()
+		still, err := s.pinRepo.UpdatePinProgress(ctx, pin.ID, blocks, bytes, totalBytes, advanced)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger.WithError(err).WithField("pin_id", pin.ID).Warn("Failed to save pin progress")
+			}
+		} else if !still {
+			cancel(errPinCancelled)
+			return
+		}
+
+		if tracksProgress && time.Since(activeAt) > s.config.Pinning.StallTimeout {
+			s.logger.WithFields(logrus.Fields{
+				"pin_id": pin.ID,
+				"cid":    pin.CID,
+				"blocks": blocks,
+			}).Warn("Pin stalled, cancelling")
+			cancel(errPinStalled)
+			return
+		}
+	}
+}
+
+// heartbeatTimeout is how long after its last heartbeat an attempt is
+// considered abandoned. Saving progress can wait on a slow node, so it
+// allows a few missed intervals.
+func (s *PinService) heartbeatTimeout() time.Duration {
+	return 3*s.config.Pinning.ProgressInterval + s.config.IPFS.Timeout
+}
+
+// pinTracker collects the progress reported while a pin runs. Block and
+// byte counts only grow, since each node and each attempt counts from
+// zero again.
+type pinTracker struct {
+	mu         sync.Mutex
+	node       string
+	lastBlocks int64
+	maxBlocks  int64
+	maxBytes   int64
+	activeAt   time.Time
+	advanced   bool
+}
+
+func (t *pinTracker) report(nodeID string, blocks int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if nodeID != t.node || blocks != t.lastBlocks {
+		t.activeAt = time.Now()
+		t.advanced = true
+	}
+	t.node = nodeID
+	t.lastBlocks = blocks
+	if blocks > t.maxBlocks {
+		t.maxBlocks = blocks
+	}
+}
+
+func (t *pinTracker) reportBytes(bytes int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if bytes > t.maxBytes {
+		t.maxBytes = bytes
+		t.activeAt = time.Now()
+		t.advanced = true
+	}
+}
+
+func (t *pinTracker) currentNode() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.node
+}
+
+// snapshot returns the progress so far and whether it advanced since the
+// last snapshot
+func (t *pinTracker) snapshot() (int64, int64, time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	advanced := t.advanced
+	t.advanced = false
+	return t.maxBlocks, t.maxBytes, t.activeAt, advanced
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+// fakePinRepo records the limits pins are created and completed with and
+// answers with canned errors
+type fakePinRepo struct {
+	storage.PinRequestRepository
+	createErr error
+	markErr   error
+
+	created  *storage.PinLimits
+	marked   []int64 // size and max bytes
+	released string
+	failed   bool
+}
+
+func (r *fakePinRepo) CreateWithinLimits(ctx context.Context, pin *models.PinRequest, limits storage.PinLimits) error {
+	r.created = &limits
+	return r.createErr
+}
+
+func (r *fakePinRepo) MarkPinned(ctx context.Context, id uuid.UUID, sizeBytes, maxBytes int64) error {
+	r.marked = []int64{sizeBytes, maxBytes}
+	return r.markErr
+}
+
+func (r *fakePinRepo) ReleasePin(ctx context.Context, id uuid.UUID, pinError string, failed bool) error {
+	r.released, r.failed = pinError, failed
+	return nil
+}
+
+type fakeContentRepo struct {
+	storage.ContentRepository
+	released []uuid.UUID
+}
+
+func (r *fakeContentRepo) Release(ctx context.Context, pinID uuid.UUID) (*models.Content, error) {
+	r.released = append(r.released, pinID)
+	return nil, nil
+}
+
+type fakeQuotaRepo struct {
+	storage.QuotaRepository
+	override *models.AccountQuota
+}
+
+func (r *fakeQuotaRepo) GetQuota(ctx context.Context, userID uuid.UUID) (*models.AccountQuota, error) {
+	return r.override, nil
+}
+
+type fakeUserRepo struct {
+	storage.UserRepository
+	balance decimal.Decimal
+}
+
+func (r *fakeUserRepo) GetByID(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	return &models.User{ID: id, Balance: r.balance}, nil
+}
+
+type pinHarness struct {
+	service     *PinService
+	pinRepo     *fakePinRepo
+	contentRepo *fakeContentRepo
+	quotaRepo   *fakeQuotaRepo
+	userRepo    *fakeUserRepo
+	config      *config.Config
+}
+
+func newPinHarness() *pinHarness {
+	cfg := &config.Config{}
+	cfg.Quotas.Enabled = true
+	cfg.Quotas.MaxBytes = 1 << 30
+	cfg.Quotas.MaxPins = 100
+	cfg.Quotas.MaxPendingPins = 10
+	cfg.Pricing.BasePricePerGBPerMonth = 0.01
+	cfg.Pinning.MaxAttempts = 3
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	h := &pinHarness{
+		pinRepo:     &fakePinRepo{},
+		contentRepo: &fakeContentRepo{},
+		quotaRepo:   &fakeQuotaRepo{},
+		userRepo:    &fakeUserRepo{balance: decimal.NewFromInt(1)},
+		config:      cfg,
+	}
+	pricing := NewPricingService(cfg)
+	quota := NewQuotaService(pricing, h.userRepo, h.quotaRepo, nil, nil, cfg, logger)
+	content := NewContentService(nil, pricing, h.contentRepo, h.pinRepo, cfg, logger)
+	h.service = NewPinService(nil, content, quota, h.pinRepo, nil, cfg, logger)
+	return h
+}
+
+func TestCreatePinRequestEnforcesLimits(t *testing.T) {
+	maxPending := 2
+	for _, tc := range []struct {
+		err  error
+		want error
+	}{
+		{storage.ErrPinLimitReached, ErrPinQuotaExceeded},
+		{storage.ErrPendingLimitReached, ErrTooManyPendingPins},
+		{storage.ErrByteLimitReached, ErrStorageQuotaExceeded},
+	} {
+		t.Run(tc.want.Error(), func(t *testing.T) {
+			h := newPinHarness()
+			h.quotaRepo.override = &models.AccountQuota{MaxPendingPins: &maxPending}
+			h.pinRepo.createErr = fmt.Errorf("%w: 2 of 2 used", tc.err)
+
+			err := h.service.CreatePinRequest(context.Background(), &models.PinRequest{ID: uuid.New(), UserID: uuid.New()})
+			if !errors.Is(err, tc.want) || !QuotaExceeded(err) {
+				t.Fatalf("err = %v, want %v", err, tc.want)
+			}
+
+			want := storage.PinLimits{MaxBytes: 1 << 30, MaxPins: 100, MaxPendingPins: 2}
+			if h.pinRepo.created == nil || *h.pinRepo.created != want {
+				t.Fatalf("created with limits %+v, want %+v", h.pinRepo.created, want)
+			}
+		})
+	}
+
+	t.Run("other errors", func(t *testing.T) {
+		h := newPinHarness()
+		h.pinRepo.createErr = errors.New("connection reset")
+
+		err := h.service.CreatePinRequest(context.Background(), &models.PinRequest{ID: uuid.New(), UserID: uuid.New()})
+		if err == nil || QuotaExceeded(err) {
+			t.Fatalf("err = %v, want a failure that is not a quota error", err)
+		}
+	})
+
+	t.Run("quotas disabled", func(t *testing.T) {
+		h := newPinHarness()
+		h.config.Quotas.Enabled = false
+		h.pinRepo.createErr = errors.New("stop before queueing")
+
+		h.service.CreatePinRequest(context.Background(), &models.PinRequest{ID: uuid.New(), UserID: uuid.New()})
+		if h.pinRepo.created == nil || *h.pinRepo.created != (storage.PinLimits{}) {
+			t.Fatalf("created with limits %+v, want none", h.pinRepo.created)
+		}
+	})
+}
+
+func TestMarkPinnedRechecksQuota(t *testing.T) {
+	ctx := context.Background()
+	newPin := func() *models.PinRequest {
+		return &models.PinRequest{ID: uuid.New(), UserID: uuid.New(), DurationDays: 30, Tier: models.TierHotCold}
+	}
+
+	t.Run("within quota", func(t *testing.T) {
+		h := newPinHarness()
+
+		pinned, err := h.service.markPinned(ctx, newPin(), 1<<20)
+		if err != nil || !pinned {
+			t.Fatalf("markPinned = %v, %v, want pinned", pinned, err)
+		}
+		if len(h.pinRepo.marked) != 2 || h.pinRepo.marked[0] != 1<<20 || h.pinRepo.marked[1] != 1<<30 {
+			t.Fatalf("marked pinned with %v, want size 1 MiB and limit 1 GiB", h.pinRepo.marked)
+		}
+		if h.pinRepo.released != "" || len(h.contentRepo.released) != 0 {
+			t.Fatal("released a pin within quota")
+		}
+	})
+
+	t.Run("over storage quota", func(t *testing.T) {
+		h := newPinHarness()
+		h.pinRepo.markErr = fmt.Errorf("%w: 900 of 1000 bytes used", storage.ErrByteLimitReached)
+		pin := newPin()
+
+		pinned, err := h.service.markPinned(ctx, pin, 200)
+		if err != nil || pinned {
+			t.Fatalf("markPinned = %v, %v, want the pin failed without an error", pinned, err)
+		}
+		if !h.pinRepo.failed || h.pinRepo.released == "" {
+			t.Fatalf("pin released with failed = %v, %q, want it failed", h.pinRepo.failed, h.pinRepo.released)
+		}
+		if len(h.contentRepo.released) != 1 || h.contentRepo.released[0] != pin.ID {
+			t.Fatalf("released content of %v, want the pin's", h.contentRepo.released)
+		}
+	})
+
+	t.Run("balance", func(t *testing.T) {
+		h := newPinHarness()
+		h.config.Quotas.EnforceBalance = true
+		h.userRepo.balance = decimal.RequireFromString("0.001")
+
+		// A minimum price passed when the pin was submitted, but 100 GiB
+		// costs more than the balance
+		pinned, err := h.service.markPinned(ctx, newPin(), 100<<30)
+		if err != nil || pinned {
+			t.Fatalf("markPinned = %v, %v, want the pin failed without an error", pinned, err)
+		}
+		if h.pinRepo.marked != nil {
+			t.Fatal("marked pinned a pin the account cannot pay for")
+		}
+		if !h.pinRepo.failed || len(h.contentRepo.released) != 1 {
+			t.Fatal("pin was not failed and released")
+		}
+
+		h = newPinHarness()
+		h.config.Quotas.EnforceBalance = true
+		if pinned, err := h.service.markPinned(ctx, newPin(), 1<<20); err != nil || !pinned {
+			t.Fatalf("markPinned = %v, %v, want pinned within balance", pinned, err)
+		}
+	})
+
+	t.Run("repository error", func(t *testing.T) {
+		h := newPinHarness()
+		h.pinRepo.markErr = errors.New("connection reset")
+
+		if _, err := h.service.markPinned(ctx, newPin(), 200); err == nil {
+			t.Fatal("markPinned hid a repository error")
+		}
+		if h.pinRepo.released != "" {
+			t.Fatal("failed a pin on a repository error")
+		}
+	})
+}
@@ -1,9 +1,15 @@
 package services
 
 import (
+	"github.com/shopspring/decimal"
+
+	"pinning-service/internal/models"
 	"pinning-service/pkg/config"
 )
 
+// attoFILPlaces is the number of decimal places of the smallest FIL unit
+const attoFILPlaces = 18
+
 type PricingService struct {
 	config *config.Config
 }
@@ -16,24 +22,65 @@ func NewPricingService(config *config.Config) *PricingService {
 
 // CalculatePrice calculates storage price in FIL
 func (s *PricingService) CalculatePrice(sizeBytes int64, durationDays int) float64 {
-	// Convert bytes to GB
-	sizeGB := float64(sizeBytes) / (1024 * 1024 * 1024)
+	return s.CalculatePriceFIL(sizeBytes, durationDays).InexactFloat64()
+}
+
+// CalculatePriceFIL is CalculatePrice in exact decimal arithmetic, for
+// amounts that are charged to the ledger
+func (s *PricingService) CalculatePriceFIL(sizeBytes int64, durationDays int) decimal.Decimal {
+	return s.calculate(sizeBytes, durationDays, s.config.Pricing.BasePricePerGBPerMonth)
+}
+
+// CalculateVerifiedPrice calculates the price in FIL of storage made with
+// verified deals, which providers accept for free
+func (s *PricingService) CalculateVerifiedPrice(sizeBytes int64, durationDays int) float64 {
+	return s.CalculateVerifiedPriceFIL(sizeBytes, durationDays).InexactFloat64()
+}
 
-	// Convert days to months for pricing calculation
-	durationMonths := float64(durationDays) / 30.0
+// CalculateVerifiedPriceFIL is CalculateVerifiedPrice in exact decimal
+// arithmetic
+func (s *PricingService) CalculateVerifiedPriceFIL(sizeBytes int64, durationDays int) decimal.Decimal {
+	return s.calculate(sizeBytes, durationDays, s.config.Pricing.VerifiedPricePerGBPerMonth)
+}
+
+// CalculateTierPrice calculates the price in FIL of storage in a tier.
+// A hot_cold pin with hotDays set pays for both tiers for its first
+// hotDays and for cold storage after that.
+func (s *PricingService) CalculateTierPrice(tier string, hotDays int, sizeBytes int64, durationDays int) float64 {
+	return s.CalculateTierPriceFIL(tier, hotDays, sizeBytes, durationDays).InexactFloat64()
+}
 
-	// Base price calculation
-	basePrice := sizeGB * durationMonths * s.config.Pricing.BasePricePerGBPerMonth
+// CalculateTierPriceFIL is CalculateTierPrice in exact decimal arithmetic
+func (s *PricingService) CalculateTierPriceFIL(tier string, hotDays int, sizeBytes int64, durationDays int) decimal.Decimal {
+	switch tier {
+	case models.TierHot:
+		return s.calculate(sizeBytes, durationDays, s.config.Pricing.HotPricePerGBPerMonth)
+	case models.TierCold:
+		return s.calculate(sizeBytes, durationDays, s.config.Pricing.ColdPricePerGBPerMonth)
+	}
+
+	if hotDays <= 0 || hotDays >= durationDays {
+		return s.CalculatePriceFIL(sizeBytes, durationDays)
+	}
+	return s.CalculatePriceFIL(sizeBytes, hotDays).Add(s.CalculateTierPriceFIL(models.TierCold, 0, sizeBytes, durationDays-hotDays))
+}
 
-	// Apply markup
-	markup := basePrice * (s.config.Pricing.MarkupPercentage / 100.0)
-	totalPrice := basePrice + markup
+// calculate prices storage at a rate per GB per month of 30 days, plus
+// markup, rounded to attoFIL. Everything is multiplied out before the one
+// division so no precision is lost along the way.
+func (s *PricingService) calculate(sizeBytes int64, durationDays int, basePricePerGBPerMonth float64) decimal.Decimal {
+	gbMonth := decimal.NewFromInt(1024 * 1024 * 1024 * 30)
+	hundred := decimal.NewFromInt(100)
+	rate := decimal.NewFromFloat(basePricePerGBPerMonth).Mul(decimal.NewFromInt(int64(durationDays)))
+
+	// Base price plus markup
+	markup := hundred.Add(decimal.NewFromFloat(s.config.Pricing.MarkupPercentage))
+	totalPrice := decimal.NewFromInt(sizeBytes).Mul(rate).Mul(markup).DivRound(gbMonth.Mul(hundred), attoFILPlaces)
 
 	// Ensure minimum price
 	if sizeBytes < s.config.Pricing.MinimumDealSize {
-		minPrice := float64(s.config.Pricing.MinimumDealSize) / (1024 * 1024 * 1024) *
-			durationMonths * s.config.Pricing.BasePricePerGBPerMonth
-		if totalPrice < minPrice {
+		minPrice := decimal.NewFromInt(s.config.Pricing.MinimumDealSize).Mul(rate).DivRound(gbMonth, attoFILPlaces)
+		if totalPrice.LessThan(minPrice) {
 			totalPrice = minPrice
 		}
 	}
@@ -41,12 +88,56 @@ func (s *PricingService) CalculatePrice(sizeBytes int64, durationDays int) float
 	return totalPrice
 }
 
+// CalculateAggregateShare calculates the price of a pin stored as part of
+// an aggregate: its proportional share of the aggregate's price, so small
+// pins do not each pay the minimum deal size
+func (s *PricingService) CalculateAggregateShare(sizeBytes, aggregateSize int64, durationDays int) float64 {
+	return s.CalculateAggregateShareFIL(sizeBytes, aggregateSize, durationDays).InexactFloat64()
+}
+
+// CalculateAggregateShareFIL is CalculateAggregateShare in exact decimal
+// arithmetic
+func (s *PricingService) CalculateAggregateShareFIL(sizeBytes, aggregateSize int64, durationDays int) decimal.Decimal {
+	return shareOf(s.CalculatePriceFIL(aggregateSize, durationDays), sizeBytes, aggregateSize)
+}
+
+// shareOf splits an amount in proportion to size, rounded to attoFIL
+func shareOf(amount decimal.Decimal, sizeBytes, totalSize int64) decimal.Decimal {
+	if totalSize == 0 {
+		return decimal.Zero
+	}
+	return amount.Mul(decimal.NewFromInt(sizeBytes)).DivRound(decimal.NewFromInt(totalSize), attoFILPlaces)
+}
+
+// CalculatePinPriceFIL calculates the price in FIL of storing a pin of the
+// given size for its duration: the verified price for verified pins and the
+// price of its tier otherwise
+func (s *PricingService) CalculatePinPriceFIL(pin *models.PinRequest, sizeBytes int64) decimal.Decimal {
+	if pin.Verified {
+		return s.CalculateVerifiedPriceFIL(sizeBytes, pin.DurationDays)
+	}
+	return s.CalculateTierPriceFIL(pin.Tier, pin.HotDays, sizeBytes, pin.DurationDays)
+}
+
+// CalculateStoredPriceFIL calculates the price of pinning content that is
+// already stored through another pin, which shares its deals: the price
+// the pin would pay otherwise less the stored content discount
+func (s *PricingService) CalculateStoredPriceFIL(price decimal.Decimal) decimal.Decimal {
+	hundred := decimal.NewFromInt(100)
+	discount := decimal.NewFromFloat(s.config.Pricing.StoredContentDiscountPercentage)
+	return price.Mul(hundred.Sub(discount)).DivRound(hundred, attoFILPlaces)
+}
+
 // GetPricingInfo returns current pricing configuration
 func (s *PricingService) GetPricingInfo() map[string]interface{} {
 	return map[string]interface{}{
-		"base_price_per_gb_per_month": s.config.Pricing.BasePricePerGBPerMonth,
-		"markup_percentage":           s.config.Pricing.MarkupPercentage,
-		"minimum_deal_size":           s.config.Pricing.MinimumDealSize,
-		"currency":                    "FIL",
+		"base_price_per_gb_per_month":     s.config.Pricing.BasePricePerGBPerMonth,
+		"markup_percentage":               s.config.Pricing.MarkupPercentage,
+		"minimum_deal_size":               s.config.Pricing.MinimumDealSize,
+		"verified_price_per_gb_per_month": s.config.Pricing.VerifiedPricePerGBPerMonth,
+		"stored_content_discount":         s.config.Pricing.StoredContentDiscountPercentage,
+		"hot_price_per_gb_per_month":      s.config.Pricing.HotPricePerGBPerMonth,
+		"cold_price_per_gb_per_month":     s.config.Pricing.ColdPricePerGBPerMonth,
+		"currency":                        "FIL",
 	}
 }
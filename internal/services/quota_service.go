@@ -0,0 +1,399 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+// Quota errors. Pins that would exceed the account's storage or pin quota
+// are refused, while too many pending pins only has to wait.
+var (
+	ErrStorageQuotaExceeded = errors.New("storage quota exceeded")
+	ErrPinQuotaExceeded     = errors.New("pin quota exceeded")
+	ErrTooManyPendingPins   = errors.New("too many pending pins")
+)
+
+const (
+	quotaRequestsKey = "quota:requests:%s:%d"
+	quotaRateKey     = "quota:rate:%s"
+)
+
+// maxUsageDays bounds the time series returned by GetUsage
+const maxUsageDays = 366
+
+// QuotaLimits are the limits that apply to an account. Zero means
+// unlimited.
+type QuotaLimits struct {
+	MaxBytes          int64 `json:"max_bytes"`
+	MaxPins           int64 `json:"max_pins"`
+	RequestsPerMinute int   `json:"requests_per_minute"`
+	MaxPendingPins    int   `json:"max_pending_pins"`
+}
+
+// PinEstimate is what a new pin is known to need before it is submitted.
+// The size of a pin by CID is only known once it is fetched.
+type PinEstimate struct {
+	SizeBytes int64
+	PriceFIL  decimal.Decimal
+}
+
+// UsagePoint is an account's usage on one day
+type UsagePoint struct {
+	Date           string `json:"date"`
+	PinnedBytes    int64  `json:"pinned_bytes"`
+	PeakBytes      int64  `json:"peak_bytes"`
+	PinnedPins     int64  `json:"pinned_pins"`
+	PinsCreated    int64  `json:"pins_created"`
+	BandwidthBytes int64  `json:"bandwidth_bytes"`
+	Requests       int64  `json:"gateway_requests"`
+}
+
+// UsageReport is an account's current usage, its limits and its daily
+// usage over a period
+type UsageReport struct {
+	Usage  *models.AccountUsage `json:"usage"`
+	Limits *QuotaLimits         `json:"limits"`
+	Series []*UsagePoint        `json:"series"`
+}
+
+// AccountQuotaReport is an account's quota override, the limits that
+// result from it and its current usage
+type AccountQuotaReport struct {
+	Override *models.AccountQuota `json:"override,omitempty"`
+	Limits   *QuotaLimits         `json:"limits"`
+	Usage    *models.AccountUsage `json:"usage"`
+}
+
+// QuotaService enforces per-account limits on bytes pinned, pins held,
+// pins waiting to be pinned and API request rate, along with the balance
+// needed to pay for new pins. Limits default to the configured quotas and
+// admins can override them per account. Usage is recounted by the pin
+// request repository whenever a pin changes status.
+type QuotaService struct {
+	userRepo      storage.UserRepository
+	quotaRepo     storage.QuotaRepository
+	bandwidthRepo storage.BandwidthRepository
+	pricing       *PricingService
+	redisClient   *redis.Client
+	config        *config.Config
+	logger        *logrus.Logger
+}
+
+func NewQuotaService(pricingService *PricingService, userRepo storage.UserRepository, quotaRepo storage.QuotaRepository, bandwidthRepo storage.BandwidthRepository, redisClient *redis.Client, cfg *config.Config, logger *logrus.Logger) *QuotaService {
+	return &QuotaService{
+		pricing:       pricingService,
+		userRepo:      userRepo,
+		quotaRepo:     quotaRepo,
+		bandwidthRepo: bandwidthRepo,
+		redisClient:   redisClient,
+		config:        cfg,
+		logger:        logger,
+	}
+}
+
+// QuotaExceeded reports whether an error is a pin refused by an account's
+// quotas or balance
+func QuotaExceeded(err error) bool {
+	return errors.Is(err, ErrStorageQuotaExceeded) || errors.Is(err, ErrPinQuotaExceeded) ||
+		errors.Is(err, ErrTooManyPendingPins) || errors.Is(err, storage.ErrInsufficientBalance)
+}
+
+// CheckPin returns an error if an account may not submit a new pin: it
+// holds as many pins or bytes as its quota allows, has too many pins
+// pending or cannot pay for the pin. It turns away requests early; the
+// pin limits are enforced again when the pin is created, and the byte
+// quota and balance once its size is known.
+func (s *QuotaService) CheckPin(ctx context.Context, userID uuid.UUID, estimate PinEstimate) error {
+	if !s.config.Quotas.Enabled {
+		return nil
+	}
+
+	limits, err := s.limits(ctx, userID)
+	if err != nil {
+		return err
+	}
+	usage, err := s.quotaRepo.GetUsage(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to get usage: %w", err)
+	}
+
+	if limits.MaxPins > 0 && usage.PinnedPins+usage.PendingPins >= limits.MaxPins {
+		return fmt.Errorf("%w: %d of %d pins used", ErrPinQuotaExceeded, usage.PinnedPins+usage.PendingPins, limits.MaxPins)
+	}
+	if limits.MaxBytes > 0 && usage.PinnedBytes+estimate.SizeBytes > limits.MaxBytes {
+		return fmt.Errorf("%w: %d of %d bytes used", ErrStorageQuotaExceeded, usage.PinnedBytes, limits.MaxBytes)
+	}
+	if limits.MaxPendingPins > 0 && usage.PendingPins >= int64(limits.MaxPendingPins) {
+		return fmt.Errorf("%w: %d of %d pending", ErrTooManyPendingPins, usage.PendingPins, limits.MaxPendingPins)
+	}
+
+	if s.config.Quotas.EnforceBalance {
+		return s.checkBalance(ctx, userID, estimate.PriceFIL)
+	}
+
+	return nil
+}
+
+// PinLimits returns the limits that apply when an account creates or
+// completes a pin, or no limits when quotas are disabled
+func (s *QuotaService) PinLimits(ctx context.Context, userID uuid.UUID) (storage.PinLimits, error) {
+	if !s.config.Quotas.Enabled {
+		return storage.PinLimits{}, nil
+	}
+
+	limits, err := s.limits(ctx, userID)
+	if err != nil {
+		return storage.PinLimits{}, err
+	}
+	return storage.PinLimits{
+		MaxBytes:       limits.MaxBytes,
+		MaxPins:        limits.MaxPins,
+		MaxPendingPins: int64(limits.MaxPendingPins),
+	}, nil
+}
+
+// CheckPinned returns an error if an account cannot pay for a pin now
+// that its size is known
+func (s *QuotaService) CheckPinned(ctx context.Context, pin *models.PinRequest, sizeBytes int64) error {
+	if !s.config.Quotas.Enabled || !s.config.Quotas.EnforceBalance {
+		return nil
+	}
+
+	return s.checkBalance(ctx, pin.UserID, s.pricing.CalculatePinPriceFIL(pin, sizeBytes))
+}
+
+// limitError turns an error from a repository enforcing PinLimits into
+// the matching quota error
+func limitError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrByteLimitReached):
+		return fmt.Errorf("%w: %v", ErrStorageQuotaExceeded, err)
+	case errors.Is(err, storage.ErrPinLimitReached):
+		return fmt.Errorf("%w: %v", ErrPinQuotaExceeded, err)
+	case errors.Is(err, storage.ErrPendingLimitReached):
+		return fmt.Errorf("%w: %v", ErrTooManyPendingPins, err)
+	}
+	return err
+}
+
+// checkBalance returns an error if an account's balance is below a price
+func (s *QuotaService) checkBalance(ctx context.Context, userID uuid.UUID, price decimal.Decimal) error {
+	user, err := s.userRepo.GetByID(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+	if user.Balance.LessThan(price) {
+		return fmt.Errorf("%w: %s FIL required, %s FIL available", storage.ErrInsufficientBalance, price, user.Balance)
+	}
+	return nil
+}
+
+// AllowRequest counts an API request against the account's request rate
+// and reports whether it is within it, along with when the current
+// minute ends. Requests are allowed when Redis is unavailable.
+func (s *QuotaService) AllowRequest(ctx context.Context, userID string) (bool, time.Duration) {
+	if !s.config.Quotas.Enabled {
+		return true, 0
+	}
+
+	now := time.Now()
+	minute := now.Unix() / 60
+	retryAfter := time.Unix((minute+1)*60, 0).Sub(now)
+
+	limit, err := s.requestsPerMinute(ctx, userID)
+	if err != nil {
+		s.logger.WithError(err).WithField("user_id", userID).Warn("Failed to get request quota")
+		return true, 0
+	}
+	if limit <= 0 {
+		return true, 0
+	}
+
+	key := fmt.Sprintf(quotaRequestsKey, userID, minute)
+	pipe := s.redisClient.TxPipeline()
+	count := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, 2*time.Minute)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return true, 0
+	}
+
+	return count.Val() <= int64(limit), retryAfter
+}
+
+// GetUsage returns an account's usage, its limits and its daily usage
+// between two dates. Days without changes carry the previous day's usage.
+func (s *QuotaService) GetUsage(ctx context.Context, userID string, from, to time.Time) (*UsageReport, error) {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	from, to = from.Truncate(24*time.Hour), to.Truncate(24*time.Hour)
+	if to.Before(from) || to.Sub(from) > maxUsageDays*24*time.Hour {
+		return nil, fmt.Errorf("invalid date range")
+	}
+
+	limits, err := s.limits(ctx, userUUID)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := s.quotaRepo.GetUsage(ctx, userUUID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get usage: %w", err)
+	}
+
+	days, err := s.quotaRepo.GetDaily(ctx, userUUID, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get daily usage: %w", err)
+	}
+	bandwidth, err := s.bandwidthRepo.GetByUserID(ctx, userUUID, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bandwidth usage: %w", err)
+	}
+
+	byDate := make(map[string]*models.UsageDaily, len(days))
+	for _, day := range days {
+		byDate[day.Date.Format("2006-01-02")] = day
+	}
+	bandwidthByDate := make(map[string]*models.BandwidthUsage, len(bandwidth))
+	for _, day := range bandwidth {
+		bandwidthByDate[day.Date.Format("2006-01-02")] = day
+	}
+
+	// The repository returns the last day before the range first, if any
+	var last *models.UsageDaily
+	if len(days) > 0 && days[0].Date.Before(from) {
+		last = days[0]
+	}
+
+	series := make([]*UsagePoint, 0, int(to.Sub(from).Hours()/24)+1)
+	for date := from; !date.After(to); date = date.AddDate(0, 0, 1) {
+		key := date.Format("2006-01-02")
+		point := &UsagePoint{Date: key}
+		if day, ok := byDate[key]; ok {
+			point.PinnedBytes = day.PinnedBytes
+			point.PeakBytes = day.PeakBytes
+			point.PinnedPins = day.PinnedPins
+			point.PinsCreated = day.PinsCreated
+			last = day
+		} else if last != nil {
+			point.PinnedBytes = last.PinnedBytes
+			point.PeakBytes = last.PinnedBytes
+			point.PinnedPins = last.PinnedPins
+		}
+		if day, ok := bandwidthByDate[key]; ok {
+			point.BandwidthBytes = day.Bytes
+			point.Requests = day.Requests
+		}
+		series = append(series, point)
+	}
+
+	return &UsageReport{Usage: usage, Limits: limits, Series: series}, nil
+}
+
+// GetAccountQuota returns an account's quota override, limits and usage
+func (s *QuotaService) GetAccountQuota(ctx context.Context, userID uuid.UUID) (*AccountQuotaReport, error) {
+	if _, err := s.userRepo.GetByID(ctx, userID); err != nil {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	override, err := s.quotaRepo.GetQuota(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get quota: %w", err)
+	}
+	usage, err := s.quotaRepo.GetUsage(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get usage: %w", err)
+	}
+
+	return &AccountQuotaReport{Override: override, Limits: s.merge(override), Usage: usage}, nil
+}
+
+// SetAccountQuota replaces an account's quota override. Limits left unset
+// fall back to the configured defaults.
+func (s *QuotaService) SetAccountQuota(ctx context.Context, quota *models.AccountQuota) (*AccountQuotaReport, error) {
+	if _, err := s.userRepo.GetByID(ctx, quota.UserID); err != nil {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	if err := s.quotaRepo.SetQuota(ctx, quota); err != nil {
+		return nil, fmt.Errorf("failed to set quota: %w", err)
+	}
+	if err := s.redisClient.Del(ctx, fmt.Sprintf(quotaRateKey, quota.UserID)).Err(); err != nil {
+		s.logger.WithError(err).WithField("user_id", quota.UserID).Warn("Failed to clear cached request quota")
+	}
+
+	s.logger.WithField("user_id", quota.UserID).Info("Account quota changed")
+
+	return s.GetAccountQuota(ctx, quota.UserID)
+}
+
+// limits returns the limits that apply to an account
+func (s *QuotaService) limits(ctx context.Context, userID uuid.UUID) (*QuotaLimits, error) {
+	override, err := s.quotaRepo.GetQuota(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get quota: %w", err)
+	}
+	return s.merge(override), nil
+}
+
+// merge applies an account's override to the configured defaults
+func (s *QuotaService) merge(override *models.AccountQuota) *QuotaLimits {
+	limits := &QuotaLimits{
+		MaxBytes:          s.config.Quotas.MaxBytes,
+		MaxPins:           s.config.Quotas.MaxPins,
+		RequestsPerMinute: s.config.Quotas.RequestsPerMinute,
+		MaxPendingPins:    s.config.Quotas.MaxPendingPins,
+	}
+	if override == nil {
+		return limits
+	}
+
+	if override.MaxBytes != nil {
+		limits.MaxBytes = *override.MaxBytes
+	}
+	if override.MaxPins != nil {
+		limits.MaxPins = *override.MaxPins
+	}
+	if override.RequestsPerMinute != nil {
+		limits.RequestsPerMinute = *override.RequestsPerMinute
+	}
+	if override.MaxPendingPins != nil {
+		limits.MaxPendingPins = *override.MaxPendingPins
+	}
+	return limits
+}
+
+// requestsPerMinute returns an account's request rate limit, cached in
+// Redis for a minute so requests do not each query the database
+func (s *QuotaService) requestsPerMinute(ctx context.Context, userID string) (int, error) {
+	key := fmt.Sprintf(quotaRateKey, userID)
+	if limit, err := s.redisClient.Get(ctx, key).Int(); err == nil {
+		return limit, nil
+	}
+
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return 0, fmt.Errorf("invalid user ID: %w", err)
+	}
+	limits, err := s.limits(ctx, userUUID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.redisClient.Set(ctx, key, limits.RequestsPerMinute, time.Minute).Err(); err != nil {
+		s.logger.WithError(err).WithField("user_id", userID).Debug("Failed to cache request quota")
+	}
+	return limits.RequestsPerMinute, nil
+}
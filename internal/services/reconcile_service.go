@@ -0,0 +1,392 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gocraft/work"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/ipfs"
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+	"pinning-service/pkg/utils"
+)
+
+// JobReconcilePins is the job that compares the pins of every IPFS node
+// with the database and fixes what differs
+const JobReconcilePins = "reconcile_pins"
+
+// NodeReconcileReport is what reconciling one node found and did. In a
+// dry run each discrepancy's action is the one that would be taken.
+type NodeReconcileReport struct {
+	NodeID        string                   `json:"node_id"`
+	Pins          int                      `json:"pins"`
+	Placements    int                      `json:"placements"`
+	Discrepancies []*models.PinDiscrepancy `json:"discrepancies"`
+	Cleared       int                      `json:"cleared"`
+	RepoSize      uint64                   `json:"repo_size,omitempty"`
+	StorageMax    uint64                   `json:"storage_max,omitempty"`
+	GCNeeded      bool                     `json:"gc_needed"`
+	GCRemoved     int                      `json:"gc_removed,omitempty"`
+	Error         string                   `json:"error,omitempty"`
+}
+
+// ReconcileReport is the outcome of a reconciliation run
+type ReconcileReport struct {
+	DryRun    bool                   `json:"dry_run"`
+	StartedAt time.Time              `json:"started_at"`
+	Nodes     []*NodeReconcileReport `json:"nodes"`
+}
+
+// finding is a discrepancy with the CID in the form the node or the
+// placement holds it, which is what the fix must use
+type finding struct {
+	discrepancy *models.PinDiscrepancy
+	rawCID      string
+}
+
+// ReconcileService keeps the pins held by the IPFS nodes in line with the
+// database. For each healthy node it lists the recursive pins and compares
+// them with the node's placements:
+//
+//   - a placed CID the node does not pin is pinned again while it is
+//     referenced, and its placement dropped otherwise
+//   - a referenced CID the node pins without a placement is recorded as
+//     placed there, leaving rebalancing to decide whether it stays
+//   - a CID the node pins that nothing references is unpinned from the
+//     node once it has been seen for the orphan grace period
+//
+// Pins are compared by normalized CID since nodes report their own
+// canonical form. Discrepancies are recorded so the grace period survives
+// between runs and admins can review them. With the cluster backend IPFS
+// Cluster reconciles its own pins and this service does nothing.
+type ReconcileService struct {
+	nodePool        *NodePoolService
+	placementRepo   storage.PlacementRepository
+	discrepancyRepo storage.DiscrepancyRepository
+	enqueuer        *work.Enqueuer
+	config          *config.Config
+	logger          *logrus.Logger
+}
+
+func NewReconcileService(nodePool *NodePoolService, placementRepo storage.PlacementRepository, discrepancyRepo storage.DiscrepancyRepository, enqueuer *work.Enqueuer, cfg *config.Config, logger *logrus.Logger) *ReconcileService {
+	return &ReconcileService{
+		nodePool:        nodePool,
+		placementRepo:   placementRepo,
+		discrepancyRepo: discrepancyRepo,
+		enqueuer:        enqueuer,
+		config:          cfg,
+		logger:          logger,
+	}
+}
+
+// Enqueue queues a reconciliation run unless one is already queued
+func (s *ReconcileService) Enqueue(ctx context.Context) error {
+	if _, err := s.nodePool.Pool(); err != nil {
+		return err
+	}
+	if _, err := s.enqueuer.EnqueueUnique(JobReconcilePins, nil); err != nil {
+		return fmt.Errorf("failed to enqueue reconciliation: %w", err)
+	}
+	return nil
+}
+
+// Reconcile compares every healthy node's pins with the database. A dry
+// run only reports what differs and what would be done about it; nothing
+// is pinned, unpinned or recorded.
+func (s *ReconcileService) Reconcile(ctx context.Context, dryRun bool) (*ReconcileReport, error) {
+	pool, err := s.nodePool.Pool()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReconcileReport{DryRun: dryRun, StartedAt: time.Now().UTC()}
+	for _, status := range pool.CheckHealth(ctx) {
+		nodeReport := &NodeReconcileReport{NodeID: status.ID}
+		report.Nodes = append(report.Nodes, nodeReport)
+
+		if !status.Healthy {
+			nodeReport.Error = "node is unhealthy"
+			continue
+		}
+		if err := s.reconcileNode(ctx, pool, nodeReport, dryRun); err != nil {
+			nodeReport.Error = err.Error()
+			s.logger.WithError(err).WithField("node_id", status.ID).Warn("Failed to reconcile IPFS node")
+			continue
+		}
+		if err := s.collectGarbage(ctx, pool, nodeReport, dryRun); err != nil {
+			nodeReport.Error = err.Error()
+			s.logger.WithError(err).WithField("node_id", status.ID).Warn("Failed to collect garbage on IPFS node")
+		}
+
+		if len(nodeReport.Discrepancies) > 0 || nodeReport.Cleared > 0 {
+			s.logger.WithFields(logrus.Fields{
+				"node_id":       status.ID,
+				"discrepancies": len(nodeReport.Discrepancies),
+				"cleared":       nodeReport.Cleared,
+				"dry_run":       dryRun,
+			}).Info("Reconciled IPFS node")
+		}
+	}
+
+	return report, nil
+}
+
+// GetDiscrepancies lists recorded discrepancies, optionally only the open
+// ones
+func (s *ReconcileService) GetDiscrepancies(ctx context.Context, open bool, page, limit int) ([]*models.PinDiscrepancy, int64, error) {
+	return s.discrepancyRepo.List(ctx, open, page, limit)
+}
+
+// reconcileNode finds and fixes the discrepancies of one node
+func (s *ReconcileService) reconcileNode(ctx context.Context, pool *ipfs.Pool, report *NodeReconcileReport, dryRun bool) error {
+	nodeID := report.NodeID
+	client, ok := pool.Client(nodeID)
+	if !ok {
+		return fmt.Errorf("unknown IPFS node %s", nodeID)
+	}
+
+	pins, err := client.ListPins(ctx)
+	if err != nil {
+		return err
+	}
+	placements, err := s.placementRepo.GetByNode(ctx, nodeID)
+	if err != nil {
+		return fmt.Errorf("failed to get placements: %w", err)
+	}
+	report.Pins = len(pins)
+	report.Placements = len(placements)
+
+	// Both sides keyed by normalized CID, keeping the form each holds
+	pinned := make(map[string]string, len(pins))
+	for key := range pins {
+		pinned[normalizeOrKeep(key)] = key
+	}
+	placed := make(map[string]string, len(placements))
+	for _, placement := range placements {
+		placed[normalizeOrKeep(placement.CID)] = placement.CID
+	}
+
+	referenced, err := s.referenced(ctx, pinned, placed)
+	if err != nil {
+		return err
+	}
+
+	open, err := s.discrepancyRepo.GetOpen(ctx, nodeID)
+	if err != nil {
+		return fmt.Errorf("failed to get open discrepancies: %w", err)
+	}
+	known := make(map[string]*models.PinDiscrepancy, len(open))
+	for _, discrepancy := range open {
+		known[discrepancy.Kind+" "+discrepancy.CID] = discrepancy
+	}
+
+	now := time.Now().UTC()
+	var findings []finding
+	observe := func(kind, cid, rawCID string) {
+		discrepancy, ok := known[kind+" "+cid]
+		if ok {
+			delete(known, kind+" "+cid)
+		} else {
+			discrepancy = &models.PinDiscrepancy{NodeID: nodeID, CID: cid, Kind: kind, FirstSeenAt: now}
+		}
+		discrepancy.LastSeenAt = now
+		findings = append(findings, finding{discrepancy: discrepancy, rawCID: rawCID})
+	}
+
+	for cid, rawCID := range placed {
+		if _, ok := pinned[cid]; ok {
+			continue
+		}
+		if referenced[cid] {
+			observe(models.DiscrepancyMissing, cid, rawCID)
+		} else {
+			observe(models.DiscrepancyStale, cid, rawCID)
+		}
+	}
+	for cid, rawCID := range pinned {
+		_, isPlaced := placed[cid]
+		switch {
+		case !isPlaced && referenced[cid]:
+			observe(models.DiscrepancyUntracked, cid, rawCID)
+		case !isPlaced:
+			observe(models.DiscrepancyOrphaned, cid, rawCID)
+		case !referenced[cid]:
+			observe(models.DiscrepancyUnreferenced, cid, rawCID)
+		}
+	}
+
+	for _, f := range findings {
+		s.fix(ctx, pool, f, dryRun)
+		report.Discrepancies = append(report.Discrepancies, f.discrepancy)
+	}
+
+	// Whatever was open and not seen again has gone away by itself
+	var cleared []uuid.UUID
+	for _, discrepancy := range known {
+		cleared = append(cleared, discrepancy.ID)
+	}
+	report.Cleared = len(cleared)
+	if dryRun {
+		return nil
+	}
+	if err := s.discrepancyRepo.Resolve(ctx, cleared, models.DiscrepancyActionCleared); err != nil {
+		return fmt.Errorf("failed to resolve cleared discrepancies: %w", err)
+	}
+	return nil
+}
+
+// fix takes the action a discrepancy calls for and records the outcome.
+// Unpinning waits for the grace period since the first sighting, which
+// also covers pins whose placement is recorded only after pinning ends.
+func (s *ReconcileService) fix(ctx context.Context, pool *ipfs.Pool, f finding, dryRun bool) {
+	discrepancy := f.discrepancy
+	nodeID := discrepancy.NodeID
+
+	switch discrepancy.Kind {
+	case models.DiscrepancyMissing:
+		discrepancy.Action = models.DiscrepancyActionRepin
+	case models.DiscrepancyStale:
+		discrepancy.Action = models.DiscrepancyActionDrop
+	case models.DiscrepancyUntracked:
+		discrepancy.Action = models.DiscrepancyActionAdopt
+	default:
+		discrepancy.Action = models.DiscrepancyActionWait
+		if time.Since(discrepancy.FirstSeenAt) >= s.config.IPFS.OrphanGracePeriod {
+			discrepancy.Action = models.DiscrepancyActionUnpin
+		}
+	}
+	if dryRun {
+		return
+	}
+
+	var err error
+	switch discrepancy.Action {
+	case models.DiscrepancyActionRepin:
+		err = pool.PinOn(ctx, nodeID, f.rawCID)
+	case models.DiscrepancyActionDrop:
+		err = s.placementRepo.Remove(ctx, f.rawCID, []string{nodeID})
+	case models.DiscrepancyActionAdopt:
+		err = s.placementRepo.Add(ctx, f.rawCID, []string{nodeID})
+	case models.DiscrepancyActionUnpin:
+		err = s.unpin(ctx, pool, f)
+	}
+
+	discrepancy.Error = ""
+	if err != nil {
+		discrepancy.Error = err.Error()
+		s.logger.WithError(err).WithFields(logrus.Fields{
+			"node_id": nodeID,
+			"cid":     discrepancy.CID,
+			"kind":    discrepancy.Kind,
+		}).Warn("Failed to fix pin discrepancy")
+	} else if discrepancy.Action != models.DiscrepancyActionWait {
+		now := time.Now().UTC()
+		discrepancy.ResolvedAt = &now
+	}
+
+	if err := s.discrepancyRepo.Save(ctx, discrepancy); err != nil {
+		s.logger.WithError(err).WithField("cid", discrepancy.CID).Error("Failed to record pin discrepancy")
+	}
+}
+
+// unpin removes an unreferenced CID from a node and drops its placement
+// there. References are checked once more since a pin may have been
+// requested since the node was listed.
+func (s *ReconcileService) unpin(ctx context.Context, pool *ipfs.Pool, f finding) error {
+	cids := []string{f.discrepancy.CID}
+	if f.rawCID != f.discrepancy.CID {
+		cids = append(cids, f.rawCID)
+	}
+	referenced, err := s.placementRepo.GetReferenced(ctx, cids)
+	if err != nil {
+		return fmt.Errorf("failed to check references: %w", err)
+	}
+	if len(referenced) > 0 {
+		return fmt.Errorf("CID is referenced again")
+	}
+
+	nodeID := f.discrepancy.NodeID
+	if _, err := pool.Unpin(ctx, f.rawCID, []string{nodeID}); err != nil {
+		return err
+	}
+	if f.discrepancy.Kind == models.DiscrepancyUnreferenced {
+		return s.placementRepo.Remove(ctx, f.rawCID, []string{nodeID})
+	}
+	return nil
+}
+
+// referenced returns which normalized CIDs pinned by or placed on a node
+// are still referenced. Tables may hold either form of a CID, so both are
+// looked up.
+func (s *ReconcileService) referenced(ctx context.Context, pinned, placed map[string]string) (map[string]bool, error) {
+	byForm := make(map[string]string, 2*(len(pinned)+len(placed)))
+	for _, forms := range []map[string]string{pinned, placed} {
+		for cid, rawCID := range forms {
+			byForm[cid] = cid
+			byForm[rawCID] = cid
+		}
+	}
+	lookup := make([]string, 0, len(byForm))
+	for form := range byForm {
+		lookup = append(lookup, form)
+	}
+
+	found, err := s.placementRepo.GetReferenced(ctx, lookup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check references: %w", err)
+	}
+
+	referenced := make(map[string]bool, len(found))
+	for form := range found {
+		referenced[byForm[form]] = true
+	}
+	return referenced, nil
+}
+
+// collectGarbage runs repo gc on a node whose repo is fuller than the
+// configured threshold, reclaiming the blocks of unpinned content
+func (s *ReconcileService) collectGarbage(ctx context.Context, pool *ipfs.Pool, report *NodeReconcileReport, dryRun bool) error {
+	threshold := s.config.IPFS.GCThresholdPercent
+	if threshold <= 0 {
+		return nil
+	}
+
+	client, _ := pool.Client(report.NodeID)
+	size, storageMax, err := client.RepoStat(ctx)
+	if err != nil {
+		return err
+	}
+	report.RepoSize = size
+	report.StorageMax = storageMax
+	report.GCNeeded = storageMax > 0 && float64(size)*100 >= threshold*float64(storageMax)
+	if !report.GCNeeded || dryRun {
+		return nil
+	}
+
+	removed, err := client.RepoGC(ctx)
+	report.GCRemoved = removed
+	if err != nil {
+		return err
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"node_id":   report.NodeID,
+		"repo_size": size,
+		"removed":   removed,
+	}).Info("Collected garbage on IPFS node")
+	return nil
+}
+
+// normalizeOrKeep returns the normalized form of a CID, or the CID as is
+// if it does not parse
+func normalizeOrKeep(cid string) string {
+	if normalized, err := utils.NormalizeCID(cid); err == nil {
+		return normalized
+	}
+	return cid
+}
@@ -0,0 +1,738 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"pinning-service/internal/filecoin"
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+// RenewalPreferences are the user-controlled renewal settings of a pin
+type RenewalPreferences struct {
+	AutoRenew          string           `json:"auto_renew" binding:"required,oneof=off until indefinite"`
+	RenewUntil         *time.Time       `json:"renew_until"`
+	MaxRenewalPriceFIL *decimal.Decimal `json:"max_renewal_price_fil"`
+}
+
+// RenewalService renews expiring deals. Every renewal of a deal, whether
+// triggered by the scheduler or by the user, shares one idempotency key, so
+// concurrent or retried runs never charge or make a deal twice.
+//
+// A deal cannot be extended in place: the market actor fixes a deal's end
+// epoch in its proposal, and the verified claim extensions of later network
+// versions are not available through the Lotus API we build against. The
+// same provider is instead preferred for a new deal starting where the old
+// one ends.
+type RenewalService struct {
+	lotusClient    *filecoin.LotusClient
+	dealMaker      *DealMaker
+	pricingService *PricingService
+	notifications  *NotificationService
+	pinRepo        storage.PinRequestRepository
+	dealRepo       storage.FilecoinDealRepository
+	userRepo       storage.UserRepository
+	renewalRepo    storage.RenewalRepository
+	ledgerRepo     storage.LedgerRepository
+	aggregateRepo  storage.AggregateRepository
+	config         *config.Config
+	logger         *logrus.Logger
+}
+
+func NewRenewalService(
+	lotusClient *filecoin.LotusClient,
+	dealMaker *DealMaker,
+	pricingService *PricingService,
+	notifications *NotificationService,
+	pinRepo storage.PinRequestRepository,
+	dealRepo storage.FilecoinDealRepository,
+	userRepo storage.UserRepository,
+	renewalRepo storage.RenewalRepository,
+	ledgerRepo storage.LedgerRepository,
+	aggregateRepo storage.AggregateRepository,
+	cfg *config.Config,
+	logger *logrus.Logger,
+) *RenewalService {
+	return &RenewalService{
+		lotusClient:    lotusClient,
+		dealMaker:      dealMaker,
+		pricingService: pricingService,
+		notifications:  notifications,
+		pinRepo:        pinRepo,
+		dealRepo:       dealRepo,
+		userRepo:       userRepo,
+		renewalRepo:    renewalRepo,
+		ledgerRepo:     ledgerRepo,
+		aggregateRepo:  aggregateRepo,
+		config:         cfg,
+		logger:         logger,
+	}
+}
+
+// RenewExpiringDeals renews deals inside the renewal window for pins with
+// auto-renew enabled, and warns users whose balance will not cover renewals
+// coming up within the notice period
+func (s *RenewalService) RenewExpiringDeals(ctx context.Context) error {
+	currentEpoch, err := s.lotusClient.GetCurrentEpoch(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get current epoch: %w", err)
+	}
+
+	window := int64(s.config.Renewal.WindowDays) * filecoin.EpochsPerDay
+	notice := int64(s.config.Renewal.LowBalanceNoticeDays) * filecoin.EpochsPerDay
+	if notice < window {
+		notice = window
+	}
+
+	deals, err := s.dealRepo.GetExpiringDeals(ctx, currentEpoch+notice)
+	if err != nil {
+		return fmt.Errorf("failed to get expiring deals: %w", err)
+	}
+
+	now := time.Now()
+	renewed := 0
+	var aggregateDeals [][]*models.FilecoinDeal
+	aggregateIndex := make(map[string]int)
+	for _, deal := range deals {
+		// Pins sharing another pin's deals let their own deals run out
+		pin := &deal.PinRequest
+		if !pin.IsActive() || !pin.WantsRenewal(now) || pin.SharesDeals {
+			continue
+		}
+
+		// Aggregated pins are renewed together, one aggregate deal at a time
+		if pin.AggregateID != nil {
+			i, ok := aggregateIndex[deal.DealCID]
+			if !ok {
+				i = len(aggregateDeals)
+				aggregateIndex[deal.DealCID] = i
+				aggregateDeals = append(aggregateDeals, nil)
+			}
+			aggregateDeals[i] = append(aggregateDeals[i], deal)
+			continue
+		}
+
+		if !deal.NeedsRenewal(currentEpoch, window) {
+			verified := s.dealMaker.CanMakeVerified(ctx, pin, pin.SizeBytes)
+			s.checkBalance(ctx, deal, pin, s.price(pin, now, pin.RenewalDays(now), verified))
+			continue
+		}
+
+		renewal, err := s.renew(ctx, deal, pin, models.RenewalTriggerAuto, pin.RenewalDays(now))
+		if err != nil {
+			s.logger.WithError(err).WithField("deal_id", deal.ID).Error("Failed to renew deal")
+			continue
+		}
+		if renewal.Status == models.RenewalStatusCompleted {
+			renewed++
+		}
+	}
+
+	for _, group := range aggregateDeals {
+		if !group[0].NeedsRenewal(currentEpoch, window) {
+			s.checkAggregateBalance(ctx, group, now)
+			continue
+		}
+
+		renewals, err := s.renewAggregate(ctx, group, models.RenewalTriggerAuto, now)
+		if err != nil {
+			s.logger.WithError(err).WithField("deal_cid", group[0].DealCID).Error("Failed to renew aggregate deal")
+		}
+		for _, renewal := range renewals {
+			if renewal.Status == models.RenewalStatusCompleted {
+				renewed++
+			}
+		}
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"candidates": len(deals),
+		"renewed":    renewed,
+	}).Info("Renewal run completed")
+
+	return nil
+}
+
+// RenewDealsForCID renews the user's active deals for a CID on request,
+// regardless of their auto-renew preference
+func (s *RenewalService) RenewDealsForCID(ctx context.Context, cid, userID string) ([]*models.Renewal, error) {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	deals, err := s.dealRepo.GetByCID(ctx, cid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deals: %w", err)
+	}
+
+	pins := make(map[uuid.UUID]*models.PinRequest)
+	var renewals []*models.Renewal
+	for _, deal := range deals {
+		if !deal.IsActive() {
+			continue
+		}
+
+		pin, ok := pins[deal.PinRequestID]
+		if !ok {
+			pin, err = s.pinRepo.GetByID(ctx, deal.PinRequestID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get pin request: %w", err)
+			}
+			pins[deal.PinRequestID] = pin
+		}
+		if pin.UserID != userUUID || !pin.IsActive() || pin.SharesDeals {
+			continue
+		}
+
+		if pin.AggregateID != nil {
+			deal.PinRequest = *pin
+			aggregateRenewals, err := s.renewAggregate(ctx, []*models.FilecoinDeal{deal}, models.RenewalTriggerManual, time.Now())
+			renewals = append(renewals, aggregateRenewals...)
+			if err != nil {
+				return renewals, err
+			}
+			continue
+		}
+
+		renewal, err := s.renew(ctx, deal, pin, models.RenewalTriggerManual, pin.DurationDays)
+		if err != nil {
+			return renewals, err
+		}
+		renewals = append(renewals, renewal)
+	}
+
+	if len(renewals) == 0 {
+		return nil, fmt.Errorf("no renewable deals found")
+	}
+
+	return renewals, nil
+}
+
+// UpdatePreferences changes the renewal settings of one of the user's pins
+func (s *RenewalService) UpdatePreferences(ctx context.Context, pinID uuid.UUID, userID string, prefs RenewalPreferences) (*models.PinRequest, error) {
+	pin, err := s.pinRepo.GetByID(ctx, pinID)
+	if err != nil {
+		return nil, fmt.Errorf("pin request not found")
+	}
+	if pin.UserID.String() != userID {
+		return nil, fmt.Errorf("pin request not found")
+	}
+
+	if prefs.AutoRenew == models.AutoRenewUntil && (prefs.RenewUntil == nil || prefs.RenewUntil.Before(time.Now())) {
+		return nil, fmt.Errorf("renew_until must be a future date")
+	}
+
+	pin.AutoRenew = prefs.AutoRenew
+	pin.RenewUntil = nil
+	if prefs.AutoRenew == models.AutoRenewUntil {
+		pin.RenewUntil = prefs.RenewUntil
+	}
+
+	pin.MaxRenewalPriceFIL = prefs.MaxRenewalPriceFIL
+
+	if err := s.pinRepo.Update(ctx, pin); err != nil {
+		return nil, fmt.Errorf("failed to update pin request: %w", err)
+	}
+
+	return pin, nil
+}
+
+// GetRenewals lists the renewals of one of the user's pins
+func (s *RenewalService) GetRenewals(ctx context.Context, pinID uuid.UUID, userID string) ([]*models.Renewal, error) {
+	pin, err := s.pinRepo.GetByID(ctx, pinID)
+	if err != nil || pin.UserID.String() != userID {
+		return nil, fmt.Errorf("pin request not found")
+	}
+	return s.renewalRepo.GetByPinRequestID(ctx, pinID)
+}
+
+// renew runs one attempt at renewing a deal. It returns the renewal record,
+// which is left unchanged if another worker holds it or it has already been
+// resolved.
+func (s *RenewalService) renew(ctx context.Context, deal *models.FilecoinDeal, pin *models.PinRequest, trigger string, days int) (*models.Renewal, error) {
+	renewal, claimed, err := s.begin(ctx, deal, pin, trigger)
+	if err != nil || !claimed {
+		return renewal, err
+	}
+
+	if days <= 0 {
+		return s.skip(ctx, renewal, pin, "renewal period has ended")
+	}
+
+	// Prefer the provider that already stores the data
+	verified := s.dealMaker.CanMakeVerified(ctx, pin, pin.SizeBytes)
+	asks, err := s.dealMaker.SelectProviders(ctx, ProviderCriteria{
+		Preferred: []string{deal.MinerID},
+		PieceSize: pin.SizeBytes,
+		Verified:  verified,
+		Count:     1,
+	})
+	if err != nil {
+		return s.fail(ctx, renewal, pin, err)
+	}
+	renewal.MinerID = asks[0].MinerID
+
+	settled, err := s.settle(ctx, renewal, deal, pin, s.price(pin, time.Now(), days, verified), days)
+	if err != nil || !settled {
+		return renewal, err
+	}
+
+	// A worker that crashed after making the deal but before recording the
+	// renewal leaves the new deal behind; adopt it rather than make another
+	var newDeal *models.FilecoinDeal
+	if renewal.Attempts > 1 {
+		newDeal, err = s.findRenewalDeal(ctx, deal)
+		if err != nil {
+			return s.fail(ctx, renewal, pin, err)
+		}
+	}
+	if newDeal == nil {
+		newDeal, err = s.dealMaker.MakeDeal(ctx, DealRequest{
+			PinRequest:   pin,
+			Ask:          asks[0],
+			StartEpoch:   deal.EndEpoch,
+			DurationDays: days,
+			Verified:     verified,
+		})
+		if err != nil {
+			return s.fail(ctx, renewal, pin, err)
+		}
+	}
+
+	if err := s.complete(ctx, renewal, pin, newDeal, days); err != nil {
+		return nil, err
+	}
+	return renewal, nil
+}
+
+// renewAggregate runs one attempt at renewing a deal of an aggregate for
+// the members whose rows of it are given. Each member's renewal is claimed
+// and charged like a deal of its own, at its share of the aggregate, and one
+// aggregate deal is then made for every member charged.
+func (s *RenewalService) renewAggregate(ctx context.Context, deals []*models.FilecoinDeal, trigger string, now time.Time) ([]*models.Renewal, error) {
+	aggregate, err := s.aggregateRepo.GetByID(ctx, *deals[0].AggregateID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aggregate: %w", err)
+	}
+	entries, err := s.aggregateRepo.GetEntries(ctx, aggregate.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aggregate entries: %w", err)
+	}
+	entryByPin := make(map[uuid.UUID]*models.AggregateEntry, len(entries))
+	for _, entry := range entries {
+		entryByPin[entry.PinRequestID] = entry
+	}
+
+	type member struct {
+		renewal *models.Renewal
+		pin     *models.PinRequest
+		entry   *models.AggregateEntry
+		days    int
+		newDeal *models.FilecoinDeal
+	}
+
+	var renewals []*models.Renewal
+	var members []*member
+	for _, deal := range deals {
+		pin := &deal.PinRequest
+		renewal, claimed, err := s.begin(ctx, deal, pin, trigger)
+		if err != nil {
+			return renewals, err
+		}
+		renewals = append(renewals, renewal)
+		if !claimed {
+			continue
+		}
+
+		days := pin.DurationDays
+		if trigger == models.RenewalTriggerAuto {
+			days = pin.RenewalDays(now)
+		}
+		if days <= 0 {
+			if _, err := s.skip(ctx, renewal, pin, "renewal period has ended"); err != nil {
+				return renewals, err
+			}
+			continue
+		}
+
+		entry, ok := entryByPin[pin.ID]
+		if !ok {
+			if _, err := s.fail(ctx, renewal, pin, fmt.Errorf("pin is not an entry of aggregate %s", aggregate.ID)); err != nil {
+				return renewals, err
+			}
+			continue
+		}
+
+		settled, err := s.settle(ctx, renewal, deal, pin, s.aggregatePrice(pin, aggregate, days), days)
+		if err != nil {
+			return renewals, err
+		}
+		if !settled {
+			continue
+		}
+
+		m := &member{renewal: renewal, pin: pin, entry: entry, days: days}
+		if renewal.Attempts > 1 {
+			m.newDeal, err = s.findRenewalDeal(ctx, deal)
+			if err != nil {
+				if _, err := s.fail(ctx, renewal, pin, err); err != nil {
+					return renewals, err
+				}
+				continue
+			}
+		}
+		members = append(members, m)
+	}
+
+	// Members whose deal an earlier attempt already made keep it
+	var pending []*models.AggregateEntry
+	durationDays := 0
+	for _, m := range members {
+		if m.newDeal == nil {
+			pending = append(pending, m.entry)
+			if m.days > durationDays {
+				durationDays = m.days
+			}
+		}
+	}
+	if len(pending) > 0 {
+		newDeals, err := s.makeAggregateDeal(ctx, aggregate, deals[0], pending, durationDays)
+		for _, m := range members {
+			if m.newDeal != nil {
+				continue
+			}
+			if err != nil {
+				if _, failErr := s.fail(ctx, m.renewal, m.pin, err); failErr != nil {
+					return renewals, failErr
+				}
+				continue
+			}
+			m.newDeal = newDeals[m.pin.ID]
+		}
+	}
+
+	for _, m := range members {
+		if m.newDeal == nil {
+			continue
+		}
+		if err := s.complete(ctx, m.renewal, m.pin, m.newDeal, m.days); err != nil {
+			return renewals, err
+		}
+	}
+
+	return renewals, nil
+}
+
+// makeAggregateDeal makes the deal following on from one of an aggregate's
+// deals for the given entries, preferring the provider that already stores
+// the aggregate. It returns the new deal rows by pin.
+func (s *RenewalService) makeAggregateDeal(ctx context.Context, aggregate *models.Aggregate, deal *models.FilecoinDeal, entries []*models.AggregateEntry, days int) (map[uuid.UUID]*models.FilecoinDeal, error) {
+	asks, err := s.dealMaker.SelectProviders(ctx, ProviderCriteria{
+		Preferred: []string{deal.MinerID},
+		PieceSize: aggregate.PieceSize,
+		Count:     1,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	deals, err := s.dealMaker.MakeAggregateDeal(ctx, AggregateDealRequest{
+		Aggregate:    aggregate,
+		Entries:      entries,
+		Ask:          asks[0],
+		StartEpoch:   deal.EndEpoch,
+		DurationDays: days,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	byPin := make(map[uuid.UUID]*models.FilecoinDeal, len(deals))
+	for _, d := range deals {
+		byPin[d.PinRequestID] = d
+	}
+	return byPin, nil
+}
+
+// begin loads or creates the renewal of a deal and claims it for this
+// worker. It returns false if another worker holds the renewal or it has
+// already been resolved.
+func (s *RenewalService) begin(ctx context.Context, deal *models.FilecoinDeal, pin *models.PinRequest, trigger string) (*models.Renewal, bool, error) {
+	key := fmt.Sprintf("renewal:%s:%d", deal.ID, deal.EndEpoch)
+
+	renewal, err := s.renewalRepo.GetOrCreate(ctx, &models.Renewal{
+		ID:             uuid.New(),
+		PinRequestID:   pin.ID,
+		FilecoinDealID: deal.ID,
+		IdempotencyKey: key,
+		Trigger:        trigger,
+		Status:         models.RenewalStatusPending,
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create renewal: %w", err)
+	}
+	if renewal.IsFinal() {
+		return renewal, false, nil
+	}
+
+	claimed, err := s.renewalRepo.Claim(ctx, renewal.ID, s.config.Renewal.MaxAttempts, s.config.Renewal.ClaimLease)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to claim renewal: %w", err)
+	}
+	if !claimed {
+		return renewal, false, nil
+	}
+	claimedAt := time.Now()
+	renewal.Status = models.RenewalStatusInProgress
+	renewal.Attempts++
+	renewal.ClaimedAt = &claimedAt
+
+	return renewal, true, nil
+}
+
+// settle charges for a renewal at the given price. An earlier attempt that
+// failed after charging keeps its charge until the renewal is resolved, so
+// a retry reuses it instead of charging again. It returns false if the
+// renewal was skipped or failed instead.
+func (s *RenewalService) settle(ctx context.Context, renewal *models.Renewal, deal *models.FilecoinDeal, pin *models.PinRequest, price decimal.Decimal, days int) (bool, error) {
+	charge, err := s.ledgerRepo.GetByIdempotencyKey(ctx, renewalChargeKey(renewal))
+	if err == nil {
+		renewal.PriceFIL = charge.AmountFIL
+		return true, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, fmt.Errorf("failed to get renewal charge: %w", err)
+	}
+
+	renewal.PriceFIL = price
+	if pin.MaxRenewalPriceFIL != nil && price.GreaterThan(*pin.MaxRenewalPriceFIL) {
+		_, err := s.skip(ctx, renewal, pin, fmt.Sprintf("price %s FIL exceeds the maximum of %s FIL", price, pin.MaxRenewalPriceFIL))
+		return false, err
+	}
+
+	if err := s.charge(ctx, renewal, deal, pin, price, days); err != nil {
+		_, err := s.fail(ctx, renewal, pin, err)
+		return false, err
+	}
+	return true, nil
+}
+
+// complete records a renewal as done by the deal that follows on from the
+// expiring one and tells the user
+func (s *RenewalService) complete(ctx context.Context, renewal *models.Renewal, pin *models.PinRequest, newDeal *models.FilecoinDeal, days int) error {
+	renewal.Status = models.RenewalStatusCompleted
+	renewal.MinerID = newDeal.MinerID
+	renewal.NewDealID = &newDeal.ID
+	renewal.Error = ""
+	if err := s.renewalRepo.Update(ctx, renewal); err != nil {
+		return fmt.Errorf("failed to update renewal: %w", err)
+	}
+
+	s.notify(ctx, pin.UserID, models.NotificationRenewed, "renewed:"+renewal.IdempotencyKey,
+		fmt.Sprintf("Storage of %s was renewed for %d days", pin.CID, days),
+		map[string]interface{}{"pin_request_id": pin.ID, "cid": pin.CID, "deal_id": newDeal.ID, "price_fil": renewal.PriceFIL})
+
+	s.logger.WithFields(logrus.Fields{
+		"renewal_id":  renewal.ID,
+		"deal_id":     renewal.FilecoinDealID,
+		"trigger":     renewal.Trigger,
+		"attempt":     renewal.Attempts,
+		"new_deal_id": newDeal.ID,
+	}).Info("Deal renewed")
+	return nil
+}
+
+// findRenewalDeal returns the deal already made to follow on from an
+// expiring one, if any
+func (s *RenewalService) findRenewalDeal(ctx context.Context, deal *models.FilecoinDeal) (*models.FilecoinDeal, error) {
+	deals, err := s.dealRepo.GetByPinRequestID(ctx, deal.PinRequestID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deals: %w", err)
+	}
+	for _, d := range deals {
+		if d.ID != deal.ID && d.ChunkID == nil && d.StartEpoch >= deal.EndEpoch &&
+			d.Status != models.DealStatusFailed && d.Status != models.DealStatusCancelled {
+			return d, nil
+		}
+	}
+	return nil, nil
+}
+
+// charge charges the user for renewing one of a pin's deals, warning them
+// if their balance is too low
+func (s *RenewalService) charge(ctx context.Context, renewal *models.Renewal, deal *models.FilecoinDeal, pin *models.PinRequest, price decimal.Decimal, days int) error {
+	_, err := s.ledgerRepo.Charge(ctx, &models.LedgerEntry{
+		ID:             uuid.New(),
+		UserID:         pin.UserID,
+		PinRequestID:   &pin.ID,
+		FilecoinDealID: &deal.ID,
+		Category:       models.LedgerCategoryRenewal,
+		AmountFIL:      price,
+		Description:    fmt.Sprintf("Renewal of %s for %d days", pin.CID, days),
+		IdempotencyKey: renewalChargeKey(renewal),
+	})
+	if errors.Is(err, storage.ErrInsufficientBalance) {
+		s.notify(ctx, pin.UserID, models.NotificationLowBalance, "low-balance:"+renewal.IdempotencyKey,
+			fmt.Sprintf("Your balance is too low to renew storage of %s (%s FIL required)", pin.CID, price),
+			map[string]interface{}{"pin_request_id": pin.ID, "cid": pin.CID, "required_fil": price})
+	}
+	return err
+}
+
+// price returns what renewing one of a pin's deals from start costs the
+// user. Each deal is renewed on its own, so the price of renewing the pin
+// is split evenly across the replicas it keeps and the pin pays for a
+// period once, as an extension does, however many deals store it.
+// Renewing is cheaper when the renewal is a verified deal or the pin is
+// only stored on Filecoin, including a hot_cold pin once it moves to cold.
+func (s *RenewalService) price(pin *models.PinRequest, start time.Time, days int, verified bool) decimal.Decimal {
+	var price decimal.Decimal
+	if verified {
+		price = s.pricingService.CalculateVerifiedPriceFIL(pin.SizeBytes, days)
+	} else {
+		tier, hotDays := pin.TierAt(start)
+		price = s.pricingService.CalculateTierPriceFIL(tier, hotDays, pin.SizeBytes, days)
+	}
+	return price.DivRound(decimal.NewFromInt(int64(s.replicas(pin.Replicas))), attoFILPlaces)
+}
+
+// aggregatePrice returns what renewing one deal of an aggregate costs a
+// member: its share of the aggregate's price, split across the aggregate's
+// replicas as price splits a pin's
+func (s *RenewalService) aggregatePrice(pin *models.PinRequest, aggregate *models.Aggregate, days int) decimal.Decimal {
+	share := s.pricingService.CalculateAggregateShareFIL(pin.SizeBytes, aggregate.SizeBytes, days)
+	return share.DivRound(decimal.NewFromInt(int64(s.replicas(aggregate.Replicas))), attoFILPlaces)
+}
+
+// replicas returns how many deals are kept under a replication policy, as
+// repair maintains them
+func (s *RenewalService) replicas(policy int) int {
+	switch {
+	case policy > 0:
+		return policy
+	case s.config.Repair.DefaultReplicas > 0:
+		return s.config.Repair.DefaultReplicas
+	}
+	return 1
+}
+
+// refund returns the charge made for a renewal that will not complete, if
+// an attempt made one
+func (s *RenewalService) refund(ctx context.Context, renewal *models.Renewal, pin *models.PinRequest) {
+	chargeKey := renewalChargeKey(renewal)
+	charge, err := s.ledgerRepo.GetByIdempotencyKey(ctx, chargeKey)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return
+	}
+	if err != nil {
+		s.logger.WithError(err).WithField("renewal_id", renewal.ID).Error("Failed to get renewal charge")
+		return
+	}
+
+	_, err = s.ledgerRepo.Credit(ctx, &models.LedgerEntry{
+		ID:             uuid.New(),
+		UserID:         pin.UserID,
+		PinRequestID:   &pin.ID,
+		FilecoinDealID: &renewal.FilecoinDealID,
+		Type:           models.LedgerTypeRefund,
+		Category:       models.LedgerCategoryRenewal,
+		AmountFIL:      charge.AmountFIL,
+		Description:    fmt.Sprintf("Refund of failed renewal of %s", pin.CID),
+		IdempotencyKey: chargeKey + ":refund",
+	})
+	if err != nil {
+		s.logger.WithError(err).WithField("renewal_id", renewal.ID).Error("Failed to refund renewal charge")
+	}
+}
+
+// renewalChargeKey is the idempotency key of the one charge made for a
+// renewal, whichever attempt makes it
+func renewalChargeKey(renewal *models.Renewal) string {
+	return renewal.IdempotencyKey + ":charge"
+}
+
+// checkAggregateBalance warns the members of an aggregate deal ahead of
+// the renewal window if their balance will not cover their share
+func (s *RenewalService) checkAggregateBalance(ctx context.Context, deals []*models.FilecoinDeal, now time.Time) {
+	aggregate, err := s.aggregateRepo.GetByID(ctx, *deals[0].AggregateID)
+	if err != nil {
+		s.logger.WithError(err).WithField("aggregate_id", *deals[0].AggregateID).Warn("Failed to get aggregate")
+		return
+	}
+
+	for _, deal := range deals {
+		pin := &deal.PinRequest
+		s.checkBalance(ctx, deal, pin, s.aggregatePrice(pin, aggregate, pin.RenewalDays(now)))
+	}
+}
+
+// checkBalance warns the user ahead of the renewal window if their balance
+// will not cover the renewal at the given price
+func (s *RenewalService) checkBalance(ctx context.Context, deal *models.FilecoinDeal, pin *models.PinRequest, price decimal.Decimal) {
+	if pin.MaxRenewalPriceFIL != nil && price.GreaterThan(*pin.MaxRenewalPriceFIL) {
+		return
+	}
+
+	user, err := s.userRepo.GetByID(ctx, pin.UserID)
+	if err != nil {
+		s.logger.WithError(err).WithField("user_id", pin.UserID).Warn("Failed to get user")
+		return
+	}
+	if user.Balance.GreaterThanOrEqual(price) {
+		return
+	}
+
+	s.notify(ctx, pin.UserID, models.NotificationLowBalance, fmt.Sprintf("low-balance:renewal:%s:%d", deal.ID, deal.EndEpoch),
+		fmt.Sprintf("Storage of %s is due for renewal soon but your balance is below the %s FIL required", pin.CID, price),
+		map[string]interface{}{"pin_request_id": pin.ID, "cid": pin.CID, "required_fil": price, "end_epoch": deal.EndEpoch})
+}
+
+func (s *RenewalService) skip(ctx context.Context, renewal *models.Renewal, pin *models.PinRequest, reason string) (*models.Renewal, error) {
+	renewal.Status = models.RenewalStatusSkipped
+	renewal.Error = reason
+	if err := s.renewalRepo.Update(ctx, renewal); err != nil {
+		return nil, fmt.Errorf("failed to update renewal: %w", err)
+	}
+	s.refund(ctx, renewal, pin)
+
+	s.notify(ctx, pin.UserID, models.NotificationRenewalSkipped, "skipped:"+renewal.IdempotencyKey,
+		fmt.Sprintf("Renewal of %s was skipped: %s", pin.CID, reason),
+		map[string]interface{}{"pin_request_id": pin.ID, "cid": pin.CID})
+
+	return renewal, nil
+}
+
+func (s *RenewalService) fail(ctx context.Context, renewal *models.Renewal, pin *models.PinRequest, cause error) (*models.Renewal, error) {
+	renewal.Status = models.RenewalStatusFailed
+	renewal.Error = cause.Error()
+	if err := s.renewalRepo.Update(ctx, renewal); err != nil {
+		return nil, fmt.Errorf("failed to update renewal: %w", err)
+	}
+
+	// The charge is held for the next attempt unless this was the last
+	if renewal.Attempts >= s.config.Renewal.MaxAttempts {
+		s.refund(ctx, renewal, pin)
+		s.notify(ctx, pin.UserID, models.NotificationRenewalFailed, "failed:"+renewal.IdempotencyKey,
+			fmt.Sprintf("Renewal of %s failed: %s", pin.CID, cause),
+			map[string]interface{}{"pin_request_id": pin.ID, "cid": pin.CID})
+	}
+
+	s.logger.WithError(cause).WithField("renewal_id", renewal.ID).Warn("Renewal attempt failed")
+	return renewal, nil
+}
+
+func (s *RenewalService) notify(ctx context.Context, userID uuid.UUID, notificationType, key, message string, data map[string]interface{}) {
+	if err := s.notifications.Notify(ctx, userID, notificationType, key, message, data); err != nil {
+		s.logger.WithError(err).WithField("type", notificationType).Warn("Failed to send notification")
+	}
+}
@@ -0,0 +1,300 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+// fakeLedgerRepo keeps ledger entries and balances in memory, applying
+// entries the way the database does: once per idempotency key, and charges
+// only when the balance covers them
+type fakeLedgerRepo struct {
+	storage.LedgerRepository
+	mu       sync.Mutex
+	entries  []*models.LedgerEntry
+	balances map[uuid.UUID]decimal.Decimal
+	now      func() time.Time
+}
+
+func newFakeLedgerRepo() *fakeLedgerRepo {
+	return &fakeLedgerRepo{balances: make(map[uuid.UUID]decimal.Decimal), now: time.Now}
+}
+
+func (r *fakeLedgerRepo) Charge(ctx context.Context, entry *models.LedgerEntry) (bool, error) {
+	entry.Type = models.LedgerTypeCharge
+	return r.apply(entry)
+}
+
+func (r *fakeLedgerRepo) Credit(ctx context.Context, entry *models.LedgerEntry) (bool, error) {
+	if entry.Type == "" {
+		entry.Type = models.LedgerTypeCredit
+	}
+	return r.apply(entry)
+}
+
+func (r *fakeLedgerRepo) apply(entry *models.LedgerEntry) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.entries {
+		if existing.IdempotencyKey == entry.IdempotencyKey {
+			return false, nil
+		}
+	}
+
+	balance := r.balances[entry.UserID]
+	if entry.IsDebit() {
+		if balance.LessThan(entry.AmountFIL) {
+			return false, storage.ErrInsufficientBalance
+		}
+		balance = balance.Sub(entry.AmountFIL)
+	} else {
+		balance = balance.Add(entry.AmountFIL)
+	}
+	r.balances[entry.UserID] = balance
+
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = r.now()
+	}
+	r.entries = append(r.entries, entry)
+	return true, nil
+}
+
+func (r *fakeLedgerRepo) GetByIdempotencyKey(ctx context.Context, key string) (*models.LedgerEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, entry := range r.entries {
+		if entry.IdempotencyKey == key {
+			return entry, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakeLedgerRepo) GetByUserID(ctx context.Context, userID uuid.UUID, from, to time.Time) ([]*models.LedgerEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var entries []*models.LedgerEntry
+	for _, entry := range r.entries {
+		if entry.UserID == userID && !entry.CreatedAt.Before(from) && entry.CreatedAt.Before(to) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (r *fakeLedgerRepo) GetTotals(ctx context.Context, userID uuid.UUID, from, to time.Time) (map[string]decimal.Decimal, error) {
+	entries, _ := r.GetByUserID(ctx, userID, from, to)
+	totals := make(map[string]decimal.Decimal)
+	for _, entry := range entries {
+		totals[entry.Type] = totals[entry.Type].Add(entry.AmountFIL)
+	}
+	return totals, nil
+}
+
+func (r *fakeLedgerRepo) GetBalanceAt(ctx context.Context, userID uuid.UUID, at time.Time) (decimal.Decimal, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	balance := r.balances[userID]
+	for _, entry := range r.entries {
+		if entry.UserID != userID || entry.CreatedAt.Before(at) {
+			continue
+		}
+		if entry.IsDebit() {
+			balance = balance.Add(entry.AmountFIL)
+		} else {
+			balance = balance.Sub(entry.AmountFIL)
+		}
+	}
+	return balance, nil
+}
+
+func newTestRenewalService(ledger storage.LedgerRepository) (*RenewalService, *config.Config) {
+	cfg := &config.Config{}
+	cfg.Pricing.BasePricePerGBPerMonth = 0.02
+	cfg.Pricing.MarkupPercentage = 10
+	cfg.Pricing.ColdPricePerGBPerMonth = 0.01
+	cfg.Repair.DefaultReplicas = 2
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	s := NewRenewalService(nil, nil, NewPricingService(cfg), nil, nil, nil, nil, nil, ledger, nil, cfg, logger)
+	return s, cfg
+}
+
+func TestRenewalChargesPinOncePerPeriod(t *testing.T) {
+	ctx := context.Background()
+	const days = 180
+
+	for _, tc := range []struct {
+		name     string
+		replicas int
+		deals    int
+	}{
+		{"three replicas", 3, 3},
+		{"default replicas", 0, 2},
+		{"single replica", 1, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ledger := newFakeLedgerRepo()
+			s, _ := newTestRenewalService(ledger)
+
+			pin := &models.PinRequest{
+				ID:        uuid.New(),
+				UserID:    uuid.New(),
+				CID:       "bafytest",
+				SizeBytes: 7 << 30,
+				Replicas:  tc.replicas,
+				Tier:      models.TierHotCold,
+			}
+			ledger.balances[pin.UserID] = decimal.NewFromInt(100)
+
+			for i := 0; i < tc.deals; i++ {
+				deal := &models.FilecoinDeal{ID: uuid.New(), PinRequestID: pin.ID, EndEpoch: int64(1000000 + i*7)}
+				renewal := &models.Renewal{ID: uuid.New(), IdempotencyKey: fmt.Sprintf("renewal:%s:%d", deal.ID, deal.EndEpoch)}
+
+				price := s.price(pin, time.Now(), days, false)
+				if err := s.charge(ctx, renewal, deal, pin, price, days); err != nil {
+					t.Fatalf("charge: %v", err)
+				}
+				// A retried attempt reuses the charge
+				if err := s.charge(ctx, renewal, deal, pin, price, days); err != nil {
+					t.Fatalf("charge retry: %v", err)
+				}
+			}
+
+			if len(ledger.entries) != tc.deals {
+				t.Fatalf("%d ledger entries, want one per deal", len(ledger.entries))
+			}
+			total := decimal.Zero
+			for _, entry := range ledger.entries {
+				if entry.Category != models.LedgerCategoryRenewal || *entry.PinRequestID != pin.ID {
+					t.Fatalf("unexpected entry %+v", entry)
+				}
+				if !entry.AmountFIL.Equal(ledger.entries[0].AmountFIL) {
+					t.Fatalf("replicas charged %s and %s, want equal shares", entry.AmountFIL, ledger.entries[0].AmountFIL)
+				}
+				total = total.Add(entry.AmountFIL)
+			}
+
+			// The pin pays for the period what an extension charges, to
+			// within the rounding of each share to the attoFIL
+			want := s.pricingService.CalculatePriceFIL(pin.SizeBytes, days)
+			if diff := total.Sub(want).Abs(); diff.GreaterThan(decimal.New(int64(tc.deals), -attoFILPlaces)) {
+				t.Fatalf("renewals charged %s FIL in total, want %s FIL", total, want)
+			}
+		})
+	}
+}
+
+func TestAggregateRenewalChargesMembersTheirShare(t *testing.T) {
+	ctx := context.Background()
+	const days = 180
+
+	ledger := newFakeLedgerRepo()
+	s, _ := newTestRenewalService(ledger)
+
+	aggregate := &models.Aggregate{ID: uuid.New(), Replicas: 2, DurationDays: days}
+	var pins []*models.PinRequest
+	for _, size := range []int64{3 << 20, 5 << 20, 11 << 20} {
+		pin := &models.PinRequest{
+			ID:          uuid.New(),
+			UserID:      uuid.New(),
+			CID:         "bafymember",
+			SizeBytes:   size,
+			AggregateID: &aggregate.ID,
+		}
+		ledger.balances[pin.UserID] = decimal.NewFromInt(100)
+		aggregate.SizeBytes += size
+		pins = append(pins, pin)
+	}
+
+	// Each replica of the aggregate is one deal with a row per member
+	for i := 0; i < aggregate.Replicas; i++ {
+		dealCID := fmt.Sprintf("bafydeal%d", i)
+		for _, pin := range pins {
+			deal := &models.FilecoinDeal{ID: uuid.New(), PinRequestID: pin.ID, AggregateID: &aggregate.ID, DealCID: dealCID, EndEpoch: int64(1000000 + i*7)}
+			renewal := &models.Renewal{ID: uuid.New(), IdempotencyKey: fmt.Sprintf("renewal:%s:%d", deal.ID, deal.EndEpoch)}
+			if err := s.charge(ctx, renewal, deal, pin, s.aggregatePrice(pin, aggregate, days), days); err != nil {
+				t.Fatalf("charge: %v", err)
+			}
+		}
+	}
+
+	if len(ledger.entries) != len(pins)*aggregate.Replicas {
+		t.Fatalf("%d ledger entries, want one per member per replica", len(ledger.entries))
+	}
+
+	total := decimal.Zero
+	for _, pin := range pins {
+		paid := decimal.Zero
+		for _, entry := range ledger.entries {
+			if *entry.PinRequestID == pin.ID {
+				paid = paid.Add(entry.AmountFIL)
+			}
+		}
+
+		// A member pays its share of the aggregate once per period
+		want := s.pricingService.CalculateAggregateShareFIL(pin.SizeBytes, aggregate.SizeBytes, days)
+		if diff := paid.Sub(want).Abs(); diff.GreaterThan(decimal.New(int64(aggregate.Replicas), -attoFILPlaces)) {
+			t.Fatalf("member of %d bytes paid %s FIL, want %s FIL", pin.SizeBytes, paid, want)
+		}
+		total = total.Add(paid)
+	}
+
+	// Together the members pay for the aggregate, not a minimum deal each
+	want := s.pricingService.CalculatePriceFIL(aggregate.SizeBytes, days)
+	if diff := total.Sub(want).Abs(); diff.GreaterThan(decimal.New(int64(len(pins)*(aggregate.Replicas+1)), -attoFILPlaces)) {
+		t.Fatalf("members paid %s FIL in total, want %s FIL", total, want)
+	}
+}
+
+func TestRenewalPricesHotColdPinByTier(t *testing.T) {
+	const days = 180
+	now := time.Now()
+	s, _ := newTestRenewalService(newFakeLedgerRepo())
+
+	for _, tc := range []struct {
+		name   string
+		coldAt *time.Time
+		want   decimal.Decimal
+	}{
+		{"never moves to cold", nil, s.pricingService.CalculatePriceFIL(7<<30, days)},
+		{"moves to cold during the period", timePtr(now.AddDate(0, 0, 30)), s.pricingService.CalculateTierPriceFIL(models.TierHotCold, 30, 7<<30, days)},
+		{"past cold_at", timePtr(now.AddDate(0, 0, -1)), s.pricingService.CalculateTierPriceFIL(models.TierCold, 0, 7<<30, days)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pin := &models.PinRequest{
+				SizeBytes: 7 << 30,
+				Replicas:  1,
+				Tier:      models.TierHotCold,
+				HotDays:   30,
+				ColdAt:    tc.coldAt,
+			}
+			if got := s.price(pin, now, days, false); !got.Equal(tc.want) {
+				t.Fatalf("renewal priced at %s FIL, want %s FIL", got, tc.want)
+			}
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
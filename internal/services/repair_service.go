@@ -0,0 +1,597 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gocraft/work"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/filecoin"
+	"pinning-service/internal/ipfs"
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+// Job names used by the repair process. Repairs are split by urgency so
+// pins closest to losing their last copy are worked first.
+const (
+	JobRepairScan        = "repair_scan"
+	JobRepairPinCritical = "repair_pin_critical"
+	JobRepairPinDegraded = "repair_pin_degraded"
+	JobRepairPin         = "repair_pin"
+	JobRepairAggregate   = "repair_aggregate"
+)
+
+// Replica states
+const (
+	ReplicaHealthy = "healthy"
+	ReplicaPending = "pending"
+	ReplicaFaulted = "faulted"
+	ReplicaSlashed = "slashed"
+	ReplicaExpired = "expired"
+	ReplicaLost    = "lost"
+	ReplicaFailed  = "failed"
+)
+
+// Replica is the classified state of one deal for a pin
+type Replica struct {
+	DealID   uuid.UUID `json:"deal_id"`
+	MinerID  string    `json:"miner_id"`
+	State    string    `json:"state"`
+	EndEpoch int64     `json:"end_epoch"`
+}
+
+// ReplicaReport compares a pin's replicas, or an aggregate's, against its
+// replication policy
+type ReplicaReport struct {
+	PinRequestID uuid.UUID  `json:"pin_request_id"`
+	AggregateID  *uuid.UUID `json:"aggregate_id,omitempty"`
+	CID          string     `json:"cid"`
+	Policy       int        `json:"policy"`
+	Healthy      int        `json:"healthy"`
+	Pending      int        `json:"pending"`
+	Replicas     []Replica  `json:"replicas"`
+}
+
+// Deficit returns how many new deals are needed to meet the policy. Deals
+// still being made count towards the policy so they are not duplicated.
+func (r *ReplicaReport) Deficit() int {
+	return r.Policy - r.Healthy - r.Pending
+}
+
+// RepairService restores redundancy for pins that have lost replicas to
+// slashing, faults, unexpected expiry or vanished providers. Aggregated pins
+// are repaired together through their aggregate's deals.
+type RepairService struct {
+	ipfsClient    *ipfs.Client
+	lotusClient   *filecoin.LotusClient
+	dealMaker     *DealMaker
+	pinRepo       storage.PinRequestRepository
+	dealRepo      storage.FilecoinDealRepository
+	aggregateRepo storage.AggregateRepository
+	enqueuer      *work.Enqueuer
+	config        *config.Config
+	logger        *logrus.Logger
+}
+
+func NewRepairService(ipfsClient *ipfs.Client, lotusClient *filecoin.LotusClient, dealMaker *DealMaker, pinRepo storage.PinRequestRepository, dealRepo storage.FilecoinDealRepository, aggregateRepo storage.AggregateRepository, enqueuer *work.Enqueuer, cfg *config.Config, logger *logrus.Logger) *RepairService {
+	return &RepairService{
+		ipfsClient:    ipfsClient,
+		lotusClient:   lotusClient,
+		dealMaker:     dealMaker,
+		pinRepo:       pinRepo,
+		dealRepo:      dealRepo,
+		aggregateRepo: aggregateRepo,
+		enqueuer:      enqueuer,
+		config:        cfg,
+		logger:        logger,
+	}
+}
+
+// ScanPins classifies the replicas of every pinned request and enqueues a
+// repair for each pin below its replication policy, and for each aggregate
+// below its own whose members are still retained. It returns the number of
+// repairs enqueued.
+func (s *RepairService) ScanPins(ctx context.Context) (int, error) {
+	currentEpoch, err := s.lotusClient.GetCurrentEpoch(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get current epoch: %w", err)
+	}
+
+	batchSize := s.config.Repair.ScanBatchSize
+	if batchSize < 1 {
+		batchSize = 200
+	}
+
+	now := time.Now()
+	scanned, queued := 0, 0
+	afterID := uuid.Nil
+	aggregateDeals := make(map[uuid.UUID]map[string]*models.FilecoinDeal)
+	for {
+		pins, err := s.pinRepo.GetNextPinned(ctx, afterID, batchSize)
+		if err != nil {
+			return queued, fmt.Errorf("failed to get pins: %w", err)
+		}
+		if len(pins) == 0 {
+			break
+		}
+		afterID = pins[len(pins)-1].ID
+
+		pinIDs := make([]uuid.UUID, 0, len(pins))
+		for _, pin := range pins {
+			pinIDs = append(pinIDs, pin.ID)
+		}
+
+		deals, err := s.dealRepo.GetByPinRequestIDs(ctx, pinIDs)
+		if err != nil {
+			return queued, fmt.Errorf("failed to get deals: %w", err)
+		}
+
+		dealsByPin := make(map[uuid.UUID][]*models.FilecoinDeal, len(pins))
+		for _, deal := range deals {
+			dealsByPin[deal.PinRequestID] = append(dealsByPin[deal.PinRequestID], deal)
+		}
+
+		health := s.providerHealth(ctx, deals)
+		for _, pin := range pins {
+			scanned++
+			// Aggregated pins are kept at policy through their aggregate,
+			// whose deals every member holds a row of
+			if pin.AggregateID != nil {
+				if pin.RetentionDays(now) > 0 {
+					collectAggregateDeals(aggregateDeals, *pin.AggregateID, dealsByPin[pin.ID])
+				}
+				continue
+			}
+
+			// Deals of shared content are kept up through the pin making
+			// them, and hot pins have none
+			if pin.RetentionDays(now) <= 0 || s.isSplit(pin) || pin.SharesDeals || !pin.MakesDeals() {
+				continue
+			}
+
+			report := s.classify(s.pinReport(pin), dealsByPin[pin.ID], currentEpoch, health)
+			if report.Deficit() <= 0 {
+				continue
+			}
+
+			if err := s.enqueueRepair(report); err != nil {
+				s.logger.WithError(err).WithField("pin_id", pin.ID).Error("Failed to enqueue repair")
+				continue
+			}
+			queued++
+		}
+	}
+
+	for aggregateID, deals := range aggregateDeals {
+		aggregate, err := s.aggregateRepo.GetByID(ctx, aggregateID)
+		if err != nil {
+			s.logger.WithError(err).WithField("aggregate_id", aggregateID).Error("Failed to get aggregate")
+			continue
+		}
+		if aggregate.Status != models.AggregateStatusDealt {
+			continue
+		}
+
+		report := s.aggregateReport(ctx, aggregate, deals, currentEpoch)
+		if report.Deficit() <= 0 {
+			continue
+		}
+
+		if err := s.enqueueRepair(report); err != nil {
+			s.logger.WithError(err).WithField("aggregate_id", aggregateID).Error("Failed to enqueue aggregate repair")
+			continue
+		}
+		queued++
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"scanned": scanned,
+		"queued":  queued,
+	}).Info("Repair scan completed")
+
+	return queued, nil
+}
+
+// RepairPin makes new deals for a pin until it meets its replication
+// policy, sourcing the data from the local IPFS node or, failing that, from
+// a provider that still holds a healthy copy
+func (s *RepairService) RepairPin(ctx context.Context, pinID uuid.UUID) error {
+	pin, err := s.pinRepo.GetByID(ctx, pinID)
+	if err != nil {
+		return fmt.Errorf("failed to get pin request: %w", err)
+	}
+	if pin.Status != models.PinStatusPinned {
+		return nil
+	}
+
+	days := pin.RetentionDays(time.Now())
+	if days <= 0 || s.isSplit(pin) || pin.SharesDeals || pin.AggregateID != nil {
+		return nil
+	}
+
+	report, err := s.report(ctx, pin)
+	if err != nil {
+		return err
+	}
+
+	deficit := report.Deficit()
+	if deficit <= 0 {
+		return nil
+	}
+
+	log := s.logger.WithFields(logrus.Fields{
+		"pin_id":  pin.ID,
+		"cid":     pin.CID,
+		"healthy": report.Healthy,
+		"deficit": deficit,
+	})
+	log.Info("Repairing pin")
+
+	payloadCID, err := s.stageContent(ctx, pin.ID, pin.CID, report)
+	if err != nil {
+		return err
+	}
+
+	// Spread new copies across providers that do not already hold one
+	var exclude []string
+	for _, replica := range report.Replicas {
+		if replica.State != ReplicaExpired {
+			exclude = append(exclude, replica.MinerID)
+		}
+	}
+
+	verified := s.dealMaker.CanMakeVerified(ctx, pin, pin.SizeBytes)
+	asks, err := s.dealMaker.SelectProviders(ctx, ProviderCriteria{
+		Exclude:   exclude,
+		PieceSize: pin.SizeBytes,
+		Verified:  verified,
+		Count:     deficit,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to select providers: %w", err)
+	}
+
+	made := 0
+	for _, ask := range asks {
+		deal, err := s.dealMaker.MakeDeal(ctx, DealRequest{
+			PinRequest:   pin,
+			PayloadCID:   payloadCID,
+			Ask:          ask,
+			DurationDays: days,
+			Verified:     verified,
+		})
+		if err != nil {
+			log.WithError(err).WithField("miner_id", ask.MinerID).Warn("Failed to make repair deal")
+			continue
+		}
+		log.WithField("deal_id", deal.ID).Info("Repair deal started")
+		made++
+	}
+
+	if made < deficit {
+		return fmt.Errorf("made %d of %d repair deals", made, deficit)
+	}
+
+	return nil
+}
+
+// RepairAggregate makes new deals for an aggregate until it meets its
+// replication policy. The deals are recorded for the members still pinned,
+// each carrying its share of the cost, and run for as long as the longest
+// retained of them.
+func (s *RepairService) RepairAggregate(ctx context.Context, aggregateID uuid.UUID) error {
+	aggregate, err := s.aggregateRepo.GetByID(ctx, aggregateID)
+	if err != nil {
+		return fmt.Errorf("failed to get aggregate: %w", err)
+	}
+	if aggregate.Status != models.AggregateStatusDealt {
+		return nil
+	}
+
+	entries, err := s.aggregateRepo.GetEntries(ctx, aggregateID)
+	if err != nil {
+		return fmt.Errorf("failed to get aggregate entries: %w", err)
+	}
+
+	now := time.Now()
+	days := 0
+	var members []*models.AggregateEntry
+	pinIDs := make([]uuid.UUID, 0, len(entries))
+	for _, entry := range entries {
+		pinIDs = append(pinIDs, entry.PinRequestID)
+
+		pin, err := s.pinRepo.GetByID(ctx, entry.PinRequestID)
+		if err != nil {
+			return fmt.Errorf("failed to get pin request: %w", err)
+		}
+		retention := pin.RetentionDays(now)
+		if pin.Status != models.PinStatusPinned || retention <= 0 {
+			continue
+		}
+		members = append(members, entry)
+		if retention > days {
+			days = retention
+		}
+	}
+	if len(members) == 0 {
+		return nil
+	}
+
+	currentEpoch, err := s.lotusClient.GetCurrentEpoch(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get current epoch: %w", err)
+	}
+	deals, err := s.dealRepo.GetByPinRequestIDs(ctx, pinIDs)
+	if err != nil {
+		return fmt.Errorf("failed to get deals: %w", err)
+	}
+	collected := make(map[uuid.UUID]map[string]*models.FilecoinDeal)
+	collectAggregateDeals(collected, aggregateID, deals)
+
+	report := s.aggregateReport(ctx, aggregate, collected[aggregateID], currentEpoch)
+	deficit := report.Deficit()
+	if deficit <= 0 {
+		return nil
+	}
+
+	log := s.logger.WithFields(logrus.Fields{
+		"aggregate_id": aggregateID,
+		"root_cid":     aggregate.RootCID,
+		"healthy":      report.Healthy,
+		"deficit":      deficit,
+	})
+	log.Info("Repairing aggregate")
+
+	if _, err := s.stageContent(ctx, aggregateID, aggregate.RootCID, report); err != nil {
+		return err
+	}
+
+	var exclude []string
+	for _, replica := range report.Replicas {
+		if replica.State != ReplicaExpired {
+			exclude = append(exclude, replica.MinerID)
+		}
+	}
+
+	asks, err := s.dealMaker.SelectProviders(ctx, ProviderCriteria{
+		Exclude:   exclude,
+		PieceSize: aggregate.PieceSize,
+		Count:     deficit,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to select providers: %w", err)
+	}
+
+	made := 0
+	for _, ask := range asks {
+		deals, err := s.dealMaker.MakeAggregateDeal(ctx, AggregateDealRequest{
+			Aggregate:    aggregate,
+			Entries:      members,
+			Ask:          ask,
+			DurationDays: days,
+		})
+		if err != nil {
+			log.WithError(err).WithField("miner_id", ask.MinerID).Warn("Failed to make aggregate repair deal")
+			continue
+		}
+		log.WithField("deal_cid", deals[0].DealCID).Info("Aggregate repair deal started")
+		made++
+	}
+
+	if made < deficit {
+		return fmt.Errorf("made %d of %d aggregate repair deals", made, deficit)
+	}
+
+	return nil
+}
+
+// GetReplicaReport returns the replica health of one of the user's pins
+func (s *RepairService) GetReplicaReport(ctx context.Context, pinID uuid.UUID, userID string) (*ReplicaReport, error) {
+	pin, err := s.pinRepo.GetByID(ctx, pinID)
+	if err != nil || pin.UserID.String() != userID {
+		return nil, fmt.Errorf("pin request not found")
+	}
+
+	return s.report(ctx, pin)
+}
+
+func (s *RepairService) report(ctx context.Context, pin *models.PinRequest) (*ReplicaReport, error) {
+	currentEpoch, err := s.lotusClient.GetCurrentEpoch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current epoch: %w", err)
+	}
+
+	deals, err := s.dealRepo.GetByPinRequestID(ctx, pin.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deals: %w", err)
+	}
+
+	return s.classify(s.pinReport(pin), deals, currentEpoch, s.providerHealth(ctx, deals)), nil
+}
+
+// aggregateReport classifies an aggregate's deals, given one row of each
+func (s *RepairService) aggregateReport(ctx context.Context, aggregate *models.Aggregate, byDealCID map[string]*models.FilecoinDeal, currentEpoch int64) *ReplicaReport {
+	deals := make([]*models.FilecoinDeal, 0, len(byDealCID))
+	for _, deal := range byDealCID {
+		deals = append(deals, deal)
+	}
+
+	report := &ReplicaReport{
+		AggregateID: &aggregate.ID,
+		CID:         aggregate.RootCID,
+		Policy:      s.policy(aggregate.Replicas),
+	}
+	return s.classify(report, deals, currentEpoch, s.providerHealth(ctx, deals))
+}
+
+// collectAggregateDeals adds the rows of an aggregate's deals to those
+// already collected, keeping one row per aggregate deal
+func collectAggregateDeals(collected map[uuid.UUID]map[string]*models.FilecoinDeal, aggregateID uuid.UUID, deals []*models.FilecoinDeal) {
+	byDealCID, ok := collected[aggregateID]
+	if !ok {
+		byDealCID = make(map[string]*models.FilecoinDeal)
+		collected[aggregateID] = byDealCID
+	}
+	for _, deal := range deals {
+		if deal.AggregateID != nil && *deal.AggregateID == aggregateID {
+			byDealCID[deal.DealCID] = deal
+		}
+	}
+}
+
+// pinReport starts the replica report of a pin
+func (s *RepairService) pinReport(pin *models.PinRequest) *ReplicaReport {
+	return &ReplicaReport{
+		PinRequestID: pin.ID,
+		CID:          pin.CID,
+		Policy:       s.policy(pin.Replicas),
+	}
+}
+
+// policy returns how many replicas a replication policy asks for
+func (s *RepairService) policy(replicas int) int {
+	if replicas <= 0 {
+		return s.config.Repair.DefaultReplicas
+	}
+	return replicas
+}
+
+// classify sorts deals into replica states on a report. Providers whose
+// health could not be checked are given the benefit of the doubt, so a Lotus
+// hiccup never triggers a wave of repairs.
+func (s *RepairService) classify(report *ReplicaReport, deals []*models.FilecoinDeal, currentEpoch int64, health map[string]*filecoin.ProviderHealth) *ReplicaReport {
+
+	for _, deal := range deals {
+		state := ReplicaHealthy
+		switch {
+		case deal.Status == models.DealStatusSlashed:
+			state = ReplicaSlashed
+		case deal.Status == models.DealStatusFailed || deal.Status == models.DealStatusCancelled:
+			state = ReplicaFailed
+		case deal.IsExpired() || deal.EndEpoch <= currentEpoch:
+			state = ReplicaExpired
+		case deal.AwaitingActivation():
+			state = ReplicaPending
+		default:
+			if h, ok := health[deal.MinerID]; ok {
+				if !h.HasPower {
+					state = ReplicaLost
+				} else if h.FaultedDeals[deal.DealID] {
+					state = ReplicaFaulted
+				}
+			}
+		}
+
+		switch state {
+		case ReplicaHealthy:
+			report.Healthy++
+		case ReplicaPending:
+			report.Pending++
+		}
+
+		report.Replicas = append(report.Replicas, Replica{
+			DealID:   deal.ID,
+			MinerID:  deal.MinerID,
+			State:    state,
+			EndEpoch: deal.EndEpoch,
+		})
+	}
+
+	return report
+}
+
+// isSplit reports whether a pin is too large for a single deal. Those are
+// stored as chunks and kept at policy by the split service.
+func (s *RepairService) isSplit(pin *models.PinRequest) bool {
+	return s.config.Splitting.Enabled && pin.SizeBytes > s.config.Splitting.MaxChunkSize
+}
+
+// providerHealth checks each provider holding one of the active deals once
+func (s *RepairService) providerHealth(ctx context.Context, deals []*models.FilecoinDeal) map[string]*filecoin.ProviderHealth {
+	dealIDs := make(map[string][]int64)
+	for _, deal := range deals {
+		if deal.IsActive() && deal.IsOnChain() {
+			dealIDs[deal.MinerID] = append(dealIDs[deal.MinerID], deal.DealID)
+		}
+	}
+
+	health := make(map[string]*filecoin.ProviderHealth, len(dealIDs))
+	for minerID, ids := range dealIDs {
+		h, err := s.lotusClient.GetProviderHealth(ctx, minerID, ids)
+		if err != nil {
+			s.logger.WithError(err).WithField("miner_id", minerID).Warn("Failed to check provider health")
+			continue
+		}
+		health[minerID] = h
+	}
+
+	return health
+}
+
+// stageContent makes the data of a pin or aggregate available to Lotus for
+// new deals and returns the payload CID to deal on
+func (s *RepairService) stageContent(ctx context.Context, id uuid.UUID, cid string, report *ReplicaReport) (string, error) {
+	if s.ipfsClient.IsPinned(ctx, cid) {
+		return cid, nil
+	}
+
+	if err := os.MkdirAll(s.config.Repair.StagingDir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create staging directory: %w", err)
+	}
+
+	carPath := filepath.Join(s.config.Repair.StagingDir, id.String()+".car")
+	defer os.Remove(carPath)
+
+	for _, replica := range report.Replicas {
+		if replica.State != ReplicaHealthy {
+			continue
+		}
+
+		cost, err := s.lotusClient.RetrieveToCAR(ctx, cid, replica.MinerID, s.config.Filecoin.WalletAddress, carPath)
+		if err != nil {
+			s.logger.WithError(err).WithField("miner_id", replica.MinerID).Warn("Failed to retrieve from provider")
+			continue
+		}
+		if err := s.dealRepo.AddRetrievalCost(ctx, replica.DealID, cost); err != nil {
+			s.logger.WithError(err).WithField("deal_id", replica.DealID).Warn("Failed to record retrieval cost")
+		}
+
+		root, err := s.lotusClient.ImportCAR(ctx, carPath)
+		if err != nil {
+			return "", err
+		}
+		return root, nil
+	}
+
+	return "", fmt.Errorf("no source available for %s", cid)
+}
+
+func (s *RepairService) enqueueRepair(report *ReplicaReport) error {
+	if report.AggregateID != nil {
+		_, err := s.enqueuer.EnqueueUnique(JobRepairAggregate, map[string]interface{}{
+			"aggregate_id": report.AggregateID.String(),
+		})
+		return err
+	}
+
+	jobName := JobRepairPin
+	switch report.Healthy {
+	case 0:
+		jobName = JobRepairPinCritical
+	case 1:
+		jobName = JobRepairPinDegraded
+	}
+
+	// Unique so a pin is not queued again while a repair is outstanding
+	_, err := s.enqueuer.EnqueueUnique(jobName, map[string]interface{}{
+		"pin_id": report.PinRequestID.String(),
+	})
+	return err
+}
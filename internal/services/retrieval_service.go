@@ -0,0 +1,382 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gocraft/work"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/filecoin"
+	"pinning-service/internal/ipfs"
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+// JobRetrieveContent is the job that restores content from Filecoin
+const JobRetrieveContent = "retrieve_content"
+
+// RetrievalService serves pinned content and falls back to retrieving it
+// from the pin's storage providers when the IPFS node no longer has it
+type RetrievalService struct {
+	ipfsClient    *ipfs.Client
+	nodePool      *NodePoolService
+	lotusClient   *filecoin.LotusClient
+	httpRetrieval *filecoin.HTTPRetrievalClient
+	pinRepo       storage.PinRequestRepository
+	dealRepo      storage.FilecoinDealRepository
+	retrievalRepo storage.RetrievalRepository
+	splitRepo     storage.SplitRepository
+	enqueuer      *work.Enqueuer
+	config        *config.Config
+	logger        *logrus.Logger
+}
+
+func NewRetrievalService(ipfsClient *ipfs.Client, nodePool *NodePoolService, lotusClient *filecoin.LotusClient, pinRepo storage.PinRequestRepository, dealRepo storage.FilecoinDealRepository, retrievalRepo storage.RetrievalRepository, splitRepo storage.SplitRepository, enqueuer *work.Enqueuer, cfg *config.Config, logger *logrus.Logger) *RetrievalService {
+	return &RetrievalService{
+		ipfsClient:    ipfsClient,
+		nodePool:      nodePool,
+		lotusClient:   lotusClient,
+		httpRetrieval: filecoin.NewHTTPRetrievalClient(cfg.Retrieval.Timeout),
+		pinRepo:       pinRepo,
+		dealRepo:      dealRepo,
+		retrievalRepo: retrievalRepo,
+		splitRepo:     splitRepo,
+		enqueuer:      enqueuer,
+		config:        cfg,
+		logger:        logger,
+	}
+}
+
+// GetContent opens a stream of a CID the user has pinned. If the IPFS
+// node no longer holds it, such as content in the cold tier, a retrieval
+// from Filecoin is started and returned instead of the stream.
+func (s *RetrievalService) GetContent(ctx context.Context, cid, userID string) (io.ReadCloser, *models.Retrieval, error) {
+	pin, err := s.findPin(ctx, cid, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if s.nodePool.IsPinned(ctx, cid) {
+		content, err := s.nodePool.Cat(ctx, cid)
+		if err == nil {
+			return content, nil, nil
+		}
+		s.logger.WithError(err).WithField("cid", cid).Warn("Failed to read pinned content, falling back to Filecoin")
+	}
+
+	retrieval, err := s.StartRetrieval(ctx, pin)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return nil, retrieval, nil
+}
+
+// RetrieveCold starts a retrieval for a cold pin whose content is not on
+// IPFS, returning it, or nil if the content can be read from IPFS
+func (s *RetrievalService) RetrieveCold(ctx context.Context, pin *models.PinRequest) (*models.Retrieval, error) {
+	if pin.Tier != models.TierCold || s.nodePool.IsPinned(ctx, pin.CID) {
+		return nil, nil
+	}
+	return s.StartRetrieval(ctx, pin)
+}
+
+// StartRetrieval queues a retrieval for a pin, or returns the one already
+// in flight
+func (s *RetrievalService) StartRetrieval(ctx context.Context, pin *models.PinRequest) (*models.Retrieval, error) {
+	retrieval := &models.Retrieval{
+		ID:           uuid.New(),
+		UserID:       pin.UserID,
+		PinRequestID: pin.ID,
+		CID:          pin.CID,
+		Status:       models.RetrievalStatusQueued,
+	}
+
+	created, err := s.retrievalRepo.Create(ctx, retrieval)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create retrieval: %w", err)
+	}
+	if !created {
+		return s.retrievalRepo.GetActiveByPinRequestID(ctx, pin.ID)
+	}
+
+	if _, err := s.enqueuer.EnqueueUnique(JobRetrieveContent, map[string]interface{}{
+		"retrieval_id": retrieval.ID.String(),
+	}); err != nil {
+		retrieval.Status = models.RetrievalStatusFailed
+		retrieval.Error = "failed to schedule retrieval"
+		s.retrievalRepo.Update(ctx, retrieval)
+		return nil, fmt.Errorf("failed to enqueue retrieval: %w", err)
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"retrieval_id": retrieval.ID,
+		"cid":          pin.CID,
+	}).Info("Filecoin retrieval queued")
+
+	return retrieval, nil
+}
+
+// GetRetrieval returns one of the user's retrievals
+func (s *RetrievalService) GetRetrieval(ctx context.Context, id uuid.UUID, userID string) (*models.Retrieval, error) {
+	retrieval, err := s.retrievalRepo.GetByID(ctx, id)
+	if err != nil || retrieval.UserID.String() != userID {
+		return nil, fmt.Errorf("retrieval not found")
+	}
+	return retrieval, nil
+}
+
+// ProcessRetrieval tries each of the pin's active deals in turn until one
+// provider serves the content, then imports it back into IPFS. Providers
+// with an HTTP endpoint are tried first since those retrievals are free.
+func (s *RetrievalService) ProcessRetrieval(ctx context.Context, id uuid.UUID) error {
+	retrieval, err := s.retrievalRepo.GetByID(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to get retrieval: %w", err)
+	}
+	if retrieval.IsFinished() {
+		return nil
+	}
+
+	now := time.Now()
+	retrieval.Status = models.RetrievalStatusInProgress
+	retrieval.Attempts++
+	retrieval.StartedAt = &now
+	if err := s.retrievalRepo.Update(ctx, retrieval); err != nil {
+		return fmt.Errorf("failed to update retrieval: %w", err)
+	}
+
+	// The content may have been restored by other means in the meantime
+	if s.nodePool.IsPinned(ctx, retrieval.CID) {
+		return s.complete(ctx, retrieval)
+	}
+
+	deals, err := s.dealRepo.GetByPinRequestID(ctx, retrieval.PinRequestID)
+	if err != nil {
+		return s.fail(ctx, retrieval, fmt.Errorf("failed to get deals: %w", err))
+	}
+
+	if err := os.MkdirAll(s.config.Retrieval.StagingDir, 0o755); err != nil {
+		return s.fail(ctx, retrieval, fmt.Errorf("failed to create staging directory: %w", err))
+	}
+
+	carPath := filepath.Join(s.config.Retrieval.StagingDir, retrieval.ID.String()+".car")
+	defer os.Remove(carPath)
+
+	// Oversized pins were stored as chunks and must be put back together
+	if manifest, err := s.splitRepo.GetManifestByPinRequestID(ctx, retrieval.PinRequestID); err == nil {
+		if err := s.reassemble(ctx, retrieval, manifest, deals, carPath); err != nil {
+			return s.fail(ctx, retrieval, err)
+		}
+		return s.complete(ctx, retrieval)
+	}
+
+	if err := s.retrieveAny(ctx, retrieval, deals, retrieval.CID, carPath); err != nil {
+		return s.fail(ctx, retrieval, err)
+	}
+
+	return s.complete(ctx, retrieval)
+}
+
+// retrieveAny tries each active deal in turn until one provider serves the
+// content and it is imported into IPFS. Cost and bytes are added to the
+// retrieval.
+func (s *RetrievalService) retrieveAny(ctx context.Context, retrieval *models.Retrieval, deals []*models.FilecoinDeal, cid, carPath string) error {
+	var candidates []*models.FilecoinDeal
+	for _, deal := range deals {
+		if deal.IsActive() {
+			candidates = append(candidates, deal)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		_, iHTTP := s.config.Retrieval.HTTPEndpoints[candidates[i].MinerID]
+		_, jHTTP := s.config.Retrieval.HTTPEndpoints[candidates[j].MinerID]
+		return iHTTP && !jHTTP
+	})
+
+	if len(candidates) == 0 {
+		return fmt.Errorf("no active deals for %s", cid)
+	}
+
+	var lastErr error
+	for _, deal := range candidates {
+		log := s.logger.WithFields(logrus.Fields{
+			"retrieval_id": retrieval.ID,
+			"miner_id":     deal.MinerID,
+		})
+
+		method, cost, err := s.retrieveFrom(ctx, deal, cid, carPath)
+		if err != nil {
+			log.WithError(err).Warn("Retrieval from provider failed")
+			lastErr = err
+			continue
+		}
+
+		if err := s.dealRepo.AddRetrievalCost(ctx, deal.ID, cost); err != nil {
+			log.WithError(err).Warn("Failed to record retrieval cost")
+		}
+
+		dealID := deal.ID
+		retrieval.FilecoinDealID = &dealID
+		retrieval.MinerID = deal.MinerID
+		retrieval.Method = method
+		retrieval.CostFIL += cost
+
+		if info, err := os.Stat(carPath); err == nil {
+			retrieval.BytesReceived += info.Size()
+		}
+
+		if err := s.restore(ctx, carPath); err != nil {
+			lastErr = err
+			continue
+		}
+
+		log.WithField("method", method).Info("Content restored from Filecoin")
+		return nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no provider could serve %s", cid)
+	}
+	return lastErr
+}
+
+// reassemble restores a split pin by retrieving every chunk, putting back
+// the blocks above the split points and pinning the original root
+func (s *RetrievalService) reassemble(ctx context.Context, retrieval *models.Retrieval, manifest *models.SplitManifest, deals []*models.FilecoinDeal, carPath string) error {
+	chunks, err := s.splitRepo.GetChunks(ctx, manifest.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get chunks: %w", err)
+	}
+
+	for _, chunk := range chunks {
+		if s.nodePool.IsPinned(ctx, chunk.RootCID) {
+			continue
+		}
+
+		var chunkDeals []*models.FilecoinDeal
+		for _, deal := range deals {
+			if deal.ChunkID != nil && *deal.ChunkID == chunk.ID {
+				chunkDeals = append(chunkDeals, deal)
+			}
+		}
+
+		if err := s.retrieveAny(ctx, retrieval, chunkDeals, chunk.RootCID, carPath); err != nil {
+			return fmt.Errorf("chunk %d: %w", chunk.Position, err)
+		}
+	}
+
+	blocks, err := s.splitRepo.GetBlocks(ctx, manifest.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get split blocks: %w", err)
+	}
+	for _, block := range blocks {
+		if err := s.ipfsClient.BlockPut(ctx, block.CID, block.Data); err != nil {
+			return err
+		}
+	}
+
+	if err := s.nodePool.Pin(ctx, manifest.RootCID); err != nil {
+		return err
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"retrieval_id": retrieval.ID,
+		"cid":          manifest.RootCID,
+		"chunks":       len(chunks),
+	}).Info("Split content reassembled from Filecoin")
+
+	return nil
+}
+
+// retrieveFrom fetches the content from a deal's provider into a CAR file
+// and returns the method used and the FIL paid
+func (s *RetrievalService) retrieveFrom(ctx context.Context, deal *models.FilecoinDeal, cid, carPath string) (string, float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Retrieval.Timeout)
+	defer cancel()
+
+	if endpoint, ok := s.config.Retrieval.HTTPEndpoints[deal.MinerID]; ok {
+		_, err := s.httpRetrieval.RetrieveToCAR(ctx, endpoint, cid, carPath)
+		if err == nil {
+			return models.RetrievalMethodHTTP, 0, nil
+		}
+		s.logger.WithError(err).WithField("miner_id", deal.MinerID).Debug("HTTP retrieval failed, trying Lotus")
+	}
+
+	cost, err := s.lotusClient.RetrieveToCAR(ctx, cid, deal.MinerID, s.config.Filecoin.WalletAddress, carPath)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return models.RetrievalMethodLotus, cost, nil
+}
+
+// restore imports a retrieved CAR into IPFS and pins it across the node
+// pool
+func (s *RetrievalService) restore(ctx context.Context, carPath string) error {
+	file, err := os.Open(carPath)
+	if err != nil {
+		return fmt.Errorf("failed to open CAR: %w", err)
+	}
+	defer file.Close()
+
+	root, err := s.ipfsClient.DagImport(ctx, file)
+	if err != nil {
+		return err
+	}
+
+	return s.nodePool.Pin(ctx, root)
+}
+
+func (s *RetrievalService) findPin(ctx context.Context, cid, userID string) (*models.PinRequest, error) {
+	pins, err := s.pinRepo.GetByCID(ctx, cid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pin requests: %w", err)
+	}
+
+	for _, pin := range pins {
+		if pin.UserID.String() == userID && pin.Status == models.PinStatusPinned {
+			return pin, nil
+		}
+	}
+
+	return nil, fmt.Errorf("content not found")
+}
+
+func (s *RetrievalService) complete(ctx context.Context, retrieval *models.Retrieval) error {
+	now := time.Now()
+	retrieval.Status = models.RetrievalStatusCompleted
+	retrieval.CompletedAt = &now
+	retrieval.Error = ""
+	return s.retrievalRepo.Update(ctx, retrieval)
+}
+
+// fail records a failed attempt. The retrieval is requeued by the job
+// runner until it runs out of attempts.
+func (s *RetrievalService) fail(ctx context.Context, retrieval *models.Retrieval, cause error) error {
+	if cause == nil {
+		cause = fmt.Errorf("no provider could serve %s", retrieval.CID)
+	}
+
+	retrieval.Error = cause.Error()
+	retrieval.Status = models.RetrievalStatusQueued
+	if retrieval.Attempts >= s.config.Retrieval.MaxAttempts {
+		now := time.Now()
+		retrieval.Status = models.RetrievalStatusFailed
+		retrieval.CompletedAt = &now
+	}
+
+	if err := s.retrievalRepo.Update(ctx, retrieval); err != nil {
+		s.logger.WithError(err).WithField("retrieval_id", retrieval.ID).Error("Failed to update retrieval")
+	}
+
+	return cause
+}
@@ -0,0 +1,378 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/filecoin"
+	"pinning-service/internal/ipfs"
+	"pinning-service/internal/models"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+// JobProcessSplits is the job that splits oversized pins and keeps their
+// chunks replicated
+const JobProcessSplits = "process_splits"
+
+// ChunkReport is the replication state of one chunk of a split pin
+type ChunkReport struct {
+	*models.SplitChunk
+	Healthy int `json:"healthy"`
+	Pending int `json:"pending"`
+}
+
+// SplitReport is the replication state of a split pin. The pin is active
+// only once every chunk meets the policy.
+type SplitReport struct {
+	Manifest *models.SplitManifest `json:"manifest"`
+	Policy   int                   `json:"policy"`
+	Chunks   []*ChunkReport        `json:"chunks"`
+}
+
+// subDAG is a sub-DAG small enough to be stored whole in a chunk
+type subDAG struct {
+	cid  string
+	size int64
+}
+
+// SplitService divides DAGs larger than a provider's sector into chunks
+// along sub-DAG boundaries, makes deals per chunk and keeps every chunk at
+// the pin's replication policy
+type SplitService struct {
+	ipfsClient  *ipfs.Client
+	nodePool    *NodePoolService
+	lotusClient *filecoin.LotusClient
+	dealMaker   *DealMaker
+	pinRepo     storage.PinRequestRepository
+	dealRepo    storage.FilecoinDealRepository
+	splitRepo   storage.SplitRepository
+	config      *config.Config
+	logger      *logrus.Logger
+}
+
+func NewSplitService(ipfsClient *ipfs.Client, nodePool *NodePoolService, lotusClient *filecoin.LotusClient, dealMaker *DealMaker, pinRepo storage.PinRequestRepository, dealRepo storage.FilecoinDealRepository, splitRepo storage.SplitRepository, cfg *config.Config, logger *logrus.Logger) *SplitService {
+	return &SplitService{
+		ipfsClient:  ipfsClient,
+		nodePool:    nodePool,
+		lotusClient: lotusClient,
+		dealMaker:   dealMaker,
+		pinRepo:     pinRepo,
+		dealRepo:    dealRepo,
+		splitRepo:   splitRepo,
+		config:      cfg,
+		logger:      logger,
+	}
+}
+
+// ProcessSplits splits newly pinned oversized DAGs, then brings the chunks
+// of split pins up to policy. Manifests already active are rechecked too,
+// least recently first, so a lost chunk replica is noticed and replaced.
+func (s *SplitService) ProcessSplits(ctx context.Context) error {
+	batchSize := s.config.Splitting.BatchSize
+
+	candidates, err := s.pinRepo.GetSplitCandidates(ctx, s.config.Splitting.MaxChunkSize, batchSize)
+	if err != nil {
+		return fmt.Errorf("failed to get split candidates: %w", err)
+	}
+	for _, pin := range candidates {
+		if _, err := s.Split(ctx, pin); err != nil {
+			s.logger.WithError(err).WithField("pin_request_id", pin.ID).Error("Failed to split pin")
+		}
+	}
+
+	currentEpoch, err := s.lotusClient.GetCurrentEpoch(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get current epoch: %w", err)
+	}
+
+	for _, status := range []string{models.SplitStatusStoring, models.SplitStatusActive} {
+		manifests, err := s.splitRepo.GetManifestsByStatus(ctx, status, batchSize)
+		if err != nil {
+			return fmt.Errorf("failed to get split manifests: %w", err)
+		}
+		for _, manifest := range manifests {
+			if err := s.replicate(ctx, manifest, currentEpoch); err != nil {
+				s.logger.WithError(err).WithField("manifest_id", manifest.ID).Warn("Failed to replicate split chunks")
+			}
+		}
+	}
+
+	return nil
+}
+
+// Split divides a pinned DAG into chunks no larger than the configured
+// chunk size. Chunks are built as directories linking whole sub-DAGs, so
+// every block below the split points lands in exactly one chunk; the
+// blocks above them are kept in the manifest.
+func (s *SplitService) Split(ctx context.Context, pin *models.PinRequest) (*models.SplitManifest, error) {
+	maxChunk := s.config.Splitting.MaxChunkSize
+
+	manifest := &models.SplitManifest{
+		ID:           uuid.New(),
+		PinRequestID: pin.ID,
+		RootCID:      pin.CID,
+		Status:       models.SplitStatusStoring,
+	}
+
+	var subDAGs []subDAG
+	var blocks []*models.SplitBlock
+	var walk func(cid string, size int64) error
+	walk = func(cid string, size int64) error {
+		if size <= maxChunk {
+			subDAGs = append(subDAGs, subDAG{cid: cid, size: size})
+			return nil
+		}
+
+		links, err := s.ipfsClient.Links(ctx, cid)
+		if err != nil {
+			return err
+		}
+		if len(links) == 0 {
+			return fmt.Errorf("block %s is larger than a chunk", cid)
+		}
+
+		data, err := s.ipfsClient.BlockGet(ctx, cid)
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, &models.SplitBlock{ManifestID: manifest.ID, CID: cid, Data: data})
+
+		for _, link := range links {
+			if err := walk(link.CID, link.Size); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	size, err := s.nodePool.GetSize(ctx, pin.CID)
+	if err != nil {
+		return nil, err
+	}
+	if err := walk(pin.CID, size); err != nil {
+		return nil, err
+	}
+
+	// Pack sub-DAGs into chunks in DAG order
+	var groups [][]subDAG
+	var current []subDAG
+	var currentSize int64
+	for _, sub := range subDAGs {
+		if len(current) > 0 && currentSize+sub.size > maxChunk {
+			groups = append(groups, current)
+			current, currentSize = nil, 0
+		}
+		current = append(current, sub)
+		currentSize += sub.size
+	}
+	if len(current) > 0 {
+		groups = append(groups, current)
+	}
+
+	chunks := make([]*models.SplitChunk, len(groups))
+	for i, group := range groups {
+		chunk, err := s.buildChunk(ctx, manifest.ID, i, group)
+		if err != nil {
+			return nil, err
+		}
+		chunks[i] = chunk
+		manifest.SizeBytes += chunk.SizeBytes
+	}
+	manifest.ChunkCount = len(chunks)
+
+	if err := s.splitRepo.Create(ctx, manifest, chunks, blocks); err != nil {
+		return nil, fmt.Errorf("failed to create split manifest: %w", err)
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"pin_request_id": pin.ID,
+		"cid":            pin.CID,
+		"chunks":         len(chunks),
+		"spine_blocks":   len(blocks),
+	}).Info("Split oversized pin into chunks")
+
+	return manifest, nil
+}
+
+// GetSplitReport returns the chunk replication state of one of the user's
+// pins
+func (s *SplitService) GetSplitReport(ctx context.Context, pinID uuid.UUID, userID string) (*SplitReport, error) {
+	pin, err := s.pinRepo.GetByID(ctx, pinID)
+	if err != nil || pin.UserID.String() != userID {
+		return nil, fmt.Errorf("pin request not found")
+	}
+
+	manifest, err := s.splitRepo.GetManifestByPinRequestID(ctx, pin.ID)
+	if err != nil {
+		return nil, fmt.Errorf("pin request is not split")
+	}
+
+	currentEpoch, err := s.lotusClient.GetCurrentEpoch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current epoch: %w", err)
+	}
+
+	return s.report(ctx, pin, manifest, currentEpoch)
+}
+
+func (s *SplitService) report(ctx context.Context, pin *models.PinRequest, manifest *models.SplitManifest, currentEpoch int64) (*SplitReport, error) {
+	chunks, err := s.splitRepo.GetChunks(ctx, manifest.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chunks: %w", err)
+	}
+	deals, err := s.dealRepo.GetByPinRequestID(ctx, pin.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deals: %w", err)
+	}
+
+	report := &SplitReport{
+		Manifest: manifest,
+		Policy:   pin.Replicas,
+	}
+	if report.Policy <= 0 {
+		report.Policy = s.config.Repair.DefaultReplicas
+	}
+
+	byChunk := make(map[uuid.UUID]*ChunkReport, len(chunks))
+	for _, chunk := range chunks {
+		chunkReport := &ChunkReport{SplitChunk: chunk}
+		byChunk[chunk.ID] = chunkReport
+		report.Chunks = append(report.Chunks, chunkReport)
+	}
+
+	for _, deal := range deals {
+		if deal.ChunkID == nil || byChunk[*deal.ChunkID] == nil || deal.EndEpoch <= currentEpoch {
+			continue
+		}
+		switch {
+		case deal.IsActive():
+			byChunk[*deal.ChunkID].Healthy++
+		case deal.AwaitingActivation():
+			byChunk[*deal.ChunkID].Pending++
+		}
+	}
+
+	return report, nil
+}
+
+// replicate makes deals for every chunk below the pin's policy and marks
+// the manifest active once all chunks meet it
+func (s *SplitService) replicate(ctx context.Context, manifest *models.SplitManifest, currentEpoch int64) error {
+	pin, err := s.pinRepo.GetByID(ctx, manifest.PinRequestID)
+	if err != nil {
+		return fmt.Errorf("failed to get pin request: %w", err)
+	}
+
+	days := pin.RetentionDays(time.Now())
+	if pin.Status != models.PinStatusPinned || days <= 0 {
+		return nil
+	}
+
+	report, err := s.report(ctx, pin, manifest, currentEpoch)
+	if err != nil {
+		return err
+	}
+
+	deals, err := s.dealRepo.GetByPinRequestID(ctx, pin.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get deals: %w", err)
+	}
+
+	complete := true
+	for _, chunk := range report.Chunks {
+		if chunk.Healthy < report.Policy {
+			complete = false
+		}
+
+		deficit := report.Policy - chunk.Healthy - chunk.Pending
+		if deficit <= 0 {
+			continue
+		}
+
+		// Spread copies of a chunk across providers
+		var exclude []string
+		for _, deal := range deals {
+			if deal.ChunkID != nil && *deal.ChunkID == chunk.ID && !deal.IsExpired() {
+				exclude = append(exclude, deal.MinerID)
+			}
+		}
+
+		verified := s.dealMaker.CanMakeVerified(ctx, pin, chunk.SizeBytes)
+		asks, err := s.dealMaker.SelectProviders(ctx, ProviderCriteria{
+			Exclude:   exclude,
+			PieceSize: chunk.PieceSize,
+			Verified:  verified,
+			Count:     deficit,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to select providers for chunk %d: %w", chunk.Position, err)
+		}
+
+		chunkID := chunk.ID
+		for _, ask := range asks {
+			if _, err := s.dealMaker.MakeDeal(ctx, DealRequest{
+				PinRequest:   pin,
+				PayloadCID:   chunk.RootCID,
+				ChunkID:      &chunkID,
+				SizeBytes:    chunk.SizeBytes,
+				Ask:          ask,
+				DurationDays: days,
+				Verified:     verified,
+			}); err != nil {
+				s.logger.WithError(err).WithFields(logrus.Fields{
+					"manifest_id": manifest.ID,
+					"chunk":       chunk.Position,
+					"miner_id":    ask.MinerID,
+				}).Warn("Chunk deal proposal failed")
+			}
+		}
+	}
+
+	if complete && manifest.Status != models.SplitStatusActive {
+		s.logger.WithField("pin_request_id", pin.ID).Info("All chunks of split pin stored")
+	}
+
+	manifest.Status = models.SplitStatusStoring
+	if complete {
+		manifest.Status = models.SplitStatusActive
+	}
+
+	// Saving also moves the manifest to the back of the refresh order
+	return s.splitRepo.UpdateManifest(ctx, manifest)
+}
+
+// buildChunk links a group of sub-DAGs into a chunk directory and pins it
+func (s *SplitService) buildChunk(ctx context.Context, manifestID uuid.UUID, position int, group []subDAG) (*models.SplitChunk, error) {
+	links := make([]ipfs.DirectoryLink, len(group))
+	roots := make([]string, len(group))
+	var size int64
+	for i, sub := range group {
+		links[i] = ipfs.DirectoryLink{Name: fmt.Sprintf("%06d", i), CID: sub.cid}
+		roots[i] = sub.cid
+		size += sub.size
+	}
+
+	root, err := s.ipfsClient.NewDirectory(ctx, links)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.nodePool.Pin(ctx, root); err != nil {
+		return nil, err
+	}
+
+	return &models.SplitChunk{
+		ID:         uuid.New(),
+		ManifestID: manifestID,
+		Position:   position,
+		RootCID:    root,
+		SubRoots:   strings.Join(roots, ","),
+		SizeBytes:  size,
+		PieceSize:  filecoin.PaddedPieceSize(size),
+	}, nil
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/staging"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+// JobStagingGC is the job that removes expired and orphaned staged blobs
+const JobStagingGC = "staging_gc"
+
+// StagingService garbage collects the staging blob store. Blobs past their
+// TTL are always removed. Staged CARs are orphaned once no open transfer
+// needs them, which happens when a proposal fails after staging or a
+// worker dies before cleanup; they are kept for a grace period so CARs
+// being staged for a new deal are not removed under it.
+type StagingService struct {
+	store        staging.BlobStore
+	transferRepo storage.TransferRepository
+	config       *config.Config
+	logger       *logrus.Logger
+}
+
+func NewStagingService(store staging.BlobStore, transferRepo storage.TransferRepository, cfg *config.Config, logger *logrus.Logger) *StagingService {
+	return &StagingService{
+		store:        store,
+		transferRepo: transferRepo,
+		config:       cfg,
+		logger:       logger,
+	}
+}
+
+// CollectGarbage removes expired and orphaned blobs and returns how many
+// were removed
+func (s *StagingService) CollectGarbage(ctx context.Context) (int, error) {
+	blobs, err := s.store.List(ctx, "")
+	if err != nil {
+		return 0, fmt.Errorf("failed to list staged blobs: %w", err)
+	}
+
+	now := time.Now()
+	removed := 0
+	for _, blob := range blobs {
+		reason, err := s.collectable(ctx, blob, now)
+		if err != nil {
+			s.logger.WithError(err).WithField("key", blob.Key).Warn("Failed to check staged blob")
+			continue
+		}
+		if reason == "" {
+			continue
+		}
+
+		if err := s.store.Delete(ctx, blob.Key); err != nil {
+			s.logger.WithError(err).WithField("key", blob.Key).Warn("Failed to remove staged blob")
+			continue
+		}
+
+		s.logger.WithFields(logrus.Fields{
+			"key":    blob.Key,
+			"size":   blob.Size,
+			"reason": reason,
+		}).Info("Removed staged blob")
+		removed++
+	}
+
+	return removed, nil
+}
+
+// collectable returns why a blob should be removed, or an empty string if
+// it should be kept
+func (s *StagingService) collectable(ctx context.Context, blob *staging.BlobInfo, now time.Time) (string, error) {
+	// Listings do not always carry expiry
+	info := blob
+	if info.ExpiresAt == nil {
+		var err error
+		if info, err = s.store.Stat(ctx, blob.Key); err == staging.ErrNotFound {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+	if info.Expired(now) {
+		return "expired", nil
+	}
+
+	if now.Sub(blob.ModTime) < s.config.Staging.OrphanGrace {
+		return "", nil
+	}
+
+	if strings.HasPrefix(blob.Key, carPrefix) {
+		payloadCID := strings.TrimSuffix(strings.TrimPrefix(blob.Key, carPrefix), ".car")
+		count, err := s.transferRepo.CountUncleanedByPayloadCID(ctx, payloadCID)
+		if err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return "orphaned", nil
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,353 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/filecoin"
+	"pinning-service/internal/ipfs"
+	"pinning-service/internal/models"
+	"pinning-service/internal/staging"
+	"pinning-service/internal/storage"
+	"pinning-service/internal/transfer"
+	"pinning-service/pkg/config"
+	"pinning-service/pkg/utils"
+)
+
+// JobCleanupTransfers is the job that removes staged CARs of sealed deals
+const JobCleanupTransfers = "cleanup_transfers"
+
+// carPrefix is where staged CARs are kept in the blob store
+const carPrefix = "cars/"
+
+// StagedPayload is a CAR staged for manual transfer deals, with the piece
+// commitment the deals are proposed with
+type StagedPayload struct {
+	PayloadCID string
+	PieceCID   string
+	PieceSize  int64
+	CARSize    int64
+}
+
+// TransferReport is a transfer with the share of the CAR received
+type TransferReport struct {
+	*models.Transfer
+	Progress float64 `json:"progress"`
+}
+
+// TransferService moves deal data to providers without graphsync. CARs are
+// exported from IPFS into the staging blob store and deals are proposed as
+// manual transfers. In http mode providers download the CAR from our
+// transfer endpoint; in offline mode it is shipped to them. Either way a
+// manifest with everything the provider needs is written per deal, since
+// Lotus cannot hand transfer details to the provider itself.
+type TransferService struct {
+	ipfsClient   *ipfs.Client
+	lotusClient  *filecoin.LotusClient
+	store        staging.BlobStore
+	pinRepo      storage.PinRequestRepository
+	dealRepo     storage.FilecoinDealRepository
+	transferRepo storage.TransferRepository
+	config       *config.Config
+	logger       *logrus.Logger
+}
+
+func NewTransferService(ipfsClient *ipfs.Client, lotusClient *filecoin.LotusClient, store staging.BlobStore, pinRepo storage.PinRequestRepository, dealRepo storage.FilecoinDealRepository, transferRepo storage.TransferRepository, cfg *config.Config, logger *logrus.Logger) *TransferService {
+	return &TransferService{
+		ipfsClient:   ipfsClient,
+		lotusClient:  lotusClient,
+		store:        store,
+		pinRepo:      pinRepo,
+		dealRepo:     dealRepo,
+		transferRepo: transferRepo,
+		config:       cfg,
+		logger:       logger,
+	}
+}
+
+// Manual returns true if deals are made as manual transfers from staged
+// CARs rather than pulled from Lotus over graphsync
+func (s *TransferService) Manual() bool {
+	mode := s.config.Transfer.Mode
+	return mode == transfer.ModeHTTP || mode == transfer.ModeOffline
+}
+
+// Prepare stages the CAR for a payload and computes its piece commitment.
+// A CAR already staged for another deal is reused.
+func (s *TransferService) Prepare(ctx context.Context, payloadCID string) (*StagedPayload, error) {
+	key := carKey(payloadCID)
+
+	var size int64
+	if info, err := s.store.Stat(ctx, key); err == nil {
+		size = info.Size
+		if existing, err := s.transferRepo.GetStagedByPayloadCID(ctx, payloadCID); err == nil {
+			return &StagedPayload{
+				PayloadCID: payloadCID,
+				PieceCID:   existing.PieceCID,
+				PieceSize:  existing.PieceSize,
+				CARSize:    size,
+			}, nil
+		}
+	} else {
+		car, err := s.ipfsClient.DagExport(ctx, payloadCID)
+		if err != nil {
+			return nil, err
+		}
+		size, err = s.store.Put(ctx, key, car, staging.PutOptions{TTL: s.config.Staging.CARTTL})
+		car.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stage CAR: %w", err)
+		}
+	}
+
+	pieceCID, pieceSize, err := s.calcCommP(ctx, key)
+	if err != nil {
+		s.Discard(ctx, payloadCID)
+		return nil, err
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"payload_cid": payloadCID,
+		"piece_cid":   pieceCID,
+		"car_size":    size,
+	}).Info("Staged CAR for transfer")
+
+	return &StagedPayload{
+		PayloadCID: payloadCID,
+		PieceCID:   pieceCID,
+		PieceSize:  pieceSize,
+		CARSize:    size,
+	}, nil
+}
+
+// Register records the transfer for a proposed deal and writes the
+// manifest the provider works from
+func (s *TransferService) Register(ctx context.Context, dealCID, minerID string, staged *StagedPayload) (*models.Transfer, error) {
+	token, err := utils.GenerateAPIKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate transfer token: %w", err)
+	}
+
+	t := &models.Transfer{
+		ID:         uuid.New(),
+		DealCID:    dealCID,
+		MinerID:    minerID,
+		Mode:       s.config.Transfer.Mode,
+		Status:     models.TransferStatusStaged,
+		PayloadCID: staged.PayloadCID,
+		PieceCID:   staged.PieceCID,
+		PieceSize:  staged.PieceSize,
+		CARSize:    staged.CARSize,
+		Token:      token,
+	}
+
+	manifest := &transfer.Manifest{
+		Mode:       t.Mode,
+		DealCID:    dealCID,
+		MinerID:    minerID,
+		PayloadCID: staged.PayloadCID,
+		PieceCID:   staged.PieceCID,
+		PieceSize:  staged.PieceSize,
+		CARSize:    staged.CARSize,
+	}
+	if t.Mode == transfer.ModeHTTP {
+		manifest.URL = s.carURL(t.ID)
+		manifest.Headers = map[string]string{"Authorization": "Bearer " + token}
+	} else {
+		manifest.CARFile = s.store.Location(carKey(staged.PayloadCID))
+	}
+
+	t.ManifestPath, err = transfer.WriteManifest(filepath.Join(s.config.Transfer.StagingDir, "manifests"), manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.transferRepo.Create(ctx, t); err != nil {
+		os.Remove(t.ManifestPath)
+		return nil, fmt.Errorf("failed to create transfer: %w", err)
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"transfer_id": t.ID,
+		"deal_cid":    dealCID,
+		"miner_id":    minerID,
+		"mode":        t.Mode,
+		"manifest":    t.ManifestPath,
+	}).Info("Deal transfer registered")
+
+	return t, nil
+}
+
+// Discard removes a staged CAR no transfer needs, such as when proposing
+// the deal it was staged for failed
+func (s *TransferService) Discard(ctx context.Context, payloadCID string) {
+	count, err := s.transferRepo.CountUncleanedByPayloadCID(ctx, payloadCID)
+	if err != nil || count > 0 {
+		return
+	}
+	if err := s.store.Delete(ctx, carKey(payloadCID)); err != nil {
+		s.logger.WithError(err).WithField("payload_cid", payloadCID).Warn("Failed to remove staged CAR")
+	}
+}
+
+// Open authenticates a provider's download and opens the staged CAR. The
+// caller must close the reader.
+func (s *TransferService) Open(ctx context.Context, id uuid.UUID, token string) (*models.Transfer, *staging.BlobReader, error) {
+	t, err := s.transferRepo.GetByID(ctx, id)
+	if err != nil || t.Mode != transfer.ModeHTTP || t.CleanedAt != nil {
+		return nil, nil, fmt.Errorf("transfer not found")
+	}
+
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) != 1 {
+		return nil, nil, fmt.Errorf("access denied")
+	}
+
+	key := carKey(t.PayloadCID)
+	info, err := s.store.Stat(ctx, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("transfer not found")
+	}
+
+	return t, staging.NewBlobReader(ctx, s.store, key, info.Size), nil
+}
+
+// RecordProgress adds bytes a provider downloaded to the transfer
+func (s *TransferService) RecordProgress(ctx context.Context, id uuid.UUID, bytes int64) {
+	if err := s.transferRepo.AddProgress(ctx, id, bytes); err != nil {
+		s.logger.WithError(err).WithField("transfer_id", id).Warn("Failed to record transfer progress")
+	}
+}
+
+// GetTransfers returns the transfers of a user's pin
+func (s *TransferService) GetTransfers(ctx context.Context, pinID uuid.UUID, userID string) ([]*TransferReport, error) {
+	pin, err := s.pinRepo.GetByID(ctx, pinID)
+	if err != nil || pin.UserID.String() != userID {
+		return nil, fmt.Errorf("pin request not found")
+	}
+
+	transfers, err := s.transferRepo.GetByPinRequestID(ctx, pin.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transfers: %w", err)
+	}
+
+	reports := make([]*TransferReport, len(transfers))
+	for i, t := range transfers {
+		reports[i] = &TransferReport{Transfer: t, Progress: t.Progress()}
+	}
+	return reports, nil
+}
+
+// CleanupTransfers closes out the transfers of deals that were sealed or
+// failed and removes their staged CARs once no other deal needs them
+func (s *TransferService) CleanupTransfers(ctx context.Context) (int, error) {
+	transfers, err := s.transferRepo.GetCleanable(ctx, []string{
+		models.DealStatusActive,
+		models.DealStatusExpired,
+		models.DealStatusSlashed,
+		models.DealStatusFailed,
+		models.DealStatusCancelled,
+	}, s.config.Transfer.CleanupBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get transfers: %w", err)
+	}
+	if len(transfers) == 0 {
+		return 0, nil
+	}
+
+	dealCIDs := make([]string, len(transfers))
+	for i, t := range transfers {
+		dealCIDs[i] = t.DealCID
+	}
+	deals, err := s.dealRepo.GetByDealCIDs(ctx, dealCIDs)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get deals: %w", err)
+	}
+	statuses := make(map[string]string, len(deals))
+	for _, deal := range deals {
+		statuses[deal.DealCID] = deal.Status
+	}
+
+	cleaned := 0
+	for _, t := range transfers {
+		now := time.Now()
+		switch statuses[t.DealCID] {
+		case models.DealStatusActive, models.DealStatusExpired:
+			t.Status = models.TransferStatusCompleted
+			t.CompletedAt = &now
+		default:
+			t.Status = models.TransferStatusFailed
+			t.Error = fmt.Sprintf("deal %s", statuses[t.DealCID])
+		}
+		t.CleanedAt = &now
+
+		if err := s.transferRepo.Update(ctx, t); err != nil {
+			s.logger.WithError(err).WithField("transfer_id", t.ID).Warn("Failed to update transfer")
+			continue
+		}
+
+		if t.ManifestPath != "" {
+			os.Remove(t.ManifestPath)
+		}
+		s.Discard(ctx, t.PayloadCID)
+		cleaned++
+	}
+
+	return cleaned, nil
+}
+
+// calcCommP computes the piece commitment of a staged CAR. Lotus reads the
+// CAR from disk, so blobs that are not local files are copied to a scratch
+// file first.
+func (s *TransferService) calcCommP(ctx context.Context, key string) (string, int64, error) {
+	if local, ok := s.store.(staging.LocalStore); ok {
+		if path, ok := local.LocalPath(key); ok {
+			return s.lotusClient.CalcCommP(ctx, path)
+		}
+	}
+
+	dir := filepath.Join(s.config.Transfer.StagingDir, "scratch")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", 0, err
+	}
+	scratch, err := os.CreateTemp(dir, "*.car")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(scratch.Name())
+
+	car, err := s.store.GetRange(ctx, key, 0, -1)
+	if err != nil {
+		scratch.Close()
+		return "", 0, err
+	}
+	_, err = io.Copy(scratch, car)
+	car.Close()
+	if closeErr := scratch.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to copy CAR to scratch file: %w", err)
+	}
+	if err := os.Chmod(scratch.Name(), 0644); err != nil {
+		return "", 0, err
+	}
+
+	return s.lotusClient.CalcCommP(ctx, scratch.Name())
+}
+
+func carKey(payloadCID string) string {
+	return carPrefix + payloadCID + ".car"
+}
+
+func (s *TransferService) carURL(id uuid.UUID) string {
+	return strings.TrimSuffix(s.config.Transfer.PublicURL, "/") + "/transfers/" + id.String() + "/car"
+}
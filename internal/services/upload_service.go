@@ -0,0 +1,187 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"pinning-service/internal/encryption"
+	"pinning-service/internal/ipfs"
+	"pinning-service/internal/models"
+	"pinning-service/pkg/config"
+	"pinning-service/pkg/utils"
+)
+
+// UploadOptions describes how uploaded content is pinned
+type UploadOptions struct {
+	DurationDays int
+	Replicas     int
+	ContentType  string
+	Encrypt      bool
+}
+
+// UploadService adds uploaded content to IPFS and submits it for pinning,
+// optionally encrypting it first so that only ciphertext ever reaches IPFS
+// and storage providers
+type UploadService struct {
+	ipfsClient  *ipfs.Client
+	pinService  *PinService
+	keyProvider encryption.KeyProvider
+	config      *config.Config
+	logger      *logrus.Logger
+}
+
+func NewUploadService(ipfsClient *ipfs.Client, pinService *PinService, keyProvider encryption.KeyProvider, cfg *config.Config, logger *logrus.Logger) *UploadService {
+	return &UploadService{
+		ipfsClient:  ipfsClient,
+		pinService:  pinService,
+		keyProvider: keyProvider,
+		config:      cfg,
+		logger:      logger,
+	}
+}
+
+// MaxUploadSize returns the largest upload accepted, in bytes
+func (s *UploadService) MaxUploadSize() int64 {
+	return s.config.Encryption.MaxUploadSize
+}
+
+// Upload streams content into IPFS and submits a pin request for the
+// resulting CID. Encrypted uploads get a fresh data key which is stored on
+// the pin wrapped under the user's key.
+func (s *UploadService) Upload(ctx context.Context, userID string, content io.Reader, opts UploadOptions) (*models.PinRequest, error) {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	pinRequest := &models.PinRequest{
+		ID:           uuid.New(),
+		UserID:       userUUID,
+		DurationDays: opts.DurationDays,
+		Replicas:     opts.Replicas,
+		Status:       models.PinStatusPending,
+		AutoRenew:    models.AutoRenewOff,
+		ContentType:  opts.ContentType,
+	}
+
+	counter := &countingReader{r: content}
+	if opts.Encrypt {
+		if !s.config.Encryption.Enabled {
+			return nil, fmt.Errorf("encryption is not enabled")
+		}
+		pinRequest.CID, err = s.addEncrypted(ctx, pinRequest, counter)
+	} else {
+		pinRequest.CID, err = s.ipfsClient.AddReader(ctx, counter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pinRequest.CID, err = utils.NormalizeCID(pinRequest.CID); err != nil {
+		return nil, err
+	}
+	pinRequest.PlaintextSize = counter.n
+
+	if err := s.pinService.CreatePinRequest(ctx, pinRequest); err != nil {
+		return nil, err
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"pin_request_id": pinRequest.ID,
+		"cid":            pinRequest.CID,
+		"encrypted":      pinRequest.Encrypted,
+		"bytes":          counter.n,
+	}).Info("Upload added to IPFS")
+
+	return pinRequest, nil
+}
+
+// OpenDecrypted streams the plaintext of an encrypted pin. The caller must
+// close the returned reader.
+func (s *UploadService) OpenDecrypted(ctx context.Context, pin *models.PinRequest) (io.ReadCloser, error) {
+	if !pin.Encrypted {
+		return nil, fmt.Errorf("pin request is not encrypted")
+	}
+	if pin.KeyProvider != s.keyProvider.Name() {
+		return nil, fmt.Errorf("pin was encrypted with key provider %q", pin.KeyProvider)
+	}
+
+	dataKey, err := s.keyProvider.UnwrapKey(ctx, pin.KeyID, pin.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := s.ipfsClient.Cat(ctx, pin.CID)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := encryption.NewDecryptReader(ciphertext, dataKey)
+	if err != nil {
+		ciphertext.Close()
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{plaintext, ciphertext}, nil
+}
+
+// addEncrypted encrypts content on the fly while it is added to IPFS
+func (s *UploadService) addEncrypted(ctx context.Context, pinRequest *models.PinRequest, content io.Reader) (string, error) {
+	dataKey, err := encryption.NewDataKey()
+	if err != nil {
+		return "", err
+	}
+
+	keyID := pinRequest.UserID.String()
+	wrapped, err := s.keyProvider.WrapKey(ctx, keyID, dataKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := encryption.NewEncryptWriter(pw, dataKey)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(w, content); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
+
+	cid, err := s.ipfsClient.AddReader(ctx, pr)
+	// Unblock the encrypting goroutine if IPFS stopped reading early
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return "", err
+	}
+
+	pinRequest.Encrypted = true
+	pinRequest.EncryptionAlgorithm = encryption.Algorithm
+	pinRequest.KeyProvider = s.keyProvider.Name()
+	pinRequest.KeyID = keyID
+	pinRequest.WrappedKey = wrapped
+
+	return cid, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,230 @@
+package staging
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// metaSuffix marks the sidecar file holding a blob's expiry
+	metaSuffix = ".meta"
+	// tmpPrefix marks blobs that are still being written
+	tmpPrefix = ".put-"
+)
+
+// blobMeta is stored next to blobs that have a TTL
+type blobMeta struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// DiskStore keeps blobs as files under a directory. Blobs are written to a
+// temporary file and renamed into place, so readers never see a partial
+// blob.
+type DiskStore struct {
+	dir string
+}
+
+func NewDiskStore(dir string) *DiskStore {
+	return &DiskStore{dir: dir}
+}
+
+func (d *DiskStore) path(key string) (string, error) {
+	if err := validKey(key); err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(key, metaSuffix) || strings.HasPrefix(filepath.Base(key), tmpPrefix) {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(key)), nil
+}
+
+func (d *DiskStore) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (int64, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), tmpPrefix)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, &contextReader{ctx: ctx, r: r})
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+
+	// The blob must be readable by Lotus for piece commitment
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return 0, err
+	}
+
+	if opts.TTL > 0 {
+		data, err := json.Marshal(blobMeta{ExpiresAt: time.Now().Add(opts.TTL)})
+		if err != nil {
+			return 0, err
+		}
+		if err := os.WriteFile(path+metaSuffix, data, 0644); err != nil {
+			return 0, err
+		}
+	} else if err := os.Remove(path + metaSuffix); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+func (d *DiskStore) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	if length < 0 {
+		return f, nil
+	}
+	return &readCloser{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
+
+func (d *DiskStore) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return d.info(key, path, fi), nil
+}
+
+func (d *DiskStore) Delete(ctx context.Context, key string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(path + metaSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *DiskStore) List(ctx context.Context, prefix string) ([]*BlobInfo, error) {
+	var blobs []*BlobInfo
+	err := filepath.Walk(d.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(path, metaSuffix) || strings.HasPrefix(fi.Name(), tmpPrefix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			blobs = append(blobs, d.info(key, path, fi))
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return blobs, nil
+}
+
+func (d *DiskStore) Location(key string) string {
+	return filepath.Join(d.dir, filepath.FromSlash(key))
+}
+
+// LocalPath returns the file holding a blob
+func (d *DiskStore) LocalPath(key string) (string, bool) {
+	path, err := d.path(key)
+	return path, err == nil
+}
+
+func (d *DiskStore) info(key, path string, fi os.FileInfo) *BlobInfo {
+	info := &BlobInfo{
+		Key:     key,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+
+	if data, err := os.ReadFile(path + metaSuffix); err == nil {
+		var meta blobMeta
+		if json.Unmarshal(data, &meta) == nil {
+			info.ExpiresAt = &meta.ExpiresAt
+		}
+	}
+
+	return info
+}
+
+// contextReader stops a copy once its context is cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
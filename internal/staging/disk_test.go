@@ -0,0 +1,238 @@
+package staging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingReader returns some data and then an error
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, f.err
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestDiskStorePutGetDelete(t *testing.T) {
+	dir := t.TempDir()
+	store := NewDiskStore(dir)
+	ctx := context.Background()
+	content := []byte("hello staging store")
+
+	size, err := store.Put(ctx, "cars/a.car", bytes.NewReader(content), PutOptions{})
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if size != int64(len(content)) {
+		t.Fatalf("Put size = %d, want %d", size, len(content))
+	}
+
+	path, ok := store.LocalPath("cars/a.car")
+	if !ok || path != filepath.Join(dir, "cars", "a.car") {
+		t.Fatalf("LocalPath = %s, %v", path, ok)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("blob file: %v", err)
+	}
+	if fi.Mode().Perm()&0044 != 0044 {
+		t.Fatalf("blob mode %s is not readable by other users", fi.Mode())
+	}
+
+	if got := readBlob(t, store, "cars/a.car", 0, -1); !bytes.Equal(got, content) {
+		t.Fatalf("GetRange = %q, want %q", got, content)
+	}
+	if got := readBlob(t, store, "cars/a.car", 6, 7); string(got) != "staging" {
+		t.Fatalf("GetRange(6, 7) = %q, want %q", got, "staging")
+	}
+	if got := readBlob(t, store, "cars/a.car", 14, -1); string(got) != "store" {
+		t.Fatalf("GetRange(14, -1) = %q, want %q", got, "store")
+	}
+
+	info, err := store.Stat(ctx, "cars/a.car")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Size != int64(len(content)) || info.ExpiresAt != nil {
+		t.Fatalf("Stat = %+v, want size %d without expiry", info, len(content))
+	}
+
+	if err := store.Delete(ctx, "cars/a.car"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Stat(ctx, "cars/a.car"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Stat after Delete: err = %v, want ErrNotFound", err)
+	}
+	if _, err := store.GetRange(ctx, "cars/a.car", 0, -1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetRange after Delete: err = %v, want ErrNotFound", err)
+	}
+	if err := store.Delete(ctx, "cars/a.car"); err != nil {
+		t.Fatalf("Delete of a missing blob: %v", err)
+	}
+}
+
+func TestDiskStoreTTL(t *testing.T) {
+	store := NewDiskStore(t.TempDir())
+	ctx := context.Background()
+
+	if _, err := store.Put(ctx, "a.car", strings.NewReader("v1"), PutOptions{TTL: time.Hour}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	info, err := store.Stat(ctx, "a.car")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.ExpiresAt == nil || time.Until(*info.ExpiresAt) < 59*time.Minute {
+		t.Fatalf("ExpiresAt = %v, want about an hour from now", info.ExpiresAt)
+	}
+	if info.Expired(time.Now()) || !info.Expired(time.Now().Add(2*time.Hour)) {
+		t.Fatal("Expired does not follow ExpiresAt")
+	}
+
+	// Replacing the blob without a TTL keeps it until deleted
+	if _, err := store.Put(ctx, "a.car", strings.NewReader("v2"), PutOptions{}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	info, err = store.Stat(ctx, "a.car")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.ExpiresAt != nil {
+		t.Fatalf("ExpiresAt = %v after replacing without a TTL, want nil", info.ExpiresAt)
+	}
+}
+
+func TestDiskStoreList(t *testing.T) {
+	dir := t.TempDir()
+	store := NewDiskStore(dir)
+	ctx := context.Background()
+
+	if blobs, err := NewDiskStore(filepath.Join(dir, "missing")).List(ctx, ""); err != nil || len(blobs) != 0 {
+		t.Fatalf("List of a missing directory = %v, %v", blobs, err)
+	}
+
+	for _, key := range []string{"cars/a.car", "cars/b.car", "chunks/c"} {
+		if _, err := store.Put(ctx, key, strings.NewReader(key), PutOptions{TTL: time.Hour}); err != nil {
+			t.Fatalf("Put(%s): %v", key, err)
+		}
+	}
+	// A Put in progress in another process
+	if err := os.WriteFile(filepath.Join(dir, "cars", tmpPrefix+"123"), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	blobs, err := store.List(ctx, "cars/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var keys []string
+	for _, blob := range blobs {
+		keys = append(keys, blob.Key)
+		if blob.ExpiresAt == nil {
+			t.Errorf("%s: expiry not listed", blob.Key)
+		}
+	}
+	if got := strings.Join(keys, ","); got != "cars/a.car,cars/b.car" {
+		t.Fatalf("List keys = %s, want cars/a.car,cars/b.car without sidecars or partial blobs", got)
+	}
+}
+
+func TestDiskStoreFailedPutLeavesNothing(t *testing.T) {
+	dir := t.TempDir()
+	store := NewDiskStore(dir)
+	ctx := context.Background()
+
+	if _, err := store.Put(ctx, "a.car", strings.NewReader("original"), PutOptions{}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	readErr := errors.New("connection reset")
+	_, err := store.Put(ctx, "a.car", &failingReader{data: []byte("partial"), err: readErr}, PutOptions{TTL: time.Hour})
+	if !errors.Is(err, readErr) {
+		t.Fatalf("Put: err = %v, want %v", err, readErr)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := store.Put(cancelled, "b.car", strings.NewReader("data"), PutOptions{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Put with a cancelled context: err = %v, want context.Canceled", err)
+	}
+
+	// The replaced blob is untouched and no temporary files are left
+	if got := readBlob(t, store, "a.car", 0, -1); string(got) != "original" {
+		t.Fatalf("blob = %q after a failed replace, want %q", got, "original")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "a.car" {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Fatalf("directory holds %v, want only a.car", names)
+	}
+}
+
+func TestDiskStoreInvalidKeys(t *testing.T) {
+	dir := t.TempDir()
+	store := NewDiskStore(filepath.Join(dir, "store"))
+	ctx := context.Background()
+
+	for _, key := range []string{"", "/etc/passwd", "../outside", "a/../../outside", "a//b", `a\b`, "a.car" + metaSuffix, "cars/" + tmpPrefix + "x"} {
+		if _, err := store.Put(ctx, key, strings.NewReader("x"), PutOptions{}); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Put(%q): err = %v, want ErrInvalidKey", key, err)
+		}
+		if _, err := store.GetRange(ctx, key, 0, -1); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("GetRange(%q): err = %v, want ErrInvalidKey", key, err)
+		}
+		if err := store.Delete(ctx, key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Delete(%q): err = %v, want ErrInvalidKey", key, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "outside")); !os.IsNotExist(err) {
+		t.Fatal("a key escaped the store directory")
+	}
+}
+
+func TestBlobReaderSeek(t *testing.T) {
+	store := NewDiskStore(t.TempDir())
+	ctx := context.Background()
+	content := []byte("0123456789")
+	if _, err := store.Put(ctx, "a", bytes.NewReader(content), PutOptions{}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	r := NewBlobReader(ctx, store, "a", int64(len(content)))
+	defer r.Close()
+
+	if _, err := r.Seek(-3, io.SeekEnd); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if got, _ := io.ReadAll(r); string(got) != "789" {
+		t.Fatalf("read %q after seeking to the end, want %q", got, "789")
+	}
+	if _, err := r.Seek(2, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "234" {
+		t.Fatalf("read %q, %v after seeking back, want %q", buf, err, "234")
+	}
+}
@@ -0,0 +1,90 @@
+package staging
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// quotaStore limits the total size of the blobs in a store. Usage is
+// counted from a listing on every Put so that several processes sharing a
+// store see each other's blobs; the limit is still best effort when they
+// write at the same time.
+type quotaStore struct {
+	BlobStore
+	maxBytes int64
+	mu       sync.Mutex
+}
+
+// WithQuota wraps a store so Put fails with ErrQuotaExceeded once the
+// blobs in it would exceed maxBytes
+func WithQuota(store BlobStore, maxBytes int64) BlobStore {
+	return &quotaStore{BlobStore: store, maxBytes: maxBytes}
+}
+
+func (q *quotaStore) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	used, err := q.Usage(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// A blob replacing another frees the old one's space
+	if info, err := q.BlobStore.Stat(ctx, key); err == nil {
+		used -= info.Size
+	}
+
+	remaining := q.maxBytes - used
+	if remaining <= 0 {
+		return 0, ErrQuotaExceeded
+	}
+
+	limited := &quotaReader{r: r, remaining: remaining}
+	size, err := q.BlobStore.Put(ctx, key, limited, opts)
+	if limited.exceeded {
+		return 0, ErrQuotaExceeded
+	}
+	return size, err
+}
+
+// Usage returns the total size of the blobs in the store
+func (q *quotaStore) Usage(ctx context.Context) (int64, error) {
+	blobs, err := q.BlobStore.List(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+
+	var used int64
+	for _, blob := range blobs {
+		used += blob.Size
+	}
+	return used, nil
+}
+
+// LocalPath passes through to the wrapped store
+func (q *quotaStore) LocalPath(key string) (string, bool) {
+	if local, ok := q.BlobStore.(LocalStore); ok {
+		return local.LocalPath(key)
+	}
+	return "", false
+}
+
+// quotaReader fails a Put once it reads past the remaining quota, which
+// makes the store discard the partial blob
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.remaining -= int64(n)
+	if q.remaining < 0 {
+		q.exceeded = true
+		return n, ErrQuotaExceeded
+	}
+	return n, err
+}
@@ -0,0 +1,584 @@
+package staging
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"pinning-service/pkg/config"
+)
+
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testRegion    = "us-east-1"
+	testBucket    = "staging-bucket"
+)
+
+type fakeObject struct {
+	data      []byte
+	header    http.Header
+	modTime   time.Time
+	expiresAt string
+}
+
+type fakeUpload struct {
+	key    string
+	header http.Header
+	parts  map[int][]byte
+}
+
+// fakeS3 is an in-memory S3 bucket served over path style URLs. It checks
+// every request's SigV4 signature independently of the store's signer.
+type fakeS3 struct {
+	t        *testing.T
+	mu       sync.Mutex
+	objects  map[string]*fakeObject
+	uploads  map[string]*fakeUpload
+	aborted  []string
+	requests []string
+	pageSize int
+	uploadID int
+
+	// fail, if set, can answer a request with an error before it is handled
+	fail func(r *http.Request) (status int, body string)
+	// completeError, if set, is returned in the body of a 200 response to
+	// CompleteMultipartUpload
+	completeError string
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{
+		t:        t,
+		objects:  make(map[string]*fakeObject),
+		uploads:  make(map[string]*fakeUpload),
+		pageSize: 1000,
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func newTestS3Store(t *testing.T, endpoint string, secretKey string) *S3Store {
+	t.Helper()
+
+	store, err := NewS3Store(config.S3Config{
+		Endpoint:  endpoint,
+		Region:    testRegion,
+		Bucket:    testBucket,
+		Prefix:    "/staging/",
+		AccessKey: testAccessKey,
+		SecretKey: secretKey,
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatalf("NewS3Store: %v", err)
+	}
+	return store
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	query := r.URL.Query()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery)
+
+	if err := f.verify(r); err != nil {
+		writeS3Error(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+	if f.fail != nil {
+		if status, body := f.fail(r); status != 0 {
+			w.WriteHeader(status)
+			io.WriteString(w, body)
+			return
+		}
+	}
+
+	bucketPath := "/" + testBucket
+	if r.URL.Path != bucketPath && !strings.HasPrefix(r.URL.Path, bucketPath+"/") {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, bucketPath), "/")
+
+	switch {
+	case key == "" && r.Method == http.MethodGet && query.Get("list-type") == "2":
+		f.list(w, query)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.uploadID++
+		id := "upload-" + strconv.Itoa(f.uploadID)
+		f.uploads[id] = &fakeUpload{key: key, header: r.Header.Clone(), parts: make(map[int][]byte)}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", testBucket, key, id)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		data, _ := io.ReadAll(r.Body)
+		upload.parts[number] = data
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, number))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		f.complete(w, r, query.Get("uploadId"), key)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		f.aborted = append(f.aborted, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		if int64(len(data)) != r.ContentLength {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody", "body does not match Content-Length")
+			return
+		}
+		f.objects[key] = &fakeObject{data: data, modTime: time.Now().UTC().Truncate(time.Second), expiresAt: r.Header.Get(s3ExpiresHeader)}
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := f.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+			return
+		}
+		if object.expiresAt != "" {
+			w.Header().Set(s3ExpiresHeader, object.expiresAt)
+		}
+		http.ServeContent(w, r, "", object.modTime, bytes.NewReader(object.data))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+func (f *fakeS3) complete(w http.ResponseWriter, r *http.Request, uploadID, key string) {
+	upload, ok := f.uploads[uploadID]
+	if !ok || upload.key != key {
+		writeS3Error(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+
+	var req struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeS3Error(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+
+	if f.completeError != "" {
+		fmt.Fprintf(w, "<Error><Code>%s</Code><Message>completion failed</Message></Error>", f.completeError)
+		return
+	}
+
+	var data []byte
+	for i, part := range req.Parts {
+		if part.PartNumber != i+1 || part.ETag != fmt.Sprintf(`"etag-%d"`, part.PartNumber) {
+			writeS3Error(w, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("part %d", part.PartNumber))
+			return
+		}
+		data = append(data, upload.parts[part.PartNumber]...)
+	}
+
+	f.objects[key] = &fakeObject{data: data, modTime: time.Now().UTC().Truncate(time.Second), expiresAt: upload.header.Get(s3ExpiresHeader)}
+	delete(f.uploads, uploadID)
+	fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>", key)
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, query.Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start := 0
+	if token := query.Get("continuation-token"); token != "" {
+		start, _ = strconv.Atoi(token)
+	}
+	end := start + f.pageSize
+	if end > len(keys) {
+		end = len(keys)
+	}
+
+	var b strings.Builder
+	b.WriteString("<ListBucketResult>")
+	for _, key := range keys[start:end] {
+		fmt.Fprintf(&b, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>",
+			key, len(f.objects[key].data), f.objects[key].modTime.Format(time.RFC3339))
+	}
+	if end < len(keys) {
+		fmt.Fprintf(&b, "<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>", end)
+	} else {
+		b.WriteString("<IsTruncated>false</IsTruncated>")
+	}
+	b.WriteString("</ListBucketResult>")
+	io.WriteString(w, b.String())
+}
+
+// verify recomputes a request's SigV4 signature from what the server
+// received
+func (f *fakeS3) verify(r *http.Request) error {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+		return errors.New("missing authorization")
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ", ") {
+		if name, value, ok := strings.Cut(field, "="); ok {
+			fields[name] = value
+		}
+	}
+
+	credential := strings.SplitN(fields["Credential"], "/", 2)
+	if len(credential) != 2 || credential[0] != testAccessKey {
+		return fmt.Errorf("unknown access key in %q", fields["Credential"])
+	}
+	scope := credential[1]
+	amzDate := r.Header.Get("X-Amz-Date")
+	if want := amzDate[:8] + "/" + testRegion + "/s3/aws4_request"; scope != want {
+		return fmt.Errorf("scope %q, want %q", scope, want)
+	}
+
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	required := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	for name := range r.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-meta-") || lower == "range" {
+			required = append(required, lower)
+		}
+	}
+	for _, name := range required {
+		if !containsString(signed, name) {
+			return fmt.Errorf("header %s is not signed", name)
+		}
+	}
+
+	var headers strings.Builder
+	for _, name := range signed {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	segments := strings.Split(r.URL.Path, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+
+	params := r.URL.Query()
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		for _, value := range params[name] {
+			pairs = append(pairs, awsEscape(name)+"="+awsEscape(value))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		strings.Join(segments, "/"),
+		strings.Join(pairs, "&"),
+		headers.String(),
+		fields["SignedHeaders"],
+		r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + testSecretKey)
+	for _, part := range []string{amzDate[:8], testRegion, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if want := hex.EncodeToString(key); fields["Signature"] != want {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+// awsEscape percent-encodes everything but unreserved characters
+func awsEscape(s string) string {
+	escaped := url.QueryEscape(s)
+	escaped = strings.ReplaceAll(escaped, "+", "%20")
+	return strings.ReplaceAll(escaped, "%7E", "~")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, message)
+}
+
+func readBlob(t *testing.T, store BlobStore, key string, offset, length int64) []byte {
+	t.Helper()
+
+	body, err := store.GetRange(context.Background(), key, offset, length)
+	if err != nil {
+		t.Fatalf("GetRange(%s, %d, %d): %v", key, offset, length, err)
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("reading %s: %v", key, err)
+	}
+	return data
+}
+
+func TestS3StorePutGetDelete(t *testing.T) {
+	fake, server := newFakeS3(t)
+	store := newTestS3Store(t, server.URL, testSecretKey)
+	ctx := context.Background()
+
+	// Spaces and pluses must be encoded the same way on both sides of the
+	// signature
+	key := "cars/bafy car+1.car"
+	content := []byte("hello staging store")
+
+	size, err := store.Put(ctx, key, bytes.NewReader(content), PutOptions{TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if size != int64(len(content)) {
+		t.Fatalf("Put size = %d, want %d", size, len(content))
+	}
+	if _, ok := fake.objects["staging/"+key]; !ok {
+		t.Fatalf("object not stored under the prefix: %v", fake.requests)
+	}
+
+	if got := readBlob(t, store, key, 0, -1); !bytes.Equal(got, content) {
+		t.Fatalf("GetRange = %q, want %q", got, content)
+	}
+	if got := readBlob(t, store, key, 6, 7); string(got) != "staging" {
+		t.Fatalf("GetRange(6, 7) = %q, want %q", got, "staging")
+	}
+	if got := readBlob(t, store, key, 14, -1); string(got) != "store" {
+		t.Fatalf("GetRange(14, -1) = %q, want %q", got, "store")
+	}
+	if got := readBlob(t, store, key, 3, 0); len(got) != 0 {
+		t.Fatalf("GetRange(3, 0) = %q, want nothing", got)
+	}
+
+	info, err := store.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Size != int64(len(content)) || info.ExpiresAt == nil || info.ModTime.IsZero() {
+		t.Fatalf("Stat = %+v, want size %d with expiry and mod time", info, len(content))
+	}
+	if time.Until(*info.ExpiresAt) < 59*time.Minute {
+		t.Fatalf("ExpiresAt = %s, want about an hour from now", info.ExpiresAt)
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Stat(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Stat after Delete: err = %v, want ErrNotFound", err)
+	}
+	if _, err := store.GetRange(ctx, key, 0, -1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetRange after Delete: err = %v, want ErrNotFound", err)
+	}
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete of a missing blob: %v", err)
+	}
+}
+
+func TestS3StoreList(t *testing.T) {
+	fake, server := newFakeS3(t)
+	fake.pageSize = 2
+	store := newTestS3Store(t, server.URL, testSecretKey)
+	ctx := context.Background()
+
+	for _, key := range []string{"cars/a.car", "cars/b.car", "cars/c.car", "chunks/d"} {
+		if _, err := store.Put(ctx, key, strings.NewReader(key), PutOptions{}); err != nil {
+			t.Fatalf("Put(%s): %v", key, err)
+		}
+	}
+
+	blobs, err := store.List(ctx, "cars/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var keys []string
+	for _, blob := range blobs {
+		keys = append(keys, blob.Key)
+		if blob.Size != int64(len(blob.Key)) {
+			t.Errorf("%s: size %d, want %d", blob.Key, blob.Size, len(blob.Key))
+		}
+	}
+	if got := strings.Join(keys, ","); got != "cars/a.car,cars/b.car,cars/c.car" {
+		t.Fatalf("List keys = %s, want the three cars across pages", got)
+	}
+}
+
+func TestS3StoreMultipartUpload(t *testing.T) {
+	fake, server := newFakeS3(t)
+	store := newTestS3Store(t, server.URL, testSecretKey)
+	ctx := context.Background()
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), (s3PartSize+1000)/16)
+	size, err := store.Put(ctx, "big.car", bytes.NewReader(content), PutOptions{TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if size != int64(len(content)) {
+		t.Fatalf("Put size = %d, want %d", size, len(content))
+	}
+
+	object, ok := fake.objects["staging/big.car"]
+	if !ok || !bytes.Equal(object.data, content) {
+		t.Fatal("multipart object does not match the content")
+	}
+	if object.expiresAt == "" {
+		t.Fatal("expiry metadata was not set on the multipart upload")
+	}
+	if len(fake.uploads) != 0 {
+		t.Fatalf("%d multipart uploads left open", len(fake.uploads))
+	}
+}
+
+func TestS3StoreAbortsFailedMultipartUpload(t *testing.T) {
+	for name, setup := range map[string]func(*fakeS3){
+		"part fails": func(f *fakeS3) {
+			f.fail = func(r *http.Request) (int, string) {
+				if r.URL.Query().Get("partNumber") == "2" {
+					return http.StatusInternalServerError, "<Error><Code>InternalError</Code><Message>try again</Message></Error>"
+				}
+				return 0, ""
+			}
+		},
+		"completion fails": func(f *fakeS3) {
+			f.completeError = "InternalError"
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fake, server := newFakeS3(t)
+			setup(fake)
+			store := newTestS3Store(t, server.URL, testSecretKey)
+
+			content := bytes.Repeat([]byte{'x'}, s3PartSize+1)
+			if _, err := store.Put(context.Background(), "big.car", bytes.NewReader(content), PutOptions{}); err == nil {
+				t.Fatal("Put succeeded, want an error")
+			}
+
+			if len(fake.aborted) != 1 {
+				t.Fatalf("aborted %d uploads, want 1", len(fake.aborted))
+			}
+			if len(fake.uploads) != 0 {
+				t.Fatalf("%d multipart uploads left open", len(fake.uploads))
+			}
+			if _, ok := fake.objects["staging/big.car"]; ok {
+				t.Fatal("failed upload left an object behind")
+			}
+		})
+	}
+}
+
+func TestS3StoreErrors(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("bad credentials", func(t *testing.T) {
+		_, server := newFakeS3(t)
+		store := newTestS3Store(t, server.URL, "wrong-secret")
+
+		_, err := store.Put(ctx, "a.car", strings.NewReader("data"), PutOptions{})
+		if err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+			t.Fatalf("err = %v, want SignatureDoesNotMatch", err)
+		}
+	})
+
+	t.Run("server error", func(t *testing.T) {
+		fake, server := newFakeS3(t)
+		fake.fail = func(r *http.Request) (int, string) {
+			return http.StatusServiceUnavailable, "<Error><Code>SlowDown</Code><Message>Please reduce your request rate</Message></Error>"
+		}
+		store := newTestS3Store(t, server.URL, testSecretKey)
+
+		_, err := store.Put(ctx, "a.car", strings.NewReader("data"), PutOptions{})
+		if err == nil || !strings.Contains(err.Error(), "SlowDown") {
+			t.Fatalf("err = %v, want SlowDown", err)
+		}
+		// HEAD responses have no body to carry the error code
+		if _, err := store.Stat(ctx, "a.car"); err == nil || !strings.Contains(err.Error(), "status 503") {
+			t.Fatalf("Stat: err = %v, want status 503", err)
+		}
+		if err := store.Delete(ctx, "a.car"); err == nil {
+			t.Fatal("Delete succeeded on a server error")
+		}
+	})
+
+	t.Run("error without body", func(t *testing.T) {
+		fake, server := newFakeS3(t)
+		fake.fail = func(r *http.Request) (int, string) {
+			return http.StatusBadGateway, "bad gateway"
+		}
+		store := newTestS3Store(t, server.URL, testSecretKey)
+
+		_, err := store.List(ctx, "")
+		if err == nil || !strings.Contains(err.Error(), "status 502") {
+			t.Fatalf("err = %v, want status 502", err)
+		}
+	})
+
+	t.Run("invalid keys", func(t *testing.T) {
+		fake, server := newFakeS3(t)
+		store := newTestS3Store(t, server.URL, testSecretKey)
+
+		for _, key := range []string{"", "/abs", "a/../b", "a//b", `a\b`} {
+			if _, err := store.Put(ctx, key, strings.NewReader("x"), PutOptions{}); !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("Put(%q): err = %v, want ErrInvalidKey", key, err)
+			}
+		}
+		if len(fake.requests) != 0 {
+			t.Fatalf("invalid keys made requests: %v", fake.requests)
+		}
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		if _, err := NewS3Store(config.S3Config{Endpoint: "not a url", Bucket: testBucket}); err == nil {
+			t.Error("accepted an endpoint without a host")
+		}
+		if _, err := NewS3Store(config.S3Config{Endpoint: "http://localhost:9000"}); err == nil {
+			t.Error("accepted a missing bucket")
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package staging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"pinning-service/pkg/config"
+)
+
+// Backend names
+const (
+	BackendDisk = "disk"
+	BackendS3   = "s3"
+)
+
+var (
+	// ErrNotFound is returned for keys that hold no blob
+	ErrNotFound = errors.New("blob not found")
+	// ErrQuotaExceeded is returned when a blob does not fit in the quota
+	ErrQuotaExceeded = errors.New("staging quota exceeded")
+	// ErrInvalidKey is returned for keys that are empty or escape the store
+	ErrInvalidKey = errors.New("invalid blob key")
+)
+
+// BlobInfo describes a stored blob. ExpiresAt is nil for blobs kept until
+// deleted.
+type BlobInfo struct {
+	Key       string     `json:"key"`
+	Size      int64      `json:"size"`
+	ModTime   time.Time  `json:"mod_time"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Expired returns true if the blob's TTL has passed
+func (b *BlobInfo) Expired(now time.Time) bool {
+	return b.ExpiresAt != nil && !now.Before(*b.ExpiresAt)
+}
+
+// PutOptions control how a blob is stored. A TTL of zero keeps the blob
+// until it is deleted; expired blobs are removed by garbage collection.
+type PutOptions struct {
+	TTL time.Duration
+}
+
+// BlobStore holds data between IPFS and storage providers: CARs waiting
+// to be transferred and other large intermediate files. Keys are slash
+// separated paths.
+type BlobStore interface {
+	// Put streams a blob into the store, replacing any blob under the key,
+	// and returns its size. A failed Put leaves no partial blob behind.
+	Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (int64, error)
+	// GetRange opens length bytes of a blob from offset, or the rest of it
+	// if length is negative
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	// Stat describes a blob
+	Stat(ctx context.Context, key string) (*BlobInfo, error)
+	// Delete removes a blob; deleting a missing blob is not an error
+	Delete(ctx context.Context, key string) error
+	// List describes the blobs whose keys start with prefix. Backends that
+	// cannot list expiry cheaply leave ExpiresAt unset; use Stat for it.
+	List(ctx context.Context, prefix string) ([]*BlobInfo, error)
+	// Location returns where a blob lives, for humans and manifests
+	Location(key string) string
+}
+
+// LocalStore is implemented by stores that keep blobs as local files
+type LocalStore interface {
+	LocalPath(key string) (string, bool)
+}
+
+// NewBlobStore returns the configured store, enforcing the quota if one is
+// set
+func NewBlobStore(cfg config.StagingConfig) (BlobStore, error) {
+	var store BlobStore
+	switch cfg.Backend {
+	case BackendDisk:
+		store = NewDiskStore(cfg.Dir)
+	case BackendS3:
+		s3, err := NewS3Store(cfg.S3)
+		if err != nil {
+			return nil, err
+		}
+		store = s3
+	default:
+		return nil, fmt.Errorf("unknown staging backend %q", cfg.Backend)
+	}
+
+	if cfg.MaxBytes > 0 {
+		store = WithQuota(store, cfg.MaxBytes)
+	}
+
+	return store, nil
+}
+
+// validKey rejects keys that are empty or could address anything outside
+// the store
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return ErrInvalidKey
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return ErrInvalidKey
+		}
+	}
+	return nil
+}
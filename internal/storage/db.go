@@ -76,5 +76,28 @@ func autoMigrate(db *gorm.DB) error {
 		&models.User{},
 		&models.PinRequest{},
 		&models.FilecoinDeal{},
+		&models.ChainEvent{},
+		&models.ChainCheckpoint{},
+		&models.LedgerEntry{},
+		&models.Renewal{},
+		&models.Notification{},
+		&models.Retrieval{},
+		&models.BandwidthUsage{},
+		&models.ShareLink{},
+		&models.Aggregate{},
+		&models.AggregateEntry{},
+		&models.SplitManifest{},
+		&models.SplitChunk{},
+		&models.SplitBlock{},
+		&models.DataCapAllocation{},
+		&models.Transfer{},
+		&models.PinPlacement{},
+		&models.Content{},
+		&models.PinDiscrepancy{},
+		&models.AccountQuota{},
+		&models.AccountUsage{},
+		&models.UsageDaily{},
+		&models.Invoice{},
+		&models.InvoiceLine{},
 	)
 }
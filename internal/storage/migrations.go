@@ -1,12 +1,16 @@
 package storage
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"gorm.io/gorm"
 
+	"pinning-service/internal/models"
 	"pinning-service/pkg/config"
 )
 
@@ -42,3 +46,82 @@ func RunMigrations(cfg *config.Config) error {
 
 	return nil
 }
+
+// mergeContent moves content recorded under an old form of a CID to its
+// normalized form, merging it into content already recorded under that
+func mergeContent(tx *gorm.DB, old, cid string) error {
+	statements := []string{
+		`UPDATE pin_requests SET content_id = cur.id,
+			shares_deals = pin_requests.id <> COALESCE(cur.deal_pin_id, old.deal_pin_id)
+		FROM contents old, contents cur
+		WHERE old.cid = @old AND cur.cid = @cid AND pin_requests.content_id = old.id`,
+		`UPDATE contents cur SET ref_count = cur.ref_count + old.ref_count,
+			deal_pin_id = COALESCE(cur.deal_pin_id, old.deal_pin_id)
+		FROM contents old
+		WHERE old.cid = @old AND cur.cid = @cid`,
+		`DELETE FROM contents old USING contents cur WHERE old.cid = @old AND cur.cid = @cid`,
+		`UPDATE contents SET cid = @cid WHERE cid = @old`,
+	}
+	for _, statement := range statements {
+		if err := tx.Exec(statement, sql.Named("old", old), sql.Named("cid", cid)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NormalizeCIDs rewrites pin request CIDs stored before CIDs were
+// normalized, along with the content, placements, retrievals and share
+// links keyed by them, keeping the old form as the pin's original CID. CID
+// parsing lives above this package, so normalize is passed in. It returns
+// how many distinct CIDs were rewritten.
+func NormalizeCIDs(ctx context.Context, db *gorm.DB, normalize func(string) (string, error)) (int, error) {
+	// Normalized CIDs are base32, whose multibase prefix is "b"
+	var cids []string
+	err := db.WithContext(ctx).Model(&models.PinRequest{}).
+		Where("cid NOT LIKE 'b%'").
+		Distinct().
+		Pluck("cid", &cids).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to get CIDs: %w", err)
+	}
+
+	normalized := 0
+	for _, old := range cids {
+		cid, err := normalize(old)
+		if err != nil || cid == old {
+			continue
+		}
+
+		err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&models.PinRequest{}).
+				Where("cid = ? AND original_cid IS NULL", old).
+				Update("original_cid", old).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&models.PinRequest{}).Where("cid = ?", old).Update("cid", cid).Error; err != nil {
+				return err
+			}
+			if err := mergeContent(tx, old, cid); err != nil {
+				return err
+			}
+			// A node may already hold the content under both forms
+			if err := tx.Exec(`DELETE FROM pin_placements old USING pin_placements cur
+				WHERE old.cid = ? AND cur.cid = ? AND old.node_id = cur.node_id`, old, cid).Error; err != nil {
+				return err
+			}
+			for _, model := range []interface{}{&models.PinPlacement{}, &models.Retrieval{}, &models.ShareLink{}} {
+				if err := tx.Model(model).Where("cid = ?", old).Update("cid", cid).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return normalized, fmt.Errorf("failed to normalize CID %s: %w", old, err)
+		}
+		normalized++
+	}
+
+	return normalized, nil
+}
@@ -2,9 +2,15 @@ package storage
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"pinning-service/internal/models"
 )
@@ -19,28 +25,236 @@ type UserRepository interface {
 	Delete(ctx context.Context, id uuid.UUID) error
 }
 
+// PinLimits are the limits on what an account may pin. Zero means
+// unlimited.
+type PinLimits struct {
+	MaxBytes       int64
+	MaxPins        int64
+	MaxPendingPins int64
+}
+
+// Errors returned when a pin would exceed an account's PinLimits
+var (
+	ErrByteLimitReached    = errors.New("byte limit reached")
+	ErrPinLimitReached     = errors.New("pin limit reached")
+	ErrPendingLimitReached = errors.New("pending pin limit reached")
+)
+
 // PinRequestRepository defines pin request data access methods
 type PinRequestRepository interface {
 	Create(ctx context.Context, pinRequest *models.PinRequest) error
+	CreateWithinLimits(ctx context.Context, pinRequest *models.PinRequest, limits PinLimits) error
 	GetByID(ctx context.Context, id uuid.UUID) (*models.PinRequest, error)
 	GetByUserID(ctx context.Context, userID uuid.UUID, page, limit int, status string) ([]*models.PinRequest, int64, error)
 	GetByCID(ctx context.Context, cid string) ([]*models.PinRequest, error)
 	Update(ctx context.Context, pinRequest *models.PinRequest) error
 	Delete(ctx context.Context, id uuid.UUID) error
 	GetPendingRequests(ctx context.Context, limit int) ([]*models.PinRequest, error)
+	GetNextPinned(ctx context.Context, afterID uuid.UUID, limit int) ([]*models.PinRequest, error)
+	GetAggregationCandidates(ctx context.Context, maxSize int64, limit int) ([]*models.PinRequest, error)
+	GetSplitCandidates(ctx context.Context, minSize int64, limit int) ([]*models.PinRequest, error)
+	GetNextUnplaced(ctx context.Context, afterID uuid.UUID, limit int) ([]*models.PinRequest, error)
+	ClaimPin(ctx context.Context, id uuid.UUID, staleBefore time.Time) (bool, error)
+	UpdatePinProgress(ctx context.Context, id uuid.UUID, blocks, bytes, totalBytes int64, advanced bool) (bool, error)
+	ResolvePath(ctx context.Context, id uuid.UUID, cid string) error
+	SetPrice(ctx context.Context, id uuid.UUID, priceFIL decimal.Decimal) error
+	MarkPinned(ctx context.Context, id uuid.UUID, sizeBytes, maxBytes int64) error
+	ReleasePin(ctx context.Context, id uuid.UUID, pinError string, failed bool) error
+	GetOrphanedPins(ctx context.Context, staleBefore time.Time, limit int) ([]*models.PinRequest, error)
+	GetNextExpiring(ctx context.Context, before time.Time, afterID uuid.UUID, limit int) ([]*models.PinRequest, error)
+	GetNextExpired(ctx context.Context, expiredBefore time.Time, afterID uuid.UUID, limit int) ([]*models.PinRequest, error)
+	Expire(ctx context.Context, id uuid.UUID, now time.Time) (bool, error)
+	Extend(ctx context.Context, id uuid.UUID, from, to time.Time) (bool, error)
+	SetLegalHold(ctx context.Context, id uuid.UUID, hold bool, reason string) error
+	RefreshDealsExpiry(ctx context.Context, currentEpoch int64, now time.Time) error
+	GetNextColdDue(ctx context.Context, now time.Time, afterID uuid.UUID, limit int) ([]*models.PinRequest, error)
+	MoveToCold(ctx context.Context, id uuid.UUID, now time.Time) (bool, error)
 }
 
 // FilecoinDealRepository defines Filecoin deal data access methods
 type FilecoinDealRepository interface {
 	Create(ctx context.Context, deal *models.FilecoinDeal) error
+	CreateBatch(ctx context.Context, deals []*models.FilecoinDeal) error
 	GetByID(ctx context.Context, id uuid.UUID) (*models.FilecoinDeal, error)
 	GetByPinRequestID(ctx context.Context, pinRequestID uuid.UUID) ([]*models.FilecoinDeal, error)
+	GetByPinRequestIDs(ctx context.Context, pinRequestIDs []uuid.UUID) ([]*models.FilecoinDeal, error)
 	GetByCID(ctx context.Context, cid string) ([]*models.FilecoinDeal, error)
 	GetByMinerID(ctx context.Context, minerID string) ([]*models.FilecoinDeal, error)
 	Update(ctx context.Context, deal *models.FilecoinDeal) error
 	Delete(ctx context.Context, id uuid.UUID) error
 	GetExpiringDeals(ctx context.Context, epochThreshold int64) ([]*models.FilecoinDeal, error)
 	GetActiveDeals(ctx context.Context) ([]*models.FilecoinDeal, error)
+	GetBatchBoundaries(ctx context.Context, statuses []string, batchSize int) ([]uuid.UUID, error)
+	GetBatch(ctx context.Context, statuses []string, afterID, untilID uuid.UUID) ([]*models.FilecoinDeal, error)
+	GetNextBatch(ctx context.Context, statuses []string, afterID uuid.UUID, limit int) ([]*models.FilecoinDeal, error)
+	MarkExpired(ctx context.Context, currentEpoch int64) (int64, error)
+	TouchChecked(ctx context.Context, ids []uuid.UUID, checkedAt time.Time) error
+	GetByDealCIDs(ctx context.Context, dealCIDs []string) ([]*models.FilecoinDeal, error)
+	GetByDealIDs(ctx context.Context, dealIDs []int64) ([]*models.FilecoinDeal, error)
+	GetPublishedDeals(ctx context.Context) ([]*models.FilecoinDeal, error)
+	AddRetrievalCost(ctx context.Context, id uuid.UUID, costFIL float64) error
+}
+
+// ChainRepository defines chain follower data access methods
+type ChainRepository interface {
+	GetCheckpoint(ctx context.Context, name string) (*models.ChainCheckpoint, error)
+	SaveCheckpoint(ctx context.Context, checkpoint *models.ChainCheckpoint) error
+	CreateEvent(ctx context.Context, event *models.ChainEvent) error
+	GetEventsByTipSet(ctx context.Context, tipSetKey string) ([]*models.ChainEvent, error)
+	GetEventsAboveHeight(ctx context.Context, height int64) ([]*models.ChainEvent, error)
+	DeleteEvents(ctx context.Context, ids []uuid.UUID) error
+	PruneEvents(ctx context.Context, belowHeight int64) error
+}
+
+// ErrInsufficientBalance is returned when a charge exceeds the user's balance
+var ErrInsufficientBalance = errors.New("insufficient balance")
+
+// LedgerRepository defines balance ledger data access methods. Charges and
+// credits are recorded together with the balance change in one transaction
+// and are no-ops when the idempotency key has already been recorded.
+type LedgerRepository interface {
+	Charge(ctx context.Context, entry *models.LedgerEntry) (bool, error)
+	Credit(ctx context.Context, entry *models.LedgerEntry) (bool, error)
+	GetByIdempotencyKey(ctx context.Context, key string) (*models.LedgerEntry, error)
+	GetByUserID(ctx context.Context, userID uuid.UUID, from, to time.Time) ([]*models.LedgerEntry, error)
+	GetTotals(ctx context.Context, userID uuid.UUID, from, to time.Time) (map[string]decimal.Decimal, error)
+	GetBalanceAt(ctx context.Context, userID uuid.UUID, at time.Time) (decimal.Decimal, error)
+}
+
+// RenewalRepository defines deal renewal data access methods
+type RenewalRepository interface {
+	GetOrCreate(ctx context.Context, renewal *models.Renewal) (*models.Renewal, error)
+	Claim(ctx context.Context, id uuid.UUID, maxAttempts int, lease time.Duration) (bool, error)
+	Update(ctx context.Context, renewal *models.Renewal) error
+	GetByPinRequestID(ctx context.Context, pinRequestID uuid.UUID) ([]*models.Renewal, error)
+}
+
+// NotificationRepository defines notification data access methods
+type NotificationRepository interface {
+	Create(ctx context.Context, notification *models.Notification) (bool, error)
+	GetByUserID(ctx context.Context, userID uuid.UUID, page, limit int) ([]*models.Notification, int64, error)
+	MarkRead(ctx context.Context, id, userID uuid.UUID) error
+}
+
+// RetrievalRepository defines Filecoin retrieval data access methods
+type RetrievalRepository interface {
+	Create(ctx context.Context, retrieval *models.Retrieval) (bool, error)
+	GetByID(ctx context.Context, id uuid.UUID) (*models.Retrieval, error)
+	GetActiveByPinRequestID(ctx context.Context, pinRequestID uuid.UUID) (*models.Retrieval, error)
+	Update(ctx context.Context, retrieval *models.Retrieval) error
+}
+
+// BandwidthRepository defines gateway bandwidth usage data access methods
+type BandwidthRepository interface {
+	Add(ctx context.Context, userID uuid.UUID, date time.Time, bytes, requests int64) error
+	GetByUserID(ctx context.Context, userID uuid.UUID, from, to time.Time) ([]*models.BandwidthUsage, error)
+}
+
+// ShareLinkRepository defines share link data access methods
+type ShareLinkRepository interface {
+	Create(ctx context.Context, link *models.ShareLink) error
+	GetByID(ctx context.Context, id uuid.UUID) (*models.ShareLink, error)
+	GetByPinRequestID(ctx context.Context, pinRequestID uuid.UUID) ([]*models.ShareLink, error)
+	Revoke(ctx context.Context, id uuid.UUID) error
+	ClaimDownload(ctx context.Context, id uuid.UUID) (bool, error)
+}
+
+// ErrAlreadyAggregated is returned when a pin was claimed by another
+// aggregate
+var ErrAlreadyAggregated = errors.New("pins already aggregated")
+
+// AggregateRepository defines deal aggregate data access methods
+type AggregateRepository interface {
+	Create(ctx context.Context, aggregate *models.Aggregate, entries []*models.AggregateEntry) error
+	GetByID(ctx context.Context, id uuid.UUID) (*models.Aggregate, error)
+	GetByStatus(ctx context.Context, status string, limit int) ([]*models.Aggregate, error)
+	GetEntries(ctx context.Context, aggregateID uuid.UUID) ([]*models.AggregateEntry, error)
+	GetEntryByPinRequestID(ctx context.Context, pinRequestID uuid.UUID) (*models.AggregateEntry, error)
+	Update(ctx context.Context, aggregate *models.Aggregate) error
+	Fail(ctx context.Context, id uuid.UUID, reason string) error
+}
+
+// SplitRepository defines split DAG manifest data access methods
+type SplitRepository interface {
+	Create(ctx context.Context, manifest *models.SplitManifest, chunks []*models.SplitChunk, blocks []*models.SplitBlock) error
+	GetManifestByPinRequestID(ctx context.Context, pinRequestID uuid.UUID) (*models.SplitManifest, error)
+	GetManifestsByStatus(ctx context.Context, status string, limit int) ([]*models.SplitManifest, error)
+	GetChunks(ctx context.Context, manifestID uuid.UUID) ([]*models.SplitChunk, error)
+	GetBlocks(ctx context.Context, manifestID uuid.UUID) ([]*models.SplitBlock, error)
+	UpdateManifest(ctx context.Context, manifest *models.SplitManifest) error
+}
+
+// DataCapRepository defines DataCap allocation data access methods
+type DataCapRepository interface {
+	GetByUserID(ctx context.Context, userID uuid.UUID) (*models.DataCapAllocation, error)
+	List(ctx context.Context) ([]*models.DataCapAllocation, error)
+	SetAllowance(ctx context.Context, userID uuid.UUID, allowanceBytes int64) (*models.DataCapAllocation, error)
+	Reserve(ctx context.Context, userID uuid.UUID, bytes int64) (bool, error)
+	Release(ctx context.Context, userID uuid.UUID, bytes int64) error
+	Reconcile(ctx context.Context) error
+}
+
+// TransferRepository defines deal data transfer access methods
+type TransferRepository interface {
+	Create(ctx context.Context, transfer *models.Transfer) error
+	GetByID(ctx context.Context, id uuid.UUID) (*models.Transfer, error)
+	GetByPinRequestID(ctx context.Context, pinRequestID uuid.UUID) ([]*models.Transfer, error)
+	GetStagedByPayloadCID(ctx context.Context, payloadCID string) (*models.Transfer, error)
+	GetCleanable(ctx context.Context, dealStatuses []string, limit int) ([]*models.Transfer, error)
+	CountUncleanedByPayloadCID(ctx context.Context, payloadCID string) (int64, error)
+	AddProgress(ctx context.Context, id uuid.UUID, bytes int64) error
+	Update(ctx context.Context, transfer *models.Transfer) error
+}
+
+// PlacementRepository defines IPFS pin placement data access methods
+type PlacementRepository interface {
+	GetNodes(ctx context.Context, cid string) ([]string, error)
+	GetByCID(ctx context.Context, cid string) ([]*models.PinPlacement, error)
+	Add(ctx context.Context, cid string, nodeIDs []string) error
+	Replace(ctx context.Context, cid string, placements []*models.PinPlacement) error
+	Remove(ctx context.Context, cid string, nodeIDs []string) error
+	GetNextCIDs(ctx context.Context, afterCID string, limit int) ([]string, error)
+	CountByNode(ctx context.Context) (map[string]int64, error)
+	GetByNode(ctx context.Context, nodeID string) ([]*models.PinPlacement, error)
+	GetReferenced(ctx context.Context, cids []string) (map[string]bool, error)
+}
+
+// ContentRepository defines content data access methods. References are
+// counted under a lock on the content row, so concurrent pins and releases
+// of the same CID see each other.
+type ContentRepository interface {
+	GetByCID(ctx context.Context, cid string) (*models.Content, error)
+	Share(ctx context.Context, pinID uuid.UUID, cid string, statuses []string) (*models.Content, error)
+	Attach(ctx context.Context, pinID uuid.UUID, cid string, sizeBytes int64) (*models.Content, error)
+	Release(ctx context.Context, pinID uuid.UUID) (*models.Content, error)
+	FinishUnpin(ctx context.Context, id uuid.UUID) (bool, error)
+	GetNextCoolable(ctx context.Context, afterID uuid.UUID, limit int) ([]*models.Content, error)
+	Cool(ctx context.Context, id uuid.UUID) (bool, error)
+	GetNextRestored(ctx context.Context, restoredBefore time.Time, afterID uuid.UUID, limit int) ([]*models.Content, error)
+}
+
+// DiscrepancyRepository defines pin discrepancy data access methods
+type DiscrepancyRepository interface {
+	GetOpen(ctx context.Context, nodeID string) ([]*models.PinDiscrepancy, error)
+	Save(ctx context.Context, discrepancy *models.PinDiscrepancy) error
+	Resolve(ctx context.Context, ids []uuid.UUID, action string) error
+	List(ctx context.Context, open bool, page, limit int) ([]*models.PinDiscrepancy, int64, error)
+}
+
+// QuotaRepository defines account quota and usage data access methods
+type QuotaRepository interface {
+	GetQuota(ctx context.Context, userID uuid.UUID) (*models.AccountQuota, error)
+	SetQuota(ctx context.Context, quota *models.AccountQuota) error
+	GetUsage(ctx context.Context, userID uuid.UUID) (*models.AccountUsage, error)
+	GetDaily(ctx context.Context, userID uuid.UUID, from, to time.Time) ([]*models.UsageDaily, error)
+}
+
+// InvoiceRepository defines invoice data access methods
+type InvoiceRepository interface {
+	Create(ctx context.Context, invoices []*models.Invoice) (bool, error)
+	GetByID(ctx context.Context, id uuid.UUID) (*models.Invoice, error)
+	GetByUserID(ctx context.Context, userID uuid.UUID, kind string, page, limit int) ([]*models.Invoice, int64, error)
+	GetUninvoicedUsers(ctx context.Context, from, to time.Time, afterID uuid.UUID, limit int) ([]uuid.UUID, error)
 }
 
 // userRepository implements UserRepository
@@ -101,7 +315,38 @@ func NewPinRequestRepository(db *gorm.DB) PinRequestRepository {
 }
 
 func (r *pinRequestRepository) Create(ctx context.Context, pinRequest *models.PinRequest) error {
-	return r.db.WithContext(ctx).Create(pinRequest).Error
+	if err := r.db.WithContext(ctx).Create(pinRequest).Error; err != nil {
+		return err
+	}
+	return refreshUsage(r.db.WithContext(ctx), pinRequest.UserID, 1)
+}
+
+// CreateWithinLimits creates a pin request unless the account already
+// holds as many pins or bytes as its limits allow. The account is locked
+// while its pins are counted, so concurrent requests cannot both take the
+// last slot.
+func (r *pinRequestRepository) CreateWithinLimits(ctx context.Context, pinRequest *models.PinRequest, limits PinLimits) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		usage, err := lockUsage(tx, pinRequest.UserID, uuid.Nil)
+		if err != nil {
+			return err
+		}
+
+		if limits.MaxPins > 0 && usage.PinnedPins+usage.PendingPins >= limits.MaxPins {
+			return fmt.Errorf("%w: %d of %d pins used", ErrPinLimitReached, usage.PinnedPins+usage.PendingPins, limits.MaxPins)
+		}
+		if limits.MaxPendingPins > 0 && usage.PendingPins >= limits.MaxPendingPins {
+			return fmt.Errorf("%w: %d of %d pending", ErrPendingLimitReached, usage.PendingPins, limits.MaxPendingPins)
+		}
+		if limits.MaxBytes > 0 && usage.PinnedBytes+pinRequest.SizeBytes > limits.MaxBytes {
+			return fmt.Errorf("%w: %d of %d bytes used", ErrByteLimitReached, usage.PinnedBytes, limits.MaxBytes)
+		}
+
+		if err := tx.Create(pinRequest).Error; err != nil {
+			return err
+		}
+		return refreshUsage(tx, pinRequest.UserID, 1)
+	})
 }
 
 func (r *pinRequestRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.PinRequest, error) {
@@ -140,11 +385,21 @@ func (r *pinRequestRepository) GetByCID(ctx context.Context, cid string) ([]*mod
 }
 
 func (r *pinRequestRepository) Update(ctx context.Context, pinRequest *models.PinRequest) error {
-	return r.db.WithContext(ctx).Save(pinRequest).Error
+	if err := r.db.WithContext(ctx).Save(pinRequest).Error; err != nil {
+		return err
+	}
+	return refreshUsage(r.db.WithContext(ctx), pinRequest.UserID, 0)
 }
 
 func (r *pinRequestRepository) Delete(ctx context.Context, id uuid.UUID) error {
-	return r.db.WithContext(ctx).Delete(&models.PinRequest{}, "id = ?", id).Error
+	var pin models.PinRequest
+	if err := r.db.WithContext(ctx).Select("id", "user_id").First(&pin, "id = ?", id).Error; err != nil {
+		return err
+	}
+	if err := r.db.WithContext(ctx).Delete(&models.PinRequest{}, "id = ?", id).Error; err != nil {
+		return err
+	}
+	return refreshUsage(r.db.WithContext(ctx), pin.UserID, 0)
 }
 
 func (r *pinRequestRepository) GetPendingRequests(ctx context.Context, limit int) ([]*models.PinRequest, error) {
@@ -153,6 +408,390 @@ func (r *pinRequestRepository) GetPendingRequests(ctx context.Context, limit int
 	return pinRequests, err
 }
 
+// GetNextPinned returns up to limit pinned requests ordered by ID, starting
+// after afterID, for scans that page through every pin
+func (r *pinRequestRepository) GetNextPinned(ctx context.Context, afterID uuid.UUID, limit int) ([]*models.PinRequest, error) {
+	var pinRequests []*models.PinRequest
+	err := r.db.WithContext(ctx).
+		Where("status = ? AND id > ?", models.PinStatusPinned, afterID).
+		Order("id").
+		Limit(limit).
+		Find(&pinRequests).Error
+	return pinRequests, err
+}
+
+// GetNextUnplaced returns pinned requests whose CID has no recorded IPFS
+// node, such as pins made before the node pool, in ID order
+func (r *pinRequestRepository) GetNextUnplaced(ctx context.Context, afterID uuid.UUID, limit int) ([]*models.PinRequest, error) {
+	var pinRequests []*models.PinRequest
+	err := r.db.WithContext(ctx).
+		Where("status = ? AND id > ?", models.PinStatusPinned, afterID).
+		Where("NOT EXISTS (SELECT 1 FROM pin_placements pp WHERE pp.cid = pin_requests.cid)").
+		Order("id").
+		Limit(limit).
+		Find(&pinRequests).Error
+	return pinRequests, err
+}
+
+// ClaimPin starts a pinning attempt for a pending pin, or one whose last
+// attempt stopped or whose worker stopped sending heartbeats before
+// staleBefore. It returns false if the pin is not claimable, so only one
+// worker pins a request at a time.
+func (r *pinRequestRepository) ClaimPin(ctx context.Context, id uuid.UUID, staleBefore time.Time) (bool, error) {
+	now := time.Now()
+	result := r.db.WithContext(ctx).Model(&models.PinRequest{}).
+		Where("id = ?", id).
+		Where("status = ? OR (status = ? AND (pin_heartbeat_at IS NULL OR pin_heartbeat_at < ?))",
+			models.PinStatusPending, models.PinStatusPinning, staleBefore).
+		Updates(map[string]interface{}{
+			"status":           models.PinStatusPinning,
+			"pin_attempts":     gorm.Expr("pin_attempts + 1"),
+			"pin_error":        "",
+			"pin_started_at":   gorm.Expr("COALESCE(pin_started_at, ?)", now),
+			"pin_progress_at":  now,
+			"pin_heartbeat_at": now,
+		})
+	return result.RowsAffected == 1, result.Error
+}
+
+// UpdatePinProgress records the progress of a pinning attempt and its
+// heartbeat. Block counts never go backwards. It returns false if the pin
+// is no longer being pinned, such as after it was cancelled.
+func (r *pinRequestRepository) UpdatePinProgress(ctx context.Context, id uuid.UUID, blocks, bytes, totalBytes int64, advanced bool) (bool, error) {
+	now := time.Now()
+	updates := map[string]interface{}{
+		"blocks_fetched":   gorm.Expr("GREATEST(blocks_fetched, ?)", blocks),
+		"bytes_fetched":    gorm.Expr("GREATEST(bytes_fetched, ?)", bytes),
+		"pin_heartbeat_at": now,
+	}
+	if advanced {
+		updates["pin_progress_at"] = now
+	}
+	if totalBytes > 0 {
+		updates["size_bytes"] = totalBytes
+	}
+
+	result := r.db.WithContext(ctx).Model(&models.PinRequest{}).
+		Where("id = ? AND status = ?", id, models.PinStatusPinning).
+		Updates(updates)
+	return result.RowsAffected == 1, result.Error
+}
+
+// ResolvePath replaces a pin request's CID with the CID its path resolved
+// to
+func (r *pinRequestRepository) ResolvePath(ctx context.Context, id uuid.UUID, cid string) error {
+	return r.db.WithContext(ctx).Model(&models.PinRequest{}).
+		Where("id = ? AND status = ?", id, models.PinStatusPinning).
+		Updates(map[string]interface{}{
+			"cid":  cid,
+			"path": "",
+		}).Error
+}
+
+func (r *pinRequestRepository) SetPrice(ctx context.Context, id uuid.UUID, priceFIL decimal.Decimal) error {
+	return r.db.WithContext(ctx).Model(&models.PinRequest{}).
+		Where("id = ?", id).
+		Update("price_fil", priceFIL).Error
+}
+
+// MarkPinned completes a pinning attempt. If maxBytes is set and the pin
+// would take the account over it, the pin is left as it is and
+// ErrByteLimitReached is returned.
+func (r *pinRequestRepository) MarkPinned(ctx context.Context, id uuid.UUID, sizeBytes, maxBytes int64) error {
+	updates := map[string]interface{}{
+		"status":           models.PinStatusPinned,
+		"pin_error":        "",
+		"pin_heartbeat_at": nil,
+		"expires_at":       gorm.Expr("COALESCE(expires_at, NOW() + duration_days * INTERVAL '1 day')"),
+		"cold_at":          gorm.Expr("CASE WHEN hot_days > 0 THEN COALESCE(cold_at, NOW() + hot_days * INTERVAL '1 day') END"),
+	}
+	if sizeBytes > 0 {
+		updates["size_bytes"] = sizeBytes
+		updates["bytes_fetched"] = sizeBytes
+	}
+
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if maxBytes > 0 {
+			var pin models.PinRequest
+			if err := tx.Select("id", "user_id").First(&pin, "id = ?", id).Error; err != nil {
+				return err
+			}
+			usage, err := lockUsage(tx, pin.UserID, id)
+			if err != nil {
+				return err
+			}
+			if usage.PinnedBytes+sizeBytes > maxBytes {
+				return fmt.Errorf("%w: %d of %d bytes used, %d more needed", ErrByteLimitReached, usage.PinnedBytes, maxBytes, sizeBytes)
+			}
+		}
+
+		result := tx.Model(&models.PinRequest{}).
+			Where("id = ? AND status = ?", id, models.PinStatusPinning).
+			Updates(updates)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return refreshPinUsage(tx, id)
+	})
+}
+
+// ReleasePin ends a failed pinning attempt so it can be retried, or fails
+// the pin for good
+func (r *pinRequestRepository) ReleasePin(ctx context.Context, id uuid.UUID, pinError string, failed bool) error {
+	updates := map[string]interface{}{
+		"pin_error":        pinError,
+		"pin_heartbeat_at": nil,
+	}
+	if failed {
+		updates["status"] = models.PinStatusFailed
+	}
+
+	result := r.db.WithContext(ctx).Model(&models.PinRequest{}).
+		Where("id = ? AND status = ?", id, models.PinStatusPinning).
+		Updates(updates)
+	if result.Error != nil || result.RowsAffected == 0 || !failed {
+		return result.Error
+	}
+	return refreshPinUsage(r.db.WithContext(ctx), id)
+}
+
+// GetOrphanedPins returns pins being pinned that no worker is working on:
+// their last attempt failed or their heartbeat is older than staleBefore
+func (r *pinRequestRepository) GetOrphanedPins(ctx context.Context, staleBefore time.Time, limit int) ([]*models.PinRequest, error) {
+	var pinRequests []*models.PinRequest
+	err := r.db.WithContext(ctx).
+		Where("status = ? AND (pin_heartbeat_at IS NULL OR pin_heartbeat_at < ?)", models.PinStatusPinning, staleBefore).
+		Order("updated_at").
+		Limit(limit).
+		Find(&pinRequests).Error
+	return pinRequests, err
+}
+
+// GetNextExpiring returns pins whose hot storage or deals end before the
+// given time, in ID order. Pins under legal hold are left out.
+func (r *pinRequestRepository) GetNextExpiring(ctx context.Context, before time.Time, afterID uuid.UUID, limit int) ([]*models.PinRequest, error) {
+	var pinRequests []*models.PinRequest
+	err := r.db.WithContext(ctx).
+		Where("status = ? AND NOT legal_hold AND id > ?", models.PinStatusPinned, afterID).
+		Where("expires_at <= ? OR deals_expire_at <= ?", before, before).
+		Order("id").
+		Limit(limit).
+		Find(&pinRequests).Error
+	return pinRequests, err
+}
+
+// GetNextExpired returns pins that expired before the given time and still
+// reference their content, in ID order
+func (r *pinRequestRepository) GetNextExpired(ctx context.Context, expiredBefore time.Time, afterID uuid.UUID, limit int) ([]*models.PinRequest, error) {
+	var pinRequests []*models.PinRequest
+	err := r.db.WithContext(ctx).
+		Where("status = ? AND NOT legal_hold AND id > ?", models.PinStatusExpired, afterID).
+		Where("expired_at <= ? AND content_id IS NOT NULL", expiredBefore).
+		Order("id").
+		Limit(limit).
+		Find(&pinRequests).Error
+	return pinRequests, err
+}
+
+// Expire moves a pinned pin past its expiry to expired. It returns false
+// if the pin was extended or put under legal hold meanwhile.
+func (r *pinRequestRepository) Expire(ctx context.Context, id uuid.UUID, now time.Time) (bool, error) {
+	result := r.db.WithContext(ctx).Model(&models.PinRequest{}).
+		Where("id = ? AND status = ? AND NOT legal_hold AND expires_at <= ?", id, models.PinStatusPinned, now).
+		Updates(map[string]interface{}{
+			"status":     models.PinStatusExpired,
+			"expired_at": now,
+		})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	return true, refreshPinUsage(r.db.WithContext(ctx), id)
+}
+
+// Extend moves a pin's expiry from one time to another, restoring an
+// expired pin whose content has not been released. It returns false if
+// the expiry is no longer from, so concurrent extensions apply once.
+func (r *pinRequestRepository) Extend(ctx context.Context, id uuid.UUID, from, to time.Time) (bool, error) {
+	result := r.db.WithContext(ctx).Model(&models.PinRequest{}).
+		Where("id = ? AND expires_at = ?", id, from).
+		Where("status = ? OR (status = ? AND content_id IS NOT NULL)", models.PinStatusPinned, models.PinStatusExpired).
+		Updates(map[string]interface{}{
+			"status":     models.PinStatusPinned,
+			"expires_at": to,
+			"expired_at": nil,
+		})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	return true, refreshPinUsage(r.db.WithContext(ctx), id)
+}
+
+func (r *pinRequestRepository) SetLegalHold(ctx context.Context, id uuid.UUID, hold bool, reason string) error {
+	result := r.db.WithContext(ctx).Model(&models.PinRequest{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{
+			"legal_hold":        hold,
+			"legal_hold_reason": reason,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// RefreshDealsExpiry records when each pin's Filecoin storage ends: the
+// end of its last live deal, or of the deals it shares through its
+// content. Epochs are converted to times from the current epoch.
+func (r *pinRequestRepository) RefreshDealsExpiry(ctx context.Context, currentEpoch int64, now time.Time) error {
+	return r.db.WithContext(ctx).Exec(`
+		UPDATE pin_requests SET deals_expire_at = CAST(@now AS TIMESTAMPTZ) + (ends.end_epoch - @epoch) * INTERVAL '30 seconds'
+		FROM (
+			SELECT p.id, MAX(d.end_epoch) AS end_epoch
+			FROM pin_requests p
+			LEFT JOIN contents c ON p.shares_deals AND c.id = p.content_id
+			JOIN filecoin_deals d ON d.pin_request_id = COALESCE(c.deal_pin_id, p.id)
+			WHERE p.status = @pinned AND d.status IN @statuses
+			GROUP BY p.id
+		) ends
+		WHERE pin_requests.id = ends.id`,
+		sql.Named("now", now),
+		sql.Named("epoch", currentEpoch),
+		sql.Named("pinned", models.PinStatusPinned),
+		sql.Named("statuses", []string{models.DealStatusPending, models.DealStatusPublished, models.DealStatusActive}),
+	).Error
+}
+
+// lockUsage locks an account's row for the rest of the transaction and
+// counts what it has pinned and pending. The excluded pin, whose size is
+// being recorded, is left out of the count.
+func lockUsage(tx *gorm.DB, userID, excluding uuid.UUID) (*models.AccountUsage, error) {
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&models.User{}, "id = ?", userID).Error; err != nil {
+		return nil, err
+	}
+
+	usage := models.AccountUsage{UserID: userID}
+	err := tx.Model(&models.PinRequest{}).
+		Select("COALESCE(SUM(size_bytes) FILTER (WHERE status = ?), 0) AS pinned_bytes, "+
+			"COUNT(*) FILTER (WHERE status = ?) AS pinned_pins, "+
+			"COUNT(*) FILTER (WHERE status IN ?) AS pending_pins",
+			models.PinStatusPinned, models.PinStatusPinned, []string{models.PinStatusPending, models.PinStatusPinning}).
+		Where("user_id = ? AND id <> ?", userID, excluding).
+		Scan(&usage).Error
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// refreshPinUsage recounts the usage of the account owning a pin
+func refreshPinUsage(db *gorm.DB, pinID uuid.UUID) error {
+	var pin models.PinRequest
+	if err := db.Select("id", "user_id").First(&pin, "id = ?", pinID).Error; err != nil {
+		return err
+	}
+	return refreshUsage(db, pin.UserID, 0)
+}
+
+// refreshUsage recounts what an account has pinned and pending after one
+// of its pins changed status, and records it in the day's usage along with
+// the number of pins created
+func refreshUsage(db *gorm.DB, userID uuid.UUID, created int64) error {
+	now := time.Now().UTC()
+	err := db.Exec(`
+		INSERT INTO account_usage (user_id, pinned_bytes, pinned_pins, pending_pins, updated_at)
+		SELECT u.id,
+			COALESCE(SUM(p.size_bytes) FILTER (WHERE p.status = @pinned), 0),
+			COUNT(p.id) FILTER (WHERE p.status = @pinned),
+			COUNT(p.id) FILTER (WHERE p.status IN @pending),
+			@now
+		FROM users u
+		LEFT JOIN pin_requests p ON p.user_id = u.id
+		WHERE u.id = @user
+		GROUP BY u.id
+		ON CONFLICT (user_id) DO UPDATE SET
+			pinned_bytes = EXCLUDED.pinned_bytes,
+			pinned_pins = EXCLUDED.pinned_pins,
+			pending_pins = EXCLUDED.pending_pins,
+			updated_at = EXCLUDED.updated_at`,
+		sql.Named("user", userID),
+		sql.Named("now", now),
+		sql.Named("pinned", models.PinStatusPinned),
+		sql.Named("pending", []string{models.PinStatusPending, models.PinStatusPinning}),
+	).Error
+	if err != nil {
+		return err
+	}
+
+	return db.Exec(`
+		INSERT INTO usage_daily (user_id, date, pinned_bytes, peak_bytes, pinned_pins, pins_created, updated_at)
+		SELECT user_id, CAST(@now AS DATE), pinned_bytes, pinned_bytes, pinned_pins, @created, @now
+		FROM account_usage
+		WHERE user_id = @user
+		ON CONFLICT (user_id, date) DO UPDATE SET
+			pinned_bytes = EXCLUDED.pinned_bytes,
+			peak_bytes = GREATEST(usage_daily.peak_bytes, EXCLUDED.peak_bytes),
+			pinned_pins = EXCLUDED.pinned_pins,
+			pins_created = usage_daily.pins_created + EXCLUDED.pins_created,
+			updated_at = EXCLUDED.updated_at`,
+		sql.Named("user", userID),
+		sql.Named("now", now),
+		sql.Named("created", created),
+	).Error
+}
+
+// GetNextColdDue returns hot_cold pins whose lifecycle rule moves them to
+// the cold tier by now, in ID order
+func (r *pinRequestRepository) GetNextColdDue(ctx context.Context, now time.Time, afterID uuid.UUID, limit int) ([]*models.PinRequest, error) {
+	var pinRequests []*models.PinRequest
+	err := r.db.WithContext(ctx).
+		Where("status = ? AND tier = ? AND cold_at <= ? AND id > ?", models.PinStatusPinned, models.TierHotCold, now, afterID).
+		Order("id").
+		Limit(limit).
+		Find(&pinRequests).Error
+	return pinRequests, err
+}
+
+// MoveToCold moves a hot_cold pin that is due to the cold tier. It returns
+// false if the pin is no longer due.
+func (r *pinRequestRepository) MoveToCold(ctx context.Context, id uuid.UUID, now time.Time) (bool, error) {
+	result := r.db.WithContext(ctx).Model(&models.PinRequest{}).
+		Where("id = ? AND status = ? AND tier = ? AND cold_at <= ?", id, models.PinStatusPinned, models.TierHotCold, now).
+		Update("tier", models.TierCold)
+	return result.RowsAffected > 0, result.Error
+}
+
+// GetAggregationCandidates returns pinned content too small for a deal of
+// its own that has neither deals nor an aggregate yet, oldest first
+func (r *pinRequestRepository) GetAggregationCandidates(ctx context.Context, maxSize int64, limit int) ([]*models.PinRequest, error) {
+	var pinRequests []*models.PinRequest
+	err := r.db.WithContext(ctx).
+		Where("status = ? AND aggregate_id IS NULL AND size_bytes > 0 AND size_bytes < ?", models.PinStatusPinned, maxSize).
+		Where("NOT shares_deals AND tier <> ?", models.TierHot).
+		Where("NOT EXISTS (SELECT 1 FROM filecoin_deals WHERE filecoin_deals.pin_request_id = pin_requests.id)").
+		Order("created_at").
+		Limit(limit).
+		Find(&pinRequests).Error
+	return pinRequests, err
+}
+
+// GetSplitCandidates returns pinned content too large for a single deal
+// that has not been split yet and has no live whole-DAG deals
+func (r *pinRequestRepository) GetSplitCandidates(ctx context.Context, minSize int64, limit int) ([]*models.PinRequest, error) {
+	var pinRequests []*models.PinRequest
+	err := r.db.WithContext(ctx).
+		Where("status = ? AND size_bytes > ? AND NOT shares_deals AND tier <> ?", models.PinStatusPinned, minSize, models.TierHot).
+		Where("NOT EXISTS (SELECT 1 FROM split_manifests WHERE split_manifests.pin_request_id = pin_requests.id)").
+		Where("NOT EXISTS (SELECT 1 FROM filecoin_deals WHERE filecoin_deals.pin_request_id = pin_requests.id AND filecoin_deals.status IN ?)",
+			[]string{models.DealStatusPending, models.DealStatusPublished, models.DealStatusActive}).
+		Order("created_at").
+		Limit(limit).
+		Find(&pinRequests).Error
+	return pinRequests, err
+}
+
 // filecoinDealRepository implements FilecoinDealRepository
 type filecoinDealRepository struct {
 	db *gorm.DB
@@ -166,6 +805,10 @@ func (r *filecoinDealRepository) Create(ctx context.Context, deal *models.Fileco
 	return r.db.WithContext(ctx).Create(deal).Error
 }
 
+func (r *filecoinDealRepository) CreateBatch(ctx context.Context, deals []*models.FilecoinDeal) error {
+	return r.db.WithContext(ctx).Create(&deals).Error
+}
+
 func (r *filecoinDealRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.FilecoinDeal, error) {
 	var deal models.FilecoinDeal
 	err := r.db.WithContext(ctx).Preload("PinRequest").First(&deal, "id = ?", id).Error
@@ -181,6 +824,21 @@ func (r *filecoinDealRepository) GetByPinRequestID(ctx context.Context, pinReque
 	return deals, err
 }
 
+func (r *filecoinDealRepository) GetByPinRequestIDs(ctx context.Context, pinRequestIDs []uuid.UUID) ([]*models.FilecoinDeal, error) {
+	var deals []*models.FilecoinDeal
+	if len(pinRequestIDs) == 0 {
+		return deals, nil
+	}
+	err := r.db.WithContext(ctx).Find(&deals, "pin_request_id IN ?", pinRequestIDs).Error
+	return deals, err
+}
+
+func (r *filecoinDealRepository) AddRetrievalCost(ctx context.Context, id uuid.UUID, costFIL float64) error {
+	return r.db.WithContext(ctx).Model(&models.FilecoinDeal{}).
+		Where("id = ?", id).
+		Update("retrieval_cost", gorm.Expr("retrieval_cost + ?", costFIL)).Error
+}
+
 func (r *filecoinDealRepository) GetByCID(ctx context.Context, cid string) ([]*models.FilecoinDeal, error) {
 	var deals []*models.FilecoinDeal
 	err := r.db.WithContext(ctx).
@@ -218,3 +876,1374 @@ func (r *filecoinDealRepository) GetActiveDeals(ctx context.Context) ([]*models.
 	err := r.db.WithContext(ctx).Where("status = ?", models.DealStatusActive).Find(&deals).Error
 	return deals, err
 }
+
+// GetBatchBoundaries returns the ID of every batchSize-th deal with one of the
+// given statuses, in ID order. Consecutive boundaries delimit batches of at
+// most batchSize deals without loading the deals themselves.
+func (r *filecoinDealRepository) GetBatchBoundaries(ctx context.Context, statuses []string, batchSize int) ([]uuid.UUID, error) {
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("batch size must be positive, got %d", batchSize)
+	}
+
+	var ids []uuid.UUID
+	err := r.db.WithContext(ctx).Raw(`
+		SELECT id FROM (
+			SELECT id, row_number() OVER (ORDER BY id) AS rn
+			FROM filecoin_deals
+			WHERE status IN ?
+		) numbered
+		WHERE rn % ? = 0
+		ORDER BY id`, statuses, batchSize).
+		Scan(&ids).Error
+	return ids, err
+}
+
+// GetBatch returns deals with one of the given statuses whose ID lies in
+// (afterID, untilID]. A nil untilID leaves the range open-ended.
+func (r *filecoinDealRepository) GetBatch(ctx context.Context, statuses []string, afterID, untilID uuid.UUID) ([]*models.FilecoinDeal, error) {
+	var deals []*models.FilecoinDeal
+	query := r.db.WithContext(ctx).Where("status IN ? AND id > ?", statuses, afterID)
+	if untilID != uuid.Nil {
+		query = query.Where("id <= ?", untilID)
+	}
+	err := query.Order("id").Find(&deals).Error
+	return deals, err
+}
+
+// GetNextBatch returns up to limit deals with one of the given statuses
+// after afterID in ID order, for callers walking the table incrementally
+func (r *filecoinDealRepository) GetNextBatch(ctx context.Context, statuses []string, afterID uuid.UUID, limit int) ([]*models.FilecoinDeal, error) {
+	var deals []*models.FilecoinDeal
+	err := r.db.WithContext(ctx).
+		Where("status IN ? AND id > ?", statuses, afterID).
+		Order("id").
+		Limit(limit).
+		Find(&deals).Error
+	return deals, err
+}
+
+// MarkExpired moves active deals past their end epoch to expired in bulk
+func (r *filecoinDealRepository) MarkExpired(ctx context.Context, currentEpoch int64) (int64, error) {
+	result := r.db.WithContext(ctx).Model(&models.FilecoinDeal{}).
+		Where("status = ? AND end_epoch <= ?", models.DealStatusActive, currentEpoch).
+		Update("status", models.DealStatusExpired)
+	return result.RowsAffected, result.Error
+}
+
+// TouchChecked records when deals were last checked by the monitor
+func (r *filecoinDealRepository) TouchChecked(ctx context.Context, ids []uuid.UUID, checkedAt time.Time) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return r.db.WithContext(ctx).Model(&models.FilecoinDeal{}).
+		Where("id IN ?", ids).
+		UpdateColumn("last_checked_at", checkedAt).Error
+}
+
+func (r *filecoinDealRepository) GetByDealCIDs(ctx context.Context, dealCIDs []string) ([]*models.FilecoinDeal, error) {
+	var deals []*models.FilecoinDeal
+	if len(dealCIDs) == 0 {
+		return deals, nil
+	}
+	err := r.db.WithContext(ctx).Find(&deals, "deal_cid IN ?", dealCIDs).Error
+	return deals, err
+}
+
+func (r *filecoinDealRepository) GetByDealIDs(ctx context.Context, dealIDs []int64) ([]*models.FilecoinDeal, error) {
+	var deals []*models.FilecoinDeal
+	if len(dealIDs) == 0 {
+		return deals, nil
+	}
+	err := r.db.WithContext(ctx).Find(&deals, "deal_id IN ?", dealIDs).Error
+	return deals, err
+}
+
+// GetPublishedDeals returns deals that are on chain but not yet activated
+func (r *filecoinDealRepository) GetPublishedDeals(ctx context.Context) ([]*models.FilecoinDeal, error) {
+	var deals []*models.FilecoinDeal
+	err := r.db.WithContext(ctx).
+		Where("status = ? AND deal_id > 0", models.DealStatusPublished).
+		Find(&deals).Error
+	return deals, err
+}
+
+// chainRepository implements ChainRepository
+type chainRepository struct {
+	db *gorm.DB
+}
+
+func NewChainRepository(db *gorm.DB) ChainRepository {
+	return &chainRepository{db: db}
+}
+
+func (r *chainRepository) GetCheckpoint(ctx context.Context, name string) (*models.ChainCheckpoint, error) {
+	var checkpoint models.ChainCheckpoint
+	err := r.db.WithContext(ctx).First(&checkpoint, "name = ?", name).Error
+	if err != nil {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+func (r *chainRepository) SaveCheckpoint(ctx context.Context, checkpoint *models.ChainCheckpoint) error {
+	return r.db.WithContext(ctx).Save(checkpoint).Error
+}
+
+func (r *chainRepository) CreateEvent(ctx context.Context, event *models.ChainEvent) error {
+	return r.db.WithContext(ctx).Create(event).Error
+}
+
+func (r *chainRepository) GetEventsByTipSet(ctx context.Context, tipSetKey string) ([]*models.ChainEvent, error) {
+	var events []*models.ChainEvent
+	err := r.db.WithContext(ctx).Order("created_at DESC").Find(&events, "tipset_key = ?", tipSetKey).Error
+	return events, err
+}
+
+func (r *chainRepository) GetEventsAboveHeight(ctx context.Context, height int64) ([]*models.ChainEvent, error) {
+	var events []*models.ChainEvent
+	err := r.db.WithContext(ctx).
+		Where("height > ?", height).
+		Order("height DESC, created_at DESC").
+		Find(&events).Error
+	return events, err
+}
+
+func (r *chainRepository) DeleteEvents(ctx context.Context, ids []uuid.UUID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return r.db.WithContext(ctx).Delete(&models.ChainEvent{}, "id IN ?", ids).Error
+}
+
+// PruneEvents drops events for tipsets that can no longer be reverted
+func (r *chainRepository) PruneEvents(ctx context.Context, belowHeight int64) error {
+	return r.db.WithContext(ctx).Delete(&models.ChainEvent{}, "height < ?", belowHeight).Error
+}
+
+// ledgerRepository implements LedgerRepository
+type ledgerRepository struct {
+	db *gorm.DB
+}
+
+func NewLedgerRepository(db *gorm.DB) LedgerRepository {
+	return &ledgerRepository{db: db}
+}
+
+func (r *ledgerRepository) Charge(ctx context.Context, entry *models.LedgerEntry) (bool, error) {
+	entry.Type = models.LedgerTypeCharge
+	return r.apply(ctx, entry, "balance - ?")
+}
+
+func (r *ledgerRepository) Credit(ctx context.Context, entry *models.LedgerEntry) (bool, error) {
+	if entry.Type == "" {
+		entry.Type = models.LedgerTypeCredit
+	}
+	return r.apply(ctx, entry, "balance + ?")
+}
+
+func (r *ledgerRepository) apply(ctx context.Context, entry *models.LedgerEntry, balanceExpr string) (bool, error) {
+	created := false
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(entry)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			// Already recorded under this idempotency key
+			return nil
+		}
+
+		query := tx.Model(&models.User{}).Where("id = ?", entry.UserID)
+		if entry.IsDebit() {
+			query = query.Where("balance >= ?", entry.AmountFIL)
+		}
+		update := query.Update("balance", gorm.Expr(balanceExpr, entry.AmountFIL))
+		if update.Error != nil {
+			return update.Error
+		}
+		if update.RowsAffected == 0 {
+			return ErrInsufficientBalance
+		}
+
+		created = true
+		return nil
+	})
+	return created, err
+}
+
+func (r *ledgerRepository) GetByIdempotencyKey(ctx context.Context, key string) (*models.LedgerEntry, error) {
+	var entry models.LedgerEntry
+	err := r.db.WithContext(ctx).First(&entry, "idempotency_key = ?", key).Error
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (r *ledgerRepository) GetByUserID(ctx context.Context, userID uuid.UUID, from, to time.Time) ([]*models.LedgerEntry, error) {
+	var entries []*models.LedgerEntry
+	err := r.db.WithContext(ctx).
+		Where("user_id = ? AND created_at >= ? AND created_at < ?", userID, from, to).
+		Order("created_at").
+		Find(&entries).Error
+	return entries, err
+}
+
+// GetTotals returns the sum of a user's ledger entries of each type made
+// between from and to
+func (r *ledgerRepository) GetTotals(ctx context.Context, userID uuid.UUID, from, to time.Time) (map[string]decimal.Decimal, error) {
+	var rows []struct {
+		Type  string
+		Total decimal.Decimal
+	}
+	err := r.db.WithContext(ctx).Model(&models.LedgerEntry{}).
+		Select("type, SUM(amount_fil) AS total").
+		Where("user_id = ? AND created_at >= ? AND created_at < ?", userID, from, to).
+		Group("type").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	totals := make(map[string]decimal.Decimal, len(rows))
+	for _, row := range rows {
+		totals[row.Type] = row.Total
+	}
+	return totals, nil
+}
+
+// GetBalanceAt returns a user's balance at a point in time: their balance
+// now less the ledger entries made since. Both are read by one statement so
+// they agree.
+func (r *ledgerRepository) GetBalanceAt(ctx context.Context, userID uuid.UUID, at time.Time) (decimal.Decimal, error) {
+	var balance decimal.Decimal
+	err := r.db.WithContext(ctx).Raw(`
+		SELECT u.balance - COALESCE((
+			SELECT SUM(CASE WHEN l.type = @charge THEN -l.amount_fil ELSE l.amount_fil END)
+			FROM ledger_entries l
+			WHERE l.user_id = u.id AND l.created_at >= @at
+		), 0)
+		FROM users u
+		WHERE u.id = @user`,
+		sql.Named("charge", models.LedgerTypeCharge),
+		sql.Named("at", at),
+		sql.Named("user", userID),
+	).Row().Scan(&balance)
+	return balance, err
+}
+
+// renewalRepository implements RenewalRepository
+type renewalRepository struct {
+	db *gorm.DB
+}
+
+func NewRenewalRepository(db *gorm.DB) RenewalRepository {
+	return &renewalRepository{db: db}
+}
+
+// GetOrCreate returns the renewal with the same idempotency key, creating it
+// if this is the first attempt to renew the deal
+func (r *renewalRepository) GetOrCreate(ctx context.Context, renewal *models.Renewal) (*models.Renewal, error) {
+	err := r.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(renewal).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var existing models.Renewal
+	err = r.db.WithContext(ctx).First(&existing, "idempotency_key = ?", renewal.IdempotencyKey).Error
+	if err != nil {
+		return nil, err
+	}
+	return &existing, nil
+}
+
+// Claim marks a renewal in progress if no one else holds it and it has
+// attempts left. A claim older than the lease is treated as abandoned by a
+// crashed worker and can be taken over. It returns false if the renewal
+// could not be claimed.
+func (r *renewalRepository) Claim(ctx context.Context, id uuid.UUID, maxAttempts int, lease time.Duration) (bool, error) {
+	now := time.Now()
+	result := r.db.WithContext(ctx).Model(&models.Renewal{}).
+		Where("id = ? AND attempts < ?", id, maxAttempts).
+		Where("status IN ? OR (status = ? AND claimed_at < ?)",
+			[]string{models.RenewalStatusPending, models.RenewalStatusFailed},
+			models.RenewalStatusInProgress, now.Add(-lease)).
+		Updates(map[string]interface{}{
+			"status":     models.RenewalStatusInProgress,
+			"attempts":   gorm.Expr("attempts + 1"),
+			"claimed_at": now,
+		})
+	return result.RowsAffected == 1, result.Error
+}
+
+func (r *renewalRepository) Update(ctx context.Context, renewal *models.Renewal) error {
+	return r.db.WithContext(ctx).Save(renewal).Error
+}
+
+func (r *renewalRepository) GetByPinRequestID(ctx context.Context, pinRequestID uuid.UUID) ([]*models.Renewal, error) {
+	var renewals []*models.Renewal
+	err := r.db.WithContext(ctx).Order("created_at DESC").Find(&renewals, "pin_request_id = ?", pinRequestID).Error
+	return renewals, err
+}
+
+// notificationRepository implements NotificationRepository
+type notificationRepository struct {
+	db *gorm.DB
+}
+
+func NewNotificationRepository(db *gorm.DB) NotificationRepository {
+	return &notificationRepository{db: db}
+}
+
+// Create stores a notification unless one with the same key already exists
+func (r *notificationRepository) Create(ctx context.Context, notification *models.Notification) (bool, error) {
+	result := r.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(notification)
+	return result.RowsAffected == 1, result.Error
+}
+
+func (r *notificationRepository) GetByUserID(ctx context.Context, userID uuid.UUID, page, limit int) ([]*models.Notification, int64, error) {
+	var notifications []*models.Notification
+	var total int64
+
+	query := r.db.WithContext(ctx).Model(&models.Notification{}).Where("user_id = ?", userID)
+	query.Count(&total)
+
+	offset := (page - 1) * limit
+	err := query.Offset(offset).Limit(limit).Order("created_at DESC").Find(&notifications).Error
+
+	return notifications, total, err
+}
+
+func (r *notificationRepository) MarkRead(ctx context.Context, id, userID uuid.UUID) error {
+	return r.db.WithContext(ctx).Model(&models.Notification{}).
+		Where("id = ? AND user_id = ?", id, userID).
+		Update("read_at", time.Now().UTC()).Error
+}
+
+// retrievalRepository implements RetrievalRepository
+type retrievalRepository struct {
+	db *gorm.DB
+}
+
+func NewRetrievalRepository(db *gorm.DB) RetrievalRepository {
+	return &retrievalRepository{db: db}
+}
+
+// Create stores a retrieval unless the pin already has one in flight
+func (r *retrievalRepository) Create(ctx context.Context, retrieval *models.Retrieval) (bool, error) {
+	result := r.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(retrieval)
+	return result.RowsAffected == 1, result.Error
+}
+
+func (r *retrievalRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Retrieval, error) {
+	var retrieval models.Retrieval
+	err := r.db.WithContext(ctx).First(&retrieval, "id = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &retrieval, nil
+}
+
+func (r *retrievalRepository) GetActiveByPinRequestID(ctx context.Context, pinRequestID uuid.UUID) (*models.Retrieval, error) {
+	var retrieval models.Retrieval
+	err := r.db.WithContext(ctx).
+		Where("pin_request_id = ? AND status IN ?", pinRequestID, []string{models.RetrievalStatusQueued, models.RetrievalStatusInProgress}).
+		First(&retrieval).Error
+	if err != nil {
+		return nil, err
+	}
+	return &retrieval, nil
+}
+
+func (r *retrievalRepository) Update(ctx context.Context, retrieval *models.Retrieval) error {
+	return r.db.WithContext(ctx).Save(retrieval).Error
+}
+
+// bandwidthRepository implements BandwidthRepository
+type bandwidthRepository struct {
+	db *gorm.DB
+}
+
+func NewBandwidthRepository(db *gorm.DB) BandwidthRepository {
+	return &bandwidthRepository{db: db}
+}
+
+// Add increments a user's usage for a day, creating the row if needed
+func (r *bandwidthRepository) Add(ctx context.Context, userID uuid.UUID, date time.Time, bytes, requests int64) error {
+	usage := &models.BandwidthUsage{
+		UserID:   userID,
+		Date:     date,
+		Bytes:    bytes,
+		Requests: requests,
+	}
+	return r.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}, {Name: "date"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"bytes":      gorm.Expr("bandwidth_usage.bytes + ?", bytes),
+			"requests":   gorm.Expr("bandwidth_usage.requests + ?", requests),
+			"updated_at": time.Now().UTC(),
+		}),
+	}).Create(usage).Error
+}
+
+func (r *bandwidthRepository) GetByUserID(ctx context.Context, userID uuid.UUID, from, to time.Time) ([]*models.BandwidthUsage, error) {
+	var usage []*models.BandwidthUsage
+	err := r.db.WithContext(ctx).
+		Where("user_id = ? AND date >= ? AND date <= ?", userID, from, to).
+		Order("date").
+		Find(&usage).Error
+	return usage, err
+}
+
+// shareLinkRepository implements ShareLinkRepository
+type shareLinkRepository struct {
+	db *gorm.DB
+}
+
+func NewShareLinkRepository(db *gorm.DB) ShareLinkRepository {
+	return &shareLinkRepository{db: db}
+}
+
+func (r *shareLinkRepository) Create(ctx context.Context, link *models.ShareLink) error {
+	return r.db.WithContext(ctx).Create(link).Error
+}
+
+func (r *shareLinkRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.ShareLink, error) {
+	var link models.ShareLink
+	err := r.db.WithContext(ctx).First(&link, "id = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+func (r *shareLinkRepository) GetByPinRequestID(ctx context.Context, pinRequestID uuid.UUID) ([]*models.ShareLink, error) {
+	var links []*models.ShareLink
+	err := r.db.WithContext(ctx).Where("pin_request_id = ?", pinRequestID).Order("created_at DESC").Find(&links).Error
+	return links, err
+}
+
+func (r *shareLinkRepository) Revoke(ctx context.Context, id uuid.UUID) error {
+	return r.db.WithContext(ctx).Model(&models.ShareLink{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", time.Now().UTC()).Error
+}
+
+// ClaimDownload counts a download against a link, returning false if the
+// link is revoked, expired or has no downloads left. The check and the
+// increment happen in one statement so concurrent downloads cannot exceed
+// the limit.
+func (r *shareLinkRepository) ClaimDownload(ctx context.Context, id uuid.UUID) (bool, error) {
+	result := r.db.WithContext(ctx).Model(&models.ShareLink{}).
+		Where("id = ? AND revoked_at IS NULL AND expires_at > ?", id, time.Now().UTC()).
+		Where("max_downloads IS NULL OR downloads < max_downloads").
+		Update("downloads", gorm.Expr("downloads + 1"))
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// aggregateRepository implements AggregateRepository
+type aggregateRepository struct {
+	db *gorm.DB
+}
+
+func NewAggregateRepository(db *gorm.DB) AggregateRepository {
+	return &aggregateRepository{db: db}
+}
+
+// Create stores an aggregate with its entries and claims the member pins.
+// It fails without changes if another aggregate claimed any of them first.
+func (r *aggregateRepository) Create(ctx context.Context, aggregate *models.Aggregate, entries []*models.AggregateEntry) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(aggregate).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&entries).Error; err != nil {
+			return err
+		}
+
+		pinIDs := make([]uuid.UUID, len(entries))
+		for i, entry := range entries {
+			pinIDs[i] = entry.PinRequestID
+		}
+		result := tx.Model(&models.PinRequest{}).
+			Where("id IN ? AND aggregate_id IS NULL", pinIDs).
+			Update("aggregate_id", aggregate.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != int64(len(pinIDs)) {
+			return ErrAlreadyAggregated
+		}
+		return nil
+	})
+}
+
+func (r *aggregateRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Aggregate, error) {
+	var aggregate models.Aggregate
+	err := r.db.WithContext(ctx).First(&aggregate, "id = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &aggregate, nil
+}
+
+func (r *aggregateRepository) GetByStatus(ctx context.Context, status string, limit int) ([]*models.Aggregate, error) {
+	var aggregates []*models.Aggregate
+	err := r.db.WithContext(ctx).Where("status = ?", status).Order("created_at").Limit(limit).Find(&aggregates).Error
+	return aggregates, err
+}
+
+func (r *aggregateRepository) GetEntries(ctx context.Context, aggregateID uuid.UUID) ([]*models.AggregateEntry, error) {
+	var entries []*models.AggregateEntry
+	err := r.db.WithContext(ctx).Where("aggregate_id = ?", aggregateID).Order("position").Find(&entries).Error
+	return entries, err
+}
+
+func (r *aggregateRepository) GetEntryByPinRequestID(ctx context.Context, pinRequestID uuid.UUID) (*models.AggregateEntry, error) {
+	var entry models.AggregateEntry
+	err := r.db.WithContext(ctx).First(&entry, "pin_request_id = ?", pinRequestID).Error
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (r *aggregateRepository) Update(ctx context.Context, aggregate *models.Aggregate) error {
+	return r.db.WithContext(ctx).Save(aggregate).Error
+}
+
+// Fail marks an aggregate failed and releases its pins so they can be
+// aggregated again
+func (r *aggregateRepository) Fail(ctx context.Context, id uuid.UUID, reason string) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.PinRequest{}).Where("aggregate_id = ?", id).Update("aggregate_id", nil).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("aggregate_id = ?", id).Delete(&models.AggregateEntry{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Aggregate{}).Where("id = ?", id).Updates(map[string]interface{}{
+			"status": models.AggregateStatusFailed,
+			"error":  reason,
+		}).Error
+	})
+}
+
+// splitRepository implements SplitRepository
+type splitRepository struct {
+	db *gorm.DB
+}
+
+func NewSplitRepository(db *gorm.DB) SplitRepository {
+	return &splitRepository{db: db}
+}
+
+func (r *splitRepository) Create(ctx context.Context, manifest *models.SplitManifest, chunks []*models.SplitChunk, blocks []*models.SplitBlock) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(manifest).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&chunks).Error; err != nil {
+			return err
+		}
+		if len(blocks) > 0 {
+			return tx.Create(&blocks).Error
+		}
+		return nil
+	})
+}
+
+func (r *splitRepository) GetManifestByPinRequestID(ctx context.Context, pinRequestID uuid.UUID) (*models.SplitManifest, error) {
+	var manifest models.SplitManifest
+	err := r.db.WithContext(ctx).First(&manifest, "pin_request_id = ?", pinRequestID).Error
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func (r *splitRepository) GetManifestsByStatus(ctx context.Context, status string, limit int) ([]*models.SplitManifest, error) {
+	var manifests []*models.SplitManifest
+	err := r.db.WithContext(ctx).Where("status = ?", status).Order("updated_at").Limit(limit).Find(&manifests).Error
+	return manifests, err
+}
+
+func (r *splitRepository) GetChunks(ctx context.Context, manifestID uuid.UUID) ([]*models.SplitChunk, error) {
+	var chunks []*models.SplitChunk
+	err := r.db.WithContext(ctx).Where("manifest_id = ?", manifestID).Order("position").Find(&chunks).Error
+	return chunks, err
+}
+
+func (r *splitRepository) GetBlocks(ctx context.Context, manifestID uuid.UUID) ([]*models.SplitBlock, error) {
+	var blocks []*models.SplitBlock
+	err := r.db.WithContext(ctx).Where("manifest_id = ?", manifestID).Find(&blocks).Error
+	return blocks, err
+}
+
+func (r *splitRepository) UpdateManifest(ctx context.Context, manifest *models.SplitManifest) error {
+	return r.db.WithContext(ctx).Save(manifest).Error
+}
+
+// dataCapRepository implements DataCapRepository
+type dataCapRepository struct {
+	db *gorm.DB
+}
+
+func NewDataCapRepository(db *gorm.DB) DataCapRepository {
+	return &dataCapRepository{db: db}
+}
+
+func (r *dataCapRepository) GetByUserID(ctx context.Context, userID uuid.UUID) (*models.DataCapAllocation, error) {
+	var allocation models.DataCapAllocation
+	err := r.db.WithContext(ctx).First(&allocation, "user_id = ?", userID).Error
+	if err != nil {
+		return nil, err
+	}
+	return &allocation, nil
+}
+
+func (r *dataCapRepository) List(ctx context.Context) ([]*models.DataCapAllocation, error) {
+	var allocations []*models.DataCapAllocation
+	err := r.db.WithContext(ctx).Order("created_at").Find(&allocations).Error
+	return allocations, err
+}
+
+// SetAllowance creates or replaces a user's allowance, keeping what they
+// have used so far
+func (r *dataCapRepository) SetAllowance(ctx context.Context, userID uuid.UUID, allowanceBytes int64) (*models.DataCapAllocation, error) {
+	allocation := &models.DataCapAllocation{
+		ID:             uuid.New(),
+		UserID:         userID,
+		AllowanceBytes: allowanceBytes,
+	}
+
+	err := r.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"allowance_bytes", "updated_at"}),
+	}).Create(allocation).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return r.GetByUserID(ctx, userID)
+}
+
+// Reserve atomically takes bytes from a user's remaining allowance. It
+// returns false without changes if the allowance does not cover them.
+func (r *dataCapRepository) Reserve(ctx context.Context, userID uuid.UUID, bytes int64) (bool, error) {
+	result := r.db.WithContext(ctx).Model(&models.DataCapAllocation{}).
+		Where("user_id = ? AND used_bytes + ? <= allowance_bytes", userID, bytes).
+		Update("used_bytes", gorm.Expr("used_bytes + ?", bytes))
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (r *dataCapRepository) Release(ctx context.Context, userID uuid.UUID, bytes int64) error {
+	return r.db.WithContext(ctx).Model(&models.DataCapAllocation{}).
+		Where("user_id = ?", userID).
+		Update("used_bytes", gorm.Expr("GREATEST(used_bytes - ?, 0)", bytes)).Error
+}
+
+// Reconcile recomputes usage from the verified deals that did not fail, so
+// DataCap reserved for deals that never made it on chain is given back
+func (r *dataCapRepository) Reconcile(ctx context.Context) error {
+	return r.db.WithContext(ctx).Exec(`
+		UPDATE datacap_allocations a SET used_bytes = COALESCE((
+			SELECT SUM(d.datacap_bytes)
+			FROM filecoin_deals d
+			JOIN pin_requests p ON p.id = d.pin_request_id
+			WHERE p.user_id = a.user_id AND d.verified AND d.status NOT IN (?, ?)
+		), 0)`, models.DealStatusFailed, models.DealStatusCancelled).Error
+}
+
+// transferRepository implements TransferRepository
+type transferRepository struct {
+	db *gorm.DB
+}
+
+func NewTransferRepository(db *gorm.DB) TransferRepository {
+	return &transferRepository{db: db}
+}
+
+func (r *transferRepository) Create(ctx context.Context, transfer *models.Transfer) error {
+	return r.db.WithContext(ctx).Create(transfer).Error
+}
+
+func (r *transferRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Transfer, error) {
+	var transfer models.Transfer
+	err := r.db.WithContext(ctx).First(&transfer, "id = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &transfer, nil
+}
+
+func (r *transferRepository) GetByPinRequestID(ctx context.Context, pinRequestID uuid.UUID) ([]*models.Transfer, error) {
+	var transfers []*models.Transfer
+	err := r.db.WithContext(ctx).
+		Where("deal_cid IN (?)", r.db.Model(&models.FilecoinDeal{}).Select("deal_cid").Where("pin_request_id = ?", pinRequestID)).
+		Order("created_at").
+		Find(&transfers).Error
+	return transfers, err
+}
+
+// GetStagedByPayloadCID returns a transfer whose CAR for the payload is
+// still staged, so new deals for the same content can reuse it
+func (r *transferRepository) GetStagedByPayloadCID(ctx context.Context, payloadCID string) (*models.Transfer, error) {
+	var transfer models.Transfer
+	err := r.db.WithContext(ctx).
+		Where("payload_cid = ? AND cleaned_at IS NULL", payloadCID).
+		Order("created_at DESC").
+		First(&transfer).Error
+	if err != nil {
+		return nil, err
+	}
+	return &transfer, nil
+}
+
+// GetCleanable returns transfers still holding staged data whose deal has
+// reached one of the given statuses
+func (r *transferRepository) GetCleanable(ctx context.Context, dealStatuses []string, limit int) ([]*models.Transfer, error) {
+	var transfers []*models.Transfer
+	err := r.db.WithContext(ctx).
+		Where("cleaned_at IS NULL AND deal_cid IN (?)", r.db.Model(&models.FilecoinDeal{}).Select("deal_cid").Where("status IN ?", dealStatuses)).
+		Order("created_at").
+		Limit(limit).
+		Find(&transfers).Error
+	return transfers, err
+}
+
+func (r *transferRepository) CountUncleanedByPayloadCID(ctx context.Context, payloadCID string) (int64, error) {
+	var count int64
+	err := r.db.WithContext(ctx).Model(&models.Transfer{}).
+		Where("payload_cid = ? AND cleaned_at IS NULL", payloadCID).
+		Count(&count).Error
+	return count, err
+}
+
+// AddProgress adds downloaded bytes to a transfer and marks it as in
+// progress
+func (r *transferRepository) AddProgress(ctx context.Context, id uuid.UUID, bytes int64) error {
+	return r.db.WithContext(ctx).Model(&models.Transfer{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{
+			"bytes_transferred": gorm.Expr("bytes_transferred + ?", bytes),
+			"status": gorm.Expr("CASE WHEN status = ? THEN ? ELSE status END",
+				models.TransferStatusStaged, models.TransferStatusTransferring),
+		}).Error
+}
+
+func (r *transferRepository) Update(ctx context.Context, transfer *models.Transfer) error {
+	return r.db.WithContext(ctx).Save(transfer).Error
+}
+
+// placementRepository implements PlacementRepository
+type placementRepository struct {
+	db *gorm.DB
+}
+
+func NewPlacementRepository(db *gorm.DB) PlacementRepository {
+	return &placementRepository{db: db}
+}
+
+func (r *placementRepository) GetNodes(ctx context.Context, cid string) ([]string, error) {
+	var nodeIDs []string
+	err := r.db.WithContext(ctx).Model(&models.PinPlacement{}).
+		Where("cid = ?", cid).
+		Order("node_id").
+		Pluck("node_id", &nodeIDs).Error
+	return nodeIDs, err
+}
+
+func (r *placementRepository) GetByCID(ctx context.Context, cid string) ([]*models.PinPlacement, error) {
+	var placements []*models.PinPlacement
+	err := r.db.WithContext(ctx).
+		Where("cid = ?", cid).
+		Order("node_id").
+		Find(&placements).Error
+	return placements, err
+}
+
+func (r *placementRepository) Add(ctx context.Context, cid string, nodeIDs []string) error {
+	if len(nodeIDs) == 0 {
+		return nil
+	}
+
+	placements := make([]*models.PinPlacement, len(nodeIDs))
+	for i, nodeID := range nodeIDs {
+		placements[i] = &models.PinPlacement{ID: uuid.New(), CID: cid, NodeID: nodeID, Status: models.PlacementStatusPinned}
+	}
+	return r.db.WithContext(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&placements).Error
+}
+
+func (r *placementRepository) Remove(ctx context.Context, cid string, nodeIDs []string) error {
+	if len(nodeIDs) == 0 {
+		return nil
+	}
+	return r.db.WithContext(ctx).
+		Where("cid = ? AND node_id IN ?", cid, nodeIDs).
+		Delete(&models.PinPlacement{}).Error
+}
+
+// Replace swaps the placements of a CID for those reported by the node
+// holding them, such as the peer map of an IPFS Cluster pin
+func (r *placementRepository) Replace(ctx context.Context, cid string, placements []*models.PinPlacement) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("cid = ?", cid).Delete(&models.PinPlacement{}).Error; err != nil {
+			return err
+		}
+		if len(placements) == 0 {
+			return nil
+		}
+		return tx.Create(&placements).Error
+	})
+}
+
+// GetNextCIDs returns placed CIDs in order, for walking every placement
+func (r *placementRepository) GetNextCIDs(ctx context.Context, afterCID string, limit int) ([]string, error) {
+	var cids []string
+	err := r.db.WithContext(ctx).Model(&models.PinPlacement{}).
+		Distinct("cid").
+		Where("cid > ?", afterCID).
+		Order("cid").
+		Limit(limit).
+		Pluck("cid", &cids).Error
+	return cids, err
+}
+
+func (r *placementRepository) CountByNode(ctx context.Context) (map[string]int64, error) {
+	var rows []struct {
+		NodeID string
+		Count  int64
+	}
+	err := r.db.WithContext(ctx).Model(&models.PinPlacement{}).
+		Select("node_id, COUNT(*) AS count").
+		Group("node_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		counts[row.NodeID] = row.Count
+	}
+	return counts, nil
+}
+
+// GetByNode returns the placements on a node
+func (r *placementRepository) GetByNode(ctx context.Context, nodeID string) ([]*models.PinPlacement, error) {
+	var placements []*models.PinPlacement
+	err := r.db.WithContext(ctx).
+		Where("node_id = ?", nodeID).
+		Order("cid").
+		Find(&placements).Error
+	return placements, err
+}
+
+// referenceQueries select the CIDs among a batch that something still
+// needs pinned: an active pin request, stored content, an aggregate or
+// split being stored or dealt, or a retrieval. Cold content is only
+// stored on Filecoin, so its pins do not need it on IPFS.
+var referenceQueries = []string{
+	"SELECT cid FROM pin_requests WHERE cid IN @cids AND status IN ('pending', 'pinning', 'pinned') AND NOT EXISTS (SELECT 1 FROM contents c WHERE c.id = pin_requests.content_id AND c.status = 'cold')",
+	"SELECT cid FROM contents WHERE cid IN @cids AND ref_count > 0 AND status <> 'cold'",
+	"SELECT root_cid FROM aggregates WHERE root_cid IN @cids AND status <> 'failed'",
+	"SELECT root_cid FROM split_manifests WHERE root_cid IN @cids",
+	"SELECT root_cid FROM split_chunks WHERE root_cid IN @cids",
+	"SELECT cid FROM retrievals WHERE cid IN @cids AND status <> 'failed'",
+}
+
+// referenceBatchSize bounds the CIDs checked per query
+const referenceBatchSize = 1000
+
+// GetReferenced returns which of the CIDs are still referenced
+func (r *placementRepository) GetReferenced(ctx context.Context, cids []string) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	for start := 0; start < len(cids); start += referenceBatchSize {
+		end := start + referenceBatchSize
+		if end > len(cids) {
+			end = len(cids)
+		}
+		batch := cids[start:end]
+
+		for _, query := range referenceQueries {
+			var found []string
+			err := r.db.WithContext(ctx).
+				Raw(query, sql.Named("cids", batch)).
+				Scan(&found).Error
+			if err != nil {
+				return nil, err
+			}
+			for _, cid := range found {
+				referenced[cid] = true
+			}
+		}
+	}
+	return referenced, nil
+}
+
+// contentRepository implements ContentRepository
+type contentRepository struct {
+	db *gorm.DB
+}
+
+func NewContentRepository(db *gorm.DB) ContentRepository {
+	return &contentRepository{db: db}
+}
+
+func (r *contentRepository) GetByCID(ctx context.Context, cid string) (*models.Content, error) {
+	var content models.Content
+	err := r.db.WithContext(ctx).First(&content, "cid = ?", cid).Error
+	if err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
+
+// Share makes a pin reference content that is already stored with one of
+// the given statuses. It returns nil without changes if it is not.
+func (r *contentRepository) Share(ctx context.Context, pinID uuid.UUID, cid string, statuses []string) (*models.Content, error) {
+	var content *models.Content
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var found models.Content
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("cid = ? AND status IN ?", cid, statuses).
+			First(&found).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := reference(tx, &found, pinID); err != nil {
+			return err
+		}
+		content = &found
+		return nil
+	})
+	return content, err
+}
+
+// Attach makes a pin reference the content it has just pinned, recording
+// the content as pinned. Content that was being unpinned is pinned again.
+func (r *contentRepository) Attach(ctx context.Context, pinID uuid.UUID, cid string, sizeBytes int64) (*models.Content, error) {
+	var content models.Content
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "cid"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"status":      models.ContentStatusPinned,
+				"size_bytes":  gorm.Expr("GREATEST(contents.size_bytes, EXCLUDED.size_bytes)"),
+				"pinned_at":   gorm.Expr("COALESCE(contents.pinned_at, EXCLUDED.pinned_at)"),
+				"unpinned_at": nil,
+				"updated_at":  now,
+			}),
+		}).Create(&models.Content{
+			ID:        uuid.New(),
+			CID:       cid,
+			SizeBytes: sizeBytes,
+			Status:    models.ContentStatusPinned,
+			PinnedAt:  &now,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&content, "cid = ?", cid).Error; err != nil {
+			return err
+		}
+		return reference(tx, &content, pinID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
+
+// reference makes a pin reference content locked by tx. The first pin to
+// reference content that stores it on Filecoin makes its deals. A pin
+// already referencing content is left alone so retries are not counted
+// twice.
+func reference(tx *gorm.DB, content *models.Content, pinID uuid.UUID) error {
+	var pin models.PinRequest
+	if err := tx.Select("id", "tier").First(&pin, "id = ?", pinID).Error; err != nil {
+		return err
+	}
+
+	result := tx.Model(&models.PinRequest{}).
+		Where("id = ? AND content_id IS NULL", pinID).
+		Updates(map[string]interface{}{
+			"content_id":   content.ID,
+			"shares_deals": pin.MakesDeals() && content.DealPinID != nil && *content.DealPinID != pinID,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+
+	if content.DealPinID == nil && pin.MakesDeals() {
+		content.DealPinID = &pinID
+	}
+	content.RefCount++
+	return tx.Model(content).Updates(map[string]interface{}{
+		"ref_count":   gorm.Expr("ref_count + 1"),
+		"deal_pin_id": content.DealPinID,
+	}).Error
+}
+
+// Release drops a pin's reference to its content and returns the content,
+// or nil if the pin held no reference. If the content's deals were made
+// through the pin they are handed to the oldest pin still referencing it.
+// Content left without references is marked unpinning.
+func (r *contentRepository) Release(ctx context.Context, pinID uuid.UUID) (*models.Content, error) {
+	var content *models.Content
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var pin models.PinRequest
+		if err := tx.Select("id", "content_id").First(&pin, "id = ?", pinID).Error; err != nil {
+			return err
+		}
+		if pin.ContentID == nil {
+			return nil
+		}
+
+		// Lock the content before the pin, in the same order as Attach
+		var found models.Content
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&found, "id = ?", *pin.ContentID).Error; err != nil {
+			return err
+		}
+		result := tx.Model(&models.PinRequest{}).
+			Where("id = ? AND content_id = ?", pinID, found.ID).
+			Updates(map[string]interface{}{
+				"content_id":   nil,
+				"shares_deals": false,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+
+		updates := map[string]interface{}{
+			"ref_count": gorm.Expr("GREATEST(ref_count - 1, 0)"),
+		}
+		if found.RefCount--; found.RefCount <= 0 {
+			found.RefCount = 0
+			found.Status = models.ContentStatusUnpinning
+			updates["status"] = found.Status
+		}
+		if found.DealPinID != nil && *found.DealPinID == pinID {
+			next, err := handOverDeals(tx, found.ID, pinID)
+			if err != nil {
+				return err
+			}
+			found.DealPinID = next
+			updates["deal_pin_id"] = next
+		}
+		if err := tx.Model(&found).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		content = &found
+		return nil
+	})
+	return content, err
+}
+
+// handOverDeals moves the running deals of content from a released pin to
+// the oldest pin still referencing it that stores it on Filecoin and
+// returns that pin's ID, or nil if none is left. Aggregate and chunk deals stay, since they store the
+// released pin's own layout of the content.
+func handOverDeals(tx *gorm.DB, contentID, pinID uuid.UUID) (*uuid.UUID, error) {
+	var next models.PinRequest
+	err := tx.Select("id").
+		Where("content_id = ? AND id <> ? AND tier <> ?", contentID, pinID, models.TierHot).
+		Order("created_at").
+		First(&next).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Model(&models.PinRequest{}).Where("id = ?", next.ID).Update("shares_deals", false).Error; err != nil {
+		return nil, err
+	}
+	err = tx.Model(&models.FilecoinDeal{}).
+		Where("pin_request_id = ? AND aggregate_id IS NULL AND chunk_id IS NULL AND status IN ?", pinID,
+			[]string{models.DealStatusPending, models.DealStatusPublished, models.DealStatusActive}).
+		Update("pin_request_id", next.ID).Error
+	if err != nil {
+		return nil, err
+	}
+	return &next.ID, nil
+}
+
+// FinishUnpin marks content unpinned once its IPFS pin is gone. It returns
+// false if the content was referenced again in the meantime.
+func (r *contentRepository) FinishUnpin(ctx context.Context, id uuid.UUID) (bool, error) {
+	result := r.db.WithContext(ctx).Model(&models.Content{}).
+		Where("id = ? AND status = ? AND ref_count = 0", id, models.ContentStatusUnpinning).
+		Updates(map[string]interface{}{
+			"status":      models.ContentStatusUnpinned,
+			"unpinned_at": time.Now(),
+		})
+	return result.RowsAffected == 1, result.Error
+}
+
+// coldOnly selects content that only cold pins reference
+const coldOnly = "NOT EXISTS (SELECT 1 FROM pin_requests p WHERE p.content_id = contents.id AND p.tier <> ?)"
+
+// GetNextCoolable returns pinned content that only cold pins reference and
+// that has an active deal, in ID order
+func (r *contentRepository) GetNextCoolable(ctx context.Context, afterID uuid.UUID, limit int) ([]*models.Content, error) {
+	var contents []*models.Content
+	err := r.db.WithContext(ctx).
+		Where("status = ? AND ref_count > 0 AND id > ?", models.ContentStatusPinned, afterID).
+		Where(coldOnly, models.TierCold).
+		Where("EXISTS (SELECT 1 FROM filecoin_deals d WHERE d.pin_request_id = contents.deal_pin_id AND d.status = ?)", models.DealStatusActive).
+		Order("id").
+		Limit(limit).
+		Find(&contents).Error
+	return contents, err
+}
+
+// Cool marks content that only cold pins reference as cold. It returns
+// false if the content is not pinned or a pin of another tier references
+// it.
+func (r *contentRepository) Cool(ctx context.Context, id uuid.UUID) (bool, error) {
+	result := r.db.WithContext(ctx).Model(&models.Content{}).
+		Where("id = ? AND status = ? AND ref_count > 0", id, models.ContentStatusPinned).
+		Where(coldOnly, models.TierCold).
+		Update("status", models.ContentStatusCold)
+	return result.RowsAffected > 0, result.Error
+}
+
+// GetNextRestored returns cold content placed on IPFS nodes again by a
+// retrieval that finished before restoredBefore, with no retrieval since,
+// in ID order
+func (r *contentRepository) GetNextRestored(ctx context.Context, restoredBefore time.Time, afterID uuid.UUID, limit int) ([]*models.Content, error) {
+	var contents []*models.Content
+	err := r.db.WithContext(ctx).
+		Where("status = ? AND id > ?", models.ContentStatusCold, afterID).
+		Where("EXISTS (SELECT 1 FROM pin_placements pp WHERE pp.cid = contents.cid)").
+		Where("NOT EXISTS (SELECT 1 FROM retrievals rt WHERE rt.cid = contents.cid AND (rt.completed_at IS NULL OR rt.completed_at > ?))", restoredBefore).
+		Order("id").
+		Limit(limit).
+		Find(&contents).Error
+	return contents, err
+}
+
+// discrepancyRepository implements DiscrepancyRepository
+type discrepancyRepository struct {
+	db *gorm.DB
+}
+
+func NewDiscrepancyRepository(db *gorm.DB) DiscrepancyRepository {
+	return &discrepancyRepository{db: db}
+}
+
+// GetOpen returns the unresolved discrepancies of a node
+func (r *discrepancyRepository) GetOpen(ctx context.Context, nodeID string) ([]*models.PinDiscrepancy, error) {
+	var discrepancies []*models.PinDiscrepancy
+	err := r.db.WithContext(ctx).
+		Where("node_id = ? AND resolved_at IS NULL", nodeID).
+		Find(&discrepancies).Error
+	return discrepancies, err
+}
+
+func (r *discrepancyRepository) Save(ctx context.Context, discrepancy *models.PinDiscrepancy) error {
+	return r.db.WithContext(ctx).Save(discrepancy).Error
+}
+
+func (r *discrepancyRepository) Resolve(ctx context.Context, ids []uuid.UUID, action string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return r.db.WithContext(ctx).Model(&models.PinDiscrepancy{}).
+		Where("id IN ? AND resolved_at IS NULL", ids).
+		Updates(map[string]interface{}{
+			"action":      action,
+			"resolved_at": time.Now().UTC(),
+		}).Error
+}
+
+// List returns discrepancies, most recently seen first; open limits them
+// to unresolved ones
+func (r *discrepancyRepository) List(ctx context.Context, open bool, page, limit int) ([]*models.PinDiscrepancy, int64, error) {
+	var discrepancies []*models.PinDiscrepancy
+	var total int64
+
+	query := r.db.WithContext(ctx).Model(&models.PinDiscrepancy{})
+	if open {
+		query = query.Where("resolved_at IS NULL")
+	}
+	query.Count(&total)
+
+	offset := (page - 1) * limit
+	err := query.Offset(offset).Limit(limit).Order("last_seen_at DESC").Find(&discrepancies).Error
+
+	return discrepancies, total, err
+}
+
+// quotaRepository implements QuotaRepository
+type quotaRepository struct {
+	db *gorm.DB
+}
+
+func NewQuotaRepository(db *gorm.DB) QuotaRepository {
+	return &quotaRepository{db: db}
+}
+
+// GetQuota returns an account's quota override, or nil if it has none
+func (r *quotaRepository) GetQuota(ctx context.Context, userID uuid.UUID) (*models.AccountQuota, error) {
+	var quota models.AccountQuota
+	err := r.db.WithContext(ctx).First(&quota, "user_id = ?", userID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &quota, nil
+}
+
+// SetQuota replaces an account's quota override
+func (r *quotaRepository) SetQuota(ctx context.Context, quota *models.AccountQuota) error {
+	return r.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"max_bytes", "max_pins", "requests_per_minute", "max_pending_pins", "note", "updated_at"}),
+	}).Create(quota).Error
+}
+
+// GetUsage returns an account's current usage, which is zero for accounts
+// that never pinned anything
+func (r *quotaRepository) GetUsage(ctx context.Context, userID uuid.UUID) (*models.AccountUsage, error) {
+	usage := models.AccountUsage{UserID: userID}
+	err := r.db.WithContext(ctx).First(&usage, "user_id = ?", userID).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// GetDaily returns an account's daily usage between two dates, preceded by
+// the last day before them with usage so gaps can be filled from it
+func (r *quotaRepository) GetDaily(ctx context.Context, userID uuid.UUID, from, to time.Time) ([]*models.UsageDaily, error) {
+	var days []*models.UsageDaily
+	var before models.UsageDaily
+	err := r.db.WithContext(ctx).
+		Where("user_id = ? AND date < ?", userID, from).
+		Order("date DESC").
+		First(&before).Error
+	if err == nil {
+		days = append(days, &before)
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	var inRange []*models.UsageDaily
+	err = r.db.WithContext(ctx).
+		Where("user_id = ? AND date >= ? AND date <= ?", userID, from, to).
+		Order("date").
+		Find(&inRange).Error
+	return append(days, inRange...), err
+}
+
+// invoiceRepository implements InvoiceRepository
+type invoiceRepository struct {
+	db *gorm.DB
+}
+
+func NewInvoiceRepository(db *gorm.DB) InvoiceRepository {
+	return &invoiceRepository{db: db}
+}
+
+// errInvoiced rolls back invoices generated for a period already invoiced
+var errInvoiced = errors.New("period already invoiced")
+
+// Create stores invoices generated together and their lines. It returns
+// false without storing any of them if one already exists for its user,
+// kind and period.
+func (r *invoiceRepository) Create(ctx context.Context, invoices []*models.Invoice) (bool, error) {
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, invoice := range invoices {
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Omit("Lines").Create(invoice)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return errInvoiced
+			}
+
+			for _, line := range invoice.Lines {
+				line.InvoiceID = invoice.ID
+			}
+			if len(invoice.Lines) > 0 {
+				if err := tx.Create(invoice.Lines).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errInvoiced) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *invoiceRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Invoice, error) {
+	var invoice models.Invoice
+	err := r.db.WithContext(ctx).
+		Preload("Lines", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).
+		First(&invoice, "id = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+// GetByUserID returns a user's invoices and credit notes, newest period
+// first, optionally of one kind
+func (r *invoiceRepository) GetByUserID(ctx context.Context, userID uuid.UUID, kind string, page, limit int) ([]*models.Invoice, int64, error) {
+	var invoices []*models.Invoice
+	var total int64
+
+	query := r.db.WithContext(ctx).Model(&models.Invoice{}).Where("user_id = ?", userID)
+	if kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+	query.Count(&total)
+
+	offset := (page - 1) * limit
+	err := query.Offset(offset).Limit(limit).Order("period_start DESC, kind").Find(&invoices).Error
+	return invoices, total, err
+}
+
+// GetUninvoicedUsers returns users with ledger entries between from and to
+// that have no invoice for the period starting at from, in ID order
+func (r *invoiceRepository) GetUninvoicedUsers(ctx context.Context, from, to time.Time, afterID uuid.UUID, limit int) ([]uuid.UUID, error) {
+	var userIDs []uuid.UUID
+	err := r.db.WithContext(ctx).Model(&models.LedgerEntry{}).
+		Distinct("user_id").
+		Where("created_at >= ? AND created_at < ? AND user_id > ?", from, to, afterID).
+		Where("NOT EXISTS (SELECT 1 FROM invoices i WHERE i.user_id = ledger_entries.user_id AND i.kind = ? AND i.period_start = ?)", models.InvoiceKindInvoice, from).
+		Order("user_id").
+		Limit(limit).
+		Pluck("user_id", &userIDs).Error
+	return userIDs, err
+}
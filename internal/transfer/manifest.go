@@ -0,0 +1,53 @@
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Transfer modes
+const (
+	// ModeGraphsync lets the provider pull the DAG from Lotus
+	ModeGraphsync = "graphsync"
+	// ModeHTTP stages a CAR the provider downloads from our HTTP endpoint
+	ModeHTTP = "http"
+	// ModeOffline stages a CAR to be shipped to the provider physically
+	ModeOffline = "offline"
+)
+
+// Manifest tells a storage provider how to get the data for a manual
+// transfer deal: the piece it must import and, for online transfers, where
+// to download it
+type Manifest struct {
+	Mode       string            `json:"mode"`
+	DealCID    string            `json:"deal_cid"`
+	MinerID    string            `json:"miner_id"`
+	PayloadCID string            `json:"payload_cid"`
+	PieceCID   string            `json:"piece_cid"`
+	PieceSize  int64             `json:"piece_size"`
+	CARSize    int64             `json:"car_size"`
+	CARFile    string            `json:"car_file,omitempty"`
+	URL        string            `json:"url,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+}
+
+// WriteManifest writes a deal's manifest into dir and returns its path
+func WriteManifest(dir string, manifest *Manifest) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create manifest directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, manifest.DealCID+".json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return "", fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	return path, nil
+}
@@ -0,0 +1,61 @@
+package workers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"pinning-service/internal/filecoin"
+	"pinning-service/internal/services"
+	"pinning-service/internal/storage"
+	"pinning-service/pkg/config"
+)
+
+// RunChainWatcher follows the chain until ctx is cancelled, resubscribing
+// with backoff whenever the Lotus head change subscription drops
+func RunChainWatcher(ctx context.Context, db *gorm.DB, redisClient *redis.Client, cfg *config.Config, logger *logrus.Logger) {
+	lotusClient, err := filecoin.NewLotusClient(cfg.Filecoin.LotusAPI, cfg.Filecoin.LotusToken)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to initialize Lotus client")
+	}
+
+	watcher := services.NewChainWatcher(
+		lotusClient,
+		storage.NewFilecoinDealRepository(db),
+		storage.NewChainRepository(db),
+		redisClient,
+		cfg,
+		logger,
+	)
+
+	backoff := time.Second
+	for {
+		logger.Info("Starting chain watcher")
+		start := time.Now()
+		err := watcher.Run(ctx)
+		if ctx.Err() != nil {
+			logger.Info("Chain watcher stopped")
+			return
+		}
+
+		// Reset backoff after a healthy run
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		logger.WithError(err).WithField("retry_in", backoff).Warn("Chain watcher exited, restarting")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
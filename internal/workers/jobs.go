@@ -3,6 +3,8 @@ package workers
 import (
 	"context"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/gocraft/work"
 	"github.com/google/uuid"
@@ -12,8 +14,25 @@ import (
 )
 
 type JobContext struct {
-	DealService *services.DealService
-	Logger      *logrus.Logger
+	DealService        *services.DealService
+	DealMonitor        *services.DealMonitor
+	RenewalService     *services.RenewalService
+	RepairService      *services.RepairService
+	RetrievalService   *services.RetrievalService
+	GatewayService     *services.GatewayService
+	AggregationService *services.AggregationService
+	SplitService       *services.SplitService
+	DataCapService     *services.DataCapService
+	TransferService    *services.TransferService
+	StagingService     *services.StagingService
+	NodePoolService    *services.NodePoolService
+	PinService         *services.PinService
+	ContentService     *services.ContentService
+	ReconcileService   *services.ReconcileService
+	ExpiryService      *services.ExpiryService
+	LifecycleService   *services.LifecycleService
+	InvoiceService     *services.InvoiceService
+	Logger             *logrus.Logger
 }
 
 // ProcessPin processes a pin request job
@@ -31,8 +50,30 @@ func (c *JobContext) ProcessPin(job *work.Job) error {
 		return fmt.Errorf("invalid pin_id format: %w", err)
 	}
 
-	// Process the pin request
+	// Fetch and pin the content first; this can take hours for large DAGs
 	ctx := context.Background()
+	pinned, err := c.PinService.PinContent(ctx, pinID)
+	if err != nil {
+		c.Logger.WithError(err).WithField("pin_id", pinID).Error("Failed to pin content")
+		return err
+	}
+	if !pinned {
+		return nil
+	}
+
+	// Hot pins are not stored on Filecoin, and content stored through
+	// another pin already has its deals
+	needsDeals, err := c.ContentService.NeedsDeals(ctx, pinID)
+	if err != nil {
+		c.Logger.WithError(err).WithField("pin_id", pinID).Error("Failed to check content deals")
+		return err
+	}
+	if !needsDeals {
+		c.Logger.WithField("pin_id", pinID).Info("Pin needs no deals of its own")
+		return nil
+	}
+
+	// Process the pin request
 	if err := c.DealService.ProcessPinRequest(ctx, pinID); err != nil {
 		c.Logger.WithError(err).WithField("pin_id", pinID).Error("Failed to process pin request")
 		return err
@@ -42,12 +83,12 @@ func (c *JobContext) ProcessPin(job *work.Job) error {
 	return nil
 }
 
-// MonitorDeals monitors existing deals for status changes
+// MonitorDeals starts a monitoring sweep that fans out batch jobs
 func (c *JobContext) MonitorDeals(job *work.Job) error {
 	c.Logger.Info("Monitoring deals")
 
 	ctx := context.Background()
-	if err := c.DealService.MonitorActiveDeals(ctx); err != nil {
+	if _, err := c.DealMonitor.StartSweep(ctx); err != nil {
 		c.Logger.WithError(err).Error("Failed to monitor deals")
 		return err
 	}
@@ -55,12 +96,41 @@ func (c *JobContext) MonitorDeals(job *work.Job) error {
 	return nil
 }
 
+// MonitorDealBatch checks one batch of deals from a monitoring sweep
+func (c *JobContext) MonitorDealBatch(job *work.Job) error {
+	sweepID := job.ArgString("sweep_id")
+	statuses := job.ArgString("statuses")
+	afterIDStr := job.ArgString("after_id")
+	untilIDStr := job.ArgString("until_id")
+	if err := job.ArgError(); err != nil {
+		return fmt.Errorf("invalid batch arguments: %w", err)
+	}
+
+	afterID, err := uuid.Parse(afterIDStr)
+	if err != nil {
+		return fmt.Errorf("invalid after_id format: %w", err)
+	}
+
+	untilID, err := uuid.Parse(untilIDStr)
+	if err != nil {
+		return fmt.Errorf("invalid until_id format: %w", err)
+	}
+
+	ctx := context.Background()
+	if err := c.DealMonitor.ProcessBatch(ctx, sweepID, strings.Split(statuses, ","), afterID, untilID); err != nil {
+		c.Logger.WithError(err).WithField("sweep_id", sweepID).Error("Failed to monitor deal batch")
+		return err
+	}
+
+	return nil
+}
+
 // RenewExpiring renews deals that are close to expiration
 func (c *JobContext) RenewExpiring(job *work.Job) error {
 	c.Logger.Info("Checking for expiring deals")
 
 	ctx := context.Background()
-	if err := c.DealService.RenewExpiringDeals(ctx); err != nil {
+	if err := c.RenewalService.RenewExpiringDeals(ctx); err != nil {
 		c.Logger.WithError(err).Error("Failed to renew expiring deals")
 		return err
 	}
@@ -68,6 +138,248 @@ func (c *JobContext) RenewExpiring(job *work.Job) error {
 	return nil
 }
 
+// RepairScan finds pins below their replication policy and enqueues repairs
+func (c *JobContext) RepairScan(job *work.Job) error {
+	c.Logger.Info("Scanning pins for lost replicas")
+
+	ctx := context.Background()
+	if _, err := c.RepairService.ScanPins(ctx); err != nil {
+		c.Logger.WithError(err).Error("Failed to scan pins for repair")
+		return err
+	}
+
+	return nil
+}
+
+// BuildAggregates batches small pins into aggregates and makes their deals
+func (c *JobContext) BuildAggregates(job *work.Job) error {
+	ctx := context.Background()
+	built, err := c.AggregationService.BuildAggregates(ctx)
+	if err != nil {
+		c.Logger.WithError(err).Error("Failed to build aggregates")
+		return err
+	}
+
+	if built > 0 {
+		c.Logger.WithField("aggregates", built).Info("Built deal aggregates")
+	}
+
+	return nil
+}
+
+// ProcessSplits splits oversized pins and replicates their chunks
+func (c *JobContext) ProcessSplits(job *work.Job) error {
+	ctx := context.Background()
+	if err := c.SplitService.ProcessSplits(ctx); err != nil {
+		c.Logger.WithError(err).Error("Failed to process split pins")
+		return err
+	}
+	return nil
+}
+
+// RefreshDataCap re-reads our DataCap and reconciles allocation usage
+func (c *JobContext) RefreshDataCap(job *work.Job) error {
+	ctx := context.Background()
+	if _, err := c.DataCapService.Refresh(ctx); err != nil {
+		c.Logger.WithError(err).Error("Failed to refresh DataCap")
+		return err
+	}
+	return nil
+}
+
+// CleanupTransfers removes staged CARs of sealed or failed deals
+func (c *JobContext) CleanupTransfers(job *work.Job) error {
+	ctx := context.Background()
+	cleaned, err := c.TransferService.CleanupTransfers(ctx)
+	if err != nil {
+		c.Logger.WithError(err).Error("Failed to clean up transfers")
+		return err
+	}
+
+	if cleaned > 0 {
+		c.Logger.WithField("transfers", cleaned).Info("Cleaned up deal transfers")
+	}
+
+	return nil
+}
+
+// RebalanceNodes health checks the IPFS nodes and moves pins to the nodes
+// they are placed on
+func (c *JobContext) RebalanceNodes(job *work.Job) error {
+	ctx := context.Background()
+	moved, err := c.NodePoolService.Rebalance(ctx)
+	if err != nil {
+		c.Logger.WithError(err).Error("Failed to rebalance IPFS nodes")
+		return err
+	}
+
+	if moved > 0 {
+		c.Logger.WithField("cids", moved).Info("Rebalanced pins across IPFS nodes")
+	}
+
+	return nil
+}
+
+// ReconcilePins compares the pins of the IPFS nodes with the database and
+// fixes what differs
+func (c *JobContext) ReconcilePins(job *work.Job) error {
+	ctx := context.Background()
+	if _, err := c.ReconcileService.Reconcile(ctx, false); err != nil {
+		c.Logger.WithError(err).Error("Failed to reconcile IPFS pins")
+		return err
+	}
+	return nil
+}
+
+// ProcessExpiry warns about, expires and releases pins whose storage is
+// ending
+func (c *JobContext) ProcessExpiry(job *work.Job) error {
+	ctx := context.Background()
+	if err := c.ExpiryService.ProcessExpiry(ctx); err != nil {
+		c.Logger.WithError(err).Error("Failed to process pin expiry")
+		return err
+	}
+	return nil
+}
+
+// ProcessLifecycle moves pins between storage tiers
+func (c *JobContext) ProcessLifecycle(job *work.Job) error {
+	ctx := context.Background()
+	if _, err := c.LifecycleService.ProcessLifecycle(ctx); err != nil {
+		c.Logger.WithError(err).Error("Failed to process storage lifecycle")
+		return err
+	}
+	return nil
+}
+
+// GenerateInvoices issues monthly invoices, for the month given as the
+// period argument or else the last month that ended
+func (c *JobContext) GenerateInvoices(job *work.Job) error {
+	ctx := context.Background()
+
+	var err error
+	if period := job.ArgString("period"); period != "" {
+		start, parseErr := time.Parse("2006-01", period)
+		if parseErr != nil {
+			return fmt.Errorf("invalid period: %w", parseErr)
+		}
+		_, err = c.InvoiceService.GeneratePeriod(ctx, start)
+	} else {
+		_, err = c.InvoiceService.GenerateInvoices(ctx)
+	}
+	if err != nil {
+		c.Logger.WithError(err).Error("Failed to generate invoices")
+		return err
+	}
+	return nil
+}
+
+// RetryPins retries pins that stalled, failed or lost their worker
+func (c *JobContext) RetryPins(job *work.Job) error {
+	ctx := context.Background()
+	retried, err := c.PinService.RetryPins(ctx)
+	if err != nil {
+		c.Logger.WithError(err).Error("Failed to retry pins")
+		return err
+	}
+
+	if retried > 0 {
+		c.Logger.WithField("pins", retried).Info("Retried interrupted pins")
+	}
+
+	return nil
+}
+
+// StagingGC removes expired staged blobs and those no pin or deal needs
+func (c *JobContext) StagingGC(job *work.Job) error {
+	ctx := context.Background()
+	removed, err := c.StagingService.CollectGarbage(ctx)
+	if err != nil {
+		c.Logger.WithError(err).Error("Failed to collect staging garbage")
+		return err
+	}
+
+	if removed > 0 {
+		c.Logger.WithField("blobs", removed).Info("Removed staged blobs")
+	}
+
+	return nil
+}
+
+// RepairPin restores the replicas of a single pin
+func (c *JobContext) RepairPin(job *work.Job) error {
+	pinIDStr := job.ArgString("pin_id")
+	if err := job.ArgError(); err != nil {
+		return fmt.Errorf("missing pin_id argument: %w", err)
+	}
+
+	pinID, err := uuid.Parse(pinIDStr)
+	if err != nil {
+		return fmt.Errorf("invalid pin_id format: %w", err)
+	}
+
+	ctx := context.Background()
+	if err := c.RepairService.RepairPin(ctx, pinID); err != nil {
+		c.Logger.WithError(err).WithField("pin_id", pinID).Error("Failed to repair pin")
+		return err
+	}
+
+	return nil
+}
+
+// RepairAggregate restores the replicas of an aggregate of pins
+func (c *JobContext) RepairAggregate(job *work.Job) error {
+	aggregateIDStr := job.ArgString("aggregate_id")
+	if err := job.ArgError(); err != nil {
+		return fmt.Errorf("missing aggregate_id argument: %w", err)
+	}
+
+	aggregateID, err := uuid.Parse(aggregateIDStr)
+	if err != nil {
+		return fmt.Errorf("invalid aggregate_id format: %w", err)
+	}
+
+	ctx := context.Background()
+	if err := c.RepairService.RepairAggregate(ctx, aggregateID); err != nil {
+		c.Logger.WithError(err).WithField("aggregate_id", aggregateID).Error("Failed to repair aggregate")
+		return err
+	}
+
+	return nil
+}
+
+// RetrieveContent restores content from Filecoin into IPFS
+func (c *JobContext) RetrieveContent(job *work.Job) error {
+	retrievalIDStr := job.ArgString("retrieval_id")
+	if err := job.ArgError(); err != nil {
+		return fmt.Errorf("missing retrieval_id argument: %w", err)
+	}
+
+	retrievalID, err := uuid.Parse(retrievalIDStr)
+	if err != nil {
+		return fmt.Errorf("invalid retrieval_id format: %w", err)
+	}
+
+	ctx := context.Background()
+	if err := c.RetrievalService.ProcessRetrieval(ctx, retrievalID); err != nil {
+		c.Logger.WithError(err).WithField("retrieval_id", retrievalID).Error("Failed to retrieve content")
+		return err
+	}
+
+	return nil
+}
+
+// FlushBandwidth persists metered gateway bandwidth
+func (c *JobContext) FlushBandwidth(job *work.Job) error {
+	ctx := context.Background()
+	if err := c.GatewayService.FlushBandwidth(ctx); err != nil {
+		c.Logger.WithError(err).Error("Failed to flush gateway bandwidth")
+		return err
+	}
+
+	return nil
+}
+
 // CleanupFailed cleans up failed pin requests
 func (c *JobContext) CleanupFailed(job *work.Job) error {
 	c.Logger.Info("Cleaning up failed requests")
@@ -12,15 +12,19 @@ import (
 	"pinning-service/internal/filecoin"
 	"pinning-service/internal/ipfs"
 	"pinning-service/internal/services"
+	"pinning-service/internal/staging"
 	"pinning-service/internal/storage"
+	"pinning-service/internal/transfer"
 	"pinning-service/pkg/config"
 )
 
 type WorkerPool struct {
-	pool   *work.WorkerPool
-	ctx    context.Context
-	cancel context.CancelFunc
-	logger *logrus.Logger
+	pool     *work.WorkerPool
+	enqueuer *work.Enqueuer
+	ctx      context.Context
+	cancel   context.CancelFunc
+	config   *config.Config
+	logger   *logrus.Logger
 }
 
 func NewWorkerPool(ctx context.Context, db *gorm.DB, redisClient *redis.Client, cfg *config.Config, logger *logrus.Logger) *WorkerPool {
@@ -36,15 +40,78 @@ func NewWorkerPool(ctx context.Context, db *gorm.DB, redisClient *redis.Client,
 	// Initialize repositories
 	pinRepo := storage.NewPinRequestRepository(db)
 	dealRepo := storage.NewFilecoinDealRepository(db)
+	userRepo := storage.NewUserRepository(db)
+	renewalRepo := storage.NewRenewalRepository(db)
+	ledgerRepo := storage.NewLedgerRepository(db)
+	notificationRepo := storage.NewNotificationRepository(db)
+	retrievalRepo := storage.NewRetrievalRepository(db)
+	bandwidthRepo := storage.NewBandwidthRepository(db)
+	shareRepo := storage.NewShareLinkRepository(db)
+	aggregateRepo := storage.NewAggregateRepository(db)
+	splitRepo := storage.NewSplitRepository(db)
+	dataCapRepo := storage.NewDataCapRepository(db)
+	transferRepo := storage.NewTransferRepository(db)
+	placementRepo := storage.NewPlacementRepository(db)
+	contentRepo := storage.NewContentRepository(db)
+	discrepancyRepo := storage.NewDiscrepancyRepository(db)
+	invoiceRepo := storage.NewInvoiceRepository(db)
+	quotaRepo := storage.NewQuotaRepository(db)
+
+	// Job enqueuer shared by services that fan out work
+	enqueuer := work.NewEnqueuer(cfg.Redis.Namespace, cfg.Redis.Pool())
 
 	// Initialize services
 	pricingService := services.NewPricingService(cfg)
 	dealService := services.NewDealService(ipfsClient, lotusClient, pinRepo, dealRepo, pricingService, redisClient, cfg, logger)
+	dealMonitor := services.NewDealMonitor(lotusClient, dealRepo, redisClient, enqueuer, cfg, logger)
+	notificationService := services.NewNotificationService(notificationRepo, redisClient, logger)
+	nodePoolService, err := services.NewNodePoolService(pinRepo, placementRepo, cfg, logger)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to initialize IPFS node pool")
+	}
+	blobStore, err := staging.NewBlobStore(cfg.Staging)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to initialize staging store")
+	}
+	transferService := services.NewTransferService(ipfsClient, lotusClient, blobStore, pinRepo, dealRepo, transferRepo, cfg, logger)
+	dealMaker := services.NewDealMaker(lotusClient, dealRepo, dataCapRepo, transferService, cfg, logger)
+	renewalService := services.NewRenewalService(lotusClient, dealMaker, pricingService, notificationService, pinRepo, dealRepo, userRepo, renewalRepo, ledgerRepo, aggregateRepo, cfg, logger)
+	repairService := services.NewRepairService(ipfsClient, lotusClient, dealMaker, pinRepo, dealRepo, aggregateRepo, enqueuer, cfg, logger)
+	retrievalService := services.NewRetrievalService(ipfsClient, nodePoolService, lotusClient, pinRepo, dealRepo, retrievalRepo, splitRepo, enqueuer, cfg, logger)
+	gatewayService := services.NewGatewayService(pinRepo, bandwidthRepo, shareRepo, redisClient, cfg, logger)
+	aggregationService := services.NewAggregationService(ipfsClient, nodePoolService, dealMaker, pricingService, pinRepo, dealRepo, aggregateRepo, cfg, logger)
+	dataCapService := services.NewDataCapService(lotusClient, dataCapRepo, userRepo, redisClient, cfg, logger)
+	splitService := services.NewSplitService(ipfsClient, nodePoolService, lotusClient, dealMaker, pinRepo, dealRepo, splitRepo, cfg, logger)
+	stagingService := services.NewStagingService(blobStore, transferRepo, cfg, logger)
+	contentService := services.NewContentService(nodePoolService, pricingService, contentRepo, pinRepo, cfg, logger)
+	quotaService := services.NewQuotaService(pricingService, userRepo, quotaRepo, bandwidthRepo, redisClient, cfg, logger)
+	pinService := services.NewPinService(nodePoolService, contentService, quotaService, pinRepo, enqueuer, cfg, logger)
+	reconcileService := services.NewReconcileService(nodePoolService, placementRepo, discrepancyRepo, enqueuer, cfg, logger)
+	expiryService := services.NewExpiryService(lotusClient, contentService, pricingService, notificationService, pinRepo, ledgerRepo, cfg, logger)
+	lifecycleService := services.NewLifecycleService(contentService, notificationService, pinRepo, contentRepo, cfg, logger)
+	invoiceService := services.NewInvoiceService(notificationService, pinRepo, ledgerRepo, bandwidthRepo, invoiceRepo, enqueuer, cfg, logger)
 
 	// Create job context
 	jobCtx := &JobContext{
-		DealService: dealService,
-		Logger:      logger,
+		DealService:        dealService,
+		DealMonitor:        dealMonitor,
+		RenewalService:     renewalService,
+		RepairService:      repairService,
+		RetrievalService:   retrievalService,
+		GatewayService:     gatewayService,
+		AggregationService: aggregationService,
+		SplitService:       splitService,
+		DataCapService:     dataCapService,
+		TransferService:    transferService,
+		StagingService:     stagingService,
+		NodePoolService:    nodePoolService,
+		PinService:         pinService,
+		ContentService:     contentService,
+		ReconcileService:   reconcileService,
+		ExpiryService:      expiryService,
+		LifecycleService:   lifecycleService,
+		InvoiceService:     invoiceService,
+		Logger:             logger,
 	}
 
 	// Create worker pool
@@ -55,16 +122,110 @@ func NewWorkerPool(ctx context.Context, db *gorm.DB, redisClient *redis.Client,
 	pool.Middleware((*JobContext).ErrorMiddleware)
 
 	// Register job handlers
-	pool.Job("process_pin", (*JobContext).ProcessPin)
+	pool.Job(services.JobProcessPin, (*JobContext).ProcessPin)
+	pool.JobWithOptions(services.JobRetryPins, work.JobOptions{
+		MaxFails:       1,
+		MaxConcurrency: 1,
+	}, (*JobContext).RetryPins)
 	pool.Job("monitor_deals", (*JobContext).MonitorDeals)
-	pool.Job("renew_expiring", (*JobContext).RenewExpiring)
+	pool.JobWithOptions(services.JobMonitorDealBatchPriority, work.JobOptions{
+		Priority:       10,
+		MaxFails:       3,
+		MaxConcurrency: uint(cfg.Monitor.BatchConcurrency),
+	}, (*JobContext).MonitorDealBatch)
+	pool.JobWithOptions(services.JobMonitorDealBatch, work.JobOptions{
+		Priority:       1,
+		MaxFails:       3,
+		MaxConcurrency: uint(cfg.Monitor.BatchConcurrency),
+	}, (*JobContext).MonitorDealBatch)
+	// Renewals charge users, so never run two renewal passes at once
+	pool.JobWithOptions("renew_expiring", work.JobOptions{
+		MaxFails:       1,
+		MaxConcurrency: 1,
+	}, (*JobContext).RenewExpiring)
+	// Expiry charges for automatic extensions, so never run two at once
+	pool.JobWithOptions(services.JobProcessExpiry, work.JobOptions{
+		MaxFails:       1,
+		MaxConcurrency: 1,
+	}, (*JobContext).ProcessExpiry)
+	pool.JobWithOptions(services.JobProcessLifecycle, work.JobOptions{
+		MaxFails:       1,
+		MaxConcurrency: 1,
+	}, (*JobContext).ProcessLifecycle)
+	pool.JobWithOptions(services.JobGenerateInvoices, work.JobOptions{
+		MaxFails:       1,
+		MaxConcurrency: 1,
+	}, (*JobContext).GenerateInvoices)
+	pool.JobWithOptions(services.JobRepairScan, work.JobOptions{
+		MaxFails:       1,
+		MaxConcurrency: 1,
+	}, (*JobContext).RepairScan)
+	pool.JobWithOptions(services.JobRepairPinCritical, work.JobOptions{
+		Priority:       100,
+		MaxFails:       5,
+		MaxConcurrency: uint(cfg.Repair.Concurrency),
+	}, (*JobContext).RepairPin)
+	pool.JobWithOptions(services.JobRepairPinDegraded, work.JobOptions{
+		Priority:       50,
+		MaxFails:       5,
+		MaxConcurrency: uint(cfg.Repair.Concurrency),
+	}, (*JobContext).RepairPin)
+	pool.JobWithOptions(services.JobRepairPin, work.JobOptions{
+		Priority:       5,
+		MaxFails:       5,
+		MaxConcurrency: uint(cfg.Repair.Concurrency),
+	}, (*JobContext).RepairPin)
+	pool.JobWithOptions(services.JobRepairAggregate, work.JobOptions{
+		Priority:       50,
+		MaxFails:       5,
+		MaxConcurrency: uint(cfg.Repair.Concurrency),
+	}, (*JobContext).RepairAggregate)
+	pool.JobWithOptions(services.JobRetrieveContent, work.JobOptions{
+		Priority:       20,
+		MaxFails:       uint(cfg.Retrieval.MaxAttempts),
+		MaxConcurrency: uint(cfg.Retrieval.Concurrency),
+	}, (*JobContext).RetrieveContent)
+	pool.JobWithOptions(services.JobBuildAggregates, work.JobOptions{
+		MaxFails:       1,
+		MaxConcurrency: 1,
+	}, (*JobContext).BuildAggregates)
+	pool.JobWithOptions(services.JobProcessSplits, work.JobOptions{
+		MaxFails:       1,
+		MaxConcurrency: 1,
+	}, (*JobContext).ProcessSplits)
+	pool.JobWithOptions(services.JobRefreshDataCap, work.JobOptions{
+		MaxFails:       1,
+		MaxConcurrency: 1,
+	}, (*JobContext).RefreshDataCap)
+	pool.JobWithOptions(services.JobCleanupTransfers, work.JobOptions{
+		MaxFails:       1,
+		MaxConcurrency: 1,
+	}, (*JobContext).CleanupTransfers)
+	pool.JobWithOptions(services.JobStagingGC, work.JobOptions{
+		MaxFails:       1,
+		MaxConcurrency: 1,
+	}, (*JobContext).StagingGC)
+	pool.JobWithOptions(services.JobRebalanceNodes, work.JobOptions{
+		MaxFails:       1,
+		MaxConcurrency: 1,
+	}, (*JobContext).RebalanceNodes)
+	pool.JobWithOptions(services.JobReconcilePins, work.JobOptions{
+		MaxFails:       1,
+		MaxConcurrency: 1,
+	}, (*JobContext).ReconcilePins)
+	pool.JobWithOptions(services.JobFlushBandwidth, work.JobOptions{
+		MaxFails:       1,
+		MaxConcurrency: 1,
+	}, (*JobContext).FlushBandwidth)
 	pool.Job("cleanup_failed", (*JobContext).CleanupFailed)
 
 	return &WorkerPool{
-		pool:   pool,
-		ctx:    ctx,
-		cancel: cancel,
-		logger: logger,
+		pool:     pool,
+		enqueuer: enqueuer,
+		ctx:      ctx,
+		cancel:   cancel,
+		config:   cfg,
+		logger:   logger,
 	}
 }
 
@@ -83,14 +244,66 @@ func (wp *WorkerPool) Stop() {
 }
 
 func (wp *WorkerPool) schedulePeriodicJobs() {
-	// Monitor deals every 5 minutes
-	dealMonitorTicker := time.NewTicker(5 * time.Minute)
+	// Start a deal monitoring sweep every monitor interval
+	dealMonitorTicker := time.NewTicker(wp.config.Monitor.Interval)
 	defer dealMonitorTicker.Stop()
 
 	// Check for expiring deals every hour
 	renewalTicker := time.NewTicker(1 * time.Hour)
 	defer renewalTicker.Stop()
 
+	// Expire pins whose hot storage has ended and warn ahead of expiry
+	expiryTicker := time.NewTicker(wp.config.Expiry.Interval)
+	defer expiryTicker.Stop()
+
+	// Move pins between storage tiers
+	lifecycleTicker := time.NewTicker(wp.config.Lifecycle.Interval)
+	defer lifecycleTicker.Stop()
+
+	// Issue invoices once a month has ended
+	invoicingTicker := time.NewTicker(wp.config.Invoicing.Interval)
+	defer invoicingTicker.Stop()
+
+	// Look for pins that lost replicas every repair interval
+	repairTicker := time.NewTicker(wp.config.Repair.Interval)
+	defer repairTicker.Stop()
+
+	// Batch small pins into deal-sized aggregates
+	aggregationTicker := time.NewTicker(wp.config.Aggregation.Interval)
+	defer aggregationTicker.Stop()
+
+	// Split oversized pins and keep their chunks replicated
+	splitTicker := time.NewTicker(wp.config.Splitting.Interval)
+	defer splitTicker.Stop()
+
+	// Track our DataCap and reconcile verified deal usage
+	dataCapTicker := time.NewTicker(wp.config.DataCap.RefreshInterval)
+	defer dataCapTicker.Stop()
+
+	// Retry pins that stalled, failed or lost their worker
+	pinRetryTicker := time.NewTicker(wp.config.Pinning.RetryInterval)
+	defer pinRetryTicker.Stop()
+
+	// Remove staged CARs once their deals are sealed
+	transferTicker := time.NewTicker(wp.config.Transfer.CleanupInterval)
+	defer transferTicker.Stop()
+
+	// Remove expired and orphaned staged blobs
+	stagingTicker := time.NewTicker(wp.config.Staging.GCInterval)
+	defer stagingTicker.Stop()
+
+	// Health check IPFS nodes and move pins to where they belong
+	rebalanceTicker := time.NewTicker(wp.config.IPFS.RebalanceInterval)
+	defer rebalanceTicker.Stop()
+
+	// Compare node pins with the database and fix what differs
+	reconcileTicker := time.NewTicker(wp.config.IPFS.ReconcileInterval)
+	defer reconcileTicker.Stop()
+
+	// Persist metered gateway bandwidth
+	bandwidthTicker := time.NewTicker(wp.config.Gateway.MeterFlushInterval)
+	defer bandwidthTicker.Stop()
+
 	// Cleanup failed requests every 6 hours
 	cleanupTicker := time.NewTicker(6 * time.Hour)
 	defer cleanupTicker.Stop()
@@ -100,9 +313,46 @@ func (wp *WorkerPool) schedulePeriodicJobs() {
 		case <-wp.ctx.Done():
 			return
 		case <-dealMonitorTicker.C:
-			wp.enqueueJob("monitor_deals", nil)
+			// Unique so a slow sweep is not started twice
+			wp.enqueueUniqueJob("monitor_deals", nil)
 		case <-renewalTicker.C:
-			wp.enqueueJob("renew_expiring", nil)
+			wp.enqueueUniqueJob("renew_expiring", nil)
+		case <-expiryTicker.C:
+			wp.enqueueUniqueJob(services.JobProcessExpiry, nil)
+		case <-lifecycleTicker.C:
+			wp.enqueueUniqueJob(services.JobProcessLifecycle, nil)
+		case <-invoicingTicker.C:
+			wp.enqueueUniqueJob(services.JobGenerateInvoices, nil)
+		case <-repairTicker.C:
+			wp.enqueueUniqueJob(services.JobRepairScan, nil)
+		case <-aggregationTicker.C:
+			if wp.config.Aggregation.Enabled {
+				wp.enqueueUniqueJob(services.JobBuildAggregates, nil)
+			}
+		case <-splitTicker.C:
+			if wp.config.Splitting.Enabled {
+				wp.enqueueUniqueJob(services.JobProcessSplits, nil)
+			}
+		case <-dataCapTicker.C:
+			if wp.config.DataCap.Enabled {
+				wp.enqueueUniqueJob(services.JobRefreshDataCap, nil)
+			}
+		case <-pinRetryTicker.C:
+			wp.enqueueUniqueJob(services.JobRetryPins, nil)
+		case <-transferTicker.C:
+			if wp.config.Transfer.Mode != transfer.ModeGraphsync {
+				wp.enqueueUniqueJob(services.JobCleanupTransfers, nil)
+			}
+		case <-stagingTicker.C:
+			wp.enqueueUniqueJob(services.JobStagingGC, nil)
+		case <-rebalanceTicker.C:
+			wp.enqueueUniqueJob(services.JobRebalanceNodes, nil)
+		case <-reconcileTicker.C:
+			if wp.config.IPFS.Backend == services.IPFSBackendKubo {
+				wp.enqueueUniqueJob(services.JobReconcilePins, nil)
+			}
+		case <-bandwidthTicker.C:
+			wp.enqueueUniqueJob(services.JobFlushBandwidth, nil)
 		case <-cleanupTicker.C:
 			wp.enqueueJob("cleanup_failed", nil)
 		}
@@ -110,7 +360,14 @@ func (wp *WorkerPool) schedulePeriodicJobs() {
 }
 
 func (wp *WorkerPool) enqueueJob(jobName string, args map[string]interface{}) {
-	_, err := wp.pool.Enqueue(jobName, args)
+	_, err := wp.enqueuer.Enqueue(jobName, args)
+	if err != nil {
+		wp.logger.WithError(err).WithField("job", jobName).Error("Failed to enqueue job")
+	}
+}
+
+func (wp *WorkerPool) enqueueUniqueJob(jobName string, args map[string]interface{}) {
+	_, err := wp.enqueuer.EnqueueUnique(jobName, args)
 	if err != nil {
 		wp.logger.WithError(err).WithField("job", jobName).Error("Failed to enqueue job")
 	}
@@ -0,0 +1,15 @@
+-- Track on-chain deal IDs and monitoring progress on filecoin_deals
+ALTER TABLE filecoin_deals ADD COLUMN deal_id BIGINT DEFAULT 0;
+ALTER TABLE filecoin_deals ADD COLUMN last_checked_at TIMESTAMPTZ;
+
+-- Create indexes
+CREATE INDEX idx_filecoin_deals_deal_id ON filecoin_deals(deal_id);
+CREATE INDEX idx_filecoin_deals_status_id ON filecoin_deals(status, id);
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_filecoin_deals_deal_id;
+DROP INDEX IF EXISTS idx_filecoin_deals_status_id;
+
+-- Drop columns
+ALTER TABLE filecoin_deals DROP COLUMN IF EXISTS last_checked_at;
+ALTER TABLE filecoin_deals DROP COLUMN IF EXISTS deal_id;
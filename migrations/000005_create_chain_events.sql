@@ -0,0 +1,49 @@
+-- Create chain_events table
+CREATE TABLE chain_events (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    filecoin_deal_id UUID NOT NULL REFERENCES filecoin_deals(id) ON DELETE CASCADE,
+    pin_request_id UUID NOT NULL REFERENCES pin_requests(id) ON DELETE CASCADE,
+    deal_id BIGINT NOT NULL,
+    type VARCHAR(20) NOT NULL,
+    tipset_key TEXT NOT NULL,
+    height BIGINT NOT NULL,
+    previous_status VARCHAR(20),
+    previous_deal_id BIGINT DEFAULT 0,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Create chain_checkpoints table
+CREATE TABLE chain_checkpoints (
+    name VARCHAR(64) PRIMARY KEY,
+    tipset_key TEXT NOT NULL,
+    cids TEXT NOT NULL,
+    height BIGINT NOT NULL,
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Create indexes
+CREATE INDEX idx_chain_events_filecoin_deal_id ON chain_events(filecoin_deal_id);
+CREATE INDEX idx_chain_events_pin_request_id ON chain_events(pin_request_id);
+CREATE INDEX idx_chain_events_tipset_key ON chain_events(tipset_key);
+CREATE INDEX idx_chain_events_height ON chain_events(height);
+
+-- Create updated_at trigger
+CREATE TRIGGER update_chain_checkpoints_updated_at BEFORE UPDATE
+    ON chain_checkpoints FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Add constraints
+ALTER TABLE chain_events ADD CONSTRAINT check_chain_event_type
+    CHECK (type IN ('published', 'activated', 'slashed', 'reverted'));
+
+-- Drop trigger
+DROP TRIGGER IF EXISTS update_chain_checkpoints_updated_at ON chain_checkpoints;
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_chain_events_filecoin_deal_id;
+DROP INDEX IF EXISTS idx_chain_events_pin_request_id;
+DROP INDEX IF EXISTS idx_chain_events_tipset_key;
+DROP INDEX IF EXISTS idx_chain_events_height;
+
+-- Drop tables
+DROP TABLE IF EXISTS chain_checkpoints;
+DROP TABLE IF EXISTS chain_events;
@@ -0,0 +1,99 @@
+-- Widen balances so ledger totals reconcile exactly
+ALTER TABLE users ALTER COLUMN balance TYPE DECIMAL(38,18);
+
+-- Add renewal preferences to pin_requests
+ALTER TABLE pin_requests ADD COLUMN auto_renew VARCHAR(20) DEFAULT 'off';
+ALTER TABLE pin_requests ADD COLUMN renew_until TIMESTAMPTZ;
+ALTER TABLE pin_requests ADD COLUMN max_renewal_price_fil DECIMAL(18,8);
+ALTER TABLE pin_requests ADD CONSTRAINT check_auto_renew
+    CHECK (auto_renew IN ('off', 'until', 'indefinite'));
+
+-- Create ledger_entries table
+CREATE TABLE ledger_entries (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    pin_request_id UUID REFERENCES pin_requests(id) ON DELETE SET NULL,
+    filecoin_deal_id UUID REFERENCES filecoin_deals(id) ON DELETE SET NULL,
+    type VARCHAR(20) NOT NULL,
+    category VARCHAR(32) NOT NULL,
+    amount_fil DECIMAL(38,18) NOT NULL,
+    description VARCHAR(255),
+    idempotency_key VARCHAR(255) UNIQUE NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Create deal_renewals table
+CREATE TABLE deal_renewals (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    pin_request_id UUID NOT NULL REFERENCES pin_requests(id) ON DELETE CASCADE,
+    filecoin_deal_id UUID NOT NULL REFERENCES filecoin_deals(id) ON DELETE CASCADE,
+    new_deal_id UUID REFERENCES filecoin_deals(id) ON DELETE SET NULL,
+    idempotency_key VARCHAR(255) UNIQUE NOT NULL,
+    trigger VARCHAR(20) NOT NULL,
+    status VARCHAR(20) DEFAULT 'pending',
+    miner_id VARCHAR(20),
+    price_fil DECIMAL(38,18) DEFAULT 0,
+    attempts INTEGER DEFAULT 0,
+    error TEXT,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Create notifications table
+CREATE TABLE notifications (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type VARCHAR(32) NOT NULL,
+    message TEXT NOT NULL,
+    data TEXT,
+    key VARCHAR(255) UNIQUE NOT NULL,
+    read_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Create indexes
+CREATE INDEX idx_ledger_entries_user_id ON ledger_entries(user_id);
+CREATE INDEX idx_ledger_entries_pin_request_id ON ledger_entries(pin_request_id);
+CREATE INDEX idx_ledger_entries_filecoin_deal_id ON ledger_entries(filecoin_deal_id);
+CREATE INDEX idx_ledger_entries_created_at ON ledger_entries(created_at);
+CREATE INDEX idx_deal_renewals_pin_request_id ON deal_renewals(pin_request_id);
+CREATE INDEX idx_deal_renewals_filecoin_deal_id ON deal_renewals(filecoin_deal_id);
+CREATE INDEX idx_notifications_user_id ON notifications(user_id);
+CREATE INDEX idx_notifications_created_at ON notifications(created_at);
+
+-- Create updated_at trigger
+CREATE TRIGGER update_deal_renewals_updated_at BEFORE UPDATE
+    ON deal_renewals FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Add constraints
+ALTER TABLE ledger_entries ADD CONSTRAINT check_ledger_type
+    CHECK (type IN ('charge', 'credit', 'refund'));
+ALTER TABLE ledger_entries ADD CONSTRAINT check_ledger_amount
+    CHECK (amount_fil >= 0);
+ALTER TABLE deal_renewals ADD CONSTRAINT check_renewal_status
+    CHECK (status IN ('pending', 'in_progress', 'completed', 'skipped', 'failed'));
+
+-- Drop trigger
+DROP TRIGGER IF EXISTS update_deal_renewals_updated_at ON deal_renewals;
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_ledger_entries_user_id;
+DROP INDEX IF EXISTS idx_ledger_entries_pin_request_id;
+DROP INDEX IF EXISTS idx_ledger_entries_filecoin_deal_id;
+DROP INDEX IF EXISTS idx_ledger_entries_created_at;
+DROP INDEX IF EXISTS idx_deal_renewals_pin_request_id;
+DROP INDEX IF EXISTS idx_deal_renewals_filecoin_deal_id;
+DROP INDEX IF EXISTS idx_notifications_user_id;
+DROP INDEX IF EXISTS idx_notifications_created_at;
+
+-- Drop tables
+DROP TABLE IF EXISTS notifications;
+DROP TABLE IF EXISTS deal_renewals;
+DROP TABLE IF EXISTS ledger_entries;
+
+-- Drop columns
+ALTER TABLE pin_requests DROP CONSTRAINT IF EXISTS check_auto_renew;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS max_renewal_price_fil;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS renew_until;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS auto_renew;
+ALTER TABLE users ALTER COLUMN balance TYPE DECIMAL(18,8);
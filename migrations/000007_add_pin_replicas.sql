@@ -0,0 +1,13 @@
+-- Add per-pin replication policy; 0 uses the service default
+ALTER TABLE pin_requests ADD COLUMN replicas INTEGER DEFAULT 0;
+ALTER TABLE pin_requests ADD CONSTRAINT check_replicas CHECK (replicas >= 0);
+
+-- Speed up per-pin replica lookups during repair scans
+CREATE INDEX idx_filecoin_deals_pin_request_status ON filecoin_deals(pin_request_id, status);
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_filecoin_deals_pin_request_status;
+
+-- Drop columns
+ALTER TABLE pin_requests DROP CONSTRAINT IF EXISTS check_replicas;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS replicas;
@@ -0,0 +1,48 @@
+-- Create retrievals table
+CREATE TABLE retrievals (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    pin_request_id UUID NOT NULL REFERENCES pin_requests(id) ON DELETE CASCADE,
+    filecoin_deal_id UUID REFERENCES filecoin_deals(id) ON DELETE SET NULL,
+    cid VARCHAR(64) NOT NULL,
+    miner_id VARCHAR(20),
+    method VARCHAR(20),
+    status VARCHAR(20) DEFAULT 'queued',
+    bytes_received BIGINT DEFAULT 0,
+    cost_fil DECIMAL(18,8) DEFAULT 0,
+    attempts INTEGER DEFAULT 0,
+    error TEXT,
+    started_at TIMESTAMPTZ,
+    completed_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Create indexes
+CREATE INDEX idx_retrievals_user_id ON retrievals(user_id);
+CREATE INDEX idx_retrievals_pin_request_id ON retrievals(pin_request_id);
+CREATE INDEX idx_retrievals_filecoin_deal_id ON retrievals(filecoin_deal_id);
+CREATE INDEX idx_retrievals_cid_status ON retrievals(cid, status);
+CREATE UNIQUE INDEX idx_retrievals_active_pin ON retrievals(pin_request_id)
+    WHERE status <> 'completed' AND status <> 'failed';
+
+-- Create updated_at trigger
+CREATE TRIGGER update_retrievals_updated_at BEFORE UPDATE
+    ON retrievals FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Add constraints
+ALTER TABLE retrievals ADD CONSTRAINT check_retrieval_status
+    CHECK (status IN ('queued', 'in_progress', 'completed', 'failed'));
+
+-- Drop trigger
+DROP TRIGGER IF EXISTS update_retrievals_updated_at ON retrievals;
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_retrievals_user_id;
+DROP INDEX IF EXISTS idx_retrievals_pin_request_id;
+DROP INDEX IF EXISTS idx_retrievals_filecoin_deal_id;
+DROP INDEX IF EXISTS idx_retrievals_cid_status;
+DROP INDEX IF EXISTS idx_retrievals_active_pin;
+
+-- Drop tables
+DROP TABLE IF EXISTS retrievals;
@@ -0,0 +1,25 @@
+-- Create bandwidth_usage table
+CREATE TABLE bandwidth_usage (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    date DATE NOT NULL,
+    bytes BIGINT DEFAULT 0,
+    requests BIGINT DEFAULT 0,
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (user_id, date)
+);
+
+-- Create indexes
+CREATE INDEX idx_bandwidth_usage_date ON bandwidth_usage(date);
+
+-- Create updated_at trigger
+CREATE TRIGGER update_bandwidth_usage_updated_at BEFORE UPDATE
+    ON bandwidth_usage FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Drop trigger
+DROP TRIGGER IF EXISTS update_bandwidth_usage_updated_at ON bandwidth_usage;
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_bandwidth_usage_date;
+
+-- Drop tables
+DROP TABLE IF EXISTS bandwidth_usage;
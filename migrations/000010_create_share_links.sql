@@ -0,0 +1,38 @@
+-- Create share_links table
+CREATE TABLE share_links (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    pin_request_id UUID NOT NULL REFERENCES pin_requests(id) ON DELETE CASCADE,
+    cid VARCHAR(64) NOT NULL,
+    path TEXT,
+    max_downloads INTEGER,
+    downloads INTEGER DEFAULT 0,
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Create indexes
+CREATE INDEX idx_share_links_user_id ON share_links(user_id);
+CREATE INDEX idx_share_links_pin_request_id ON share_links(pin_request_id);
+CREATE INDEX idx_share_links_cid ON share_links(cid);
+
+-- Create updated_at trigger
+CREATE TRIGGER update_share_links_updated_at BEFORE UPDATE
+    ON share_links FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Add constraints
+ALTER TABLE share_links ADD CONSTRAINT check_share_link_max_downloads
+    CHECK (max_downloads IS NULL OR max_downloads > 0);
+
+-- Drop trigger
+DROP TRIGGER IF EXISTS update_share_links_updated_at ON share_links;
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_share_links_user_id;
+DROP INDEX IF EXISTS idx_share_links_pin_request_id;
+DROP INDEX IF EXISTS idx_share_links_cid;
+
+-- Drop tables
+DROP TABLE IF EXISTS share_links;
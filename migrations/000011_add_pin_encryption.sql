@@ -0,0 +1,20 @@
+-- Add encryption at rest metadata to pin requests
+ALTER TABLE pin_requests ADD COLUMN encrypted BOOLEAN DEFAULT FALSE;
+ALTER TABLE pin_requests ADD COLUMN encryption_algorithm VARCHAR(40);
+ALTER TABLE pin_requests ADD COLUMN key_provider VARCHAR(20);
+ALTER TABLE pin_requests ADD COLUMN key_id VARCHAR(100);
+ALTER TABLE pin_requests ADD COLUMN wrapped_key BYTEA;
+ALTER TABLE pin_requests ADD COLUMN plaintext_size BIGINT DEFAULT 0;
+ALTER TABLE pin_requests ADD COLUMN content_type VARCHAR(255);
+ALTER TABLE pin_requests ADD CONSTRAINT check_encryption_key
+    CHECK (NOT encrypted OR (wrapped_key IS NOT NULL AND key_provider IS NOT NULL));
+
+-- Drop columns
+ALTER TABLE pin_requests DROP CONSTRAINT IF EXISTS check_encryption_key;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS content_type;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS plaintext_size;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS wrapped_key;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS key_id;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS key_provider;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS encryption_algorithm;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS encrypted;
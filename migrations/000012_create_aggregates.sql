@@ -0,0 +1,64 @@
+-- Create aggregates table
+CREATE TABLE aggregates (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    root_cid VARCHAR(64),
+    status VARCHAR(20) DEFAULT 'building',
+    size_bytes BIGINT DEFAULT 0,
+    piece_size BIGINT DEFAULT 0,
+    entry_count INTEGER DEFAULT 0,
+    duration_days INTEGER NOT NULL,
+    replicas INTEGER DEFAULT 0,
+    error TEXT,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Create aggregate_entries table
+CREATE TABLE aggregate_entries (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    aggregate_id UUID NOT NULL REFERENCES aggregates(id) ON DELETE CASCADE,
+    pin_request_id UUID NOT NULL REFERENCES pin_requests(id) ON DELETE CASCADE,
+    cid VARCHAR(64) NOT NULL,
+    path VARCHAR(64) NOT NULL,
+    position INTEGER NOT NULL,
+    "offset" BIGINT NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Link pins and deals to their aggregate
+ALTER TABLE pin_requests ADD COLUMN aggregate_id UUID REFERENCES aggregates(id) ON DELETE SET NULL;
+ALTER TABLE filecoin_deals ADD COLUMN aggregate_id UUID REFERENCES aggregates(id) ON DELETE SET NULL;
+
+-- Create indexes
+CREATE INDEX idx_aggregates_root_cid ON aggregates(root_cid);
+CREATE INDEX idx_aggregate_entries_aggregate_id ON aggregate_entries(aggregate_id);
+CREATE UNIQUE INDEX idx_aggregate_entries_pin_request_id ON aggregate_entries(pin_request_id);
+CREATE INDEX idx_pin_requests_aggregate_id ON pin_requests(aggregate_id);
+CREATE INDEX idx_filecoin_deals_aggregate_id ON filecoin_deals(aggregate_id);
+
+-- Create updated_at trigger
+CREATE TRIGGER update_aggregates_updated_at BEFORE UPDATE
+    ON aggregates FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Add constraints
+ALTER TABLE aggregates ADD CONSTRAINT check_aggregate_status
+    CHECK (status IN ('building', 'ready', 'dealt', 'failed'));
+
+-- Drop trigger
+DROP TRIGGER IF EXISTS update_aggregates_updated_at ON aggregates;
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_aggregates_root_cid;
+DROP INDEX IF EXISTS idx_aggregate_entries_aggregate_id;
+DROP INDEX IF EXISTS idx_aggregate_entries_pin_request_id;
+DROP INDEX IF EXISTS idx_pin_requests_aggregate_id;
+DROP INDEX IF EXISTS idx_filecoin_deals_aggregate_id;
+
+-- Drop columns
+ALTER TABLE filecoin_deals DROP COLUMN IF EXISTS aggregate_id;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS aggregate_id;
+
+-- Drop tables
+DROP TABLE IF EXISTS aggregate_entries;
+DROP TABLE IF EXISTS aggregates;
@@ -0,0 +1,65 @@
+-- Create split_manifests table
+CREATE TABLE split_manifests (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    pin_request_id UUID NOT NULL REFERENCES pin_requests(id) ON DELETE CASCADE,
+    root_cid VARCHAR(64) NOT NULL,
+    status VARCHAR(20) DEFAULT 'storing',
+    size_bytes BIGINT DEFAULT 0,
+    chunk_count INTEGER DEFAULT 0,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Create split_chunks table
+CREATE TABLE split_chunks (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    manifest_id UUID NOT NULL REFERENCES split_manifests(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    root_cid VARCHAR(64) NOT NULL,
+    sub_roots TEXT NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    piece_size BIGINT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Create split_blocks table
+CREATE TABLE split_blocks (
+    manifest_id UUID NOT NULL REFERENCES split_manifests(id) ON DELETE CASCADE,
+    cid VARCHAR(64) NOT NULL,
+    data BYTEA NOT NULL,
+    PRIMARY KEY (manifest_id, cid)
+);
+
+-- Link chunk deals to their chunk
+ALTER TABLE filecoin_deals ADD COLUMN chunk_id UUID REFERENCES split_chunks(id) ON DELETE SET NULL;
+
+-- Create indexes
+CREATE UNIQUE INDEX idx_split_manifests_pin_request_id ON split_manifests(pin_request_id);
+CREATE INDEX idx_split_manifests_status ON split_manifests(status);
+CREATE INDEX idx_split_chunks_manifest_id ON split_chunks(manifest_id);
+CREATE INDEX idx_filecoin_deals_chunk_id ON filecoin_deals(chunk_id);
+
+-- Create updated_at trigger
+CREATE TRIGGER update_split_manifests_updated_at BEFORE UPDATE
+    ON split_manifests FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Add constraints
+ALTER TABLE split_manifests ADD CONSTRAINT check_split_status
+    CHECK (status IN ('storing', 'active'));
+
+-- Drop trigger
+DROP TRIGGER IF EXISTS update_split_manifests_updated_at ON split_manifests;
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_split_manifests_pin_request_id;
+DROP INDEX IF EXISTS idx_split_manifests_status;
+DROP INDEX IF EXISTS idx_split_chunks_manifest_id;
+DROP INDEX IF EXISTS idx_filecoin_deals_chunk_id;
+
+-- Drop columns
+ALTER TABLE filecoin_deals DROP COLUMN IF EXISTS chunk_id;
+
+-- Drop tables
+DROP TABLE IF EXISTS split_blocks;
+DROP TABLE IF EXISTS split_chunks;
+DROP TABLE IF EXISTS split_manifests;
@@ -0,0 +1,43 @@
+-- Create datacap_allocations table
+CREATE TABLE datacap_allocations (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    allowance_bytes BIGINT NOT NULL DEFAULT 0,
+    used_bytes BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Admins manage DataCap allocations
+ALTER TABLE users ADD COLUMN is_admin BOOLEAN DEFAULT FALSE;
+
+-- Verified deal preferences and usage
+ALTER TABLE pin_requests ADD COLUMN verified BOOLEAN DEFAULT FALSE;
+ALTER TABLE filecoin_deals ADD COLUMN verified BOOLEAN DEFAULT FALSE;
+ALTER TABLE filecoin_deals ADD COLUMN datacap_bytes BIGINT DEFAULT 0;
+
+-- Create indexes
+CREATE UNIQUE INDEX idx_datacap_allocations_user_id ON datacap_allocations(user_id);
+
+-- Create updated_at trigger
+CREATE TRIGGER update_datacap_allocations_updated_at BEFORE UPDATE
+    ON datacap_allocations FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Add constraints
+ALTER TABLE datacap_allocations ADD CONSTRAINT check_datacap_allowance
+    CHECK (allowance_bytes >= 0 AND used_bytes >= 0);
+
+-- Drop trigger
+DROP TRIGGER IF EXISTS update_datacap_allocations_updated_at ON datacap_allocations;
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_datacap_allocations_user_id;
+
+-- Drop columns
+ALTER TABLE filecoin_deals DROP COLUMN IF EXISTS datacap_bytes;
+ALTER TABLE filecoin_deals DROP COLUMN IF EXISTS verified;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS verified;
+ALTER TABLE users DROP COLUMN IF EXISTS is_admin;
+
+-- Drop tables
+DROP TABLE IF EXISTS datacap_allocations;
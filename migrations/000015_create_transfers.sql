@@ -0,0 +1,46 @@
+-- Create transfers table
+CREATE TABLE transfers (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    deal_cid VARCHAR(64) NOT NULL,
+    miner_id VARCHAR(20) NOT NULL,
+    mode VARCHAR(20) NOT NULL,
+    status VARCHAR(20) DEFAULT 'staged',
+    payload_cid VARCHAR(64) NOT NULL,
+    piece_cid VARCHAR(128) NOT NULL,
+    piece_size BIGINT NOT NULL,
+    car_size BIGINT NOT NULL,
+    bytes_transferred BIGINT DEFAULT 0,
+    token VARCHAR(64),
+    manifest_path TEXT,
+    error TEXT,
+    completed_at TIMESTAMPTZ,
+    cleaned_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Create indexes
+CREATE UNIQUE INDEX idx_transfers_deal_cid ON transfers(deal_cid);
+CREATE INDEX idx_transfers_payload_cid ON transfers(payload_cid);
+CREATE INDEX idx_transfers_uncleaned ON transfers(created_at) WHERE cleaned_at IS NULL;
+
+-- Create updated_at trigger
+CREATE TRIGGER update_transfers_updated_at BEFORE UPDATE
+    ON transfers FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Add constraints
+ALTER TABLE transfers ADD CONSTRAINT check_transfer_mode
+    CHECK (mode IN ('http', 'offline'));
+ALTER TABLE transfers ADD CONSTRAINT check_transfer_status
+    CHECK (status IN ('staged', 'transferring', 'completed', 'failed'));
+
+-- Drop trigger
+DROP TRIGGER IF EXISTS update_transfers_updated_at ON transfers;
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_transfers_deal_cid;
+DROP INDEX IF EXISTS idx_transfers_payload_cid;
+DROP INDEX IF EXISTS idx_transfers_uncleaned;
+
+-- Drop tables
+DROP TABLE IF EXISTS transfers;
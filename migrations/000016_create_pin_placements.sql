@@ -0,0 +1,18 @@
+-- Create pin_placements table
+CREATE TABLE pin_placements (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    cid VARCHAR(64) NOT NULL,
+    node_id VARCHAR(64) NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Create indexes
+CREATE UNIQUE INDEX idx_pin_placements_cid_node ON pin_placements(cid, node_id);
+CREATE INDEX idx_pin_placements_node_id ON pin_placements(node_id);
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_pin_placements_cid_node;
+DROP INDEX IF EXISTS idx_pin_placements_node_id;
+
+-- Drop tables
+DROP TABLE IF EXISTS pin_placements;
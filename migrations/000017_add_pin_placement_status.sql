@@ -0,0 +1,21 @@
+-- Track per node pin status, reported by IPFS Cluster peers
+ALTER TABLE pin_placements ADD COLUMN status VARCHAR(20) DEFAULT 'pinned';
+ALTER TABLE pin_placements ADD COLUMN error TEXT;
+ALTER TABLE pin_placements ADD COLUMN updated_at TIMESTAMPTZ DEFAULT NOW();
+
+-- Create updated_at trigger
+CREATE TRIGGER update_pin_placements_updated_at BEFORE UPDATE
+    ON pin_placements FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Add constraints
+ALTER TABLE pin_placements ADD CONSTRAINT check_placement_status
+    CHECK (status IN ('pinned', 'pinning', 'error'));
+
+-- Drop trigger
+DROP TRIGGER IF EXISTS update_pin_placements_updated_at ON pin_placements;
+
+-- Drop columns
+ALTER TABLE pin_placements DROP CONSTRAINT IF EXISTS check_placement_status;
+ALTER TABLE pin_placements DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE pin_placements DROP COLUMN IF EXISTS error;
+ALTER TABLE pin_placements DROP COLUMN IF EXISTS status;
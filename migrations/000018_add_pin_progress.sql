@@ -0,0 +1,32 @@
+-- Track progress of fetching pinned content into IPFS
+ALTER TABLE pin_requests ADD COLUMN pin_attempts INTEGER DEFAULT 0;
+ALTER TABLE pin_requests ADD COLUMN blocks_fetched BIGINT DEFAULT 0;
+ALTER TABLE pin_requests ADD COLUMN bytes_fetched BIGINT DEFAULT 0;
+ALTER TABLE pin_requests ADD COLUMN pin_error TEXT;
+ALTER TABLE pin_requests ADD COLUMN pin_started_at TIMESTAMPTZ;
+ALTER TABLE pin_requests ADD COLUMN pin_progress_at TIMESTAMPTZ;
+ALTER TABLE pin_requests ADD COLUMN pin_heartbeat_at TIMESTAMPTZ;
+
+-- Create indexes
+CREATE INDEX idx_pin_requests_pin_heartbeat_at ON pin_requests(pin_heartbeat_at);
+
+-- Add constraints
+ALTER TABLE pin_requests DROP CONSTRAINT IF EXISTS check_status;
+ALTER TABLE pin_requests ADD CONSTRAINT check_status
+    CHECK (status IN ('pending', 'pinning', 'pinned', 'failed', 'cancelled'));
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_pin_requests_pin_heartbeat_at;
+
+-- Drop columns
+UPDATE pin_requests SET status = 'pending' WHERE status = 'pinning';
+ALTER TABLE pin_requests DROP CONSTRAINT IF EXISTS check_status;
+ALTER TABLE pin_requests ADD CONSTRAINT check_status
+    CHECK (status IN ('pending', 'pinned', 'failed', 'cancelled'));
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS pin_heartbeat_at;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS pin_progress_at;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS pin_started_at;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS pin_error;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS bytes_fetched;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS blocks_fetched;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS pin_attempts;
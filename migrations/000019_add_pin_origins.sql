@@ -0,0 +1,5 @@
+-- Add the peers users say hold their content, dialled before pinning
+ALTER TABLE pin_requests ADD COLUMN origins TEXT;
+
+-- Drop columns
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS origins;
@@ -0,0 +1,32 @@
+-- Widen CID columns; CIDv1 with longer hashes or other codecs does not fit
+-- in 64 characters
+ALTER TABLE pin_requests ALTER COLUMN cid TYPE VARCHAR(255);
+ALTER TABLE retrievals ALTER COLUMN cid TYPE VARCHAR(255);
+ALTER TABLE share_links ALTER COLUMN cid TYPE VARCHAR(255);
+ALTER TABLE aggregates ALTER COLUMN root_cid TYPE VARCHAR(255);
+ALTER TABLE aggregate_entries ALTER COLUMN cid TYPE VARCHAR(255);
+ALTER TABLE split_manifests ALTER COLUMN root_cid TYPE VARCHAR(255);
+ALTER TABLE split_chunks ALTER COLUMN root_cid TYPE VARCHAR(255);
+ALTER TABLE split_blocks ALTER COLUMN cid TYPE VARCHAR(255);
+ALTER TABLE pin_placements ALTER COLUMN cid TYPE VARCHAR(255);
+ALTER TABLE transfers ALTER COLUMN payload_cid TYPE VARCHAR(255);
+
+-- Keep the CID or path as the user gave it; cid holds the normalized form
+ALTER TABLE pin_requests ADD COLUMN original_cid TEXT;
+ALTER TABLE pin_requests ADD COLUMN path TEXT;
+
+-- Drop columns
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS path;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS original_cid;
+
+-- Narrow columns; fails if longer CIDs have been stored since
+ALTER TABLE transfers ALTER COLUMN payload_cid TYPE VARCHAR(64);
+ALTER TABLE pin_placements ALTER COLUMN cid TYPE VARCHAR(64);
+ALTER TABLE split_blocks ALTER COLUMN cid TYPE VARCHAR(64);
+ALTER TABLE split_chunks ALTER COLUMN root_cid TYPE VARCHAR(64);
+ALTER TABLE split_manifests ALTER COLUMN root_cid TYPE VARCHAR(64);
+ALTER TABLE aggregate_entries ALTER COLUMN cid TYPE VARCHAR(64);
+ALTER TABLE aggregates ALTER COLUMN root_cid TYPE VARCHAR(64);
+ALTER TABLE share_links ALTER COLUMN cid TYPE VARCHAR(64);
+ALTER TABLE retrievals ALTER COLUMN cid TYPE VARCHAR(64);
+ALTER TABLE pin_requests ALTER COLUMN cid TYPE VARCHAR(64);
@@ -0,0 +1,64 @@
+-- Create contents table; pin requests of the same CID share one IPFS pin
+-- and one set of deals
+CREATE TABLE contents (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    cid VARCHAR(255) NOT NULL,
+    size_bytes BIGINT DEFAULT 0,
+    ref_count INTEGER DEFAULT 0,
+    status VARCHAR(20) DEFAULT 'pinned',
+    deal_pin_id UUID REFERENCES pin_requests(id) ON DELETE SET NULL,
+    pinned_at TIMESTAMPTZ,
+    unpinned_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+ALTER TABLE pin_requests ADD COLUMN content_id UUID REFERENCES contents(id) ON DELETE SET NULL;
+ALTER TABLE pin_requests ADD COLUMN shares_deals BOOLEAN DEFAULT FALSE;
+
+-- Create indexes
+CREATE UNIQUE INDEX idx_contents_cid ON contents(cid);
+CREATE INDEX idx_contents_deal_pin_id ON contents(deal_pin_id);
+CREATE INDEX idx_pin_requests_content_id ON pin_requests(content_id);
+
+-- Add constraints
+ALTER TABLE contents ADD CONSTRAINT check_content_status
+    CHECK (status IN ('pinned', 'unpinning', 'unpinned'));
+ALTER TABLE contents ADD CONSTRAINT check_content_ref_count
+    CHECK (ref_count >= 0);
+
+-- Pinned requests reference their content. The oldest one with deals keeps
+-- making them; the others already have deals of their own, which run out
+-- without being renewed.
+INSERT INTO contents (cid, size_bytes, ref_count, status, pinned_at)
+SELECT cid, MAX(size_bytes), COUNT(*), 'pinned', MIN(updated_at)
+FROM pin_requests
+WHERE status = 'pinned'
+GROUP BY cid;
+
+UPDATE pin_requests SET content_id = contents.id
+FROM contents
+WHERE pin_requests.cid = contents.cid AND pin_requests.status = 'pinned';
+
+UPDATE contents SET deal_pin_id = (
+    SELECT p.id FROM pin_requests p
+    WHERE p.content_id = contents.id
+    ORDER BY EXISTS (SELECT 1 FROM filecoin_deals d WHERE d.pin_request_id = p.id) DESC, p.created_at
+    LIMIT 1
+);
+
+UPDATE pin_requests SET shares_deals = TRUE
+FROM contents
+WHERE pin_requests.content_id = contents.id AND pin_requests.id <> contents.deal_pin_id;
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_pin_requests_content_id;
+DROP INDEX IF EXISTS idx_contents_deal_pin_id;
+DROP INDEX IF EXISTS idx_contents_cid;
+
+-- Drop columns
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS shares_deals;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS content_id;
+
+-- Drop tables
+DROP TABLE IF EXISTS contents;
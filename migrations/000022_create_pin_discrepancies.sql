@@ -0,0 +1,27 @@
+-- Create pin_discrepancies table
+CREATE TABLE pin_discrepancies (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    node_id VARCHAR(64) NOT NULL,
+    cid VARCHAR(255) NOT NULL,
+    kind VARCHAR(20) NOT NULL,
+    action VARCHAR(20),
+    error TEXT,
+    first_seen_at TIMESTAMPTZ NOT NULL,
+    last_seen_at TIMESTAMPTZ NOT NULL,
+    resolved_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Create indexes
+CREATE INDEX idx_pin_discrepancies_node_id ON pin_discrepancies(node_id);
+CREATE INDEX idx_pin_discrepancies_resolved_at ON pin_discrepancies(resolved_at);
+CREATE UNIQUE INDEX idx_pin_discrepancies_open ON pin_discrepancies(node_id, cid, kind) WHERE resolved_at IS NULL;
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_pin_discrepancies_open;
+DROP INDEX IF EXISTS idx_pin_discrepancies_resolved_at;
+DROP INDEX IF EXISTS idx_pin_discrepancies_node_id;
+
+-- Drop tables
+DROP TABLE IF EXISTS pin_discrepancies;
@@ -0,0 +1,26 @@
+-- Add pin expiry and legal hold columns
+ALTER TABLE pin_requests ADD COLUMN expires_at TIMESTAMPTZ;
+ALTER TABLE pin_requests ADD COLUMN expired_at TIMESTAMPTZ;
+ALTER TABLE pin_requests ADD COLUMN deals_expire_at TIMESTAMPTZ;
+ALTER TABLE pin_requests ADD COLUMN legal_hold BOOLEAN DEFAULT FALSE;
+ALTER TABLE pin_requests ADD COLUMN legal_hold_reason TEXT;
+
+-- Create indexes
+CREATE INDEX idx_pin_requests_expires_at ON pin_requests(expires_at);
+
+-- Pinned content expires its duration after the pin was made, but never
+-- sooner than a week from now so users are warned before anything expires
+UPDATE pin_requests
+SET expires_at = GREATEST(created_at + duration_days * INTERVAL '1 day', NOW() + INTERVAL '7 days')
+WHERE status = 'pinned';
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_pin_requests_expires_at;
+
+-- Drop columns
+UPDATE pin_requests SET status = 'pinned' WHERE status = 'expired' AND content_id IS NOT NULL;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS legal_hold_reason;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS legal_hold;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS deals_expire_at;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS expired_at;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS expires_at;
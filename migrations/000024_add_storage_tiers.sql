@@ -0,0 +1,16 @@
+-- Add storage tier columns
+ALTER TABLE pin_requests ADD COLUMN tier VARCHAR(20) DEFAULT 'hot_cold';
+ALTER TABLE pin_requests ADD COLUMN hot_days INTEGER DEFAULT 0;
+ALTER TABLE pin_requests ADD COLUMN cold_at TIMESTAMPTZ;
+
+-- Create indexes
+CREATE INDEX idx_pin_requests_cold_at ON pin_requests(cold_at);
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_pin_requests_cold_at;
+
+-- Drop columns
+UPDATE contents SET status = 'pinned' WHERE status = 'cold';
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS cold_at;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS hot_days;
+ALTER TABLE pin_requests DROP COLUMN IF EXISTS tier;
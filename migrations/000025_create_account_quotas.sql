@@ -0,0 +1,61 @@
+-- Create account_quotas table
+CREATE TABLE account_quotas (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    max_bytes BIGINT,
+    max_pins BIGINT,
+    requests_per_minute INTEGER,
+    max_pending_pins INTEGER,
+    note TEXT,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Create account_usage table
+CREATE TABLE account_usage (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    pinned_bytes BIGINT DEFAULT 0,
+    pinned_pins BIGINT DEFAULT 0,
+    pending_pins BIGINT DEFAULT 0,
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Create usage_daily table
+CREATE TABLE usage_daily (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    date DATE NOT NULL,
+    pinned_bytes BIGINT DEFAULT 0,
+    peak_bytes BIGINT DEFAULT 0,
+    pinned_pins BIGINT DEFAULT 0,
+    pins_created BIGINT DEFAULT 0,
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (user_id, date)
+);
+
+-- Create indexes
+CREATE INDEX idx_usage_daily_date ON usage_daily(date);
+
+-- Create updated_at trigger
+CREATE TRIGGER update_account_quotas_updated_at BEFORE UPDATE
+    ON account_quotas FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Count what every account has pinned so far
+INSERT INTO account_usage (user_id, pinned_bytes, pinned_pins, pending_pins, updated_at)
+SELECT u.id,
+    COALESCE(SUM(p.size_bytes) FILTER (WHERE p.status = 'pinned'), 0),
+    COUNT(p.id) FILTER (WHERE p.status = 'pinned'),
+    COUNT(p.id) FILTER (WHERE p.status IN ('pending', 'pinning')),
+    NOW()
+FROM users u
+LEFT JOIN pin_requests p ON p.user_id = u.id
+GROUP BY u.id;
+
+-- Drop trigger
+DROP TRIGGER IF EXISTS update_account_quotas_updated_at ON account_quotas;
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_usage_daily_date;
+
+-- Drop tables
+DROP TABLE IF EXISTS usage_daily;
+DROP TABLE IF EXISTS account_usage;
+DROP TABLE IF EXISTS account_quotas;
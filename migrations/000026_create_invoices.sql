@@ -0,0 +1,46 @@
+-- Create invoices table
+CREATE TABLE invoices (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind VARCHAR(20) NOT NULL,
+    number VARCHAR(64) NOT NULL,
+    credited_invoice_id UUID REFERENCES invoices(id),
+    period_start TIMESTAMPTZ NOT NULL,
+    period_end TIMESTAMPTZ NOT NULL,
+    total_fil DECIMAL(38,18) NOT NULL,
+    credits_fil DECIMAL(38,18) NOT NULL,
+    payments_fil DECIMAL(38,18) NOT NULL,
+    opening_balance_fil DECIMAL(38,18) NOT NULL,
+    closing_balance_fil DECIMAL(38,18) NOT NULL,
+    entry_count INTEGER DEFAULT 0,
+    issued_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Create invoice_lines table
+CREATE TABLE invoice_lines (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    invoice_id UUID NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    kind VARCHAR(32) NOT NULL,
+    description VARCHAR(255),
+    pin_request_id UUID REFERENCES pin_requests(id) ON DELETE SET NULL,
+    filecoin_deal_id UUID REFERENCES filecoin_deals(id) ON DELETE SET NULL,
+    quantity BIGINT NOT NULL,
+    unit VARCHAR(20) NOT NULL,
+    amount_fil DECIMAL(38,18) NOT NULL
+);
+
+-- Create indexes
+CREATE UNIQUE INDEX idx_invoices_user_kind_period ON invoices(user_id, kind, period_start);
+CREATE INDEX idx_invoice_lines_invoice_id ON invoice_lines(invoice_id);
+CREATE INDEX idx_ledger_entries_user_id_created_at ON ledger_entries(user_id, created_at);
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_ledger_entries_user_id_created_at;
+DROP INDEX IF EXISTS idx_invoice_lines_invoice_id;
+DROP INDEX IF EXISTS idx_invoices_user_kind_period;
+
+-- Drop tables
+DROP TABLE IF EXISTS invoice_lines;
+DROP TABLE IF EXISTS invoices;
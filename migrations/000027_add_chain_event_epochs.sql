@@ -0,0 +1,7 @@
+-- Add the deal epochs replaced by a chain event, restored when it is reverted
+ALTER TABLE chain_events ADD COLUMN previous_start_epoch BIGINT DEFAULT 0;
+ALTER TABLE chain_events ADD COLUMN previous_end_epoch BIGINT DEFAULT 0;
+
+-- Drop columns
+ALTER TABLE chain_events DROP COLUMN IF EXISTS previous_end_epoch;
+ALTER TABLE chain_events DROP COLUMN IF EXISTS previous_start_epoch;
@@ -0,0 +1,6 @@
+-- Add the time a renewal was claimed, so renewals abandoned in progress by a
+-- crashed worker can be claimed again
+ALTER TABLE deal_renewals ADD COLUMN claimed_at TIMESTAMPTZ;
+
+-- Drop column
+ALTER TABLE deal_renewals DROP COLUMN IF EXISTS claimed_at;
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"strings"
 	"time"
 
@@ -9,17 +10,34 @@ import (
 )
 
 type Config struct {
-	Environment string          `mapstructure:"environment"`
-	Server      ServerConfig    `mapstructure:"server"`
-	Database    DatabaseConfig  `mapstructure:"database"`
-	Redis       RedisConfig     `mapstructure:"redis"`
-	IPFS        IPFSConfig      `mapstructure:"ipfs"`
-	Filecoin    FilecoinConfig  `mapstructure:"filecoin"`
-	Pricing     PricingConfig   `mapstructure:"pricing"`
-	Workers     WorkersConfig   `mapstructure:"workers"`
-	JWT         JWTConfig       `mapstructure:"jwt"`
-	RateLimit   RateLimitConfig `mapstructure:"rate_limit"`
-	Logging     LoggingConfig   `mapstructure:"logging"`
+	Environment string            `mapstructure:"environment"`
+	Server      ServerConfig      `mapstructure:"server"`
+	Database    DatabaseConfig    `mapstructure:"database"`
+	Redis       RedisConfig       `mapstructure:"redis"`
+	IPFS        IPFSConfig        `mapstructure:"ipfs"`
+	Pinning     PinningConfig     `mapstructure:"pinning"`
+	Filecoin    FilecoinConfig    `mapstructure:"filecoin"`
+	Pricing     PricingConfig     `mapstructure:"pricing"`
+	Workers     WorkersConfig     `mapstructure:"workers"`
+	Monitor     MonitorConfig     `mapstructure:"monitor"`
+	Renewal     RenewalConfig     `mapstructure:"renewal"`
+	Expiry      ExpiryConfig      `mapstructure:"expiry"`
+	Lifecycle   LifecycleConfig   `mapstructure:"lifecycle"`
+	Invoicing   InvoicingConfig   `mapstructure:"invoicing"`
+	Repair      RepairConfig      `mapstructure:"repair"`
+	Retrieval   RetrievalConfig   `mapstructure:"retrieval"`
+	Gateway     GatewayConfig     `mapstructure:"gateway"`
+	Encryption  EncryptionConfig  `mapstructure:"encryption"`
+	Aggregation AggregationConfig `mapstructure:"aggregation"`
+	Splitting   SplittingConfig   `mapstructure:"splitting"`
+	DataCap     DataCapConfig     `mapstructure:"datacap"`
+	Transfer    TransferConfig    `mapstructure:"transfer"`
+	Staging     StagingConfig     `mapstructure:"staging"`
+	ChainWatch  ChainWatchConfig  `mapstructure:"chain_watch"`
+	JWT         JWTConfig         `mapstructure:"jwt"`
+	RateLimit   RateLimitConfig   `mapstructure:"rate_limit"`
+	Quotas      QuotaConfig       `mapstructure:"quotas"`
+	Logging     LoggingConfig     `mapstructure:"logging"`
 }
 
 type ServerConfig struct {
@@ -59,28 +77,213 @@ func (c RedisConfig) Pool() *redis.Pool {
 }
 
 type IPFSConfig struct {
-	APIURL     string        `mapstructure:"api_url"`
-	GatewayURL string        `mapstructure:"gateway_url"`
-	Timeout    time.Duration `mapstructure:"timeout"`
+	APIURL              string            `mapstructure:"api_url"`
+	GatewayURL          string            `mapstructure:"gateway_url"`
+	Timeout             time.Duration     `mapstructure:"timeout"`
+	Backend             string            `mapstructure:"backend"`
+	Nodes               []IPFSNodeConfig  `mapstructure:"nodes"`
+	Replication         int               `mapstructure:"replication"`
+	HealthCheckInterval time.Duration     `mapstructure:"health_check_interval"`
+	RebalanceInterval   time.Duration     `mapstructure:"rebalance_interval"`
+	RebalanceBatchSize  int               `mapstructure:"rebalance_batch_size"`
+	ReconcileInterval   time.Duration     `mapstructure:"reconcile_interval"`
+	OrphanGracePeriod   time.Duration     `mapstructure:"orphan_grace_period"`
+	GCThresholdPercent  float64           `mapstructure:"gc_threshold_percent"`
+	Cluster             IPFSClusterConfig `mapstructure:"cluster"`
+}
+
+type IPFSClusterConfig struct {
+	APIURL         string        `mapstructure:"api_url"`
+	ProxyURL       string        `mapstructure:"proxy_url"`
+	Username       string        `mapstructure:"username"`
+	Password       string        `mapstructure:"password"`
+	ReplicationMin int           `mapstructure:"replication_min"`
+	ReplicationMax int           `mapstructure:"replication_max"`
+	PinTimeout     time.Duration `mapstructure:"pin_timeout"`
+}
+
+type IPFSNodeConfig struct {
+	ID     string `mapstructure:"id"`
+	APIURL string `mapstructure:"api_url"`
+}
+
+type PinningConfig struct {
+	ProgressInterval     time.Duration `mapstructure:"progress_interval"`
+	StallTimeout         time.Duration `mapstructure:"stall_timeout"`
+	MaxAttempts          int           `mapstructure:"max_attempts"`
+	RetryInterval        time.Duration `mapstructure:"retry_interval"`
+	MaxOrigins           int           `mapstructure:"max_origins"`
+	MaxOriginConnections int           `mapstructure:"max_origin_connections"`
+	AllowPrivateAddrs    bool          `mapstructure:"allow_private_addrs"`
+	Delegates            []string      `mapstructure:"delegates"`
 }
 
 type FilecoinConfig struct {
-	LotusAPI        string `mapstructure:"lotus_api"`
-	LotusToken      string `mapstructure:"lotus_token"`
-	WalletAddress   string `mapstructure:"wallet_address"`
-	MinDealDuration int64  `mapstructure:"min_deal_duration"`
+	LotusAPI        string   `mapstructure:"lotus_api"`
+	LotusToken      string   `mapstructure:"lotus_token"`
+	WalletAddress   string   `mapstructure:"wallet_address"`
+	MinDealDuration int64    `mapstructure:"min_deal_duration"`
+	CandidateMiners []string `mapstructure:"candidate_miners"`
 }
 
 type PricingConfig struct {
 	BasePricePerGBPerMonth float64 `mapstructure:"base_price_per_gb_per_month"`
 	MarkupPercentage       float64 `mapstructure:"markup_percentage"`
 	MinimumDealSize        int64   `mapstructure:"minimum_deal_size"`
+
+	// Verified deals are stored by providers for free, so only our own
+	// service fee is charged
+	VerifiedPricePerGBPerMonth float64 `mapstructure:"verified_price_per_gb_per_month"`
+
+	// Discount on content that is already stored through another pin,
+	// whose deals the new pin shares
+	StoredContentDiscountPercentage float64 `mapstructure:"stored_content_discount_percentage"`
+
+	// Prices of the single storage tiers; pins stored both on IPFS and on
+	// Filecoin pay the base price
+	HotPricePerGBPerMonth  float64 `mapstructure:"hot_price_per_gb_per_month"`
+	ColdPricePerGBPerMonth float64 `mapstructure:"cold_price_per_gb_per_month"`
 }
 
 type WorkersConfig struct {
 	Concurrency int `mapstructure:"concurrency"`
 }
 
+type MonitorConfig struct {
+	Interval          time.Duration `mapstructure:"interval"`
+	BatchSize         int           `mapstructure:"batch_size"`
+	BatchConcurrency  int           `mapstructure:"batch_concurrency"`
+	LotusConcurrency  int           `mapstructure:"lotus_concurrency"`
+	UseMarketSnapshot bool          `mapstructure:"use_market_snapshot"`
+	SnapshotTTL       time.Duration `mapstructure:"snapshot_ttl"`
+}
+
+type RenewalConfig struct {
+	WindowDays           int `mapstructure:"window_days"`
+	LowBalanceNoticeDays int `mapstructure:"low_balance_notice_days"`
+	MaxAttempts          int `mapstructure:"max_attempts"`
+
+	// A renewal left in progress this long is assumed abandoned by a
+	// crashed worker and may be claimed again
+	ClaimLease time.Duration `mapstructure:"claim_lease"`
+}
+
+type ExpiryConfig struct {
+	Interval    time.Duration `mapstructure:"interval"`
+	NoticeDays  int           `mapstructure:"notice_days"`
+	GracePeriod time.Duration `mapstructure:"grace_period"`
+	BatchSize   int           `mapstructure:"batch_size"`
+}
+
+type LifecycleConfig struct {
+	Interval  time.Duration `mapstructure:"interval"`
+	BatchSize int           `mapstructure:"batch_size"`
+	// How long content retrieved back from Filecoin for a cold pin stays
+	// on IPFS
+	RestoreTTL time.Duration `mapstructure:"restore_ttl"`
+}
+
+type InvoicingConfig struct {
+	Interval  time.Duration `mapstructure:"interval"`
+	BatchSize int           `mapstructure:"batch_size"`
+	// How long after a period ends its invoices are generated, so ledger
+	// entries committed late still land in it
+	Grace time.Duration `mapstructure:"grace"`
+}
+
+type RepairConfig struct {
+	Interval        time.Duration `mapstructure:"interval"`
+	DefaultReplicas int           `mapstructure:"default_replicas"`
+	ScanBatchSize   int           `mapstructure:"scan_batch_size"`
+	Concurrency     int           `mapstructure:"concurrency"`
+	StagingDir      string        `mapstructure:"staging_dir"`
+}
+
+type RetrievalConfig struct {
+	Timeout       time.Duration     `mapstructure:"timeout"`
+	Concurrency   int               `mapstructure:"concurrency"`
+	MaxAttempts   int               `mapstructure:"max_attempts"`
+	StagingDir    string            `mapstructure:"staging_dir"`
+	HTTPEndpoints map[string]string `mapstructure:"http_endpoints"`
+}
+
+type GatewayConfig struct {
+	Enabled            bool          `mapstructure:"enabled"`
+	Access             string        `mapstructure:"access"`
+	SigningKey         string        `mapstructure:"signing_key"`
+	CacheMaxAge        time.Duration `mapstructure:"cache_max_age"`
+	MeterFlushInterval time.Duration `mapstructure:"meter_flush_interval"`
+	PublicURL          string        `mapstructure:"public_url"`
+	ShareDefaultTTL    time.Duration `mapstructure:"share_default_ttl"`
+	ShareMaxTTL        time.Duration `mapstructure:"share_max_ttl"`
+}
+
+type EncryptionConfig struct {
+	Enabled       bool   `mapstructure:"enabled"`
+	KeyProvider   string `mapstructure:"key_provider"`
+	KeyDir        string `mapstructure:"key_dir"`
+	MaxUploadSize int64  `mapstructure:"max_upload_size"`
+}
+
+type AggregationConfig struct {
+	Enabled    bool          `mapstructure:"enabled"`
+	Interval   time.Duration `mapstructure:"interval"`
+	MaxPinSize int64         `mapstructure:"max_pin_size"`
+	MinSize    int64         `mapstructure:"min_size"`
+	TargetSize int64         `mapstructure:"target_size"`
+	MaxEntries int           `mapstructure:"max_entries"`
+	MaxWait    time.Duration `mapstructure:"max_wait"`
+	BatchSize  int           `mapstructure:"batch_size"`
+}
+
+type SplittingConfig struct {
+	Enabled      bool          `mapstructure:"enabled"`
+	Interval     time.Duration `mapstructure:"interval"`
+	MaxChunkSize int64         `mapstructure:"max_chunk_size"`
+	BatchSize    int           `mapstructure:"batch_size"`
+}
+
+type DataCapConfig struct {
+	Enabled         bool          `mapstructure:"enabled"`
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"`
+}
+
+type TransferConfig struct {
+	Mode             string        `mapstructure:"mode"`
+	StagingDir       string        `mapstructure:"staging_dir"`
+	PublicURL        string        `mapstructure:"public_url"`
+	CleanupInterval  time.Duration `mapstructure:"cleanup_interval"`
+	CleanupBatchSize int           `mapstructure:"cleanup_batch_size"`
+}
+
+type StagingConfig struct {
+	Backend     string        `mapstructure:"backend"`
+	Dir         string        `mapstructure:"dir"`
+	S3          S3Config      `mapstructure:"s3"`
+	MaxBytes    int64         `mapstructure:"max_bytes"`
+	CARTTL      time.Duration `mapstructure:"car_ttl"`
+	GCInterval  time.Duration `mapstructure:"gc_interval"`
+	OrphanGrace time.Duration `mapstructure:"orphan_grace"`
+}
+
+type S3Config struct {
+	Endpoint  string `mapstructure:"endpoint"`
+	Region    string `mapstructure:"region"`
+	Bucket    string `mapstructure:"bucket"`
+	Prefix    string `mapstructure:"prefix"`
+	AccessKey string `mapstructure:"access_key"`
+	SecretKey string `mapstructure:"secret_key"`
+	PathStyle bool   `mapstructure:"path_style"`
+}
+
+type ChainWatchConfig struct {
+	Enabled         bool     `mapstructure:"enabled"`
+	Wallets         []string `mapstructure:"wallets"`
+	ReorgDepth      int64    `mapstructure:"reorg_depth"`
+	ActiveBatchSize int      `mapstructure:"active_batch_size"`
+	EventsChannel   string   `mapstructure:"events_channel"`
+}
+
 type JWTConfig struct {
 	Secret     string        `mapstructure:"secret"`
 	Expiration time.Duration `mapstructure:"expiration"`
@@ -91,6 +294,18 @@ type RateLimitConfig struct {
 	Burst             int `mapstructure:"burst"`
 }
 
+// QuotaConfig holds the default limits of every account, which admins can
+// override per account. Zero means unlimited.
+type QuotaConfig struct {
+	Enabled           bool  `mapstructure:"enabled"`
+	MaxBytes          int64 `mapstructure:"max_bytes"`
+	MaxPins           int64 `mapstructure:"max_pins"`
+	RequestsPerMinute int   `mapstructure:"requests_per_minute"`
+	MaxPendingPins    int   `mapstructure:"max_pending_pins"`
+	// Reject pins the account's balance cannot pay for
+	EnforceBalance bool `mapstructure:"enforce_balance"`
+}
+
 type LoggingConfig struct {
 	Level  string `mapstructure:"level"`
 	Format string `mapstructure:"format"`
@@ -120,10 +335,24 @@ func Load() *Config {
 	if err := viper.Unmarshal(&config); err != nil {
 		panic(err)
 	}
+	if err := config.validate(); err != nil {
+		panic(err)
+	}
 
 	return &config
 }
 
+// validate rejects settings the services cannot run with
+func (c *Config) validate() error {
+	if c.Monitor.BatchSize <= 0 {
+		return fmt.Errorf("monitor.batch_size must be positive, got %d", c.Monitor.BatchSize)
+	}
+	if c.Renewal.ClaimLease <= 0 {
+		return fmt.Errorf("renewal.claim_lease must be positive, got %s", c.Renewal.ClaimLease)
+	}
+	return nil
+}
+
 func setDefaults() {
 	// Environment
 	viper.SetDefault("environment", "development")
@@ -148,6 +377,28 @@ func setDefaults() {
 	viper.SetDefault("ipfs.api_url", "http://localhost:5001")
 	viper.SetDefault("ipfs.gateway_url", "http://localhost:8080")
 	viper.SetDefault("ipfs.timeout", "30s")
+	viper.SetDefault("ipfs.backend", "kubo")
+	viper.SetDefault("ipfs.replication", 1)
+	viper.SetDefault("ipfs.health_check_interval", "30s")
+	viper.SetDefault("ipfs.rebalance_interval", "1h")
+	viper.SetDefault("ipfs.rebalance_batch_size", 200)
+	viper.SetDefault("ipfs.reconcile_interval", "6h")
+	viper.SetDefault("ipfs.orphan_grace_period", "24h")
+	viper.SetDefault("ipfs.gc_threshold_percent", 0)
+	viper.SetDefault("ipfs.cluster.api_url", "http://localhost:9094")
+	viper.SetDefault("ipfs.cluster.proxy_url", "http://localhost:9095")
+	viper.SetDefault("ipfs.cluster.replication_min", 0)
+	viper.SetDefault("ipfs.cluster.replication_max", 0)
+	viper.SetDefault("ipfs.cluster.pin_timeout", "10m")
+
+	// Pinning defaults
+	viper.SetDefault("pinning.progress_interval", "15s")
+	viper.SetDefault("pinning.stall_timeout", "10m")
+	viper.SetDefault("pinning.max_attempts", 3)
+	viper.SetDefault("pinning.retry_interval", "1m")
+	viper.SetDefault("pinning.max_origins", 20)
+	viper.SetDefault("pinning.max_origin_connections", 8)
+	viper.SetDefault("pinning.allow_private_addrs", false)
 
 	// Filecoin defaults
 	viper.SetDefault("filecoin.lotus_api", "http://localhost:1234/rpc/v0")
@@ -157,10 +408,113 @@ func setDefaults() {
 	viper.SetDefault("pricing.base_price_per_gb_per_month", 0.001)
 	viper.SetDefault("pricing.markup_percentage", 20.0)
 	viper.SetDefault("pricing.minimum_deal_size", 1048576)
+	viper.SetDefault("pricing.verified_price_per_gb_per_month", 0.0002)
+	viper.SetDefault("pricing.stored_content_discount_percentage", 0.0)
+	viper.SetDefault("pricing.hot_price_per_gb_per_month", 0.0008)
+	viper.SetDefault("pricing.cold_price_per_gb_per_month", 0.0004)
 
 	// Workers defaults
 	viper.SetDefault("workers.concurrency", 5)
 
+	// Deal monitor defaults
+	viper.SetDefault("monitor.interval", "5m")
+	viper.SetDefault("monitor.batch_size", 500)
+	viper.SetDefault("monitor.batch_concurrency", 4)
+	viper.SetDefault("monitor.lotus_concurrency", 8)
+	viper.SetDefault("monitor.use_market_snapshot", true)
+	viper.SetDefault("monitor.snapshot_ttl", "1h")
+
+	// Renewal defaults
+	viper.SetDefault("renewal.window_days", 14)
+	viper.SetDefault("renewal.low_balance_notice_days", 30)
+	viper.SetDefault("renewal.max_attempts", 3)
+	viper.SetDefault("renewal.claim_lease", "30m")
+
+	// Expiry defaults
+	viper.SetDefault("expiry.interval", "1h")
+	viper.SetDefault("expiry.notice_days", 7)
+	viper.SetDefault("expiry.grace_period", "72h")
+	viper.SetDefault("expiry.batch_size", 200)
+
+	// Lifecycle defaults
+	viper.SetDefault("lifecycle.interval", "1h")
+	viper.SetDefault("lifecycle.batch_size", 200)
+	viper.SetDefault("lifecycle.restore_ttl", "24h")
+
+	// Invoicing defaults
+	viper.SetDefault("invoicing.interval", "1h")
+	viper.SetDefault("invoicing.batch_size", 200)
+	viper.SetDefault("invoicing.grace", "1h")
+
+	// Repair defaults
+	viper.SetDefault("repair.interval", "1h")
+	viper.SetDefault("repair.default_replicas", 2)
+	viper.SetDefault("repair.scan_batch_size", 200)
+	viper.SetDefault("repair.concurrency", 2)
+	viper.SetDefault("repair.staging_dir", "/tmp/pinning-service/repair")
+
+	// Retrieval defaults
+	viper.SetDefault("retrieval.timeout", "1h")
+	viper.SetDefault("retrieval.concurrency", 2)
+	viper.SetDefault("retrieval.max_attempts", 3)
+	viper.SetDefault("retrieval.staging_dir", "/tmp/pinning-service/retrieval")
+
+	// Gateway defaults
+	viper.SetDefault("gateway.enabled", true)
+	viper.SetDefault("gateway.access", "public")
+	viper.SetDefault("gateway.cache_max_age", "24h")
+	viper.SetDefault("gateway.meter_flush_interval", "1m")
+	viper.SetDefault("gateway.share_default_ttl", "24h")
+	viper.SetDefault("gateway.share_max_ttl", "720h")
+
+	// Encryption defaults
+	viper.SetDefault("encryption.enabled", true)
+	viper.SetDefault("encryption.key_provider", "file")
+	viper.SetDefault("encryption.key_dir", "./data/keys")
+	viper.SetDefault("encryption.max_upload_size", 1<<30)
+
+	// Aggregation defaults
+	viper.SetDefault("aggregation.enabled", true)
+	viper.SetDefault("aggregation.interval", "15m")
+	viper.SetDefault("aggregation.max_pin_size", 1<<30)
+	viper.SetDefault("aggregation.min_size", 4<<30)
+	viper.SetDefault("aggregation.target_size", 16<<30)
+	viper.SetDefault("aggregation.max_entries", 4096)
+	viper.SetDefault("aggregation.max_wait", "72h")
+	viper.SetDefault("aggregation.batch_size", 10000)
+
+	// Splitting defaults
+	viper.SetDefault("splitting.enabled", true)
+	viper.SetDefault("splitting.interval", "30m")
+	viper.SetDefault("splitting.max_chunk_size", 30<<30)
+	viper.SetDefault("splitting.batch_size", 20)
+
+	// DataCap defaults
+	viper.SetDefault("datacap.enabled", true)
+	viper.SetDefault("datacap.refresh_interval", "1h")
+
+	// Transfer defaults
+	viper.SetDefault("transfer.mode", "graphsync")
+	viper.SetDefault("transfer.staging_dir", "/tmp/pinning-service/transfers")
+	viper.SetDefault("transfer.cleanup_interval", "1h")
+	viper.SetDefault("transfer.cleanup_batch_size", 500)
+
+	// Staging defaults
+	viper.SetDefault("staging.backend", "disk")
+	viper.SetDefault("staging.dir", "/tmp/pinning-service/staging")
+	viper.SetDefault("staging.s3.region", "us-east-1")
+	viper.SetDefault("staging.s3.path_style", true)
+	viper.SetDefault("staging.max_bytes", 0)
+	viper.SetDefault("staging.car_ttl", "720h")
+	viper.SetDefault("staging.gc_interval", "1h")
+	viper.SetDefault("staging.orphan_grace", "6h")
+
+	// Chain watcher defaults
+	viper.SetDefault("chain_watch.enabled", false)
+	viper.SetDefault("chain_watch.reorg_depth", 900)
+	viper.SetDefault("chain_watch.active_batch_size", 200)
+	viper.SetDefault("chain_watch.events_channel", "deal_events")
+
 	// JWT defaults
 	viper.SetDefault("jwt.expiration", "24h")
 
@@ -168,6 +522,14 @@ func setDefaults() {
 	viper.SetDefault("rate_limit.requests_per_minute", 100)
 	viper.SetDefault("rate_limit.burst", 20)
 
+	// Quota defaults
+	viper.SetDefault("quotas.enabled", true)
+	viper.SetDefault("quotas.max_bytes", 0)
+	viper.SetDefault("quotas.max_pins", 0)
+	viper.SetDefault("quotas.requests_per_minute", 600)
+	viper.SetDefault("quotas.max_pending_pins", 100)
+	viper.SetDefault("quotas.enforce_balance", true)
+
 	// Logging defaults
 	viper.SetDefault("logging.level", "info")
 	viper.SetDefault("logging.format", "json")
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 
 	"pinning-service/internal/storage"
@@ -71,6 +72,26 @@ func ValidateAPIKey(db interface{}, apiKey string) (string, error) {
 	return user.ID.String(), nil
 }
 
+// IsAdmin returns true if the user may use the admin endpoints
+func IsAdmin(db interface{}, userID string) bool {
+	gormDB, ok := db.(*gorm.DB)
+	if !ok {
+		return false
+	}
+
+	id, err := uuid.Parse(userID)
+	if err != nil {
+		return false
+	}
+
+	user, err := storage.NewUserRepository(gormDB).GetByID(context.Background(), id)
+	if err != nil {
+		return false
+	}
+
+	return user.IsAdmin
+}
+
 // GenerateAPIKey generates a new API key
 func GenerateAPIKey() (string, error) {
 	bytes := make([]byte, 32)
@@ -2,23 +2,89 @@ package utils
 
 import (
 	"fmt"
+	"path"
 	"regexp"
 	"strings"
+
+	gocid "github.com/ipfs/go-cid"
 )
 
-// ValidateCID validates an IPFS CID format
-func ValidateCID(cid string) error {
-	if len(cid) == 0 {
-		return fmt.Errorf("CID cannot be empty")
+// maxCIDInputLength bounds the length of a CID or IPFS path accepted from
+// users
+const maxCIDInputLength = 1024
+
+// ParsedCID is a CID given by a user, optionally with a path below it
+type ParsedCID struct {
+	// CID is the CID in its normalized form, CIDv1 in base32, which is
+	// how CIDs are stored and compared
+	CID string
+	// Original is the input as the user gave it
+	Original string
+	// Path is the cleaned path below the CID, such as "/docs/a.txt", or
+	// empty for the CID itself
+	Path string
+}
+
+// ParseCID parses a CID in any multibase encoding and codec, a
+// /ipfs/<cid>/path path or an ipfs://<cid>/path URL
+func ParseCID(input string) (*ParsedCID, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return nil, fmt.Errorf("CID cannot be empty")
+	}
+	if len(input) > maxCIDInputLength {
+		return nil, fmt.Errorf("CID is longer than %d characters", maxCIDInputLength)
 	}
 
-	// Basic CID validation (starts with Q for v0 or b for v1 base32)
-	if !strings.HasPrefix(cid, "Qm") && !strings.HasPrefix(cid, "bafy") && !strings.HasPrefix(cid, "bafk") {
-		return fmt.Errorf("invalid CID format")
+	rest := input
+	switch {
+	case strings.HasPrefix(rest, "ipfs://"):
+		rest = strings.TrimPrefix(rest, "ipfs://")
+	case strings.HasPrefix(rest, "/ipfs/"):
+		rest = strings.TrimPrefix(rest, "/ipfs/")
+	case strings.HasPrefix(rest, "/"):
+		return nil, fmt.Errorf("invalid CID: only /ipfs/ paths are supported")
 	}
 
-	// More comprehensive validation could be added here
-	return nil
+	cidStr, subPath := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		cidStr, subPath = rest[:i], rest[i:]
+	}
+
+	normalized, err := NormalizeCID(cidStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if subPath != "" {
+		subPath = path.Clean(subPath)
+		if subPath == "/" {
+			subPath = ""
+		}
+	}
+
+	return &ParsedCID{CID: normalized, Original: input, Path: subPath}, nil
+}
+
+// NormalizeCID returns a CID as CIDv1 in base32. CIDv0 and CIDv1 of the
+// same content differ only in their encoding, so they normalize to the
+// same string.
+func NormalizeCID(cidStr string) (string, error) {
+	c, err := gocid.Decode(cidStr)
+	if err != nil {
+		return "", fmt.Errorf("invalid CID %q: %w", cidStr, err)
+	}
+	return gocid.NewCidV1(c.Type(), c.Hash()).String(), nil
+}
+
+// ValidateCID checks that a string is a CID in any multibase encoding and
+// codec
+func ValidateCID(cidStr string) error {
+	if cidStr == "" {
+		return fmt.Errorf("CID cannot be empty")
+	}
+	_, err := NormalizeCID(cidStr)
+	return err
 }
 
 // ValidateEmail validates email format